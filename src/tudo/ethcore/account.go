@@ -8,13 +8,45 @@
 package ethcore
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 	"tudo/kstore"
+	"tudo/models"
 
+	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/accounts/usbwallet"
 	"github.com/ethereum/go-ethereum/node"
 )
 
+/**
+ * KsDataSource
+ * ------------
+ * Return the data source of the keystore database, the SQLite file defaults to
+ * kstore.db in the data directory, or the key directory without one.
+ */
+func KsDataSource(conf *node.Config, tdcfg *TudoConfig, keydir string) string {
+	dataSource := tdcfg.KsDataSource
+	if tdcfg.KsBackend == models.SqliteBackend && dataSource == "" {
+		dir := conf.DataDir
+		if dir == "" {
+			dir = keydir
+		}
+		dataSource = filepath.Join(dir, "kstore.db")
+	}
+	return dataSource
+}
+
+/**
+ * makeAccountManager
+ * ------------------
+ * The SQL keystore comes first and holds the user accounts.  The key file
+ * directory and the Ledger/Trezor hubs follow, for admin keys kept out of the
+ * database.
+ */
 func makeAccountManager(conf *node.Config,
 	tdcfg *TudoConfig) (AmInterface, kstore.KStoreIface, error) {
 	scryptN, scryptP, keydir, err := conf.AccountConfig()
@@ -25,9 +57,38 @@ func makeAccountManager(conf *node.Config,
 	if err != nil {
 		return nil, nil, err
 	}
-	ksIface := kstore.NewKeyStore(keydir, scryptN, scryptP)
-	ksArray := []keystore.KeyStore{
+	if err = os.MkdirAll(keydir, 0700); err != nil {
+		return nil, nil, err
+	}
+	dataSource := KsDataSource(conf, tdcfg, keydir)
+	storage, err := kstore.NewStorage(tdcfg.KsBackend, dataSource, scryptN, scryptP)
+	if err != nil {
+		return nil, nil, err
+	}
+	ksIface, err := kstore.NewKeyStore(storage,
+		tdcfg.KsKeyCacheSize, tdcfg.KsMasterKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	ksIface.SetRetention(time.Duration(tdcfg.KsRetentionDays) * 24 * time.Hour)
+	backends := []accounts.Backend{
 		ksIface,
+		keystore.NewKeyStore(keydir, scryptN, scryptP),
+	}
+	if !conf.NoUSB {
+		if ledgerhub, err := usbwallet.NewLedgerHub(); err != nil {
+			fmt.Printf("Failed to start Ledger hub, disabling: %v\n", err)
+		} else {
+			backends = append(backends, ledgerhub)
+		}
+		if trezorhub, err := usbwallet.NewTrezorHub(); err != nil {
+			fmt.Printf("Failed to start Trezor hub, disabling: %v\n", err)
+		} else {
+			backends = append(backends, trezorhub)
+		}
 	}
-	return NewManager(tdcfg, ksArray...), ksIface, nil
+	am := NewManager(tdcfg, backends...)
+	ksIface.SetApprovals(kstore.NewApprovals(storage,
+		am.AdminAccounts(), tdcfg.AdminQuorum))
+	return am, ksIface, nil
 }
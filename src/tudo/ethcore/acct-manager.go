@@ -9,14 +9,19 @@ package ethcore
 
 import (
 	"fmt"
+	"math/big"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
 )
 
 type AmInterface interface {
@@ -24,39 +29,63 @@ type AmInterface interface {
 
 	Keystore(kind reflect.Type) keystore.KeyStore
 	DefaultKeyStore() keystore.KeyStore
+	IsAdminAcct(addr common.Address) bool
+	AdminAccounts() []common.Address
 }
 
+/**
+ * Account manager over the SQL keystore, the key file directory and the USB
+ * hardware wallet hubs.  Backends are kept in the order registered, the first
+ * keystore is the default one for new accounts.
+ */
 type Manager struct {
-	kstore   map[reflect.Type]keystore.KeyStore
-	updaters []event.Subscription
-	updates  chan accounts.WalletEvent
-	wallets  []accounts.Wallet
-	feed     event.Feed
-	quit     chan chan error
-	admin    map[common.Address]string
-	lock     sync.RWMutex
+	backends  []accounts.Backend
+	byType    map[reflect.Type][]accounts.Backend
+	keystores []keystore.KeyStore
+	schemes   map[string]keystore.KeyStore
+	router    *ksRouter
+	updaters  []event.Subscription
+	updates   chan accounts.WalletEvent
+	wallets   []accounts.Wallet
+	feed      event.Feed
+	quit      chan chan error
+	admin     map[common.Address]string
+	lock      sync.RWMutex
 }
 
-func NewManager(config *TudoConfig, kstore ...keystore.KeyStore) AmInterface {
+func NewManager(config *TudoConfig, backends ...accounts.Backend) AmInterface {
 	wallets := []accounts.Wallet{}
-	updates := make(chan accounts.WalletEvent, 4*len(kstore))
-	subs := make([]event.Subscription, len(kstore))
-	ksmap := make(map[reflect.Type]keystore.KeyStore)
+	updates := make(chan accounts.WalletEvent, 4*len(backends))
+	subs := make([]event.Subscription, len(backends))
 
-	for i, ks := range kstore {
-		kind := reflect.TypeOf(ks)
-		ksmap[kind] = ks
-		wallets = mergeSorted(wallets, ks.Wallets()...)
-		subs[i] = ks.Subscribe(updates)
-	}
 	am := &Manager{
-		updaters: subs,
+		backends: backends,
+		byType:   make(map[reflect.Type][]accounts.Backend),
+		schemes:  make(map[string]keystore.KeyStore),
 		updates:  updates,
-		wallets:  wallets,
 		quit:     make(chan chan error),
-		kstore:   ksmap,
 		admin:    make(map[common.Address]string),
 	}
+	for i, backend := range backends {
+		kind := reflect.TypeOf(backend)
+		am.byType[kind] = append(am.byType[kind], backend)
+		for _, wallet := range backend.Wallets() {
+			wallets = mergeSorted(wallets, am.guard(wallet))
+		}
+		subs[i] = backend.Subscribe(updates)
+
+		switch ks := backend.(type) {
+		case kstore.KStoreIface:
+			am.addKeyStore(kstore.SqlScheme, ks)
+
+		case keystore.KeyStore:
+			am.addKeyStore(keystore.KeyStoreScheme, ks)
+		}
+	}
+	am.updaters = subs
+	am.wallets = wallets
+	am.router = &ksRouter{am: am}
+
 	for _, s := range config.AdminAccounts {
 		am.admin[common.HexToAddress(s)] = s
 	}
@@ -64,6 +93,75 @@ func NewManager(config *TudoConfig, kstore ...keystore.KeyStore) AmInterface {
 	return am
 }
 
+/**
+ * Wallet of a backend other than the SQL keystore.  Transactions signed with it
+ * go through the admin approvals of the SQL keystore like those it signs, so an
+ * admin key in a key file or on a USB wallet can't skip them.
+ */
+type guardedWallet struct {
+	accounts.Wallet
+	am *Manager
+}
+
+func (w *guardedWallet) SignTx(a accounts.Account, tx *types.Transaction,
+	chainId *big.Int) (*types.Transaction, error) {
+	return w.am.signChecked(a.Address, tx, chainId, func() (*types.Transaction, error) {
+		return w.Wallet.SignTx(a, tx, chainId)
+	})
+}
+
+func (w *guardedWallet) SignTxWithPassphrase(a accounts.Account, passphrase string,
+	tx *types.Transaction, chainId *big.Int) (*types.Transaction, error) {
+	return w.am.signChecked(a.Address, tx, chainId, func() (*types.Transaction, error) {
+		return w.Wallet.SignTxWithPassphrase(a, passphrase, tx, chainId)
+	})
+}
+
+// guard returns the SQL keystore wallets as is, they check their transactions.
+func (am *Manager) guard(wallet accounts.Wallet) accounts.Wallet {
+	if wallet == nil || wallet.URL().Scheme == kstore.SqlScheme {
+		return wallet
+	}
+	if _, ok := wallet.(*guardedWallet); ok {
+		return wallet
+	}
+	return &guardedWallet{Wallet: wallet, am: am}
+}
+
+/**
+ * signChecked
+ * -----------
+ * Sign the transaction from the account held outside the SQL keystore once its
+ * checks pass.  Without SQL keystore, the admin accounts can't sign.
+ */
+func (am *Manager) signChecked(addr common.Address, tx *types.Transaction,
+	chainId *big.Int, sign func() (*types.Transaction, error)) (*types.Transaction, error) {
+	sqlKs, ok := am.schemes[kstore.SqlScheme].(kstore.KStoreIface)
+	if !ok {
+		if am.IsAdminAcct(addr) {
+			return nil, fmt.Errorf("No keystore to approve the transactions "+
+				"from admin account %s", addr.Hex())
+		}
+		return sign()
+	}
+	req, err := sqlKs.CheckTx(addr, tx, chainId)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := sign()
+	if err == nil {
+		sqlKs.TxSigned(req, signed)
+	}
+	return signed, err
+}
+
+func (am *Manager) addKeyStore(scheme string, ks keystore.KeyStore) {
+	am.keystores = append(am.keystores, ks)
+	if am.schemes[scheme] == nil {
+		am.schemes[scheme] = ks
+	}
+}
+
 func (am *Manager) IsAdminAcct(addr common.Address) bool {
 	if _, ok := am.admin[addr]; ok {
 		return true
@@ -71,32 +169,87 @@ func (am *Manager) IsAdminAcct(addr common.Address) bool {
 	return false
 }
 
+/**
+ * AdminAccounts
+ * -------------
+ * Return the admin accounts from the config, sorted.
+ */
+func (am *Manager) AdminAccounts() []common.Address {
+	admins := make([]common.Address, 0, len(am.admin))
+	for addr := range am.admin {
+		admins = append(admins, addr)
+	}
+	sort.Slice(admins, func(i, j int) bool {
+		return strings.Compare(admins[i].Hex(), admins[j].Hex()) < 0
+	})
+	return admins
+}
+
 func (am *Manager) Close() error {
 	errc := make(chan error)
 	am.quit <- errc
 	return <-errc
 }
 
+/**
+ * Keystore
+ * --------
+ * Return the first keystore of the type.
+ */
 func (am *Manager) Keystore(kind reflect.Type) keystore.KeyStore {
-	return am.kstore[kind]
+	for _, backend := range am.byType[kind] {
+		if ks, ok := backend.(keystore.KeyStore); ok {
+			return ks
+		}
+	}
+	return nil
 }
 
+/**
+ * Backends
+ * --------
+ * Return the backends of the type in the order registered.  Asking for the file
+ * keystore type gives a keystore routing each account to its own keystore, so
+ * personal_unlockAccount and --unlock work for SQL and key file accounts alike.
+ */
 func (am *Manager) Backends(kind reflect.Type) []accounts.Backend {
-	iface := am.kstore[kind]
-	if iface != nil {
-		return []accounts.Backend{iface}
-	}
-	for _, ks := range am.kstore {
-		return []accounts.Backend{ks}
+	if kind == keystore.KeyStoreType {
+		if len(am.keystores) == 0 {
+			return nil
+		}
+		return []accounts.Backend{am.router}
 	}
-	return nil
+	return am.byType[kind]
 }
 
+/**
+ * DefaultKeyStore
+ * ---------------
+ * Return the first keystore registered, the SQL keystore on a tudo node.
+ */
 func (am *Manager) DefaultKeyStore() keystore.KeyStore {
-	for _, ks := range am.kstore {
+	if len(am.keystores) == 0 {
+		return nil
+	}
+	return am.keystores[0]
+}
+
+/**
+ * keyStoreFor
+ * -----------
+ * Route the account by its URL scheme, or to the first keystore having its
+ * address.  Unknown accounts go to the default keystore.
+ */
+func (am *Manager) keyStoreFor(account accounts.Account) keystore.KeyStore {
+	if ks := am.schemes[account.URL.Scheme]; ks != nil {
 		return ks
 	}
-	return nil
+	for _, ks := range am.keystores {
+		if ks.HasAddress(account.Address) {
+			return ks
+		}
+	}
+	return am.DefaultKeyStore()
 }
 
 func (am *Manager) Wallets() []accounts.Wallet {
@@ -108,12 +261,48 @@ func (am *Manager) Wallets() []accounts.Wallet {
 	return cpy
 }
 
+/**
+ * Wallet
+ * ------
+ * Return the wallet with the url, sql://<owner-uuid> wallets not seen yet are
+ * loaded from the SQL keystore.
+ */
 func (am *Manager) Wallet(url string) (accounts.Wallet, error) {
 	am.lock.RLock()
 	defer am.lock.RUnlock()
 
-	fmt.Printf("Get wallet from %s\n", url)
-	return nil, nil
+	parsed, err := parseWalletURL(url)
+	if err != nil {
+		return nil, err
+	}
+	for _, wallet := range am.wallets {
+		if wallet.URL() == parsed {
+			return wallet, nil
+		}
+	}
+	if parsed.Scheme != kstore.SqlScheme {
+		return nil, accounts.ErrUnknownWallet
+	}
+	if sqlKs, ok := am.schemes[kstore.SqlScheme].(kstore.KStoreIface); ok {
+		return sqlKs.OwnerWallet(parsed.Path)
+	}
+	return nil, accounts.ErrUnknownWallet
+}
+
+func parseWalletURL(url string) (accounts.URL, error) {
+	parts := strings.Split(url, "://")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return accounts.URL{}, fmt.Errorf("Invalid wallet url %s", url)
+	}
+	if parts[0] == kstore.SqlScheme {
+		owner := uuid.Parse(parts[1])
+		if owner == nil {
+			return accounts.URL{}, fmt.Errorf("Invalid owner uuid in url %s", url)
+		}
+		return kstore.NewURL(owner.String()), nil
+	}
+	// keystore:// and hardware wallets are matched as is.
+	return accounts.URL{Scheme: parts[0], Path: parts[1]}, nil
 }
 
 func (am *Manager) Find(account accounts.Account) (accounts.Wallet, error) {
@@ -129,12 +318,22 @@ func (am *Manager) Find(account accounts.Account) (accounts.Wallet, error) {
 			return wallet, nil
 		}
 	}
+	// The SQL keystore loads wallets on first use.
+	if sqlKs, ok := am.schemes[kstore.SqlScheme].(kstore.KStoreIface); ok {
+		if wallet, err := sqlKs.FindWallet(account); err == nil {
+			return wallet, nil
+		}
+	}
 	return nil, accounts.ErrUnknownAccount
 }
 
+/**
+ * Subscribe
+ * ---------
+ * Receive wallet arrival and departure events from all the backends.
+ */
 func (am *Manager) Subscribe(sink chan<- accounts.WalletEvent) event.Subscription {
-	fmt.Printf("Subscribed is called\n")
-	return nil
+	return am.feed.Subscribe(sink)
 }
 
 func (am *Manager) update() {
@@ -150,6 +349,7 @@ func (am *Manager) update() {
 	for {
 		select {
 		case event := <-am.updates:
+			event.Wallet = am.guard(event.Wallet)
 			am.lock.Lock()
 			switch event.Kind {
 			case accounts.WalletArrived:
@@ -160,7 +360,7 @@ func (am *Manager) update() {
 			}
 			am.lock.Unlock()
 
-			// am.feed.Send(event)
+			am.feed.Send(event)
 
 		case errc := <-am.quit:
 			errc <- nil
@@ -180,6 +380,10 @@ func mergeSorted(slice []accounts.Wallet,
 			slice = append(slice, wallet)
 			continue
 		}
+		if slice[n].URL() == wallet.URL() {
+			// Already there, a new account arrived in the wallet.
+			continue
+		}
 		slice = append(slice[:n], append([]accounts.Wallet{wallet}, slice[n:]...)...)
 	}
 	return slice
@@ -192,7 +396,7 @@ func dropSorted(slice []accounts.Wallet,
 		n := sort.Search(len(slice), func(i int) bool {
 			return slice[i].URL().Cmp(wallet.URL()) >= 0
 		})
-		if n == len(slice) {
+		if n == len(slice) || slice[n].URL() != wallet.URL() {
 			continue
 		}
 		slice = append(slice[:n], slice[n+1:]...)
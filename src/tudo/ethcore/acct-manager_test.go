@@ -0,0 +1,248 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+)
+
+func newFileKeyStore(t *testing.T) (keystore.KeyStore, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	return ks, func() { os.RemoveAll(dir) }
+}
+
+func newFileAccount(t *testing.T, ks keystore.KeyStore) accounts.Account {
+	acct, err := ks.NewAccount("pass")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if err = ks.Unlock(acct, "pass"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	return acct
+}
+
+func TestAdminApprovalAllBackends(t *testing.T) {
+	fileKs, cleanup := newFileKeyStore(t)
+	defer cleanup()
+	admin := newFileAccount(t, fileKs)
+	user := newFileAccount(t, fileKs)
+
+	storage := kstore.NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	sqlKs, err := kstore.NewKeyStore(storage, 0, "")
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	peer := common.HexToAddress("0x1234")
+	config := &TudoConfig{AdminAccounts: []string{admin.Address.Hex(), peer.Hex()}}
+	am := NewManager(config, sqlKs, fileKs).(*Manager)
+	defer am.Close()
+	sqlKs.SetApprovals(kstore.NewApprovals(storage, am.AdminAccounts(), 0))
+
+	chainId := big.NewInt(7)
+	tx := types.NewTransaction(0, peer, big.NewInt(100), 21000, big.NewInt(1), nil)
+	wallet, err := am.Find(admin)
+	if err != nil {
+		t.Fatalf("find failed: %v", err)
+	}
+	if _, err = wallet.SignTx(admin, tx, chainId); err == nil {
+		t.Fatalf("admin key file signed without approval")
+	}
+	pending, ok := err.(*kstore.ApprovalPendingError)
+	if !ok {
+		t.Fatalf("wallet sign failed: %v", err)
+	}
+	_, err = wallet.SignTxWithPassphrase(admin, "pass", tx, chainId)
+	if again, ok := err.(*kstore.ApprovalPendingError); !ok || again.Id != pending.Id {
+		t.Errorf("wallet sign with passphrase: %v", err)
+	}
+	router := am.Backends(keystore.KeyStoreType)[0].(keystore.KeyStore)
+	if _, err = router.SignTx(admin, tx, chainId); err == nil {
+		t.Errorf("router signed without approval")
+	}
+	for _, w := range am.Wallets() {
+		if w.URL() == wallet.URL() {
+			if _, err = w.SignTx(admin, tx, chainId); err == nil {
+				t.Errorf("listed wallet signed without approval")
+			}
+		}
+	}
+	wallet, _ = am.Find(user)
+	if _, err = wallet.SignTx(user, tx, chainId); err != nil {
+		t.Errorf("user sign failed: %v", err)
+	}
+
+	// Without SQL keystore, nothing approves the admin transactions.
+	am = NewManager(config, fileKs).(*Manager)
+	defer am.Close()
+	wallet, _ = am.Find(admin)
+	if _, err = wallet.SignTx(admin, tx, chainId); err == nil {
+		t.Errorf("admin signed without SQL keystore")
+	}
+	wallet, _ = am.Find(user)
+	if _, err = wallet.SignTx(user, tx, chainId); err != nil {
+		t.Errorf("user sign without SQL keystore failed: %v", err)
+	}
+}
+
+func TestSpendPolicyAllBackends(t *testing.T) {
+	fileKs, cleanup := newFileKeyStore(t)
+	defer cleanup()
+	acct := newFileAccount(t, fileKs)
+
+	storage := kstore.NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	sqlKs, err := kstore.NewKeyStore(storage, 0, "")
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	policy, err := kstore.NewSpendPolicy(acct.Address.Hex(), "100", "250", "", false)
+	if err != nil {
+		t.Fatalf("new policy failed: %v", err)
+	}
+	storage.StoreSpendPolicy(policy)
+	am := NewManager(&TudoConfig{}, sqlKs, fileKs).(*Manager)
+	defer am.Close()
+
+	chainId := big.NewInt(7)
+	to := common.HexToAddress("0x1234")
+	newTx := func(nonce uint64, value int64) *types.Transaction {
+		return types.NewTransaction(nonce, to, big.NewInt(value), 21000, big.NewInt(1), nil)
+	}
+	wallet, err := am.Find(acct)
+	if err != nil {
+		t.Fatalf("find failed: %v", err)
+	}
+	if _, err = wallet.SignTx(acct, newTx(0, 101), chainId); err == nil {
+		t.Errorf("key file signed over the tx limit")
+	}
+	if _, err = wallet.SignTx(acct, newTx(0, 100), chainId); err != nil {
+		t.Errorf("sign within the limits failed: %v", err)
+	}
+	router := am.Backends(keystore.KeyStoreType)[0].(keystore.KeyStore)
+	if _, err = router.SignTxWithPassphrase(acct, "pass", newTx(1, 100), chainId); err != nil {
+		t.Errorf("router sign within the limits failed: %v", err)
+	}
+	if _, err = router.SignTx(acct, newTx(2, 100), chainId); err == nil {
+		t.Errorf("router signed over the daily limit")
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	storage := kstore.NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks, err := kstore.NewKeyStore(storage, 0, "")
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	am := NewManager(&TudoConfig{}, ks).(*Manager)
+	defer am.Close()
+	sink := make(chan accounts.WalletEvent, 4)
+	sub := am.Subscribe(sink)
+	defer sub.Unsubscribe()
+
+	next := func() accounts.WalletEvent {
+		select {
+		case ev := <-sink:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("no wallet event")
+		}
+		return accounts.WalletEvent{}
+	}
+	acct, _, err := ks.NewAccountOwner("", "", "alice", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if ev := next(); ev.Kind != accounts.WalletArrived || !ev.Wallet.Contains(*acct) {
+		t.Fatalf("arrived event %+v", ev)
+	}
+	if wallets := am.Wallets(); len(wallets) != 1 || wallets[0].URL() != acct.URL {
+		t.Errorf("manager wallets %v", wallets)
+	}
+	if err = ks.Delete(*acct, "pass"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if ev := next(); ev.Kind != accounts.WalletDropped {
+		t.Fatalf("dropped event %+v", ev)
+	}
+	if wallets := am.Wallets(); len(wallets) != 0 {
+		t.Errorf("dropped wallet still listed %v", wallets)
+	}
+}
+
+func TestParseWalletURL(t *testing.T) {
+	owner := uuid.NewRandom().String()
+	tests := []struct {
+		url  string
+		want accounts.URL
+		ok   bool
+	}{
+		{"sql://" + owner, kstore.NewURL(owner), true},
+		{"sql://" + strings.ToUpper(owner), kstore.NewURL(owner), true},
+		{"sql://bogus", accounts.URL{}, false},
+		{"keystore:///tmp/key", accounts.URL{Scheme: "keystore", Path: "/tmp/key"}, true},
+		{"ledger://0001", accounts.URL{Scheme: "ledger", Path: "0001"}, true},
+		{owner, accounts.URL{}, false},
+		{"sql://", accounts.URL{}, false},
+		{"://" + owner, accounts.URL{}, false},
+		{"sql://a://b", accounts.URL{}, false},
+	}
+	for _, test := range tests {
+		url, err := parseWalletURL(test.url)
+		if (err == nil) != test.ok || url != test.want {
+			t.Errorf("%q: got %v, %v", test.url, url, err)
+		}
+	}
+}
+
+func TestManagerWallet(t *testing.T) {
+	storage := kstore.NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks, err := kstore.NewKeyStore(storage, 0, "")
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	owner := uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, "", "alice", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	// A fresh keystore over the storage loads the wallet on lookup.
+	ks, _ = kstore.NewKeyStore(storage, 0, "")
+	am := NewManager(&TudoConfig{}, ks).(*Manager)
+	defer am.Close()
+
+	wallet, err := am.Wallet("sql://" + owner)
+	if err != nil || !wallet.Contains(*acct) {
+		t.Fatalf("wallet of the owner %v: %v", wallet, err)
+	}
+	unknown := "sql://" + uuid.NewRandom().String()
+	if _, err = am.Wallet(unknown); err != accounts.ErrUnknownWallet {
+		t.Errorf("unknown owner: %v", err)
+	}
+	if _, err = am.Wallet("keystore:///tmp/none"); err != accounts.ErrUnknownWallet {
+		t.Errorf("unknown keystore wallet: %v", err)
+	}
+	if _, err = am.Wallet(owner); err == nil {
+		t.Errorf("malformed url accepted")
+	}
+}
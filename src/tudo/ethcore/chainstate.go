@@ -0,0 +1,106 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+/**
+ * Chain state reader over the local node, used to find the HD wallet accounts
+ * with activity.  A nil block number means the latest block.
+ */
+type chainState struct {
+	stateAt func(ctx context.Context, block *big.Int) (*state.StateDB, error)
+}
+
+/**
+ * NewBackendState
+ * ---------------
+ * Read the state through the running node's API backend.
+ */
+func NewBackendState(backend *eth.EthApiBackend) ethereum.ChainStateReader {
+	return &chainState{
+		stateAt: func(ctx context.Context, block *big.Int) (*state.StateDB, error) {
+			blkNo := rpc.LatestBlockNumber
+			if block != nil {
+				blkNo = rpc.BlockNumber(block.Int64())
+			}
+			st, _, err := backend.StateAndHeaderByNumber(ctx, blkNo)
+			if st == nil && err == nil {
+				err = fmt.Errorf("No state for block %v", block)
+			}
+			return st, err
+		},
+	}
+}
+
+/**
+ * NewBlockChainState
+ * ------------------
+ * Read the state from the chain database, for commands run with the node down.
+ */
+func NewBlockChainState(chain *core.BlockChain) ethereum.ChainStateReader {
+	return &chainState{
+		stateAt: func(ctx context.Context, block *big.Int) (*state.StateDB, error) {
+			if block == nil {
+				return chain.State()
+			}
+			blk := chain.GetBlockByNumber(block.Uint64())
+			if blk == nil {
+				return nil, fmt.Errorf("No block %v", block)
+			}
+			return chain.StateAt(blk.Root())
+		},
+	}
+}
+
+func (c *chainState) BalanceAt(ctx context.Context, account common.Address,
+	block *big.Int) (*big.Int, error) {
+	st, err := c.stateAt(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	return st.GetBalance(account), nil
+}
+
+func (c *chainState) StorageAt(ctx context.Context, account common.Address,
+	key common.Hash, block *big.Int) ([]byte, error) {
+	st, err := c.stateAt(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	return st.GetState(account, key).Bytes(), nil
+}
+
+func (c *chainState) CodeAt(ctx context.Context, account common.Address,
+	block *big.Int) ([]byte, error) {
+	st, err := c.stateAt(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	return st.GetCode(account), nil
+}
+
+func (c *chainState) NonceAt(ctx context.Context, account common.Address,
+	block *big.Int) (uint64, error) {
+	st, err := c.stateAt(ctx, block)
+	if err != nil {
+		return 0, err
+	}
+	return st.GetNonce(account), nil
+}
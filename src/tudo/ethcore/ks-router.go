@@ -0,0 +1,151 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"tudo/kstore"
+)
+
+/**
+ * Keystore handed out for keystore.KeyStoreType.  Calls on an account go to the
+ * keystore holding it, new and imported keys go to the default keystore.  The
+ * transactions signed by the other keystores are checked like their wallets'.
+ */
+type ksRouter struct {
+	am *Manager
+}
+
+func (r *ksRouter) Wallets() []accounts.Wallet {
+	wallets := []accounts.Wallet{}
+	for _, ks := range r.am.keystores {
+		for _, wallet := range ks.Wallets() {
+			wallets = mergeSorted(wallets, r.am.guard(wallet))
+		}
+	}
+	return wallets
+}
+
+func (r *ksRouter) Subscribe(sink chan<- accounts.WalletEvent) event.Subscription {
+	return r.am.Subscribe(sink)
+}
+
+func (r *ksRouter) HasAddress(addr common.Address) bool {
+	for _, ks := range r.am.keystores {
+		if ks.HasAddress(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ksRouter) Accounts() []accounts.Account {
+	accts := []accounts.Account{}
+	for _, ks := range r.am.keystores {
+		accts = append(accts, ks.Accounts()...)
+	}
+	return accts
+}
+
+func (r *ksRouter) Delete(a accounts.Account, passphrase string) error {
+	return r.am.keyStoreFor(a).Delete(a, passphrase)
+}
+
+func (r *ksRouter) SignHash(a accounts.Account, hash []byte) ([]byte, error) {
+	return r.am.keyStoreFor(a).SignHash(a, hash)
+}
+
+func (r *ksRouter) LogTx(tx *types.Transaction) error {
+	return r.am.DefaultKeyStore().LogTx(tx)
+}
+
+// checked tells if the keystore checks the transactions it signs itself.
+func (r *ksRouter) checked(ks keystore.KeyStore) bool {
+	_, ok := ks.(kstore.KStoreIface)
+	return ok
+}
+
+func (r *ksRouter) SignTx(a accounts.Account, tx *types.Transaction,
+	chainId *big.Int) (*types.Transaction, error) {
+	ks := r.am.keyStoreFor(a)
+	if r.checked(ks) {
+		return ks.SignTx(a, tx, chainId)
+	}
+	return r.am.signChecked(a.Address, tx, chainId, func() (*types.Transaction, error) {
+		return ks.SignTx(a, tx, chainId)
+	})
+}
+
+func (r *ksRouter) SignHashWithPassphrase(a accounts.Account, passphrase string,
+	hash []byte) ([]byte, error) {
+	return r.am.keyStoreFor(a).SignHashWithPassphrase(a, passphrase, hash)
+}
+
+func (r *ksRouter) SignTxWithPassphrase(a accounts.Account, passphrase string,
+	tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	ks := r.am.keyStoreFor(a)
+	if r.checked(ks) {
+		return ks.SignTxWithPassphrase(a, passphrase, tx, chainID)
+	}
+	return r.am.signChecked(a.Address, tx, chainID, func() (*types.Transaction, error) {
+		return ks.SignTxWithPassphrase(a, passphrase, tx, chainID)
+	})
+}
+
+func (r *ksRouter) Unlock(a accounts.Account, passphrase string) error {
+	return r.am.keyStoreFor(a).Unlock(a, passphrase)
+}
+
+func (r *ksRouter) Lock(addr common.Address) error {
+	return r.am.keyStoreFor(accounts.Account{Address: addr}).Lock(addr)
+}
+
+func (r *ksRouter) TimedUnlock(a accounts.Account, passphrase string,
+	timeout time.Duration) error {
+	return r.am.keyStoreFor(a).TimedUnlock(a, passphrase, timeout)
+}
+
+func (r *ksRouter) Find(a accounts.Account) (accounts.Account, error) {
+	return r.am.keyStoreFor(a).Find(a)
+}
+
+func (r *ksRouter) NewAccount(passphrase string) (accounts.Account, error) {
+	return r.am.DefaultKeyStore().NewAccount(passphrase)
+}
+
+func (r *ksRouter) Export(a accounts.Account,
+	passphrase, newPassphrase string) ([]byte, error) {
+	return r.am.keyStoreFor(a).Export(a, passphrase, newPassphrase)
+}
+
+func (r *ksRouter) Import(keyJson []byte,
+	passphrase, newPassphrase string) (accounts.Account, error) {
+	return r.am.DefaultKeyStore().Import(keyJson, passphrase, newPassphrase)
+}
+
+func (r *ksRouter) ImportECDSA(priv *ecdsa.PrivateKey,
+	passphrase string) (accounts.Account, error) {
+	return r.am.DefaultKeyStore().ImportECDSA(priv, passphrase)
+}
+
+func (r *ksRouter) Update(a accounts.Account, passphrase, newPassphrase string) error {
+	return r.am.keyStoreFor(a).Update(a, passphrase, newPassphrase)
+}
+
+func (r *ksRouter) ImportPreSaleKey(keyJSON []byte,
+	passphrase string) (accounts.Account, error) {
+	return r.am.DefaultKeyStore().ImportPreSaleKey(keyJSON, passphrase)
+}
@@ -0,0 +1,114 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+)
+
+func TestKeyStoreRouter(t *testing.T) {
+	fileKs, cleanup := newFileKeyStore(t)
+	defer cleanup()
+	fileAcct := newFileAccount(t, fileKs)
+
+	storage := kstore.NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	sqlKs, err := kstore.NewKeyStore(storage, 0, "")
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	owner := uuid.NewRandom().String()
+	sqlAcct, _, err := sqlKs.NewAccountOwner(owner, "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	// Whatever the map order, the SQL keystore is the default.
+	for i := 0; i < 10; i++ {
+		am := NewManager(&TudoConfig{}, sqlKs, fileKs).(*Manager)
+		if am.DefaultKeyStore() != sqlKs || am.Keystore(keystore.KeyStoreType) != fileKs {
+			t.Fatalf("keystores registered out of order")
+		}
+		am.Close()
+	}
+	am := NewManager(&TudoConfig{}, sqlKs, fileKs).(*Manager)
+	defer am.Close()
+	backends := am.Backends(keystore.KeyStoreType)
+	if len(backends) != 1 {
+		t.Fatalf("%d keystore backends", len(backends))
+	}
+	router, ok := backends[0].(*ksRouter)
+	if !ok {
+		t.Fatalf("keystore backend %T isn't the router", backends[0])
+	}
+
+	unknown := common.HexToAddress("0x1234")
+	routes := []struct {
+		name string
+		acct accounts.Account
+		ks   keystore.KeyStore
+	}{
+		{"sql url", *sqlAcct, sqlKs},
+		{"keystore url", fileAcct, fileKs},
+		{"sql address", accounts.Account{Address: sqlAcct.Address}, sqlKs},
+		{"key file address", accounts.Account{Address: fileAcct.Address}, fileKs},
+		{"unknown scheme", accounts.Account{Address: fileAcct.Address,
+			URL: accounts.URL{Scheme: "ledger", Path: "1"}}, fileKs},
+		{"unknown account", accounts.Account{Address: unknown}, sqlKs},
+	}
+	for _, route := range routes {
+		if ks := am.keyStoreFor(route.acct); ks != route.ks {
+			t.Errorf("%s routed to %T", route.name, ks)
+		}
+	}
+
+	newAcct, err := router.NewAccount("pass")
+	if err != nil || newAcct.URL.Scheme != kstore.SqlScheme {
+		t.Fatalf("new account %+v: %v", newAcct, err)
+	}
+	if !router.HasAddress(fileAcct.Address) || !router.HasAddress(newAcct.Address) ||
+		router.HasAddress(unknown) || len(router.Accounts()) != 3 {
+		t.Errorf("router accounts %v", router.Accounts())
+	}
+	for _, acct := range []accounts.Account{*sqlAcct, fileAcct} {
+		addr := accounts.Account{Address: acct.Address}
+		if err = router.Unlock(addr, "pass"); err != nil {
+			t.Errorf("unlock of %s failed: %v", acct.URL, err)
+		}
+		tx := types.NewTransaction(0, unknown, big.NewInt(1), 21000, big.NewInt(1), nil)
+		if _, err = router.SignTx(addr, tx, big.NewInt(1)); err != nil {
+			t.Errorf("sign with %s failed: %v", acct.URL, err)
+		}
+	}
+	if err = router.Unlock(accounts.Account{Address: unknown}, "pass"); err == nil {
+		t.Errorf("unknown account unlocked")
+	}
+
+	wallet, err := am.Wallet("sql://" + owner)
+	if err != nil || !wallet.Contains(*sqlAcct) {
+		t.Errorf("owner wallet %v: %v", wallet, err)
+	}
+	wallet, err = am.Wallet(fileAcct.URL.String())
+	if err != nil || !wallet.Contains(fileAcct) {
+		t.Errorf("key file wallet %v: %v", wallet, err)
+	}
+	if _, err = am.Wallet("ledger://0001"); err != accounts.ErrUnknownWallet {
+		t.Errorf("unknown wallet: %v", err)
+	}
+	for _, url := range []string{"sql://bob", "keystore", "://path"} {
+		if _, err = am.Wallet(url); err == nil {
+			t.Errorf("wallet url %s accepted", url)
+		}
+	}
+}
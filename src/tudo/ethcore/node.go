@@ -9,9 +9,10 @@
 package ethcore
 
 import (
+	"fmt"
 	"reflect"
 
-	"github.com/astaxie/beego/orm"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/rpc"
@@ -23,11 +24,41 @@ type TudoNode struct {
 	ether    *eth.Ethereum
 	bcEthApi *eth.EthApiBackend
 	kstore   kstore.KStoreIface
+	rpcAuth  *RPCAuth
 }
 
 type TudoConfig struct {
 	AdminAccounts []string
-	PeerCfgFile   string
+	// Approvals from other admins needed to sign an admin transaction, zero
+	// for a majority.
+	AdminQuorum int
+	PeerCfgFile string
+
+	// Keystore backend: "mysql" (default), "sqlite" or "memory".
+	KsBackend string
+	// Backend data source, MySQL DSN or SQLite file path.  Empty means
+	// app.conf settings for MySQL and kstore.db in the data dir for SQLite.
+	KsDataSource string
+	// Max number of unlocked keys kept in memory, zero for the default.
+	KsKeyCacheSize int
+	// File with the master keys wrapping the stored keys.  Empty means the
+	// TUDO_KS_MASTER_KEY environment variable, or no wrapping if it's not set.
+	KsMasterKeyFile string
+	// Days a deleted account can be restored before it's purged, zero for
+	// the default of 30.
+	KsRetentionDays int
+
+	// File of the bearer tokens of the HTTP and websocket RPC callers, with a
+	// "token owner-uuid" or "token admin" line for each token.  The owner
+	// tokens can only call the tudo and tudov2 methods.
+	RpcTokenFile string
+	// File with the secret of the HS256 JWTs of the HTTP and websocket RPC
+	// callers, the sub claim is the owner uuid or the role claim "admin".
+	RpcJwtSecretFile string
+	// Serve HTTP and websocket without tokens nor secret, those callers can
+	// then act for any owner they name but not call the admin methods.  The
+	// node refuses to start without it when they aren't authenticated.
+	RpcInsecure bool
 }
 
 func NewTudoNode(conf *node.Config, tdcfg *TudoConfig) (*node.Node, error) {
@@ -35,12 +66,24 @@ func NewTudoNode(conf *node.Config, tdcfg *TudoConfig) (*node.Node, error) {
 	if err != nil {
 		return nil, nil
 	}
-	tudo := &TudoNode{n, nil, nil, nil}
+	tudo := &TudoNode{n, nil, nil, nil, nil}
 	tudo.NodeIf = tudo
 
+	if tudo.rpcAuth, err = NewRPCAuth(tdcfg); err != nil {
+		return nil, err
+	}
+	if tudo.rpcAuth == nil && (conf.HTTPHost != "" || conf.WSHost != "") {
+		if !tdcfg.RpcInsecure {
+			return nil, fmt.Errorf("HTTP and websocket RPC need RpcTokenFile or " +
+				"RpcJwtSecretFile, or RpcInsecure to serve them unauthenticated")
+		}
+		fmt.Printf("RpcInsecure set, tudo RPC callers over HTTP and websocket " +
+			"aren't authenticated\n")
+	}
+
 	accman, ksIface, err := makeAccountManager(conf, tdcfg)
 	if err != nil {
-		return tudo.Node, nil
+		return nil, err
 	}
 	tudo.kstore = ksIface
 	tudo.Node.SetAccountManager(accman)
@@ -54,10 +97,28 @@ func (n *TudoNode) GetApis() []rpc.API {
 		Version:   "1.0",
 		Service:   NewTudoNodeAPI(n),
 		Public:    true,
+	}, rpc.API{
+		Namespace: "tudov2",
+		Version:   "2.0",
+		Service:   NewTudoV2API(n),
+		Public:    true,
+	}, rpc.API{
+		Namespace: "tudoadmin",
+		Version:   "1.0",
+		Service:   NewTudoAdminAPI(n),
+		Public:    false,
 	})
 	return apis
 }
 
+// GetRPCAuth returns the authenticator of the HTTP and websocket requests.
+func (n *TudoNode) GetRPCAuth() rpc.Authenticator {
+	if n.rpcAuth == nil {
+		return nil
+	}
+	return n.rpcAuth.Authenticate
+}
+
 func (n *TudoNode) GetEthereum() *eth.Ethereum {
 	if n.ether == nil {
 		e := n.GetService(reflect.TypeOf((*eth.Ethereum)(nil)))
@@ -67,6 +128,11 @@ func (n *TudoNode) GetEthereum() *eth.Ethereum {
 	return n.ether
 }
 
-func (n *TudoNode) GetOrm() orm.Ormer {
-	return n.kstore.GetStorageIf().GetOrm()
+func (n *TudoNode) isAdminAcct(addr common.Address) bool {
+	am, ok := n.AccountManager().(AmInterface)
+	return ok && am.IsAdminAcct(addr)
+}
+
+func (n *TudoNode) GetStorage() kstore.KsInterface {
+	return n.kstore.GetStorageIf()
 }
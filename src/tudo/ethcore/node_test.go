@@ -0,0 +1,66 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/node"
+	"tudo/kstore"
+	"tudo/models"
+)
+
+// newTestNode returns a node with the memory keystore and no RPC endpoint.
+func newTestNode(t *testing.T, dir string) *TudoNode {
+	n, err := NewTudoNode(&node.Config{DataDir: dir, NoUSB: true},
+		&TudoConfig{KsBackend: models.MemoryBackend})
+	if err != nil {
+		t.Fatalf("new node failed: %v", err)
+	}
+	return n.NodeIf.(*TudoNode)
+}
+
+func TestNodeMemoryBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tudo := newTestNode(t, dir)
+	if _, ok := tudo.GetStorage().(*kstore.MemKeyStore); !ok {
+		t.Errorf("node storage %T", tudo.GetStorage())
+	}
+	conf := &TudoConfig{KsBackend: "bogus"}
+	if _, err = NewTudoNode(&node.Config{DataDir: dir, NoUSB: true}, conf); err == nil {
+		t.Errorf("unknown backend accepted")
+	}
+}
+
+func TestNodeRPCAuthRequired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &node.Config{DataDir: dir, HTTPHost: "127.0.0.1"}
+	tdcfg := &TudoConfig{KsBackend: models.MemoryBackend}
+	if _, err = NewTudoNode(conf, tdcfg); err == nil ||
+		!strings.Contains(err.Error(), "RpcInsecure") {
+		t.Errorf("unauthenticated HTTP accepted: %v", err)
+	}
+	tdcfg.RpcInsecure = true
+	n, err := NewTudoNode(conf, tdcfg)
+	if err != nil || n == nil {
+		t.Fatalf("insecure node failed: %v", err)
+	}
+}
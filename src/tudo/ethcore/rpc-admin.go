@@ -0,0 +1,326 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+	"tudo/models"
+)
+
+// Max rows of a tudoadmin listing, each row sums the balances of its accounts.
+const adminListLimit = 100
+
+// Owners listed by tudoadmin_listOwners with the "frozen" status.
+const ownerFrozen = "frozen"
+
+/**
+ * The tudoadmin API, to run the custodial service without going to the keystore
+ * tables.  It isn't public: IPC callers get it, HTTP and websocket callers only
+ * if it's in the enabled modules, and then only with an admin token.  Errors are
+ * the JSON-RPC errors of the tudov2 API.
+ *
+ * echo '{"jsonrpc": "2.0", "method": "tudoadmin_listOwners", "params": [{"start":
+ *    0, "limit": 20}], "id": 1}' | nc -U tudo.ipc
+ */
+type TudoAdminAPI struct {
+	node *TudoNode
+}
+
+func NewTudoAdminAPI(node *TudoNode) *TudoAdminAPI {
+	return &TudoAdminAPI{node: node}
+}
+
+func adminListLimits(start, limit int) (int, int) {
+	start, limit = listLimit(start, limit)
+	if limit > adminListLimit {
+		limit = adminListLimit
+	}
+	return start, limit
+}
+
+// latestState returns nil if the node has no chain.
+func (api *TudoAdminAPI) latestState(ctx context.Context) *state.StateDB {
+	if !api.node.hasEthereum() {
+		return nil
+	}
+	backend := api.node.GetEthereum().ApiBackend
+	statedb, _, err := backend.StateAndHeaderByNumber(ctx, rpc.LatestBlockNumber)
+	if err != nil {
+		return nil
+	}
+	return statedb
+}
+
+// sumAccounts returns the number of admin accounts and the sum of the balances.
+func (api *TudoAdminAPI) sumAccounts(statedb *state.StateDB,
+	accts []models.Account) (int, *hexutil.Big) {
+	admins := 0
+	balance := new(big.Int)
+	for _, acct := range accts {
+		addr := common.HexToAddress(acct.Account)
+		if api.node.isAdminAcct(addr) {
+			admins++
+		}
+		if statedb != nil {
+			balance.Add(balance, statedb.GetBalance(addr))
+		}
+	}
+	if statedb == nil {
+		return admins, nil
+	}
+	return admins, (*hexutil.Big)(balance)
+}
+
+func (api *TudoAdminAPI) ownerFreeze(ownerUuid string) (*FreezeInfo, error) {
+	freeze, err := api.node.GetStorage().GetOwnerFreeze(ownerUuid)
+	if err != nil {
+		if kstore.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, rpcError(err)
+	}
+	return &FreezeInfo{Reason: freeze.Reason, Created: freeze.Created}, nil
+}
+
+/**
+ * ListOwners
+ * ----------
+ * Owners of live accounts by uuid, or only the frozen ones with the "frozen"
+ * status, at most 100 a page.
+ */
+func (api *TudoAdminAPI) ListOwners(ctx context.Context,
+	args ListReqt) ([]OwnerInfo, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	storage := api.node.GetStorage()
+	start, limit := adminListLimits(args.Start, args.Limit)
+
+	var owners []models.OwnerStat
+	switch args.Status {
+	case "":
+		stats, err := storage.ListOwners(start, limit)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		owners = stats
+	case ownerFrozen:
+		freezes, err := storage.ListOwnerFreezes(start, limit)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		for _, freeze := range freezes {
+			owners = append(owners, models.OwnerStat{OwnerUuid: freeze.OwnerUuid})
+		}
+	default:
+		return nil, invalidParams("Invalid owner status %s", args.Status)
+	}
+	statedb := api.latestState(ctx)
+	result := make([]OwnerInfo, 0, len(owners))
+	for _, stat := range owners {
+		accts, err := api.ownerAccounts(stat.OwnerUuid)
+		if err != nil {
+			return nil, err
+		}
+		if args.Status == ownerFrozen {
+			wallets := make(map[string]bool)
+			for _, acct := range accts {
+				wallets[acct.WalletUuid] = true
+			}
+			stat.Wallets, stat.Accounts = len(wallets), len(accts)
+		}
+		info := OwnerInfo{
+			OwnerUuid: stat.OwnerUuid,
+			Wallets:   stat.Wallets,
+			Accounts:  stat.Accounts,
+		}
+		info.AdminAccounts, info.Balance = api.sumAccounts(statedb, accts)
+		if info.Frozen, err = api.ownerFreeze(stat.OwnerUuid); err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// ownerAccounts returns no account for the owners that aren't uuids.
+func (api *TudoAdminAPI) ownerAccounts(ownerUuid string) ([]models.Account, error) {
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		return nil, nil
+	}
+	accts, err := api.node.GetStorage().GetUserAccount(owner)
+	if err != nil && !kstore.IsNotFound(err) {
+		return nil, rpcError(err)
+	}
+	return accts, nil
+}
+
+/**
+ * ListWallets
+ * -----------
+ * Wallets of live accounts by uuid, of every owner if none is given, at most 100
+ * a page.  The accounts without wallet are listed with an empty wallet uuid.
+ */
+func (api *TudoAdminAPI) ListWallets(ctx context.Context,
+	args ListWalletsReqt) ([]WalletInfo, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	owner, err := parseUuid("owner", args.OwnerUuid, true)
+	if err != nil {
+		return nil, err
+	}
+	ownerUuid := ""
+	if owner != nil {
+		ownerUuid = owner.String()
+	}
+	storage := api.node.GetStorage()
+	start, limit := adminListLimits(args.Start, args.Limit)
+	stats, err := storage.ListWallets(ownerUuid, start, limit)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	statedb := api.latestState(ctx)
+	result := make([]WalletInfo, 0, len(stats))
+	for _, stat := range stats {
+		accts, err := api.ownerAccounts(stat.OwnerUuid)
+		if err != nil {
+			return nil, err
+		}
+		inWallet := accts[:0]
+		for _, acct := range accts {
+			if acct.WalletUuid == stat.WalletUuid {
+				inWallet = append(inWallet, acct)
+			}
+		}
+		info := WalletInfo{
+			WalletUuid: stat.WalletUuid,
+			OwnerUuid:  stat.OwnerUuid,
+			Accounts:   stat.Accounts,
+		}
+		info.AdminAccounts, info.Balance = api.sumAccounts(statedb, inWallet)
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+/**
+ * FreezeOwner
+ * -----------
+ * Refuse signing, unlocking and exporting with the owner's keys on every node,
+ * and lock the keys unlocked on this node.  Freezing a frozen owner replaces the
+ * reason.
+ */
+func (api *TudoAdminAPI) FreezeOwner(ctx context.Context,
+	args FreezeOwnerReqt) (*LockKeysResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	owner, err := parseUuid("owner", args.OwnerUuid, false)
+	if err != nil {
+		return nil, err
+	}
+	if args.Reason == "" || len(args.Reason) > 256 {
+		return nil, invalidParams("The reason must have 1 to 256 characters")
+	}
+	if _, err = api.node.GetStorage().GetUserAccount(owner); err != nil {
+		return nil, rpcError(err)
+	}
+	locked, err := api.node.callerKStore(ctx).FreezeOwner(owner.String(), args.Reason)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &LockKeysResp{Locked: locked}, nil
+}
+
+/**
+ * UnfreezeOwner
+ * -------------
+ * The owner's keys stay locked.
+ */
+func (api *TudoAdminAPI) UnfreezeOwner(ctx context.Context, ownerUuid string) error {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return err
+	}
+	owner, err := parseUuid("owner", ownerUuid, false)
+	if err != nil {
+		return err
+	}
+	return rpcError(api.node.callerKStore(ctx).UnfreezeOwner(owner.String()))
+}
+
+/**
+ * LockKeys
+ * --------
+ * Lock the owner's keys unlocked on this node and close its HD wallet, or those
+ * of every owner with all set.
+ */
+func (api *TudoAdminAPI) LockKeys(ctx context.Context,
+	args LockKeysReqt) (*LockKeysResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	owner, err := parseUuid("owner", args.OwnerUuid, args.All)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil && args.All {
+		return nil, invalidParams("Give either an owner uuid or all")
+	}
+	ownerUuid := ""
+	if owner != nil {
+		ownerUuid = owner.String()
+	}
+	return &LockKeysResp{Locked: api.node.callerKStore(ctx).LockKeys(ownerUuid)}, nil
+}
+
+/**
+ * KeystoreStats
+ * -------------
+ */
+func (api *TudoAdminAPI) KeystoreStats(ctx context.Context) (*KeystoreStatsResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	stats, err := api.node.kstore.Stats()
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	resp := &KeystoreStatsResp{
+		Owners:           stats.Owners,
+		Wallets:          stats.Wallets,
+		Accounts:         stats.Accounts,
+		ArchivedAccounts: stats.ArchivedAccounts,
+		Keys:             stats.Keys,
+		ArchivedKeys:     stats.ArchivedKeys,
+		PlainKeys:        stats.PlainKeys,
+		KeyVersions:      stats.KeyVersions,
+		MasterKeyVersion: stats.MasterKeyVersion,
+		Seeds:            stats.Seeds,
+		SpendPolicies:    stats.SpendPolicies,
+		PendingApprovals: stats.PendingApprovals,
+		FrozenOwners:     stats.FrozenOwners,
+		LoadedWallets:    stats.LoadedWallets,
+		LoadedKeys:       stats.LoadedKeys,
+		UnlockedKeys:     stats.UnlockedKeys,
+		OpenWallets:      stats.OpenWallets,
+	}
+	if am, ok := api.node.AccountManager().(AmInterface); ok {
+		resp.AdminAccounts = len(am.AdminAccounts())
+	}
+	return resp, nil
+}
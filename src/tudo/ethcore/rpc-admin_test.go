@@ -0,0 +1,158 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+)
+
+func errorCode(err error) int {
+	if e, ok := err.(*RPCError); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestAdminAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tudo := newTestNode(t, dir)
+
+	owner, wallet := uuid.NewRandom().String(), uuid.NewRandom().String()
+	acct, _, err := tudo.kstore.NewAccountOwner(owner, wallet, "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if _, _, err = tudo.kstore.NewAccountOwner(owner, "", "b", "pass", "normal"); err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	other, _, err := tudo.kstore.NewAccountOwner(uuid.NewRandom().String(), "", "c",
+		"pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	tudo.kstore.Unlock(*acct, "pass")
+	tudo.kstore.Unlock(*other, "pass")
+
+	api := NewTudoAdminAPI(tudo)
+	ctx := context.Background()
+	owners, err := api.ListOwners(ctx, ListReqt{Limit: 10})
+	if err != nil || len(owners) != 2 {
+		t.Fatalf("owners %+v: %v", owners, err)
+	}
+	for _, info := range owners {
+		if info.OwnerUuid == owner && (info.Accounts != 2 || info.Frozen != nil) {
+			t.Errorf("owner %+v", info)
+		}
+	}
+	if _, err = api.ListOwners(ctx, ListReqt{Status: "bogus"}); errorCode(err) !=
+		CodeInvalidParams {
+		t.Errorf("bad status: %v", err)
+	}
+	if _, err = api.FreezeOwner(ctx, FreezeOwnerReqt{OwnerUuid: owner}); errorCode(err) !=
+		CodeInvalidParams {
+		t.Errorf("freeze without reason: %v", err)
+	}
+	_, err = api.FreezeOwner(ctx, FreezeOwnerReqt{OwnerUuid: uuid.NewRandom().String(),
+		Reason: "fraud"})
+	if errorCode(err) != CodeNotFound {
+		t.Errorf("freeze of an unknown owner: %v", err)
+	}
+	locked, err := api.FreezeOwner(ctx, FreezeOwnerReqt{OwnerUuid: owner, Reason: "fraud"})
+	if err != nil || locked.Locked != 1 {
+		t.Fatalf("freeze %+v: %v", locked, err)
+	}
+	frozen, _ := api.ListOwners(ctx, ListReqt{Status: "frozen"})
+	if len(frozen) != 1 || frozen[0].Frozen == nil || frozen[0].Frozen.Reason != "fraud" {
+		t.Errorf("frozen owners %+v", frozen)
+	}
+	if errorCode(rpcError(tudo.kstore.Unlock(*acct, "pass"))) != CodeOwnerFrozen {
+		t.Errorf("frozen owner unlocked")
+	}
+	stats, err := api.KeystoreStats(ctx)
+	if err != nil || stats.Accounts != 3 || stats.FrozenOwners != 1 ||
+		stats.UnlockedKeys != 1 {
+		t.Errorf("stats %+v: %v", stats, err)
+	}
+	if _, err = api.LockKeys(ctx, LockKeysReqt{}); errorCode(err) != CodeInvalidParams {
+		t.Errorf("lock without owner: %v", err)
+	}
+	if locked, err = api.LockKeys(ctx, LockKeysReqt{All: true}); err != nil ||
+		locked.Locked != 1 {
+		t.Errorf("lock all %+v: %v", locked, err)
+	}
+	if err = api.UnfreezeOwner(ctx, owner); err != nil {
+		t.Errorf("unfreeze failed: %v", err)
+	}
+	if err = api.UnfreezeOwner(ctx, owner); errorCode(err) != CodeNotFound {
+		t.Errorf("unfreeze twice: %v", err)
+	}
+}
+
+func TestAdminAPIGate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tudo := newTestNode(t, dir)
+	for _, api := range tudo.GetApis() {
+		if api.Namespace == "tudoadmin" && api.Public {
+			t.Errorf("tudoadmin is public")
+		}
+	}
+	serve := func(auth *RPCAuth) *httptest.Server {
+		srv := rpc.NewServer()
+		if auth != nil {
+			srv.SetAuthenticator(auth.Authenticate)
+		}
+		srv.RegisterName("tudoadmin", NewTudoAdminAPI(tudo))
+		return httptest.NewServer(srv)
+	}
+	server := serve(newTestAuth(t, dir))
+	defer server.Close()
+
+	method := "tudoadmin_keystoreStats"
+	if _, reply := callRPC(t, server.URL, "admin-token", method); reply.Error != nil {
+		t.Errorf("admin token refused: %s", reply.Error.Message)
+	}
+	if _, reply := callRPC(t, server.URL, "owner-token", method); reply.Error == nil {
+		t.Errorf("owner token called %s", method)
+	}
+	// The audit record names the token and the client's address.
+	callRPCParams(t, server.URL, "admin-token", "tudoadmin_unfreezeOwner",
+		`["`+uuid.NewRandom().String()+`"]`)
+	recs, err := tudo.GetStorage().GetAuditRecords(0, 100)
+	if err != nil || len(recs) == 0 {
+		t.Fatalf("audit records %v: %v", recs, err)
+	}
+	rec := recs[len(recs)-1]
+	if rec.Op != kstore.AuditUnfreeze || !strings.HasPrefix(rec.Identity, "token:admin:") ||
+		!strings.HasPrefix(rec.Remote, "127.0.0.1:") {
+		t.Errorf("audit record %+v", rec)
+	}
+	// The callers of an insecure node can't be admins.
+	open := serve(nil)
+	defer open.Close()
+	_, reply := callRPC(t, open.URL, "", method)
+	if reply.Error == nil || reply.Error.Code != CodeForbidden {
+		t.Errorf("open caller called %s: %+v", method, reply.Error)
+	}
+}
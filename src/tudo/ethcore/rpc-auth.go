@@ -0,0 +1,339 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+)
+
+// Role of the tokens allowed to call every method.
+const adminRole = "admin"
+
+// Namespaces of the owner tokens, the others act on every account of the node.
+var ownerServices = map[string]bool{"tudo": true, "tudov2": true}
+
+var (
+	ErrNoToken  = errors.New("Missing bearer token")
+	ErrBadToken = errors.New("Invalid bearer token")
+)
+
+/**
+ * What the caller of a tudo method may act on: every owner for the admin role,
+ * else the one owner of its token.  Open is the scope of the HTTP and websocket
+ * callers of a node started with RpcInsecure, the owner uuids they give are
+ * trusted but the admin methods are refused.  A JWT scope is valid until the
+ * token expires, even on a websocket opened before.  Identity names the caller
+ * in the audit log: the token's owner and hash prefix, or the JWT subject.
+ */
+type RPCScope struct {
+	Admin     bool
+	OwnerUuid string
+	Open      bool
+	Expires   time.Time
+	Identity  string
+}
+
+var (
+	localScope = &RPCScope{Admin: true, Identity: "local"}
+	openScope  = &RPCScope{Open: true, Identity: "open"}
+	// Scope of an expired token, it may act on nothing.
+	expiredScope = &RPCScope{Expires: time.Unix(0, 0), Identity: "expired"}
+)
+
+/**
+ * callerScope
+ * -----------
+ * IPC and in-process callers have the admin role, access to the IPC socket is
+ * already limited to the node's user.
+ */
+func callerScope(ctx context.Context) *RPCScope {
+	caller := rpc.CallerFrom(ctx)
+	if caller == nil {
+		return localScope
+	}
+	if scope, ok := caller.Auth.(*RPCScope); ok {
+		if scope.expired(time.Now()) {
+			return expiredScope
+		}
+		return scope
+	}
+	return openScope
+}
+
+/**
+ * callerKStore
+ * ------------
+ * The keystore recording the caller's identity and address in the audit log.
+ */
+func (n *TudoNode) callerKStore(ctx context.Context) kstore.KStoreIface {
+	caller := &kstore.AuditCaller{Identity: callerScope(ctx).Identity}
+	if rpcCaller := rpc.CallerFrom(ctx); rpcCaller != nil {
+		caller.Remote = rpcCaller.Remote
+	}
+	return n.kstore.WithCaller(caller)
+}
+
+func (s *RPCScope) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+/**
+ * AllowService
+ * ------------
+ * The server refuses the namespaces other than tudo and tudov2 to the owner
+ * tokens, eth and personal would sign with the unlocked keys of any owner.
+ */
+func (s *RPCScope) AllowService(namespace string) bool {
+	if s.expired(time.Now()) {
+		return false
+	}
+	return s.Admin || s.Open || ownerServices[namespace]
+}
+
+func forbidden(format string, args ...interface{}) *RPCError {
+	return newRPCError(CodeForbidden, format, args...)
+}
+
+func (s *RPCScope) checkAdmin() error {
+	if !s.Admin {
+		return forbidden("Admin role needed")
+	}
+	return nil
+}
+
+func sameUuid(a, b string) bool {
+	ua, ub := uuid.Parse(a), uuid.Parse(b)
+	return ua != nil && uuid.Equal(ua, ub)
+}
+
+// defaultOwner is the token's owner for an empty owner uuid.
+func (s *RPCScope) defaultOwner(ownerUuid string) string {
+	if ownerUuid == "" && !s.Admin && !s.Open {
+		return s.OwnerUuid
+	}
+	return ownerUuid
+}
+
+func (s *RPCScope) checkOwner(ownerUuid string) error {
+	if s.Admin || s.Open || sameUuid(ownerUuid, s.OwnerUuid) {
+		return nil
+	}
+	return forbidden("Caller can't act for owner %s", ownerUuid)
+}
+
+func (s *RPCScope) checkAccount(storage kstore.KsInterface, address string) error {
+	if s.Admin || s.Open {
+		return nil
+	}
+	if common.IsHexAddress(address) {
+		addr := common.HexToAddress(address).Hex()
+		if _, err := storage.GetAccountOwner(addr, s.OwnerUuid); err == nil {
+			return nil
+		}
+	}
+	return forbidden("Caller can't act for account %s", address)
+}
+
+func (s *RPCScope) checkWallet(storage kstore.KsInterface, walletUuid string) error {
+	if s.Admin || s.Open {
+		return nil
+	}
+	if wallet := uuid.Parse(walletUuid); wallet != nil {
+		accts, err := storage.GetWallet(wallet)
+		owned := err == nil && len(accts) > 0
+		for _, acct := range accts {
+			owned = owned && sameUuid(acct.OwnerUuid, s.OwnerUuid)
+		}
+		if owned {
+			return nil
+		}
+	}
+	return forbidden("Caller can't act for wallet %s", walletUuid)
+}
+
+// checkPolicyScope checks the account or wallet of a spending policy.
+func (s *RPCScope) checkPolicyScope(storage kstore.KsInterface, scope string) error {
+	if common.IsHexAddress(scope) {
+		return s.checkAccount(storage, scope)
+	}
+	return s.checkWallet(storage, scope)
+}
+
+/**
+ * Authenticator of the HTTP and websocket requests, with static bearer tokens
+ * and HS256 JWTs.
+ */
+type RPCAuth struct {
+	tokens    map[[32]byte]*RPCScope
+	jwtSecret []byte
+}
+
+/**
+ * NewRPCAuth
+ * ----------
+ * Return nil if neither RpcTokenFile nor RpcJwtSecretFile is set.
+ */
+func NewRPCAuth(tdcfg *TudoConfig) (*RPCAuth, error) {
+	if tdcfg.RpcTokenFile == "" && tdcfg.RpcJwtSecretFile == "" {
+		return nil, nil
+	}
+	auth := &RPCAuth{tokens: make(map[[32]byte]*RPCScope)}
+	if tdcfg.RpcTokenFile != "" {
+		if err := auth.loadTokens(tdcfg.RpcTokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if tdcfg.RpcJwtSecretFile != "" {
+		secret, err := ioutil.ReadFile(tdcfg.RpcJwtSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the JWT secret: %v", err)
+		}
+		auth.jwtSecret = []byte(strings.TrimSpace(string(secret)))
+		if len(auth.jwtSecret) < 32 {
+			return nil, fmt.Errorf("JWT secret in %s is shorter than 32 bytes",
+				tdcfg.RpcJwtSecretFile)
+		}
+	}
+	return auth, nil
+}
+
+// loadTokens reads the "token owner-uuid" or "token admin" lines of the file.
+func (a *RPCAuth) loadTokens(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read the RPC tokens: %v", err)
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var scope *RPCScope
+		if len(fields) == 2 {
+			scope = tokenScope(fields[1])
+		}
+		if scope == nil {
+			return fmt.Errorf("%s:%d: want \"token owner-uuid\" or \"token admin\"",
+				file, line)
+		}
+		hash := sha256.Sum256([]byte(fields[0]))
+		scope.Identity = fmt.Sprintf("token:%s:%x", fields[1], hash[:4])
+		a.tokens[hash] = scope
+	}
+	return scanner.Err()
+}
+
+func tokenScope(owner string) *RPCScope {
+	if owner == adminRole {
+		return &RPCScope{Admin: true}
+	}
+	if id := uuid.Parse(owner); id != nil {
+		return &RPCScope{OwnerUuid: id.String()}
+	}
+	return nil
+}
+
+/**
+ * Authenticate
+ * ------------
+ * The token is sent as "Authorization: Bearer <token>", or as the access_token
+ * query parameter of a websocket upgrade since browsers can't set the header.
+ */
+func (a *RPCAuth) Authenticate(r *http.Request) (interface{}, error) {
+	token := ""
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(header[len("Bearer "):])
+	} else if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	if scope, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return scope, nil
+	}
+	if a.jwtSecret != nil && strings.Count(token, ".") == 2 {
+		return a.checkJwt(token, time.Now())
+	}
+	return nil, ErrBadToken
+}
+
+/**
+ * checkJwt
+ * --------
+ * Verify the HS256 JWT, it must expire.  The sub claim is the owner uuid, or
+ * the role claim is "admin".
+ */
+func (a *RPCAuth) checkJwt(token string, now time.Time) (*RPCScope, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Sub  string `json:"sub"`
+		Role string `json:"role"`
+		Exp  int64  `json:"exp"`
+		Nbf  int64  `json:"nbf"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrBadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	mac := hmac.New(sha256.New, a.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrBadToken
+	}
+	if err = decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, ErrBadToken
+	}
+	if claims.Exp == 0 || now.Unix() >= claims.Exp || now.Unix() < claims.Nbf {
+		return nil, errors.New("Bearer token expired or not valid yet")
+	}
+	expires := time.Unix(claims.Exp, 0)
+	if claims.Role == adminRole {
+		return &RPCScope{Admin: true, Expires: expires,
+			Identity: "jwt:admin:" + claims.Sub}, nil
+	}
+	if id := uuid.Parse(claims.Sub); id != nil {
+		return &RPCScope{OwnerUuid: id.String(), Expires: expires,
+			Identity: "jwt:" + id.String()}, nil
+	}
+	return nil, ErrBadToken
+}
+
+func decodeJwtPart(part string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,370 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+)
+
+const testOwner = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// Service telling the scope of its caller.
+type ScopeService struct{}
+
+func (ScopeService) Who(ctx context.Context) (*RPCScope, error) {
+	return callerScope(ctx), nil
+}
+
+func (ScopeService) Admin(ctx context.Context) error {
+	return callerScope(ctx).checkAdmin()
+}
+
+// newTestAuth returns the authenticator of an admin token, an owner token and
+// the JWTs of the test secret.
+func newTestAuth(t *testing.T, dir string) *RPCAuth {
+	tokens := filepath.Join(dir, "tokens")
+	err := ioutil.WriteFile(tokens,
+		[]byte("# tokens\nadmin-token admin\nowner-token "+testOwner+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("write tokens failed: %v", err)
+	}
+	secret := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(secret, testSecret, 0600); err != nil {
+		t.Fatalf("write secret failed: %v", err)
+	}
+	auth, err := NewRPCAuth(&TudoConfig{RpcTokenFile: tokens, RpcJwtSecretFile: secret})
+	if err != nil {
+		t.Fatalf("new auth failed: %v", err)
+	}
+	return auth
+}
+
+// newJwt signs the claims with the header given, HS256 by default.
+func newJwt(secret []byte, header string, claims map[string]interface{}) string {
+	if header == "" {
+		header = `{"alg":"HS256","typ":"JWT"}`
+	}
+	enc := base64.RawURLEncoding
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// newTestServer serves the scope service as tudo, eth and personal.
+func newTestServer(t *testing.T, auth *RPCAuth) *httptest.Server {
+	srv := rpc.NewServer()
+	if auth != nil {
+		srv.SetAuthenticator(auth.Authenticate)
+	}
+	for _, name := range []string{"tudo", "eth", "personal"} {
+		if err := srv.RegisterName(name, ScopeService{}); err != nil {
+			t.Fatalf("register failed: %v", err)
+		}
+	}
+	return httptest.NewServer(srv)
+}
+
+type rpcReply struct {
+	Result *RPCScope
+	Error  *struct {
+		Code    int
+		Message string
+	}
+}
+
+func callRPC(t *testing.T, url, token, method string) (int, *rpcReply) {
+	return callRPCParams(t, url, token, method, "[]")
+}
+
+func callRPCParams(t *testing.T, url, token, method, params string) (int, *rpcReply) {
+	req, _ := http.NewRequest("POST", url, bytes.NewBufferString(
+		`{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":`+params+`}`))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+	reply := &rpcReply{}
+	json.NewDecoder(resp.Body).Decode(reply)
+	return resp.StatusCode, reply
+}
+
+func TestRPCAuthNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	server := newTestServer(t, newTestAuth(t, dir))
+	defer server.Close()
+
+	_, reply := callRPC(t, server.URL, "owner-token", "tudo_who")
+	if reply.Result == nil || reply.Result.OwnerUuid != testOwner {
+		t.Errorf("owner scope %+v", reply)
+	}
+	for _, method := range []string{"eth_who", "personal_who"} {
+		if _, reply = callRPC(t, server.URL, "owner-token", method); reply.Error == nil {
+			t.Errorf("owner token called %s", method)
+		}
+		if _, reply = callRPC(t, server.URL, "admin-token", method); reply.Error != nil {
+			t.Errorf("admin token %s: %s", method, reply.Error.Message)
+		}
+	}
+}
+
+func TestRPCAuthExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	auth := newTestAuth(t, dir)
+
+	srv := rpc.NewServer()
+	srv.SetAuthenticator(auth.Authenticate)
+	srv.RegisterName("tudo", ScopeService{})
+	server := httptest.NewServer(srv.WebsocketHandler([]string{"*"}))
+	defer server.Close()
+
+	// The websocket outlives the token.
+	expires := time.Now().Add(2 * time.Second).Unix()
+	token := newJwt(testSecret, "", map[string]interface{}{"sub": testOwner, "exp": expires})
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?access_token=" + token
+	client, err := rpc.DialWebsocket(context.Background(), url, "http://localhost")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+
+	scope := &RPCScope{}
+	if err = client.Call(scope, "tudo_who"); err != nil || scope.OwnerUuid != testOwner {
+		t.Fatalf("scope %+v: %v", scope, err)
+	}
+	if scope.Expires.Unix() != expires {
+		t.Errorf("scope expires %v", scope.Expires)
+	}
+	time.Sleep(time.Until(time.Unix(expires, 0)))
+	if err = client.Call(scope, "tudo_who"); err == nil {
+		t.Errorf("expired token called tudo_who")
+	}
+	if !scope.expired(time.Unix(expires, 0)) || scope.expired(time.Unix(expires-1, 0)) {
+		t.Errorf("expiry of %+v", scope)
+	}
+	if expiredScope.checkOwner(testOwner) == nil || expiredScope.AllowService("tudo") {
+		t.Errorf("expired scope acts for the owner")
+	}
+}
+
+func TestRPCAuthTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if auth, err := NewRPCAuth(&TudoConfig{}); auth != nil || err != nil {
+		t.Errorf("auth without tokens nor secret %v: %v", auth, err)
+	}
+	bad := filepath.Join(dir, "bad")
+	for _, content := range []string{"token\n", "token not-a-uuid\n", "token a b\n"} {
+		ioutil.WriteFile(bad, []byte(content), 0600)
+		if _, err = NewRPCAuth(&TudoConfig{RpcTokenFile: bad}); err == nil {
+			t.Errorf("token file %q accepted", content)
+		}
+	}
+	ioutil.WriteFile(bad, []byte("short"), 0600)
+	if _, err = NewRPCAuth(&TudoConfig{RpcJwtSecretFile: bad}); err == nil {
+		t.Errorf("short JWT secret accepted")
+	}
+	if _, err = NewRPCAuth(&TudoConfig{RpcTokenFile: filepath.Join(dir, "none")}); err == nil {
+		t.Errorf("missing token file accepted")
+	}
+
+	auth := newTestAuth(t, dir)
+	request := func(header, query string) (*RPCScope, error) {
+		req := httptest.NewRequest("POST", "/?access_token="+query, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		scope, err := auth.Authenticate(req)
+		if err != nil {
+			return nil, err
+		}
+		return scope.(*RPCScope), nil
+	}
+	scope, err := request("Bearer admin-token", "")
+	if err != nil || !scope.Admin || !strings.HasPrefix(scope.Identity, "token:admin:") {
+		t.Errorf("admin token %+v: %v", scope, err)
+	}
+	scope, err = request("Bearer owner-token", "")
+	if err != nil || scope.Admin || scope.OwnerUuid != testOwner ||
+		!strings.HasPrefix(scope.Identity, "token:"+testOwner+":") {
+		t.Errorf("owner token %+v: %v", scope, err)
+	}
+	// The identity doesn't give the token away.
+	if strings.Contains(scope.Identity, "owner-token") {
+		t.Errorf("token in identity %s", scope.Identity)
+	}
+	if _, err = request("", ""); err != ErrNoToken {
+		t.Errorf("no token: %v", err)
+	}
+	if _, err = request("Basic owner-token", ""); err != ErrNoToken {
+		t.Errorf("basic auth: %v", err)
+	}
+	if _, err = request("Bearer other-token", ""); err != ErrBadToken {
+		t.Errorf("unknown token: %v", err)
+	}
+	// The query token is only read on websocket upgrades.
+	if _, err = request("", "owner-token"); err != ErrNoToken {
+		t.Errorf("query token on HTTP: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/?access_token=owner-token", nil)
+	req.Header.Set("Upgrade", "websocket")
+	if scope, err := auth.Authenticate(req); err != nil ||
+		scope.(*RPCScope).OwnerUuid != testOwner {
+		t.Errorf("websocket token %+v: %v", scope, err)
+	}
+}
+
+func TestRPCAuthJwt(t *testing.T) {
+	auth := &RPCAuth{jwtSecret: testSecret}
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	check := func(header string, secret []byte, claims map[string]interface{}) (
+		*RPCScope, error) {
+		return auth.checkJwt(newJwt(secret, header, claims), now)
+	}
+	scope, err := check("", testSecret, map[string]interface{}{"sub": testOwner, "exp": exp})
+	if err != nil || scope.Admin || scope.OwnerUuid != testOwner ||
+		scope.Expires.Unix() != exp || scope.Identity != "jwt:"+testOwner {
+		t.Errorf("owner JWT %+v: %v", scope, err)
+	}
+	// The role wins over the sub claim.
+	scope, err = check("", testSecret,
+		map[string]interface{}{"sub": testOwner, "role": "admin", "exp": exp})
+	if err != nil || !scope.Admin || scope.Identity != "jwt:admin:"+testOwner {
+		t.Errorf("admin JWT %+v: %v", scope, err)
+	}
+	refused := map[string]struct {
+		header string
+		secret []byte
+		claims map[string]interface{}
+	}{
+		"bad signature": {"", []byte("another secret of at least 32 bytes"),
+			map[string]interface{}{"role": "admin", "exp": exp}},
+		"alg none": {`{"alg":"none"}`, testSecret,
+			map[string]interface{}{"role": "admin", "exp": exp}},
+		"alg HS512": {`{"alg":"HS512"}`, testSecret,
+			map[string]interface{}{"role": "admin", "exp": exp}},
+		"no exp": {"", testSecret, map[string]interface{}{"role": "admin"}},
+		"expired": {"", testSecret,
+			map[string]interface{}{"role": "admin", "exp": now.Unix()}},
+		"not valid yet": {"", testSecret,
+			map[string]interface{}{"role": "admin", "exp": exp, "nbf": exp - 1}},
+		"other role": {"", testSecret,
+			map[string]interface{}{"role": "user", "exp": exp}},
+		"bad sub": {"", testSecret, map[string]interface{}{"sub": "bob", "exp": exp}},
+	}
+	for name, jwt := range refused {
+		if scope, err = check(jwt.header, jwt.secret, jwt.claims); err == nil {
+			t.Errorf("%s JWT accepted: %+v", name, scope)
+		}
+	}
+	// An unsigned token is refused whatever its header.
+	token := newJwt(testSecret, `{"alg":"none"}`, map[string]interface{}{"role": "admin",
+		"exp": exp})
+	token = token[:strings.LastIndex(token, ".")+1]
+	if _, err = auth.checkJwt(token, now); err == nil {
+		t.Errorf("unsigned JWT accepted")
+	}
+	// Without secret, a JWT is an unknown static token.
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+newJwt(testSecret, "",
+		map[string]interface{}{"role": "admin", "exp": exp}))
+	if _, err = (&RPCAuth{}).Authenticate(req); err != ErrBadToken {
+		t.Errorf("JWT without secret: %v", err)
+	}
+}
+
+func TestRPCScopeChecks(t *testing.T) {
+	if scope := callerScope(context.Background()); !scope.Admin {
+		t.Errorf("in process scope %+v", scope)
+	}
+	storage := kstore.NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks, err := kstore.NewKeyStore(storage, 0, "")
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	other, wallet := uuid.NewRandom().String(), uuid.NewRandom().String()
+	mine, _, err := ks.NewAccountOwner(testOwner, wallet, "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	theirs, _, err := ks.NewAccountOwner(other, "", "b", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	owner := &RPCScope{OwnerUuid: testOwner}
+	if owner.checkAdmin() == nil || localScope.checkAdmin() != nil ||
+		openScope.checkAdmin() == nil {
+		t.Errorf("admin checks")
+	}
+	if owner.checkOwner(strings.ToUpper(testOwner)) != nil || owner.checkOwner(other) == nil ||
+		owner.checkOwner("") == nil {
+		t.Errorf("owner checks")
+	}
+	if err = owner.checkOwner(other); err.(*RPCError).Code != CodeForbidden {
+		t.Errorf("owner check error %v", err)
+	}
+	if owner.defaultOwner("") != testOwner || owner.defaultOwner(other) != other ||
+		openScope.defaultOwner("") != "" {
+		t.Errorf("default owner")
+	}
+	if owner.checkAccount(storage, strings.ToLower(mine.Address.Hex())) != nil ||
+		owner.checkAccount(storage, theirs.Address.Hex()) == nil ||
+		owner.checkAccount(storage, "0x12") == nil {
+		t.Errorf("account checks")
+	}
+	if owner.checkWallet(storage, wallet) != nil ||
+		owner.checkWallet(storage, uuid.NewRandom().String()) == nil ||
+		owner.checkPolicyScope(storage, theirs.Address.Hex()) == nil {
+		t.Errorf("wallet checks")
+	}
+	for _, scope := range []*RPCScope{localScope, openScope} {
+		if scope.checkOwner(other) != nil ||
+			scope.checkAccount(storage, theirs.Address.Hex()) != nil {
+			t.Errorf("scope %+v refused", scope)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"tudo/kstore"
+)
+
+// Codes of the JSON-RPC errors returned by the tudov2 API.  Clients test the
+// code, not the message, so a code must never change meaning.
+const (
+	CodeInternal        = -32000
+	CodeInvalidParams   = -32602
+	CodeNotFound        = -32001
+	CodeNotOwner        = -32002
+	CodeBadPassphrase   = -32003
+	CodeLocked          = -32004
+	CodeAdminAuth       = -32005
+	CodeApprovalPending = -32006
+	CodePolicyRefused   = -32007
+	CodeBadState        = -32008
+	CodeNoChain         = -32009
+	CodeForbidden       = -32010
+	CodeOwnerFrozen     = -32011
+)
+
+/**
+ * JSON-RPC error object, Data is sent in the error's data member when set.
+ */
+type RPCError struct {
+	Code    int
+	Message string
+	Data    interface{}
+}
+
+func (e *RPCError) Error() string          { return e.Message }
+func (e *RPCError) ErrorCode() int         { return e.Code }
+func (e *RPCError) ErrorData() interface{} { return e.Data }
+
+func newRPCError(code int, format string, args ...interface{}) *RPCError {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidParams(format string, args ...interface{}) *RPCError {
+	return newRPCError(CodeInvalidParams, format, args...)
+}
+
+/**
+ * rpcError
+ * --------
+ * Map the error of a keystore or chain call to its JSON-RPC error.
+ */
+func rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	switch e := err.(type) {
+	case *RPCError:
+		return e
+	case *kstore.ApprovalPendingError:
+		return &RPCError{Code: CodeApprovalPending, Message: msg,
+			Data: map[string]interface{}{"approvalId": e.Id, "account": e.Account}}
+	case *kstore.PolicyError:
+		return &RPCError{Code: CodePolicyRefused, Message: msg,
+			Data: map[string]interface{}{"account": e.Account, "scope": e.Scope,
+				"rule": e.Rule, "reason": e.Reason}}
+	case *kstore.OwnerFrozenError:
+		return &RPCError{Code: CodeOwnerFrozen, Message: msg,
+			Data: map[string]interface{}{"ownerUuid": e.OwnerUuid, "reason": e.Reason}}
+	}
+	switch {
+	case kstore.IsNotFound(err):
+		return &RPCError{Code: CodeNotFound, Message: msg}
+	case err == keystore.ErrDecrypt || err == kstore.ErrSeedPassphrase:
+		return &RPCError{Code: CodeBadPassphrase, Message: msg}
+	case err == keystore.ErrLocked:
+		return &RPCError{Code: CodeLocked, Message: msg}
+	}
+	return &RPCError{Code: CodeInternal, Message: msg}
+}
+
+// ownerRPCError is ownerError for the tudov2 API, an account of another owner
+// isn't told apart from a missing one.
+func ownerRPCError(err error, address, ownerUuid string) error {
+	if kstore.IsNotFound(err) {
+		return newRPCError(CodeNotOwner, "Invalid account %s for owner %s",
+			address, ownerUuid)
+	}
+	return rpcError(err)
+}
@@ -0,0 +1,67 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"tudo/kstore"
+)
+
+func TestRPCError(t *testing.T) {
+	if rpcError(nil) != nil {
+		t.Errorf("error for nil")
+	}
+	invalid := invalidParams("Bad %s", "limit")
+	codes := []struct {
+		err  error
+		code int
+	}{
+		{invalid, CodeInvalidParams},
+		{&kstore.ApprovalPendingError{Id: 3, Account: "0x1"}, CodeApprovalPending},
+		{&kstore.PolicyError{Account: "0x1", Rule: "maxTxValue"}, CodePolicyRefused},
+		{&kstore.OwnerFrozenError{OwnerUuid: testOwner}, CodeOwnerFrozen},
+		{kstore.ErrNoAccount, CodeNotFound},
+		{kstore.ErrNoTrans, CodeNotFound},
+		{accounts.ErrUnknownAccount, CodeNotFound},
+		{keystore.ErrDecrypt, CodeBadPassphrase},
+		{kstore.ErrSeedPassphrase, CodeBadPassphrase},
+		{keystore.ErrLocked, CodeLocked},
+		{errors.New("disk full"), CodeInternal},
+	}
+	for _, c := range codes {
+		err, ok := rpcError(c.err).(*RPCError)
+		if !ok || err.Code != c.code || err.Message != c.err.Error() {
+			t.Errorf("%v mapped to %+v", c.err, err)
+		}
+	}
+	if rpcError(invalid) != invalid || invalid.Message != "Bad limit" {
+		t.Errorf("RPC error rewrapped")
+	}
+	data := rpcError(&kstore.ApprovalPendingError{Id: 3, Account: "0x1"}).(*RPCError).
+		ErrorData().(map[string]interface{})
+	if data["approvalId"] != int64(3) || data["account"] != "0x1" {
+		t.Errorf("approval data %v", data)
+	}
+	data = rpcError(&kstore.PolicyError{Account: "0x1", Scope: "w", Rule: "allowlist",
+		Reason: "no"}).(*RPCError).ErrorData().(map[string]interface{})
+	if data["scope"] != "w" || data["rule"] != "allowlist" || data["reason"] != "no" {
+		t.Errorf("policy data %v", data)
+	}
+	err := ownerRPCError(kstore.ErrNoAccount, "0x1", testOwner).(*RPCError)
+	if err.Code != CodeNotOwner {
+		t.Errorf("missing account of an owner %+v", err)
+	}
+	err = ownerRPCError(keystore.ErrLocked, "0x1", testOwner).(*RPCError)
+	if err.Code != CodeLocked {
+		t.Errorf("locked account of an owner %+v", err)
+	}
+}
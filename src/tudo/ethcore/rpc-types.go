@@ -9,37 +9,184 @@ package ethcore
 
 import (
 	"math/big"
-	"tudo/models"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
+/*
+ * Arguments and results of the tudov2 API.  Methods take one argument object,
+ * so members can be added without breaking the callers, the getters take the
+ * address or uuid.  Amounts are decimal strings in wei, empty for no limit in
+ * spending policies.
+ */
 type UpdateAccountReqt struct {
-	Address    string
-	Name       string
-	Password   string
-	OwnerUuid  string
-	WalletUuid string
+	Address    string `json:"address"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	OwnerUuid  string `json:"ownerUuid"`
+	WalletUuid string `json:"walletUuid"`
+}
+
+type NewAccountReqt struct {
+	OwnerUuid  string `json:"ownerUuid"`
+	WalletUuid string `json:"walletUuid"`
+	Name       string `json:"name"`
+	Password   string `json:"password"`
+	Type       string `json:"type"`
+}
+
+type ImportAccountReqt struct {
+	KeyJson     string `json:"keyJson"`
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+	OwnerUuid   string `json:"ownerUuid"`
+	WalletUuid  string `json:"walletUuid"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+}
+
+// Account of the owner opened with the password, NewPassword is only used to
+// change the passphrase or export the key.
+type AccountAuthReqt struct {
+	Address     string `json:"address"`
+	OwnerUuid   string `json:"ownerUuid"`
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+type AccountResp struct {
+	Address    string `json:"address"`
+	OwnerUuid  string `json:"ownerUuid,omitempty"`
+	WalletUuid string `json:"walletUuid,omitempty"`
+	Url        string `json:"url,omitempty"`
+}
+
+type ExportAccountResp struct {
+	Address string `json:"address"`
+	KeyJson string `json:"keyJson"`
+}
+
+type WalletReqt struct {
+	OwnerUuid string `json:"ownerUuid"`
+	Mnemonic  string `json:"mnemonic,omitempty"`
+	Password  string `json:"password"`
+}
+
+type WalletResp struct {
+	OwnerUuid string   `json:"ownerUuid"`
+	Mnemonic  string   `json:"mnemonic,omitempty"`
+	Accounts  []string `json:"accounts,omitempty"`
+}
+
+type AccountRow struct {
+	Address    string `json:"address"`
+	OwnerUuid  string `json:"ownerUuid"`
+	WalletUuid string `json:"walletUuid"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+}
+
+// Signature of an admin over the hash of tudov2_adminOpHash or
+// tudov2_spendPolicyHash, made with personal_sign.
+type AdminSig struct {
+	Admin     string `json:"admin"`
+	Stamp     int64  `json:"stamp"`
+	Signature string `json:"signature"`
 }
 
-type UpdateAcountResp struct {
-	Error     string
-	Address   string
-	OwnerUuid string
+type AdminOpReqt struct {
+	Address string `json:"address"`
+	AdminSig
 }
 
+type FsckReqt struct {
+	Repair bool `json:"repair"`
+	AdminSig
+}
+
+type AdminOpHashReqt struct {
+	Op      string `json:"op"`
+	Address string `json:"address"`
+}
+
+type AdminOpHashResp struct {
+	Op      string      `json:"op"`
+	Address string      `json:"address"`
+	Stamp   int64       `json:"stamp"`
+	Hash    common.Hash `json:"hash"`
+}
+
+type SpendPolicyInfo struct {
+	Scope      string    `json:"scope"`
+	MaxTxValue string    `json:"maxTxValue"`
+	DailyLimit string    `json:"dailyLimit"`
+	Allowlist  []string  `json:"allowlist"`
+	NoContract bool      `json:"noContract"`
+	Modified   time.Time `json:"modified"`
+}
+
+type SetSpendPolicyReqt struct {
+	SpendPolicyInfo
+	AdminSig
+}
+
+type DeleteSpendPolicyReqt struct {
+	Scope string `json:"scope"`
+	AdminSig
+}
+
+type SpendPolicyHashReqt struct {
+	Op string `json:"op"`
+	SpendPolicyInfo
+}
+
+type SpendPolicyHashResp struct {
+	Op     string           `json:"op"`
+	Policy *SpendPolicyInfo `json:"policy"`
+	Stamp  int64            `json:"stamp"`
+	Hash   common.Hash      `json:"hash"`
+}
+
+type ListReqt struct {
+	Status string `json:"status,omitempty"`
+	Start  int    `json:"start"`
+	Limit  int    `json:"limit"`
+}
+
+// From selects the transactions sent from the account or owner when true, the
+// ones received when false, both when not set.  Cursor is the nextCursor of the
+// previous page, Start is only used without it.  The filters are TransFilter's.
 type ListUserTransReqt struct {
-	Address  string
-	UserUuid string
-	From     bool
-	Start    int
-	Limit    int
+	Address  string `json:"address"`
+	UserUuid string `json:"userUuid"`
+	From     *bool  `json:"from"`
+	Cursor   string `json:"cursor,omitempty"`
+	Start    int    `json:"start"`
+	Limit    int    `json:"limit"`
+	TransFilter
+}
+
+type TransInfo struct {
+	TxHash   string    `json:"txHash"`
+	FromUuid string    `json:"fromUuid"`
+	ToUuid   string    `json:"toUuid"`
+	FromAcct string    `json:"fromAcct"`
+	ToAcct   string    `json:"toAcct"`
+	XuAmount uint64    `json:"xuAmount"`
+	Created  time.Time `json:"created"`
+	Block    int64     `json:"blockNumber"`
+	TxIndex  int       `json:"txIndex"`
 }
 
+// Pending are the transactions not mined yet, only given with the first page.
 type ListUserTransResp struct {
-	Error       string
-	Transaction []models.Transaction
+	Transactions []TransInfo              `json:"transactions"`
+	TransBChain  []*RPCTransaction        `json:"transBChain"`
+	TransBlocks  []map[string]interface{} `json:"transBlocks"`
+	Pending      []TransInfo              `json:"pending"`
+	NextCursor   string                   `json:"nextCursor"`
 }
 
 type AccountInfo struct {
@@ -47,6 +194,155 @@ type AccountInfo struct {
 	Balance big.Int
 }
 
+type AccountInfoReqt struct {
+	Accounts     []string `json:"accounts"`
+	Latest       bool     `json:"latest"`
+	Transactions bool     `json:"transactions"`
+}
+
+type AccountBalance struct {
+	Account common.Address `json:"account"`
+	Balance *hexutil.Big   `json:"balance"`
+}
+
+type AccountInfoResp struct {
+	Accounts    []AccountBalance         `json:"accounts"`
+	Latest      map[string]interface{}   `json:"latest,omitempty"`
+	TransBChain []*RPCTransaction        `json:"transBChain,omitempty"`
+	TransBlocks []map[string]interface{} `json:"transBlocks,omitempty"`
+}
+
+// Count blocks ending with Start, the latest block when Start isn't set.
+type ListBlocksReqt struct {
+	Start    *int64 `json:"start"`
+	Count    int    `json:"count"`
+	TxDetail bool   `json:"txDetail"`
+}
+
+type HashesReqt struct {
+	Hashes []common.Hash `json:"hashes"`
+}
+
+type PayReqt struct {
+	From     string `json:"from"`
+	FromUuid string `json:"fromUuid"`
+	To       string `json:"to"`
+	ToUuid   string `json:"toUuid"`
+	Amount   string `json:"amount"`
+	Text     string `json:"text"`
+}
+
+type TxResp struct {
+	TxHash common.Hash `json:"txHash"`
+}
+
+type ApprovalVote struct {
+	Approver string `json:"approver"`
+	Approve  bool   `json:"approve"`
+}
+
+type ApprovalInfo struct {
+	Id          int64           `json:"id"`
+	Account     string          `json:"account"`
+	Status      string          `json:"status"`
+	Quorum      int             `json:"quorum"`
+	TxHash      string          `json:"txHash"`
+	Created     time.Time       `json:"created"`
+	ApproveHash common.Hash     `json:"approveHash"`
+	RejectHash  common.Hash     `json:"rejectHash"`
+	To          *common.Address `json:"to"`
+	Value       string          `json:"value"`
+	Nonce       uint64          `json:"nonce"`
+	Votes       []ApprovalVote  `json:"votes"`
+}
+
+// Password is only used by tudov2_submitRequest, empty for an unlocked admin.
+type VoteReqt struct {
+	Id        int64  `json:"id"`
+	Approver  string `json:"approver"`
+	Signature string `json:"signature"`
+	Password  string `json:"password"`
+}
+
+// SubmitError is set when the request was approved but its transaction
+// couldn't be sent, tudov2_submitRequest sends it again.
+type VoteResp struct {
+	Request     *ApprovalInfo `json:"request"`
+	TxHash      *common.Hash  `json:"txHash,omitempty"`
+	SubmitError string        `json:"submitError,omitempty"`
+}
+
+/*
+ * Arguments and results of the tudoadmin API.  Balances are the sums at the
+ * latest block, null when the node has no chain state.
+ */
+type ListWalletsReqt struct {
+	OwnerUuid string `json:"ownerUuid,omitempty"`
+	Start     int    `json:"start"`
+	Limit     int    `json:"limit"`
+}
+
+type OwnerInfo struct {
+	OwnerUuid     string       `json:"ownerUuid"`
+	Wallets       int          `json:"wallets"`
+	Accounts      int          `json:"accounts"`
+	AdminAccounts int          `json:"adminAccounts"`
+	Balance       *hexutil.Big `json:"balance"`
+	Frozen        *FreezeInfo  `json:"frozen,omitempty"`
+}
+
+type WalletInfo struct {
+	WalletUuid    string       `json:"walletUuid"`
+	OwnerUuid     string       `json:"ownerUuid"`
+	Accounts      int          `json:"accounts"`
+	AdminAccounts int          `json:"adminAccounts"`
+	Balance       *hexutil.Big `json:"balance"`
+}
+
+type FreezeInfo struct {
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+type FreezeOwnerReqt struct {
+	OwnerUuid string `json:"ownerUuid"`
+	Reason    string `json:"reason"`
+}
+
+// Locked is the number of keys locked on this node.
+type LockKeysResp struct {
+	Locked int `json:"locked"`
+}
+
+// All must be set to lock the keys of every owner.
+type LockKeysReqt struct {
+	OwnerUuid string `json:"ownerUuid,omitempty"`
+	All       bool   `json:"all,omitempty"`
+}
+
+// The Loaded, Unlocked and Open counts are of this node, KeyVersions counts the
+// live keys by master key version.
+type KeystoreStatsResp struct {
+	Owners           int         `json:"owners"`
+	Wallets          int         `json:"wallets"`
+	Accounts         int         `json:"accounts"`
+	ArchivedAccounts int         `json:"archivedAccounts"`
+	AdminAccounts    int         `json:"adminAccounts"`
+	Keys             int         `json:"keys"`
+	ArchivedKeys     int         `json:"archivedKeys"`
+	PlainKeys        int         `json:"plainKeys"`
+	KeyVersions      map[int]int `json:"keyVersions"`
+	MasterKeyVersion int         `json:"masterKeyVersion"`
+	Seeds            int         `json:"seeds"`
+	SpendPolicies    int         `json:"spendPolicies"`
+	PendingApprovals int         `json:"pendingApprovals"`
+	FrozenOwners     int         `json:"frozenOwners"`
+	LoadedWallets    int         `json:"loadedWallets"`
+	LoadedKeys       int         `json:"loadedKeys"`
+	UnlockedKeys     int         `json:"unlockedKeys"`
+	OpenWallets      int         `json:"openWallets"`
+}
+
 type RPCTransaction struct {
 	BlockHash        common.Hash     `json:"blockHash"`
 	BlockNumber      *hexutil.Big    `json:"blockNumber"`
@@ -0,0 +1,1087 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pborman/uuid"
+	"tudo/kstore"
+	"tudo/models"
+)
+
+// Rows returned by a list call without limit.
+const defaultListLimit = 1000
+
+/**
+ * The tudov2 API, the tudo API with typed arguments and results.  Errors are
+ * returned as JSON-RPC error objects with the codes of rpc-errors.go, the data
+ * member has the details of approval and policy errors.  Callers are limited to
+ * their scope like with the tudo API.
+ *
+ * curl -X POST -H "Content-Type: application/json" --data '{"jsonrpc": "2.0",
+ *    "method": "tudov2_newAccount", "params": [{"ownerUuid": "...",
+ *    "password": "..."}], "id": 1}' localhost:8545
+ */
+type TudoV2API struct {
+	node *TudoNode
+	v1   *TudoNodeAPI
+}
+
+func NewTudoV2API(n *TudoNode) *TudoV2API {
+	return &TudoV2API{node: n, v1: NewTudoNodeAPI(n)}
+}
+
+func parseAddress(address string) (common.Address, error) {
+	if !common.IsHexAddress(address) {
+		return common.Address{}, invalidParams("Invalid address %s", address)
+	}
+	return common.HexToAddress(address), nil
+}
+
+// parseUuid accepts an empty uuid when optional.
+func parseUuid(kind, id string, optional bool) (uuid.UUID, error) {
+	if id == "" && optional {
+		return nil, nil
+	}
+	parsed := uuid.Parse(id)
+	if parsed == nil {
+		return nil, invalidParams("Invalid %s uuid %s", kind, id)
+	}
+	return parsed, nil
+}
+
+func listLimit(start, limit int) (int, int) {
+	if start < 0 {
+		start = 0
+	}
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	return start, limit
+}
+
+// checkOwner returns the account if it belongs to the owner.
+func (api *TudoV2API) checkOwner(address, ownerUuid string) (common.Address, error) {
+	addr, err := parseAddress(address)
+	if err != nil {
+		return addr, err
+	}
+	_, err = api.node.GetStorage().GetAccountOwner(addr.Hex(), ownerUuid)
+	if err != nil {
+		return addr, ownerRPCError(err, address, ownerUuid)
+	}
+	return addr, nil
+}
+
+func parseAdminSigArgs(sig AdminSig) (common.Address, []byte, error) {
+	if !common.IsHexAddress(sig.Admin) {
+		return common.Address{}, nil, invalidParams("Invalid admin address %s", sig.Admin)
+	}
+	data, err := hexutil.Decode(sig.Signature)
+	if err != nil {
+		return common.Address{}, nil, invalidParams("Invalid signature %s", sig.Signature)
+	}
+	return common.HexToAddress(sig.Admin), data, nil
+}
+
+func (api *TudoV2API) checkAdminOp(op string, addr common.Address, sig AdminSig) error {
+	admin, data, err := parseAdminSigArgs(sig)
+	if err != nil {
+		return err
+	}
+	err = api.node.kstore.Approvals().CheckAdminOp(op, addr, admin, sig.Stamp, data)
+	if err != nil {
+		return &RPCError{Code: CodeAdminAuth, Message: err.Error()}
+	}
+	return nil
+}
+
+func (api *TudoV2API) checkPolicySig(op string, policy *models.SpendPolicy,
+	sig AdminSig) error {
+	admin, data, err := parseAdminSigArgs(sig)
+	if err != nil {
+		return err
+	}
+	err = api.node.kstore.Approvals().CheckAdminSig(kstore.PolicyHash(op, policy, sig.Stamp),
+		admin, sig.Stamp, data)
+	if err != nil {
+		return &RPCError{Code: CodeAdminAuth, Message: err.Error()}
+	}
+	return nil
+}
+
+/**
+ * NewAccount
+ * ----------
+ * Empty owner or wallet uuids are made up.
+ */
+func (api *TudoV2API) NewAccount(ctx context.Context,
+	args NewAccountReqt) (*AccountResp, error) {
+	scope := callerScope(ctx)
+	args.OwnerUuid = scope.defaultOwner(args.OwnerUuid)
+	if err := scope.checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	if _, err := parseUuid("owner", args.OwnerUuid, true); err != nil {
+		return nil, err
+	}
+	if _, err := parseUuid("wallet", args.WalletUuid, true); err != nil {
+		return nil, err
+	}
+	acct, model, err := api.node.callerKStore(ctx).NewAccountOwner(args.OwnerUuid,
+		args.WalletUuid, args.Name, args.Password, args.Type)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{
+		Address:    acct.Address.Hex(),
+		OwnerUuid:  model.OwnerUuid,
+		WalletUuid: model.WalletUuid,
+	}, nil
+}
+
+/**
+ * NewHDWallet
+ * -----------
+ * Like tudo_newHDWallet, the name and type of the arguments aren't used.
+ */
+func (api *TudoV2API) NewHDWallet(ctx context.Context,
+	args NewAccountReqt) (*AccountResp, error) {
+	scope := callerScope(ctx)
+	args.OwnerUuid = scope.defaultOwner(args.OwnerUuid)
+	if err := scope.checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	if _, err := parseUuid("owner", args.OwnerUuid, true); err != nil {
+		return nil, err
+	}
+	acct, model, err := api.node.callerKStore(ctx).NewHDWallet(args.OwnerUuid,
+		args.WalletUuid, args.Password)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{
+		Address:    acct.Address.Hex(),
+		OwnerUuid:  model.OwnerUuid,
+		WalletUuid: model.WalletUuid,
+		Url:        acct.URL.String(),
+	}, nil
+}
+
+/**
+ * UpdateAccount
+ * -------------
+ */
+func (api *TudoV2API) UpdateAccount(ctx context.Context,
+	args UpdateAccountReqt) (*AccountResp, error) {
+	scope := callerScope(ctx)
+	if err := scope.checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	if err := scope.checkAccount(api.node.GetStorage(), args.Address); err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(args.Address)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := parseUuid("owner", args.OwnerUuid, false)
+	if err != nil {
+		return nil, err
+	}
+	wallet, err := parseUuid("wallet", args.WalletUuid, true)
+	if err != nil {
+		return nil, err
+	}
+	err = api.node.GetStorage().UpdateAccount(addr, args.Name, args.Type, owner, wallet)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{
+		Address:    addr.Hex(),
+		OwnerUuid:  owner.String(),
+		WalletUuid: args.WalletUuid,
+	}, nil
+}
+
+/**
+ * ExportMnemonic
+ * --------------
+ */
+func (api *TudoV2API) ExportMnemonic(ctx context.Context,
+	args WalletReqt) (*WalletResp, error) {
+	if err := callerScope(ctx).checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	if _, err := parseUuid("owner", args.OwnerUuid, false); err != nil {
+		return nil, err
+	}
+	mnemonic, err := api.node.callerKStore(ctx).ExportMnemonic(args.OwnerUuid, args.Password)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &WalletResp{OwnerUuid: args.OwnerUuid, Mnemonic: mnemonic}, nil
+}
+
+/**
+ * RestoreWallet
+ * -------------
+ * On error, the data member has the accounts restored before the failure.
+ */
+func (api *TudoV2API) RestoreWallet(ctx context.Context,
+	args WalletReqt) (*WalletResp, error) {
+	if err := callerScope(ctx).checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	if _, err := parseUuid("owner", args.OwnerUuid, false); err != nil {
+		return nil, err
+	}
+	chain := NewBackendState(api.node.GetEthereum().ApiBackend)
+	accts, err := api.node.callerKStore(ctx).RestoreWallet(args.OwnerUuid,
+		args.Mnemonic, args.Password, chain)
+
+	addrs := make([]string, len(accts))
+	for idx, acct := range accts {
+		addrs[idx] = acct.Address.Hex()
+	}
+	if err != nil {
+		rpcErr := rpcError(err).(*RPCError)
+		if len(addrs) > 0 && rpcErr.Data == nil {
+			rpcErr.Data = map[string]interface{}{"accounts": addrs}
+		}
+		return nil, rpcErr
+	}
+	return &WalletResp{OwnerUuid: args.OwnerUuid, Accounts: addrs}, nil
+}
+
+/**
+ * ChangePassphrase
+ * ----------------
+ */
+func (api *TudoV2API) ChangePassphrase(ctx context.Context,
+	args AccountAuthReqt) (*AccountResp, error) {
+	if err := callerScope(ctx).checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	addr, err := api.checkOwner(args.Address, args.OwnerUuid)
+	if err != nil {
+		return nil, err
+	}
+	acct := accounts.Account{Address: addr}
+	err = api.node.callerKStore(ctx).Update(acct, args.Password, args.NewPassword)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{Address: addr.Hex(), OwnerUuid: args.OwnerUuid}, nil
+}
+
+/**
+ * ExportAccount
+ * -------------
+ * Return the key in V3 JSON format, encrypted with the new password.
+ */
+func (api *TudoV2API) ExportAccount(ctx context.Context,
+	args AccountAuthReqt) (*ExportAccountResp, error) {
+	if err := callerScope(ctx).checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	addr, err := api.checkOwner(args.Address, args.OwnerUuid)
+	if err != nil {
+		return nil, err
+	}
+	acct := accounts.Account{Address: addr}
+	keyJson, err := api.node.callerKStore(ctx).Export(acct, args.Password, args.NewPassword)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &ExportAccountResp{Address: addr.Hex(), KeyJson: string(keyJson)}, nil
+}
+
+/**
+ * ImportAccount
+ * -------------
+ */
+func (api *TudoV2API) ImportAccount(ctx context.Context,
+	args ImportAccountReqt) (*AccountResp, error) {
+	scope := callerScope(ctx)
+	args.OwnerUuid = scope.defaultOwner(args.OwnerUuid)
+	if err := scope.checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	if _, err := parseUuid("owner", args.OwnerUuid, true); err != nil {
+		return nil, err
+	}
+	acct, model, err := api.node.callerKStore(ctx).ImportOwner([]byte(args.KeyJson),
+		args.Password, args.NewPassword, args.OwnerUuid, args.WalletUuid,
+		args.Name, args.Type)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{
+		Address:    acct.Address.Hex(),
+		OwnerUuid:  model.OwnerUuid,
+		WalletUuid: model.WalletUuid,
+	}, nil
+}
+
+/**
+ * DeleteAccount
+ * -------------
+ */
+func (api *TudoV2API) DeleteAccount(ctx context.Context,
+	args AccountAuthReqt) (*AccountResp, error) {
+	if err := callerScope(ctx).checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	addr, err := api.checkOwner(args.Address, args.OwnerUuid)
+	if err != nil {
+		return nil, err
+	}
+	acct := accounts.Account{Address: addr}
+	if err = api.node.callerKStore(ctx).Delete(acct, args.Password); err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{Address: addr.Hex(), OwnerUuid: args.OwnerUuid}, nil
+}
+
+/**
+ * RestoreAccount
+ * --------------
+ */
+func (api *TudoV2API) RestoreAccount(ctx context.Context,
+	args AccountAuthReqt) (*AccountResp, error) {
+	if err := callerScope(ctx).checkOwner(args.OwnerUuid); err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(args.Address)
+	if err != nil {
+		return nil, err
+	}
+	ks := api.node.callerKStore(ctx)
+	keyRec, err := ks.GetStorageIf().GetArchivedKey(addr)
+	if err == nil && keyRec.OwnerUuid != args.OwnerUuid {
+		err = kstore.ErrNoAccount
+	}
+	if err != nil {
+		return nil, ownerRPCError(err, args.Address, args.OwnerUuid)
+	}
+	if err = ks.RestoreAccount(accounts.Account{Address: addr}, args.Password); err != nil {
+		rpcErr := rpcError(err).(*RPCError)
+		if rpcErr.Code == CodeInternal {
+			// Past the retention period.
+			rpcErr.Code = CodeBadState
+		}
+		return nil, rpcErr
+	}
+	return &AccountResp{Address: addr.Hex(), OwnerUuid: args.OwnerUuid}, nil
+}
+
+/**
+ * AdminDeleteAccount
+ * ------------------
+ */
+func (api *TudoV2API) AdminDeleteAccount(ctx context.Context,
+	args AdminOpReqt) (*AccountResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(args.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = api.checkAdminOp(kstore.AdminOpDelete, addr, args.AdminSig); err != nil {
+		return nil, err
+	}
+	err = api.node.callerKStore(ctx).AdminDelete(accounts.Account{Address: addr})
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{Address: addr.Hex()}, nil
+}
+
+/**
+ * PurgeAccount
+ * ------------
+ */
+func (api *TudoV2API) PurgeAccount(ctx context.Context,
+	args AdminOpReqt) (*AccountResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(args.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = api.checkAdminOp(kstore.AdminOpPurge, addr, args.AdminSig); err != nil {
+		return nil, err
+	}
+	err = api.node.callerKStore(ctx).PurgeAccount(accounts.Account{Address: addr})
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &AccountResp{Address: addr.Hex()}, nil
+}
+
+/**
+ * Fsck
+ * ----
+ * The admin signs the "fsck" or "fsck-repair" operation for the zero address.
+ */
+func (api *TudoV2API) Fsck(ctx context.Context,
+	args FsckReqt) (*kstore.FsckReport, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	op := kstore.AdminOpFsck
+	if args.Repair {
+		op = kstore.AdminOpFsckRepair
+	}
+	if err := api.checkAdminOp(op, common.Address{}, args.AdminSig); err != nil {
+		return nil, err
+	}
+	report, err := api.node.callerKStore(ctx).Fsck(args.Repair, 0)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return report, nil
+}
+
+/**
+ * AdminOpHash
+ * -----------
+ */
+func (api *TudoV2API) AdminOpHash(ctx context.Context,
+	args AdminOpHashReqt) (*AdminOpHashResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(args.Address)
+	if err != nil {
+		return nil, err
+	}
+	stamp := time.Now().Unix()
+	return &AdminOpHashResp{
+		Op:      args.Op,
+		Address: addr.Hex(),
+		Stamp:   stamp,
+		Hash:    kstore.AdminOpHash(args.Op, addr, stamp),
+	}, nil
+}
+
+func newSpendPolicy(info *SpendPolicyInfo) (*models.SpendPolicy, error) {
+	policy, err := kstore.NewSpendPolicy(info.Scope, info.MaxTxValue,
+		info.DailyLimit, strings.Join(info.Allowlist, ","), info.NoContract)
+	if err != nil {
+		return nil, invalidParams("%v", err)
+	}
+	return policy, nil
+}
+
+func spendPolicyInfo(policy *models.SpendPolicy) *SpendPolicyInfo {
+	info := &SpendPolicyInfo{
+		Scope:      policy.Scope,
+		MaxTxValue: policy.MaxTxValue,
+		DailyLimit: policy.DailyLimit,
+		Allowlist:  []string{},
+		NoContract: policy.NoContract,
+		Modified:   policy.Modified,
+	}
+	if policy.Allowlist != "" {
+		info.Allowlist = strings.Split(policy.Allowlist, ",")
+	}
+	return info
+}
+
+/**
+ * SetSpendPolicy
+ * --------------
+ * The admin signs the hash returned by tudov2_spendPolicyHash for the
+ * "set-policy" operation.
+ */
+func (api *TudoV2API) SetSpendPolicy(ctx context.Context,
+	args SetSpendPolicyReqt) (*SpendPolicyInfo, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	policy, err := newSpendPolicy(&args.SpendPolicyInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err = api.checkPolicySig(kstore.AdminOpSetPolicy, policy, args.AdminSig); err != nil {
+		return nil, err
+	}
+	if err = api.node.GetStorage().StoreSpendPolicy(policy); err != nil {
+		return nil, rpcError(err)
+	}
+	return spendPolicyInfo(policy), nil
+}
+
+/**
+ * DeleteSpendPolicy
+ * -----------------
+ * The admin signs the "delete-policy" hash of the policy with only the scope.
+ */
+func (api *TudoV2API) DeleteSpendPolicy(ctx context.Context,
+	args DeleteSpendPolicyReqt) error {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return err
+	}
+	policy, err := newSpendPolicy(&SpendPolicyInfo{Scope: args.Scope})
+	if err != nil {
+		return err
+	}
+	err = api.checkPolicySig(kstore.AdminOpDeletePolicy, policy, args.AdminSig)
+	if err != nil {
+		return err
+	}
+	return rpcError(api.node.GetStorage().DeleteSpendPolicy(policy.Scope))
+}
+
+/**
+ * SpendPolicyHash
+ * ---------------
+ */
+func (api *TudoV2API) SpendPolicyHash(ctx context.Context,
+	args SpendPolicyHashReqt) (*SpendPolicyHashResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	policy, err := newSpendPolicy(&args.SpendPolicyInfo)
+	if err != nil {
+		return nil, err
+	}
+	stamp := time.Now().Unix()
+	return &SpendPolicyHashResp{
+		Op:     args.Op,
+		Policy: spendPolicyInfo(policy),
+		Stamp:  stamp,
+		Hash:   kstore.PolicyHash(args.Op, policy, stamp),
+	}, nil
+}
+
+/**
+ * GetSpendPolicy
+ * --------------
+ */
+func (api *TudoV2API) GetSpendPolicy(ctx context.Context,
+	scope string) (*SpendPolicyInfo, error) {
+	if err := callerScope(ctx).checkPolicyScope(api.node.GetStorage(), scope); err != nil {
+		return nil, err
+	}
+	scope, err := kstore.PolicyScope(scope)
+	if err != nil {
+		return nil, invalidParams("%v", err)
+	}
+	policy, err := api.node.GetStorage().GetSpendPolicy(scope)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return spendPolicyInfo(policy), nil
+}
+
+/**
+ * ListSpendPolicies
+ * -----------------
+ */
+func (api *TudoV2API) ListSpendPolicies(ctx context.Context,
+	args ListReqt) ([]*SpendPolicyInfo, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	start, limit := listLimit(args.Start, args.Limit)
+	policies, err := api.node.GetStorage().ListSpendPolicies(start, limit)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	results := make([]*SpendPolicyInfo, 0, len(policies))
+	for idx := range policies {
+		results = append(results, spendPolicyInfo(&policies[idx]))
+	}
+	return results, nil
+}
+
+func accountRows(accts []models.Account, err error) ([]AccountRow, error) {
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	rows := make([]AccountRow, 0, len(accts))
+	for _, acct := range accts {
+		rows = append(rows, AccountRow{
+			Address:    acct.Account,
+			OwnerUuid:  acct.OwnerUuid,
+			WalletUuid: acct.WalletUuid,
+			Name:       acct.PublicName,
+			Type:       acct.Type,
+		})
+	}
+	return rows, nil
+}
+
+/**
+ * GetAccount
+ * ----------
+ */
+func (api *TudoV2API) GetAccount(ctx context.Context,
+	address string) ([]AccountRow, error) {
+	if err := callerScope(ctx).checkAccount(api.node.GetStorage(), address); err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return accountRows(api.node.GetStorage().GetAccount(addr))
+}
+
+/**
+ * GetUserAccount
+ * --------------
+ */
+func (api *TudoV2API) GetUserAccount(ctx context.Context,
+	ownerUuid string) ([]AccountRow, error) {
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		return nil, err
+	}
+	owner, err := parseUuid("owner", ownerUuid, false)
+	if err != nil {
+		return nil, err
+	}
+	return accountRows(api.node.GetStorage().GetUserAccount(owner))
+}
+
+/**
+ * GetWallet
+ * ---------
+ */
+func (api *TudoV2API) GetWallet(ctx context.Context,
+	walletUuid string) ([]AccountRow, error) {
+	if err := callerScope(ctx).checkWallet(api.node.GetStorage(), walletUuid); err != nil {
+		return nil, err
+	}
+	wallet, err := parseUuid("wallet", walletUuid, false)
+	if err != nil {
+		return nil, err
+	}
+	return accountRows(api.node.GetStorage().GetWallet(wallet))
+}
+
+/**
+ * ListUserTrans
+ * -------------
+ * Transactions of the user uuid, the address isn't used.  The mined ones are
+ * listed by block, newest first unless ordered oldest first, 100 a page and 500
+ * at most.  Those not mined yet come in pending with the first page.
+ */
+func (api *TudoV2API) ListUserTrans(ctx context.Context,
+	args ListUserTransReqt) (*ListUserTransResp, error) {
+	return api.listTrans(ctx, args, false, true)
+}
+
+/**
+ * ListAccountTrans
+ * ----------------
+ * Transactions of the address, the user uuid isn't used.
+ */
+func (api *TudoV2API) ListAccountTrans(ctx context.Context,
+	args ListUserTransReqt) (*ListUserTransResp, error) {
+	return api.listTrans(ctx, args, true, false)
+}
+
+/**
+ * ListUserAcctTrans
+ * -----------------
+ * Transactions of the address with the user uuid.
+ */
+func (api *TudoV2API) ListUserAcctTrans(ctx context.Context,
+	args ListUserTransReqt) (*ListUserTransResp, error) {
+	return api.listTrans(ctx, args, true, true)
+}
+
+func (api *TudoV2API) listTrans(ctx context.Context, args ListUserTransReqt,
+	byAddr, byUser bool) (*ListUserTransResp, error) {
+	scope := callerScope(ctx)
+	if byUser {
+		if err := scope.checkOwner(args.UserUuid); err != nil {
+			return nil, err
+		}
+	}
+	if byAddr {
+		if err := scope.checkAccount(api.node.GetStorage(), args.Address); err != nil {
+			return nil, err
+		}
+	}
+	q := &kstore.TransQuery{From: args.From}
+	if byAddr {
+		addr, err := parseAddress(args.Address)
+		if err != nil {
+			return nil, err
+		}
+		q.Account = &addr
+	}
+	if byUser {
+		user, err := parseUuid("user", args.UserUuid, false)
+		if err != nil {
+			return nil, err
+		}
+		q.Owner = user
+	}
+	q.Offset, _ = listLimit(args.Start, args.Limit)
+	page, err := api.node.listTransPage(q, &args.TransFilter, args.Cursor, args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ListUserTransResp{
+		Transactions: transInfos(page.Mined),
+		Pending:      transInfos(page.Pending),
+		NextCursor:   page.NextCursor,
+	}
+	resp.TransBChain, resp.TransBlocks = api.v1.getDetailTx(ctx, nil, page.Mined)
+	return resp, nil
+}
+
+func transInfos(results []models.Transaction) []TransInfo {
+	infos := make([]TransInfo, 0, len(results))
+	for _, t := range results {
+		infos = append(infos, TransInfo{
+			TxHash:   t.TxHash,
+			FromUuid: t.FromUuid,
+			ToUuid:   t.ToUuid,
+			FromAcct: t.FromAcct,
+			ToAcct:   t.ToAcct,
+			XuAmount: t.XuAmount,
+			Created:  t.Created,
+			Block:    t.BlockNumber,
+			TxIndex:  t.TxIndex,
+		})
+	}
+	return infos
+}
+
+/**
+ * ListAccountInfo
+ * ---------------
+ * Balances of the accounts at the latest block, with the latest block and the
+ * last 100 transactions of each account if asked.
+ */
+func (api *TudoV2API) ListAccountInfo(ctx context.Context,
+	args AccountInfoReqt) (*AccountInfoResp, error) {
+	scope := callerScope(ctx)
+	addrs := make([]common.Address, len(args.Accounts))
+	for idx, address := range args.Accounts {
+		if err := scope.checkAccount(api.node.GetStorage(), address); err != nil {
+			return nil, err
+		}
+		addr, err := parseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs[idx] = addr
+	}
+	eth := api.node.GetEthereum()
+	state, _, err := eth.ApiBackend.StateAndHeaderByNumber(ctx, rpc.LatestBlockNumber)
+	if state == nil || err != nil {
+		return nil, newRPCError(CodeNoChain, "No state for the latest block: %v", err)
+	}
+	resp := &AccountInfoResp{Accounts: make([]AccountBalance, len(addrs))}
+	if args.Transactions {
+		resp.TransBChain = make([]*RPCTransaction, 0)
+		resp.TransBlocks = make([]map[string]interface{}, 0)
+	}
+	for idx, addr := range addrs {
+		resp.Accounts[idx] = AccountBalance{
+			Account: addr,
+			Balance: (*hexutil.Big)(state.GetBalance(addr)),
+		}
+		if args.Transactions {
+			api.v1.listAcctTrans(ctx, &addrs[idx], 0, 100,
+				&resp.TransBChain, &resp.TransBlocks)
+		}
+	}
+	if args.Latest {
+		resp.Latest, err = eth.BcPublicApi.GetBlockByNumber(ctx, rpc.LatestBlockNumber, true)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+	}
+	return resp, nil
+}
+
+/**
+ * ListBlocks
+ * ----------
+ * Up to 100 blocks, oldest first.
+ */
+func (api *TudoV2API) ListBlocks(ctx context.Context,
+	args ListBlocksReqt) ([]map[string]interface{}, error) {
+	eth := api.node.GetEthereum()
+	latest := eth.BlockChain().CurrentBlock()
+	if latest == nil {
+		return nil, newRPCError(CodeNoChain, "No block")
+	}
+	last := int64(latest.NumberU64())
+	if args.Start != nil {
+		if *args.Start < 0 {
+			return nil, invalidParams("Invalid start block %d", *args.Start)
+		}
+		if *args.Start < last {
+			last = *args.Start
+		}
+	}
+	count := int64(args.Count)
+	if count <= 0 || count > 100 {
+		count = 100
+	}
+	first := last - count + 1
+	if first < 0 {
+		first = 0
+	}
+	blocks := make([]map[string]interface{}, 0, last-first+1)
+	for num := first; num <= last; num++ {
+		block, err := eth.BcPublicApi.GetBlockByNumber(ctx, rpc.BlockNumber(num), args.TxDetail)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		if block != nil {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+/**
+ * ListBlockHash
+ * -------------
+ * The blocks found with their transactions, unknown hashes are skipped.
+ */
+func (api *TudoV2API) ListBlockHash(ctx context.Context,
+	args HashesReqt) ([]map[string]interface{}, error) {
+	bcApi := api.node.GetEthereum().BcPublicApi
+
+	blocks := make([]map[string]interface{}, 0, len(args.Hashes))
+	for _, hash := range args.Hashes {
+		block, err := bcApi.GetBlockByHash(ctx, hash, true)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		if block != nil {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+/**
+ * ListTrans
+ * ---------
+ * The transactions found in the chain or the pool, unknown hashes are skipped.
+ */
+func (api *TudoV2API) ListTrans(ctx context.Context,
+	args HashesReqt) ([]*RPCTransaction, error) {
+	eth := api.node.GetEthereum()
+	bcDb := eth.ChainDb()
+
+	trans := make([]*RPCTransaction, 0, len(args.Hashes))
+	for _, hash := range args.Hashes {
+		tx, blockHash, blockNo, index := core.GetTransaction(bcDb, hash)
+		if tx == nil {
+			tx = eth.ApiBackend.GetPoolTransaction(hash)
+		}
+		if tx != nil {
+			trans = append(trans, newRPCTransaction(eth, ctx, tx, blockHash, blockNo, index))
+		}
+	}
+	return trans, nil
+}
+
+/**
+ * PayUserAccount
+ * --------------
+ * Send the amount between the owners' accounts.  A transaction waiting for
+ * approval fails with CodeApprovalPending, the data member has its approvalId.
+ */
+func (api *TudoV2API) PayUserAccount(ctx context.Context, args PayReqt) (*TxResp, error) {
+	if err := callerScope(ctx).checkOwner(args.FromUuid); err != nil {
+		return nil, err
+	}
+	fromAddr, err := parseAddress(args.From)
+	if err != nil {
+		return nil, err
+	}
+	toAddr, err := parseAddress(args.To)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = api.checkOwner(args.From, args.FromUuid); err != nil {
+		return nil, err
+	}
+	if _, err = api.checkOwner(args.To, args.ToUuid); err != nil {
+		return nil, err
+	}
+	value, ok := new(big.Int).SetString(args.Amount, 10)
+	if !ok || value.Sign() < 0 {
+		return nil, invalidParams("Invalid amount %s", args.Amount)
+	}
+	weiVal := hexutil.Big(*value)
+
+	txPool := api.node.GetEthereum().TxPublicPoolApi
+	sendTx := txPool.NewSendTxArgs(fromAddr, &toAddr, &weiVal, nil, nil)
+	txHash, err := txPool.SendTransaction(ctx, sendTx)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &TxResp{TxHash: txHash}, nil
+}
+
+/**
+ * ListApprovals
+ * -------------
+ * The admin transactions in the status, all of them if status is empty.
+ */
+func (api *TudoV2API) ListApprovals(ctx context.Context,
+	args ListReqt) ([]*ApprovalInfo, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	start, limit := listLimit(args.Start, args.Limit)
+	reqs, err := api.node.GetStorage().ListApprovalReqs(args.Status, start, limit)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	results := make([]*ApprovalInfo, 0, len(reqs))
+	for idx := range reqs {
+		results = append(results, api.approvalInfo(&reqs[idx]))
+	}
+	return results, nil
+}
+
+func (api *TudoV2API) approvalInfo(req *models.ApprovalRequest) *ApprovalInfo {
+	info := &ApprovalInfo{
+		Id:          req.Id,
+		Account:     req.Account,
+		Status:      req.Status,
+		Quorum:      req.Quorum,
+		TxHash:      req.TxHash,
+		Created:     req.Created,
+		ApproveHash: kstore.ApprovalHash(req, true),
+		RejectHash:  kstore.ApprovalHash(req, false),
+		Votes:       []ApprovalVote{},
+	}
+	if tx, _, err := kstore.DecodeApprovalTx(req); err == nil {
+		info.To = tx.To()
+		info.Value = tx.Value().String()
+		info.Nonce = tx.Nonce()
+	}
+	votes, _ := api.node.GetStorage().GetApprovals(req.Id)
+	for _, vote := range votes {
+		info.Votes = append(info.Votes, ApprovalVote{
+			Approver: vote.Approver,
+			Approve:  vote.Approve,
+		})
+	}
+	return info
+}
+
+/**
+ * ApproveRequest
+ * --------------
+ * Record the admin's approval, the transaction is sent once approved if the
+ * account is unlocked.
+ */
+func (api *TudoV2API) ApproveRequest(ctx context.Context,
+	args VoteReqt) (*VoteResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	req, err := api.voteRequest(args, true)
+	if err != nil {
+		return nil, err
+	}
+	resp := &VoteResp{Request: api.approvalInfo(req)}
+	if req.Status == models.ApprovalApproved {
+		txHash, err := api.v1.submitRequest(ctx, req, "")
+		if err != nil {
+			resp.SubmitError = err.Error()
+		} else {
+			resp.TxHash = &txHash
+		}
+	}
+	return resp, nil
+}
+
+/**
+ * RejectRequest
+ * -------------
+ */
+func (api *TudoV2API) RejectRequest(ctx context.Context,
+	args VoteReqt) (*VoteResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	req, err := api.voteRequest(args, false)
+	if err != nil {
+		return nil, err
+	}
+	return &VoteResp{Request: api.approvalInfo(req)}, nil
+}
+
+func (api *TudoV2API) voteRequest(args VoteReqt,
+	approve bool) (*models.ApprovalRequest, error) {
+	approver, err := parseAddress(args.Approver)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hexutil.Decode(args.Signature)
+	if err != nil {
+		return nil, invalidParams("Invalid signature %s", args.Signature)
+	}
+	req, err := api.node.GetStorage().GetApprovalReq(args.Id)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	if req.Status != models.ApprovalPending {
+		return nil, newRPCError(CodeBadState, "Request %d is %s", req.Id, req.Status)
+	}
+	req, err = api.node.kstore.Approvals().Vote(args.Id, approver, sig, approve)
+	if err != nil {
+		return nil, &RPCError{Code: CodeAdminAuth, Message: err.Error()}
+	}
+	return req, nil
+}
+
+/**
+ * SubmitRequest
+ * -------------
+ * Sign the approved transaction and send it, the approver and signature aren't
+ * used.  An empty password means the admin account must be unlocked.
+ */
+func (api *TudoV2API) SubmitRequest(ctx context.Context, args VoteReqt) (*TxResp, error) {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return nil, err
+	}
+	req, err := api.node.GetStorage().GetApprovalReq(args.Id)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	if req.Status != models.ApprovalApproved {
+		return nil, newRPCError(CodeBadState, "Request %d is %s", req.Id, req.Status)
+	}
+	txHash, err := api.v1.submitRequest(ctx, req, args.Password)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &TxResp{TxHash: txHash}, nil
+}
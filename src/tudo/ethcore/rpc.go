@@ -13,87 +13,677 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/pborman/uuid"
+	"tudo/kstore"
 	"tudo/models"
 )
 
+/**
+ * Over HTTP and websocket, each method is limited to the owner or admin role of
+ * the caller's token, see rpc-auth.go.  The chain queries only need a token.
+ */
 type TudoNodeAPI struct {
 	node *TudoNode
 }
 
-func NewTudoNodeAPI(n *TudoNode) *TudoNodeAPI {
-	return &TudoNodeAPI{node: n}
+func NewTudoNodeAPI(n *TudoNode) *TudoNodeAPI {
+	return &TudoNodeAPI{node: n}
+}
+
+/**
+ * UpdateAccount
+ * -------------
+ * curl -X POST -H "Content-Type: application/json" -H "Authorization: Bearer ..."
+ *    --data '{"jsonrpc": "2.0", "method": "tudo_updateAccount",
+ *    "params": [ "abc", "def", ... ], "id": "foo"}' localhost:8545
+ */
+func (api *TudoNodeAPI) UpdateAccount(ctx context.Context, address, name,
+	password, actType, ownerUuid, walletUuid string) map[string]interface{} {
+	ks := api.node.kstore.GetStorageIf()
+
+	out := make(map[string]interface{})
+	scope := callerScope(ctx)
+	if err := scope.checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if err := scope.checkAccount(ks, address); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if !common.IsHexAddress(address) {
+		out["error"] = fmt.Sprintf("Invaid address %s", address)
+		return out
+	}
+	addr := common.HexToAddress(address)
+	wallet := uuid.Parse(walletUuid)
+	owner := uuid.Parse(ownerUuid)
+
+	if owner == nil {
+		out["error"] = fmt.Sprintf("Invalid owner uuid %s", ownerUuid)
+		return out
+	}
+	err := ks.UpdateAccount(addr, name, actType, owner, wallet)
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	out["address"] = addr.Hex()
+	out["ownerUuid"] = owner.String()
+	return out
+}
+
+/**
+ * NewAccount
+ * ----------
+ */
+func (api *TudoNodeAPI) NewAccount(ctx context.Context, ownerUuid, walletUuid,
+	name, password, actType string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	scope := callerScope(ctx)
+	ownerUuid = scope.defaultOwner(ownerUuid)
+	if err := scope.checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	kstore := api.node.callerKStore(ctx)
+	acct, model, err := kstore.NewAccountOwner(ownerUuid,
+		walletUuid, name, password, actType)
+	if err != nil {
+		out["error"] = err.Error()
+		out["ownerUuid"] = ownerUuid
+		out["walletUuid"] = walletUuid
+	} else {
+		out["address"] = acct.Address.Hex()
+		out["ownerUuid"] = model.OwnerUuid
+		out["walletUuid"] = model.WalletUuid
+	}
+	return out
+}
+
+/**
+ * NewHDWallet
+ * -----------
+ * Make the owner's HD wallet seed, encrypted with the password, and its first
+ * account.  Open the wallet with personal_openWallet to derive more.
+ */
+func (api *TudoNodeAPI) NewHDWallet(ctx context.Context, ownerUuid, walletUuid,
+	password string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	scope := callerScope(ctx)
+	ownerUuid = scope.defaultOwner(ownerUuid)
+	if err := scope.checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	kstore := api.node.callerKStore(ctx)
+	acct, model, err := kstore.NewHDWallet(ownerUuid, walletUuid, password)
+	if err != nil {
+		out["error"] = err.Error()
+		out["ownerUuid"] = ownerUuid
+		out["walletUuid"] = walletUuid
+	} else {
+		out["address"] = acct.Address.Hex()
+		out["url"] = acct.URL.String()
+		out["ownerUuid"] = model.OwnerUuid
+		out["walletUuid"] = model.WalletUuid
+	}
+	return out
+}
+
+/**
+ * ExportMnemonic
+ * --------------
+ * Return the owner's HD wallet mnemonic, the password must be the wallet's.
+ */
+func (api *TudoNodeAPI) ExportMnemonic(ctx context.Context,
+	ownerUuid, password string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	mnemonic, err := api.node.callerKStore(ctx).ExportMnemonic(ownerUuid, password)
+	if err != nil {
+		out["error"] = err.Error()
+	} else {
+		out["mnemonic"] = mnemonic
+	}
+	out["ownerUuid"] = ownerUuid
+	return out
+}
+
+/**
+ * RestoreWallet
+ * -------------
+ * Rebuild the owner's HD wallet from the mnemonic, the accounts with activity on
+ * the chain are derived again and stored encrypted with the password.
+ */
+func (api *TudoNodeAPI) RestoreWallet(ctx context.Context, ownerUuid, mnemonic,
+	password string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	chain := NewBackendState(api.node.GetEthereum().ApiBackend)
+	accts, err := api.node.callerKStore(ctx).RestoreWallet(ownerUuid, mnemonic,
+		password, chain)
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	addrs := make([]string, len(accts))
+	for idx, acct := range accts {
+		addrs[idx] = acct.Address.Hex()
+	}
+	out["accounts"] = addrs
+	out["ownerUuid"] = ownerUuid
+	return out
+}
+
+/**
+ * ChangePassphrase
+ * ----------------
+ */
+func (api *TudoNodeAPI) ChangePassphrase(ctx context.Context, address, ownerUuid,
+	password, newPassword string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if !common.IsHexAddress(address) {
+		out["error"] = fmt.Sprintf("Invaid address %s", address)
+		return out
+	}
+	kstore := api.node.callerKStore(ctx)
+	addr := common.HexToAddress(address)
+	if _, err := kstore.GetStorageIf().GetAccountOwner(addr.Hex(), ownerUuid); err != nil {
+		out["error"] = ownerError(err, address, ownerUuid)
+		return out
+	}
+	acct := accounts.Account{Address: addr}
+	if err := kstore.Update(acct, password, newPassword); err != nil {
+		out["error"] = err.Error()
+	}
+	out["address"] = addr.Hex()
+	out["ownerUuid"] = ownerUuid
+	return out
+}
+
+func ownerError(err error, address, ownerUuid string) string {
+	if kstore.IsNotFound(err) {
+		return fmt.Sprintf("Invalid account %s for owner %s", address, ownerUuid)
+	}
+	return err.Error()
+}
+
+/**
+ * ExportAccount
+ * -------------
+ * Return the account key in V3 JSON format, encrypted with the new password.
+ */
+func (api *TudoNodeAPI) ExportAccount(ctx context.Context, address, ownerUuid,
+	password, newPassword string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if !common.IsHexAddress(address) {
+		out["error"] = fmt.Sprintf("Invaid address %s", address)
+		return out
+	}
+	kstore := api.node.callerKStore(ctx)
+	addr := common.HexToAddress(address)
+	if _, err := kstore.GetStorageIf().GetAccountOwner(addr.Hex(), ownerUuid); err != nil {
+		out["error"] = ownerError(err, address, ownerUuid)
+		return out
+	}
+	acct := accounts.Account{Address: addr}
+	keyJson, err := kstore.Export(acct, password, newPassword)
+	if err != nil {
+		out["error"] = err.Error()
+	} else {
+		out["address"] = addr.Hex()
+		out["keyJson"] = string(keyJson)
+	}
+	return out
+}
+
+/**
+ * ImportAccount
+ * -------------
+ * Import V3 JSON key encrypted with password, store it with the new password.
+ */
+func (api *TudoNodeAPI) ImportAccount(ctx context.Context, keyJson, password,
+	newPassword, ownerUuid, walletUuid, name, actType string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	scope := callerScope(ctx)
+	ownerUuid = scope.defaultOwner(ownerUuid)
+	if err := scope.checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	kstore := api.node.callerKStore(ctx)
+	acct, model, err := kstore.ImportOwner([]byte(keyJson),
+		password, newPassword, ownerUuid, walletUuid, name, actType)
+	if err != nil {
+		out["error"] = err.Error()
+		out["ownerUuid"] = ownerUuid
+		out["walletUuid"] = walletUuid
+	} else {
+		out["address"] = acct.Address.Hex()
+		out["ownerUuid"] = model.OwnerUuid
+		out["walletUuid"] = model.WalletUuid
+	}
+	return out
+}
+
+/**
+ * DeleteAccount
+ * -------------
+ * Delete the owner's account, the password must open its key.  The account can
+ * be restored with tudo_restoreAccount within the retention period.
+ */
+func (api *TudoNodeAPI) DeleteAccount(ctx context.Context, address, ownerUuid,
+	password string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if !common.IsHexAddress(address) {
+		out["error"] = fmt.Sprintf("Invaid address %s", address)
+		return out
+	}
+	kstore := api.node.callerKStore(ctx)
+	addr := common.HexToAddress(address)
+	if _, err := kstore.GetStorageIf().GetAccountOwner(addr.Hex(), ownerUuid); err != nil {
+		out["error"] = ownerError(err, address, ownerUuid)
+		return out
+	}
+	if err := kstore.Delete(accounts.Account{Address: addr}, password); err != nil {
+		out["error"] = err.Error()
+	}
+	out["address"] = addr.Hex()
+	out["ownerUuid"] = ownerUuid
+	return out
+}
+
+/**
+ * AdminDeleteAccount
+ * ------------------
+ * Delete the account without its password.  The admin signs the hash returned
+ * by tudo_adminOpHash for the "delete" operation with personal_sign.
+ */
+func (api *TudoNodeAPI) AdminDeleteAccount(ctx context.Context, address, admin,
+	stampArg, signature string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	addr, err := api.checkAdminOp(kstore.AdminOpDelete, address, admin, stampArg, signature)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	err = api.node.callerKStore(ctx).AdminDelete(accounts.Account{Address: addr})
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	out["address"] = addr.Hex()
+	return out
+}
+
+/**
+ * RestoreAccount
+ * --------------
+ * Restore the owner's account deleted within the retention period, the password
+ * must open its key.
+ */
+func (api *TudoNodeAPI) RestoreAccount(ctx context.Context, address, ownerUuid,
+	password string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if !common.IsHexAddress(address) {
+		out["error"] = fmt.Sprintf("Invaid address %s", address)
+		return out
+	}
+	ks := api.node.callerKStore(ctx)
+	addr := common.HexToAddress(address)
+	keyRec, err := ks.GetStorageIf().GetArchivedKey(addr)
+	if err == nil && keyRec.OwnerUuid != ownerUuid {
+		err = kstore.ErrNoAccount
+	}
+	if err != nil {
+		out["error"] = ownerError(err, address, ownerUuid)
+		return out
+	}
+	if err = ks.RestoreAccount(accounts.Account{Address: addr}, password); err != nil {
+		out["error"] = err.Error()
+	}
+	out["address"] = addr.Hex()
+	out["ownerUuid"] = ownerUuid
+	return out
+}
+
+/**
+ * PurgeAccount
+ * ------------
+ * Remove the deleted account for good.  The admin signs the hash returned by
+ * tudo_adminOpHash for the "purge" operation with personal_sign.
+ */
+func (api *TudoNodeAPI) PurgeAccount(ctx context.Context, address, admin,
+	stampArg, signature string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	addr, err := api.checkAdminOp(kstore.AdminOpPurge, address, admin, stampArg, signature)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	err = api.node.callerKStore(ctx).PurgeAccount(accounts.Account{Address: addr})
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	out["address"] = addr.Hex()
+	return out
+}
+
+/**
+ * Fsck
+ * ----
+ * Check the keystore tables and the cached wallets against each other, and fix
+ * what can be fixed with repair.  The admin signs the hash returned by
+ * tudo_adminOpHash for the "fsck" or "fsck-repair" operation and the zero
+ * address.
+ */
+func (api *TudoNodeAPI) Fsck(ctx context.Context, repair bool, admin,
+	stampArg, signature string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	op := kstore.AdminOpFsck
+	if repair {
+		op = kstore.AdminOpFsckRepair
+	}
+	_, err := api.checkAdminOp(op, common.Address{}.Hex(), admin, stampArg, signature)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	report, err := api.node.callerKStore(ctx).Fsck(repair, 0)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	out["accounts"] = report.Accounts
+	out["keys"] = report.Keys
+	out["wallets"] = report.Wallets
+	out["issues"] = report.Issues
+	out["unverified"] = report.Unverified
+	return out
+}
+
+/**
+ * AdminOpHash
+ * -----------
+ * Return the hash an admin signs to run the operation on the account, with the
+ * current time as stamp.
+ */
+func (api *TudoNodeAPI) AdminOpHash(ctx context.Context,
+	op, address string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if !common.IsHexAddress(address) {
+		out["error"] = fmt.Sprintf("Invaid address %s", address)
+		return out
+	}
+	stamp := time.Now().Unix()
+	out["op"] = op
+	out["address"] = common.HexToAddress(address).Hex()
+	out["stamp"] = strconv.FormatInt(stamp, 10)
+	out["hash"] = kstore.AdminOpHash(op, common.HexToAddress(address), stamp).Hex()
+	return out
+}
+
+func (api *TudoNodeAPI) checkAdminOp(op, address, admin,
+	stampArg, signature string) (common.Address, error) {
+	if !common.IsHexAddress(address) {
+		return common.Address{}, fmt.Errorf("Invaid address %s", address)
+	}
+	adminAddr, stamp, sig, err := parseAdminSig(admin, stampArg, signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	addr := common.HexToAddress(address)
+	err = api.node.kstore.Approvals().CheckAdminOp(op, addr, adminAddr, stamp, sig)
+	return addr, err
+}
+
+func parseAdminSig(admin, stampArg,
+	signature string) (common.Address, int64, []byte, error) {
+	if !common.IsHexAddress(admin) {
+		return common.Address{}, 0, nil, fmt.Errorf("Invaid address %s", admin)
+	}
+	stamp, err := strconv.ParseInt(stampArg, 10, 64)
+	if err != nil {
+		return common.Address{}, 0, nil, fmt.Errorf("Invalid time stamp %s", stampArg)
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return common.Address{}, 0, nil, fmt.Errorf("Invalid signature %s", signature)
+	}
+	return common.HexToAddress(admin), stamp, sig, nil
+}
+
+/**
+ * SetSpendPolicy
+ * --------------
+ * Set the spending rules of the account or wallet uuid, values in wei with empty
+ * for no limit, allowlist as comma separated addresses.  The admin signs the hash
+ * returned by tudo_spendPolicyHash for the "set-policy" operation.
+ */
+func (api *TudoNodeAPI) SetSpendPolicy(ctx context.Context,
+	scope, maxTxValue, dailyLimit, allowlist string,
+	noContract bool, admin, stampArg, signature string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	policy, err := kstore.NewSpendPolicy(scope, maxTxValue, dailyLimit, allowlist, noContract)
+	if err == nil {
+		err = api.checkPolicySig(kstore.AdminOpSetPolicy, policy, admin, stampArg, signature)
+	}
+	if err == nil {
+		err = api.node.GetStorage().StoreSpendPolicy(policy)
+	}
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	out["policy"] = policyInfo(policy)
+	return out
+}
+
+/**
+ * DeleteSpendPolicy
+ * -----------------
+ * The admin signs the hash returned by tudo_spendPolicyHash for the
+ * "delete-policy" operation, with only the scope set.
+ */
+func (api *TudoNodeAPI) DeleteSpendPolicy(ctx context.Context, scope,
+	admin, stampArg, signature string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	policy, err := kstore.NewSpendPolicy(scope, "", "", "", false)
+	if err == nil {
+		err = api.checkPolicySig(kstore.AdminOpDeletePolicy,
+			policy, admin, stampArg, signature)
+	}
+	if err == nil {
+		err = api.node.GetStorage().DeleteSpendPolicy(policy.Scope)
+	}
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	out["scope"] = scope
+	return out
 }
 
 /**
- * UpdateAccount
- * -------------
- * curl -X POST -H "Content-Type: application/json" --data '{"jsonrpc": "2.0",
- *    "method": "tudo_updateAccount", "params": [ "abc", "def", ... ], "id": "foo"}'
- *    localhost:8545
+ * SpendPolicyHash
+ * ---------------
+ * Return the hash an admin signs to set or delete the policy, with the current
+ * time as stamp.
  */
-func (api *TudoNodeAPI) UpdateAccount(address, name,
-	password, actType, ownerUuid, walletUuid string) map[string]interface{} {
-	ks := api.node.kstore.GetStorageIf()
-
+func (api *TudoNodeAPI) SpendPolicyHash(ctx context.Context, op, scope,
+	maxTxValue, dailyLimit, allowlist string, noContract bool) map[string]interface{} {
 	out := make(map[string]interface{})
-	if !common.IsHexAddress(address) {
-		out["error"] = fmt.Sprintf("Invaid address %s", address)
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
 		return out
 	}
-	addr := common.HexToAddress(address)
-	wallet := uuid.Parse(walletUuid)
-	owner := uuid.Parse(ownerUuid)
+	policy, err := kstore.NewSpendPolicy(scope, maxTxValue, dailyLimit, allowlist, noContract)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	stamp := time.Now().Unix()
+	out["op"] = op
+	out["policy"] = policyInfo(policy)
+	out["stamp"] = strconv.FormatInt(stamp, 10)
+	out["hash"] = kstore.PolicyHash(op, policy, stamp).Hex()
+	return out
+}
 
-	if owner == nil {
-		out["error"] = fmt.Sprintf("Invalid owner uuid %s", ownerUuid)
+/**
+ * GetSpendPolicy
+ * --------------
+ */
+func (api *TudoNodeAPI) GetSpendPolicy(ctx context.Context,
+	scope string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkPolicyScope(api.node.GetStorage(), scope); err != nil {
+		out["error"] = err.Error()
+		return out
 	}
-	err := ks.UpdateAccount(addr, name, actType, owner, wallet)
+	scope, err := kstore.PolicyScope(scope)
 	if err != nil {
 		out["error"] = err.Error()
+		return out
+	}
+	policy, err := api.node.GetStorage().GetSpendPolicy(scope)
+	if err != nil {
+		out["error"] = err.Error()
+	} else {
+		out["policy"] = policyInfo(policy)
 	}
-	out["address"] = addr.Hex()
-	out["ownerUuid"] = owner.String()
 	return out
 }
 
 /**
- * NewAccount
- * ----------
+ * ListSpendPolicies
+ * -----------------
  */
-func (api *TudoNodeAPI) NewAccount(ownerUuid, walletUuid,
-	name, password, actType string) map[string]interface{} {
+func (api *TudoNodeAPI) ListSpendPolicies(ctx context.Context,
+	startArg, limitArg string) map[string]interface{} {
 	out := make(map[string]interface{})
 
-	kstore := api.node.kstore
-	acct, model, err := kstore.NewAccountOwner(ownerUuid,
-		walletUuid, name, password, actType)
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	_, start, limit := parseFromStartLimitArg("", startArg, limitArg)
+	policies, err := api.node.GetStorage().ListSpendPolicies(start, limit)
 	if err != nil {
 		out["error"] = err.Error()
-		out["ownerUuid"] = ownerUuid
-		out["walletUuid"] = walletUuid
-	} else {
-		out["address"] = acct.Address.Hex()
-		out["ownerUuid"] = model.OwnerUuid
-		out["walletUuid"] = model.WalletUuid
+		return out
+	}
+	results := make([]map[string]interface{}, 0, len(policies))
+	for idx := range policies {
+		results = append(results, policyInfo(&policies[idx]))
 	}
+	out["policies"] = results
 	return out
 }
 
+func (api *TudoNodeAPI) checkPolicySig(op string, policy *models.SpendPolicy,
+	admin, stampArg, signature string) error {
+	adminAddr, stamp, sig, err := parseAdminSig(admin, stampArg, signature)
+	if err != nil {
+		return err
+	}
+	return api.node.kstore.Approvals().CheckAdminSig(kstore.PolicyHash(op, policy, stamp),
+		adminAddr, stamp, sig)
+}
+
+func policyInfo(policy *models.SpendPolicy) map[string]interface{} {
+	return map[string]interface{}{
+		"scope":      policy.Scope,
+		"maxTxValue": policy.MaxTxValue,
+		"dailyLimit": policy.DailyLimit,
+		"allowlist":  policy.Allowlist,
+		"noContract": policy.NoContract,
+		"modified":   policy.Modified,
+	}
+}
+
 /**
  * GetAccount
  * ----------
  */
-func (api *TudoNodeAPI) GetAccount(address string) map[string]interface{} {
+func (api *TudoNodeAPI) GetAccount(ctx context.Context,
+	address string) map[string]interface{} {
 	out := make(map[string]interface{})
 
+	if err := callerScope(ctx).checkAccount(api.node.GetStorage(), address); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	if !common.IsHexAddress(address) {
 		out["error"] = fmt.Sprintf("Invaid address %s", address)
 		return out
@@ -112,8 +702,13 @@ func (api *TudoNodeAPI) GetAccount(address string) map[string]interface{} {
  * GetUserAccount
  * --------------
  */
-func (api *TudoNodeAPI) GetUserAccount(ownerUuid string) map[string]interface{} {
+func (api *TudoNodeAPI) GetUserAccount(ctx context.Context,
+	ownerUuid string) map[string]interface{} {
 	out := make(map[string]interface{})
+	if err := callerScope(ctx).checkOwner(ownerUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	owner := uuid.Parse(ownerUuid)
 	if owner == nil {
 		out["error"] = fmt.Sprintf("Invalid owner uuid %s", ownerUuid)
@@ -133,8 +728,13 @@ func (api *TudoNodeAPI) GetUserAccount(ownerUuid string) map[string]interface{}
  * GetWallet
  * ---------
  */
-func (api *TudoNodeAPI) GetWallet(walletUuid string) map[string]interface{} {
+func (api *TudoNodeAPI) GetWallet(ctx context.Context,
+	walletUuid string) map[string]interface{} {
 	out := make(map[string]interface{})
+	if err := callerScope(ctx).checkWallet(api.node.GetStorage(), walletUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	wallet := uuid.Parse(walletUuid)
 	if wallet == nil {
 		out["error"] = fmt.Sprintf("Invalid wallet uuid %s", walletUuid)
@@ -156,35 +756,61 @@ func (api *TudoNodeAPI) GetWallet(walletUuid string) map[string]interface{} {
  * @param userUuid - uuid recorded in mysql
  * @param fromArg - true to find transactions sent *from* userUuid, false is for tx
  *     received by userUuid.
- * @param startArg, limitArg - start + limit entries read from mysql.
+ * @param startArg - nextCursor of the previous page, or the number of rows to skip.
+ * @param limitArg - rows of the page, 100 by default and 500 at most.
+ * @param filter - optional, see TransFilter.
+ *
+ * The transactions are listed by block, newest first unless the filter orders
+ * them oldest first.  The ones not mined yet are in "pending" on the first page.
  */
-func (api *TudoNodeAPI) ListUserTrans(ctx context.Context,
-	userUuid, fromArg, startArg, limitArg string) map[string]interface{} {
+func (api *TudoNodeAPI) ListUserTrans(ctx context.Context, userUuid, fromArg,
+	startArg, limitArg string, filter *TransFilter) map[string]interface{} {
 
-	from, start, limit := parseFromStartLimitArg(fromArg, startArg, limitArg)
+	from, cursor, start, limit := parseTransArgs(fromArg, startArg, limitArg)
 	out := make(map[string]interface{})
+	if err := callerScope(ctx).checkOwner(userUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	user := uuid.Parse(userUuid)
 
 	if user == nil {
 		out["error"] = fmt.Sprintf("Invalid user uuid %s", userUuid)
 		return out
 	}
-	ks := api.node.kstore.GetStorageIf()
-	results, err := ks.GetTransaction(nil, &user, from, start, limit)
+	q := &kstore.TransQuery{Owner: user, From: from, Offset: start}
+	api.listTrans(ctx, out, q, filter, cursor, limit)
+	return out
+}
+
+func (api *TudoNodeAPI) listTrans(ctx context.Context, out map[string]interface{},
+	q *kstore.TransQuery, filter *TransFilter, cursor string, limit int) {
+
+	page, err := api.node.listTransPage(q, filter, cursor, limit)
 	if err != nil {
 		out["error"] = err.Error()
-		return out
+		return
 	}
-	api.getDetailTx(ctx, out, results)
-	return out
+	api.getDetailTx(ctx, out, page.Mined)
+	out["pending"] = page.Pending
+	out["nextCursor"] = page.NextCursor
 }
 
+// getDetailTx leaves the details out without a chain.
 func (api *TudoNodeAPI) getDetailTx(ctx context.Context, out map[string]interface{},
 	results []models.Transaction) ([]*RPCTransaction, []map[string]interface{}) {
 
 	txDetail := make([]*RPCTransaction, len(results))
 	txBlocks := make([]map[string]interface{}, len(results))
 
+	if out != nil {
+		out["transaction"] = results
+		out["transBChain"] = txDetail
+		out["transBlocks"] = txBlocks
+	}
+	if !api.node.hasEthereum() {
+		return txDetail, txBlocks
+	}
 	eth := api.node.GetEthereum()
 	bcDb := eth.ChainDb()
 	bcApi := eth.BcPublicApi
@@ -198,35 +824,29 @@ func (api *TudoNodeAPI) getDetailTx(ctx context.Context, out map[string]interfac
 			txBlocks[i] = block
 		}
 	}
-	if out != nil {
-		out["transaction"] = results
-		out["transBChain"] = txDetail
-		out["transBlocks"] = txBlocks
-	}
 	return txDetail, txBlocks
 }
 
 /**
  * ListAccountTrans
  * ----------------
+ * Same as ListUserTrans for the transactions of the address.
  */
 func (api *TudoNodeAPI) ListAccountTrans(ctx context.Context, address string,
-	fromArg, startArg, limitArg string) map[string]interface{} {
-	from, start, limit := parseFromStartLimitArg(fromArg, startArg, limitArg)
+	fromArg, startArg, limitArg string, filter *TransFilter) map[string]interface{} {
+	from, cursor, start, limit := parseTransArgs(fromArg, startArg, limitArg)
 	out := make(map[string]interface{})
+	if err := callerScope(ctx).checkAccount(api.node.GetStorage(), address); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	if !common.IsHexAddress(address) {
 		out["error"] = fmt.Sprintf("Invaid address %s", address)
 		return out
 	}
-	ks := api.node.kstore.GetStorageIf()
 	acct := common.HexToAddress(address)
-	results, err := ks.GetTransaction(&acct, nil, from, start, limit)
-
-	if err != nil {
-		out["error"] = err.Error()
-	} else {
-		api.getDetailTx(ctx, out, results)
-	}
+	q := &kstore.TransQuery{Account: &acct, From: from, Offset: start}
+	api.listTrans(ctx, out, q, filter, cursor, limit)
 	return out
 }
 
@@ -250,40 +870,68 @@ func parseFromStartLimitArg(fromArg, startArg, limitArg string) (*bool, int, int
 	return fptr, int(start), int(limit)
 }
 
+// parseTransArgs takes for startArg the nextCursor of the previous page, or the
+// number of rows to skip.
+func parseTransArgs(fromArg, startArg, limitArg string) (*bool, string, int, int) {
+	from, start, _ := parseFromStartLimitArg(fromArg, startArg, limitArg)
+	cursor := ""
+	if _, err := strconv.ParseInt(startArg, 10, 32); err != nil {
+		cursor = startArg
+	}
+	if start < 0 {
+		start = 0
+	}
+	limit, err := strconv.ParseInt(limitArg, 10, 32)
+	if err != nil {
+		limit = 0
+	}
+	return from, cursor, start, transLimit(int(limit))
+}
+
 /**
  * ListUserAcctTrans
  * -----------------
+ * Same as ListUserTrans for the transactions of the address or the user.
  */
 func (api *TudoNodeAPI) ListUserAcctTrans(ctx context.Context, address, userUuid,
-	fromArg, startArg, limitArg string) map[string]interface{} {
+	fromArg, startArg, limitArg string, filter *TransFilter) map[string]interface{} {
 
-	from, start, limit := parseFromStartLimitArg(fromArg, startArg, limitArg)
+	from, cursor, start, limit := parseTransArgs(fromArg, startArg, limitArg)
 	out := make(map[string]interface{})
 
+	ks := api.node.kstore.GetStorageIf()
+	scope := callerScope(ctx)
+	if err := scope.checkOwner(userUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if err := scope.checkAccount(ks, address); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	if !common.IsHexAddress(address) {
 		out["error"] = fmt.Sprintf("Invaid address %s", address)
 		return out
 	}
-	ks := api.node.kstore.GetStorageIf()
 	owner := uuid.Parse(userUuid)
-	acct := common.HexToAddress(address)
-	results, err := ks.GetTransaction(&acct, &owner, from, start, limit)
-
-	if err != nil {
-		out["error"] = err.Error()
-	} else {
-		api.getDetailTx(ctx, out, results)
+	if owner == nil {
+		out["error"] = fmt.Sprintf("Invalid user uuid %s", userUuid)
+		return out
 	}
+	acct := common.HexToAddress(address)
+	q := &kstore.TransQuery{Account: &acct, Owner: owner, From: from, Offset: start}
+	api.listTrans(ctx, out, q, filter, cursor, limit)
 	return out
 }
 
+// listAcctTrans appends the details of the latest mined transactions.
 func (api *TudoNodeAPI) listAcctTrans(ctx context.Context, address *common.Address,
 	start, limit int, txOut *[]*RPCTransaction, blkOut *[]map[string]interface{}) {
 
-	ks := api.node.kstore.GetStorageIf()
-	results, err := ks.GetTransaction(address, nil, nil, start, limit)
+	q := &kstore.TransQuery{Account: address, Offset: start}
+	page, err := api.node.listTransPage(q, nil, "", limit)
 	if err == nil {
-		txD, blk := api.getDetailTx(ctx, nil, results)
+		txD, blk := api.getDetailTx(ctx, nil, page.Mined)
 		*txOut = append(*txOut, txD...)
 		*blkOut = append(*blkOut, blk...)
 	}
@@ -315,6 +963,14 @@ func listAccoutInternal(api *TudoNodeAPI, ctx context.Context, latest, txs bool,
 	txOut := make([]*RPCTransaction, 0)
 	blkOut := make([]map[string]interface{}, 0)
 
+	scope := callerScope(ctx)
+	for _, addr := range args {
+		if err := scope.checkAccount(api.node.GetStorage(), addr); err != nil {
+			out["error"] = err.Error()
+			return out
+		}
+	}
+
 	eth := api.node.GetEthereum()
 	ethApi := eth.ApiBackend
 	state, _, err := ethApi.StateAndHeaderByNumber(ctx, -1)
@@ -342,7 +998,9 @@ func listAccoutInternal(api *TudoNodeAPI, ctx context.Context, latest, txs bool,
 		out["transBlocks"] = blkOut
 	}
 	out["accounts"] = results
-	out["error"] = err
+	if err != nil {
+		out["error"] = err.Error()
+	}
 	return out
 }
 
@@ -385,7 +1043,9 @@ func (api *TudoNodeAPI) ListBlocks(ctx context.Context,
 		}
 	}
 	out["blocks"] = result
-	out["error"] = err
+	if err != nil {
+		out["error"] = err.Error()
+	}
 	return out
 }
 
@@ -486,8 +1146,11 @@ func (api *TudoNodeAPI) PayUserAccount(ctx context.Context, from, fromUuid, to,
 	weiAmount, text string) map[string]interface{} {
 
 	out := make(map[string]interface{})
+	if err := callerScope(ctx).checkOwner(fromUuid); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	ks := api.node.kstore.GetStorageIf()
-
 	fromAddr := common.HexToAddress(from)
 	fromAcct, err := ks.GetAccountOwner(fromAddr.Hex(), fromUuid)
 	if err != nil || fromAcct == nil ||
@@ -515,6 +1178,179 @@ func (api *TudoNodeAPI) PayUserAccount(ctx context.Context, from, fromUuid, to,
 	sendTx := txPool.NewSendTxArgs(fromAddr, &toAddr, &weiVal, nil, nil)
 
 	txHash, err := txPool.SendTransaction(ctx, sendTx)
+	if err != nil {
+		out["error"] = err.Error()
+		if pending, ok := err.(*kstore.ApprovalPendingError); ok &&
+			api.node.isAdminAcct(fromAddr) {
+			out["approvalId"] = pending.Id
+		}
+		if policy, ok := err.(*kstore.PolicyError); ok {
+			out["policyScope"] = policy.Scope
+			out["policyRule"] = policy.Rule
+		}
+	} else {
+		out["txHash"] = txHash.Hex()
+	}
+	return out
+}
+
+/**
+ * ListApprovals
+ * -------------
+ * List the admin transactions in the status, all of them if status is empty.
+ * Each request has the hashes an admin signs with personal_sign to vote on it.
+ */
+func (api *TudoNodeAPI) ListApprovals(ctx context.Context, status,
+	startArg, limitArg string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	_, start, limit := parseFromStartLimitArg("", startArg, limitArg)
+	reqs, err := api.node.GetStorage().ListApprovalReqs(status, start, limit)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	results := make([]map[string]interface{}, 0, len(reqs))
+	for idx := range reqs {
+		results = append(results, api.approvalInfo(&reqs[idx]))
+	}
+	out["requests"] = results
+	return out
+}
+
+func (api *TudoNodeAPI) approvalInfo(req *models.ApprovalRequest) map[string]interface{} {
+	info := map[string]interface{}{
+		"id":          req.Id,
+		"account":     req.Account,
+		"status":      req.Status,
+		"quorum":      req.Quorum,
+		"txHash":      req.TxHash,
+		"created":     req.Created,
+		"approveHash": kstore.ApprovalHash(req, true).Hex(),
+		"rejectHash":  kstore.ApprovalHash(req, false).Hex(),
+	}
+	if tx, _, err := kstore.DecodeApprovalTx(req); err == nil {
+		info["to"] = tx.To()
+		info["value"] = tx.Value().String()
+		info["nonce"] = tx.Nonce()
+	}
+	votes, _ := api.node.GetStorage().GetApprovals(req.Id)
+	voters := make([]map[string]interface{}, 0, len(votes))
+	for _, vote := range votes {
+		voters = append(voters, map[string]interface{}{
+			"approver": vote.Approver,
+			"approve":  vote.Approve,
+		})
+	}
+	info["votes"] = voters
+	return info
+}
+
+/**
+ * ApproveRequest
+ * --------------
+ * Record the admin's approval, the signature is over the request's approveHash.
+ * The transaction is sent once approved if the account is unlocked, otherwise
+ * with tudo_submitRequest.
+ */
+func (api *TudoNodeAPI) ApproveRequest(ctx context.Context,
+	idArg, approver, signature string) map[string]interface{} {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	out := api.voteRequest(idArg, approver, signature, true)
+	if req, ok := out["request"].(*models.ApprovalRequest); ok {
+		out["request"] = api.approvalInfo(req)
+		if req.Status == models.ApprovalApproved {
+			txHash, err := api.submitRequest(ctx, req, "")
+			if err != nil {
+				out["submitError"] = err.Error()
+			} else {
+				out["txHash"] = txHash.Hex()
+			}
+		}
+	}
+	return out
+}
+
+/**
+ * RejectRequest
+ * -------------
+ * Record the admin's rejection, the signature is over the request's rejectHash.
+ */
+func (api *TudoNodeAPI) RejectRequest(ctx context.Context, idArg, approver,
+	signature string) map[string]interface{} {
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	out := api.voteRequest(idArg, approver, signature, false)
+	if req, ok := out["request"].(*models.ApprovalRequest); ok {
+		out["request"] = api.approvalInfo(req)
+	}
+	return out
+}
+
+func (api *TudoNodeAPI) voteRequest(idArg, approver,
+	signature string, approve bool) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		out["error"] = fmt.Sprintf("Invalid request id %s", idArg)
+		return out
+	}
+	if !common.IsHexAddress(approver) {
+		out["error"] = fmt.Sprintf("Invaid address %s", approver)
+		return out
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		out["error"] = fmt.Sprintf("Invalid signature %s", signature)
+		return out
+	}
+	req, err := api.node.kstore.Approvals().Vote(id,
+		common.HexToAddress(approver), sig, approve)
+	if err != nil {
+		out["error"] = err.Error()
+	} else {
+		out["request"] = req
+	}
+	return out
+}
+
+/**
+ * SubmitRequest
+ * -------------
+ * Sign the approved transaction and send it.  An empty password means the admin
+ * account must be unlocked.
+ */
+func (api *TudoNodeAPI) SubmitRequest(ctx context.Context,
+	idArg, password string) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		out["error"] = fmt.Sprintf("Invalid request id %s", idArg)
+		return out
+	}
+	req, err := api.node.GetStorage().GetApprovalReq(id)
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	if req.Status != models.ApprovalApproved {
+		out["error"] = fmt.Sprintf("Request %d is %s", req.Id, req.Status)
+		return out
+	}
+	txHash, err := api.submitRequest(ctx, req, password)
 	if err != nil {
 		out["error"] = err.Error()
 	} else {
@@ -523,13 +1359,43 @@ func (api *TudoNodeAPI) PayUserAccount(ctx context.Context, from, fromUuid, to,
 	return out
 }
 
+func (api *TudoNodeAPI) submitRequest(ctx context.Context,
+	req *models.ApprovalRequest, password string) (common.Hash, error) {
+	tx, chainId, err := kstore.DecodeApprovalTx(req)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var signed *types.Transaction
+
+	ks := api.node.callerKStore(ctx)
+	acct := accounts.Account{Address: common.HexToAddress(req.Account)}
+	if password == "" {
+		signed, err = ks.SignTx(acct, tx, chainId)
+	} else {
+		signed, err = ks.SignTxWithPassphrase(acct, password, tx, chainId)
+	}
+	if err != nil {
+		return common.Hash{}, err
+	}
+	data, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return api.node.GetEthereum().TxPublicPoolApi.SendRawTransaction(ctx, data)
+}
+
 /**
  * DumpAccounts
  * ------------
+ * Admin only.
  */
 func (api *TudoNodeAPI) DumpAccounts(ctx context.Context) map[string]interface{} {
 	out := make(map[string]interface{})
 
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	eth := api.node.GetEthereum()
 	bc := eth.BlockChain()
 	latest := bc.CurrentBlock()
@@ -539,20 +1405,26 @@ func (api *TudoNodeAPI) DumpAccounts(ctx context.Context) map[string]interface{}
 		return out
 	}
 	stateDb, err := bc.StateAt(latest.Root())
-	accounts := stateDb.RawDump()
-
-	out["accounts"] = accounts.Accounts
-	out["error"] = err
+	if err != nil {
+		out["error"] = err.Error()
+		return out
+	}
+	out["accounts"] = stateDb.RawDump().Accounts
 	return out
 }
 
 /**
  * DumpTrans
  * ---------
+ * Admin only.
  */
 func (api *TudoNodeAPI) DumpTrans(ctx context.Context) map[string]interface{} {
 	out := make(map[string]interface{})
 
+	if err := callerScope(ctx).checkAdmin(); err != nil {
+		out["error"] = err.Error()
+		return out
+	}
 	eth := api.node.GetEthereum()
 	bc := eth.BlockChain()
 	latest := bc.CurrentBlock()
@@ -561,7 +1433,7 @@ func (api *TudoNodeAPI) DumpTrans(ctx context.Context) map[string]interface{} {
 		fmt.Printf("No block!")
 		return out
 	}
-	orm := api.node.GetOrm()
+	storage := api.node.GetStorage()
 	currNo := latest.Number().Uint64()
 	for i := uint64(0); i <= currNo; i++ {
 		block := bc.GetBlockByNumber(i)
@@ -574,7 +1446,7 @@ func (api *TudoNodeAPI) DumpTrans(ctx context.Context) map[string]interface{} {
 			continue
 		}
 		for _, tx := range txs {
-			LogTransaction(tx, orm)
+			LogTransaction(tx, storage)
 		}
 	}
 	return out
@@ -0,0 +1,80 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ethcore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestUpdateAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tudo := newTestNode(t, dir)
+
+	owner := uuid.NewRandom().String()
+	acct, _, err := tudo.kstore.NewAccountOwner(owner, "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	api := NewTudoNodeAPI(tudo)
+	ctx := context.Background()
+	address := acct.Address.Hex()
+
+	out := api.UpdateAccount(ctx, address, "b", "pass", "normal", "bogus", "")
+	if out["error"] == nil || out["ownerUuid"] != nil {
+		t.Errorf("update with a bad owner %v", out)
+	}
+	rows, err := tudo.GetStorage().GetAccount(acct.Address)
+	if err != nil || rows[0].OwnerUuid != owner || rows[0].PublicName != "a" {
+		t.Errorf("account after a bad update %+v: %v", rows, err)
+	}
+	out = api.UpdateAccount(ctx, address, "b", "pass", "normal", owner, "")
+	if out["error"] != nil || out["ownerUuid"] != owner {
+		t.Errorf("update %v", out)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tudo := newTestNode(t, dir)
+
+	owner := uuid.NewRandom().String()
+	acct, _, err := tudo.kstore.NewAccountOwner(owner, "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	api := NewTudoNodeAPI(tudo)
+	ctx := context.Background()
+	address := acct.Address.Hex()
+
+	out := api.ChangePassphrase(ctx, address, uuid.NewRandom().String(), "pass", "new")
+	if out["error"] == nil {
+		t.Errorf("passphrase changed for another owner")
+	}
+	if out = api.ChangePassphrase(ctx, address, owner, "wrong", "new"); out["error"] == nil {
+		t.Errorf("passphrase changed with a wrong one")
+	}
+	if out = api.ChangePassphrase(ctx, address, owner, "pass", "new"); out["error"] != nil {
+		t.Fatalf("change failed: %v", out["error"])
+	}
+	if err = tudo.kstore.Unlock(*acct, "new"); err != nil {
+		t.Errorf("new passphrase doesn't unlock: %v", err)
+	}
+}
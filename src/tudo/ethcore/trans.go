@@ -8,14 +8,250 @@
 package ethcore
 
 import (
+	"encoding/base64"
+	"fmt"
 	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/astaxie/beego/orm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth"
+	"tudo/kstore"
 	"tudo/models"
 )
 
-func LogTransaction(tx *types.Transaction, orm orm.Ormer) error {
+// Rows of a transaction listing page, by default and at most.
+const (
+	defaultTransLimit = 100
+	maxTransLimit     = 500
+)
+
+// Unmined transactions of the caller looked up in the chain before a listing.
+const pendingScanLimit = 1000
+
+// Orders of the transaction listings.
+const (
+	transNewest = "newest"
+	transOldest = "oldest"
+)
+
+/**
+ * Filters of the transaction listings.  Peer is the account on the other side.
+ * The amounts are in wei, decimal or 0x hex, and compared in xu, the unit the
+ * transactions are recorded in.  Since and Until are unix seconds of the time
+ * the transaction was sent, Since included, Until excluded.  Order is "newest",
+ * the default, or "oldest".
+ */
+type TransFilter struct {
+	Peer      string `json:"peer,omitempty"`
+	MinAmount string `json:"minAmount,omitempty"`
+	MaxAmount string `json:"maxAmount,omitempty"`
+	Since     int64  `json:"since,omitempty"`
+	Until     int64  `json:"until,omitempty"`
+	Order     string `json:"order,omitempty"`
+}
+
+/**
+ * A page of a transaction listing.  The mined transactions come by block number
+ * and index in the block, NextCursor is empty on the last page.  The ones not in
+ * a block yet are only given with the first page.
+ */
+type transPage struct {
+	Mined      []models.Transaction
+	Pending    []models.Transaction
+	NextCursor string
+}
+
+func transLimit(limit int) int {
+	if limit <= 0 {
+		return defaultTransLimit
+	}
+	if limit > maxTransLimit {
+		return maxTransLimit
+	}
+	return limit
+}
+
+func parseWei(kind, amount string) (*big.Int, error) {
+	wei, ok := new(big.Int).SetString(amount, 0)
+	if !ok || wei.Sign() < 0 {
+		return nil, invalidParams("Invalid %s amount %s", kind, amount)
+	}
+	return wei, nil
+}
+
+// applyFilter rounds the amounts in so no transaction in the range is left out.
+func (f *TransFilter) applyFilter(q *kstore.TransQuery) error {
+	if f.Peer != "" {
+		peer, err := parseAddress(f.Peer)
+		if err != nil {
+			return err
+		}
+		q.Peer = &peer
+	}
+	if f.MinAmount != "" {
+		wei, err := parseWei("min", f.MinAmount)
+		if err != nil {
+			return err
+		}
+		xu, rem := new(big.Int).DivMod(wei, models.XU_UNIT, new(big.Int))
+		if rem.Sign() != 0 {
+			xu.Add(xu, common.Big1)
+		}
+		min := xu.Uint64()
+		q.MinXu = &min
+	}
+	if f.MaxAmount != "" {
+		wei, err := parseWei("max", f.MaxAmount)
+		if err != nil {
+			return err
+		}
+		max := new(big.Int).Div(wei, models.XU_UNIT).Uint64()
+		q.MaxXu = &max
+	}
+	if f.Since < 0 || f.Until < 0 || (f.Until != 0 && f.Until <= f.Since) {
+		return invalidParams("Invalid date range %d - %d", f.Since, f.Until)
+	}
+	if f.Since != 0 {
+		q.Since = time.Unix(f.Since, 0)
+	}
+	if f.Until != 0 {
+		q.Until = time.Unix(f.Until, 0)
+	}
+	switch f.Order {
+	case "", transNewest:
+	case transOldest:
+		q.Oldest = true
+	default:
+		return invalidParams("Invalid order %s", f.Order)
+	}
+	return nil
+}
+
+/**
+ * The cursors are opaque to the callers: the order and the position of the last
+ * transaction of the page.
+ */
+func encodeTransCursor(oldest bool, t *models.Transaction) string {
+	order := transNewest
+	if oldest {
+		order = transOldest
+	}
+	cursor := fmt.Sprintf("%s:%d:%d:%s", order, t.BlockNumber, t.TxIndex, t.TxHash)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func decodeTransCursor(oldest bool, cursor string) (*kstore.TransCursor, error) {
+	order := transNewest
+	if oldest {
+		order = transOldest
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	fields := strings.Split(string(raw), ":")
+	if err != nil || len(fields) != 4 || fields[0] != order {
+		return nil, invalidParams("Invalid cursor %s for the %s order", cursor, order)
+	}
+	block, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || block <= 0 {
+		return nil, invalidParams("Invalid cursor %s", cursor)
+	}
+	index, err := strconv.ParseInt(fields[2], 10, 32)
+	if err != nil || index < 0 {
+		return nil, invalidParams("Invalid cursor %s", cursor)
+	}
+	return &kstore.TransCursor{
+		BlockNumber: block,
+		TxIndex:     int(index),
+		TxHash:      fields[3],
+	}, nil
+}
+
+func (n *TudoNode) hasEthereum() bool {
+	return n.GetService(reflect.TypeOf((*eth.Ethereum)(nil))) != nil
+}
+
+/**
+ * syncTransBlocks
+ * ---------------
+ * The transactions are recorded when sent, look up the block of the ones the
+ * query would select that weren't mined yet.  Nothing to do without a chain.
+ */
+func (n *TudoNode) syncTransBlocks(q kstore.TransQuery) {
+	if !n.hasEthereum() {
+		return
+	}
+	q.Pending, q.After, q.Offset, q.Limit = true, nil, 0, pendingScanLimit
+	storage := n.GetStorage()
+	pending, err := storage.ListTransactions(&q)
+	if err != nil {
+		return
+	}
+	chainDb := n.GetEthereum().ChainDb()
+	for _, t := range pending {
+		tx, _, blockNo, index := core.GetTransaction(chainDb, common.HexToHash(t.TxHash))
+		if tx == nil {
+			continue
+		}
+		err = storage.SetTransBlock(t.TxHash, int64(blockNo), int(index))
+		if err != nil {
+			fmt.Printf("Failed to record the block of tx %s: %v\n", t.TxHash, err)
+		}
+	}
+}
+
+/**
+ * listTransPage
+ * -------------
+ * List a page of the transactions selected by the query, after the cursor when
+ * given, else after q.Offset rows.
+ */
+func (n *TudoNode) listTransPage(q *kstore.TransQuery, filter *TransFilter,
+	cursor string, limit int) (*transPage, error) {
+	if filter != nil {
+		if err := filter.applyFilter(q); err != nil {
+			return nil, err
+		}
+	}
+	if cursor != "" {
+		after, err := decodeTransCursor(q.Oldest, cursor)
+		if err != nil {
+			return nil, err
+		}
+		q.After, q.Offset = after, 0
+	}
+	n.syncTransBlocks(*q)
+
+	storage := n.GetStorage()
+	page := &transPage{Pending: []models.Transaction{}}
+	if q.After == nil && q.Offset == 0 {
+		pending := *q
+		pending.Pending, pending.Limit = true, maxTransLimit
+		rows, err := storage.ListTransactions(&pending)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		page.Pending = rows
+	}
+	// One more row tells if there's a next page.
+	limit = transLimit(limit)
+	q.Limit = limit + 1
+	rows, err := storage.ListTransactions(q)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		page.NextCursor = encodeTransCursor(q.Oldest, &rows[limit-1])
+	}
+	page.Mined = rows
+	return page, nil
+}
+
+func LogTransaction(tx *types.Transaction, storage kstore.KsInterface) error {
 	var signer types.Signer = types.FrontierSigner{}
 	if tx.Protected() {
 		signer = types.NewEIP155Signer(tx.ChainId())
@@ -30,6 +266,5 @@ func LogTransaction(tx *types.Transaction, orm orm.Ormer) error {
 		ToAcct:   tx.To().Hex(),
 		XuAmount: (new(big.Int).Div(value, models.XU_UNIT)).Uint64(),
 	}
-	_, err := orm.Insert(txLog)
-	return err
+	return storage.StoreTransaction(txLog)
 }
@@ -27,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"gopkg.in/urfave/cli.v1"
+	"tudo/ethcore"
 )
 
 var (
@@ -188,6 +189,51 @@ this import mechanism is not needed when you transfer an account between
 nodes.
 `,
 			},
+			{
+				Name:  "mnemonic",
+				Usage: "Export or restore the mnemonic of an owner's HD wallet",
+				Subcommands: []cli.Command{
+					{
+						Name:      "export",
+						Usage:     "Print the mnemonic of the owner's HD wallet",
+						Action:    utils.MigrateFlags(accountMnemonicExport),
+						ArgsUsage: "<ownerUuid>",
+						Flags: []cli.Flag{
+							utils.DataDirFlag,
+							utils.KeyStoreDirFlag,
+							utils.PasswordFileFlag,
+						},
+						Description: `
+    tudo-geth account mnemonic export <ownerUuid>
+
+Prints the BIP39 mnemonic of the owner's HD wallet.  You are prompted for the
+wallet passphrase.  Anyone with the mnemonic can spend from all the accounts of
+the wallet, keep it offline.
+`,
+					},
+					{
+						Name:      "restore",
+						Usage:     "Rebuild the owner's HD wallet from its mnemonic",
+						Action:    utils.MigrateFlags(accountMnemonicRestore),
+						ArgsUsage: "<ownerUuid>",
+						Flags: []cli.Flag{
+							utils.DataDirFlag,
+							utils.KeyStoreDirFlag,
+							utils.PasswordFileFlag,
+							utils.LightKDFFlag,
+						},
+						Description: `
+    tudo-geth account mnemonic restore <ownerUuid>
+
+You are prompted for the mnemonic and the wallet passphrase.  The seed is
+stored again if it was lost, then the accounts along m/44'/60'/0'/0/n are
+derived and stored with their account records, up to the first account with
+no transaction and no balance in the local chain data.  Run it with the node
+stopped, after the chain is synced.
+`,
+					},
+				},
+			},
 		},
 	}
 )
@@ -377,3 +423,50 @@ func accountImport(ctx *cli.Context) error {
 	fmt.Printf("Address: {%x}\n", acct.Address)
 	return nil
 }
+
+// accountMnemonicExport prints the mnemonic of the owner's HD wallet.
+func accountMnemonicExport(ctx *cli.Context) error {
+	owner := ctx.Args().First()
+	if len(owner) == 0 {
+		utils.Fatalf("owner uuid must be given as argument")
+	}
+	stack, _ := makeConfigNode(ctx)
+	ks := getKStore(stack)
+
+	passphrase := getPassPhrase("", false, 0, utils.MakePasswordList(ctx))
+	mnemonic, err := ks.ExportMnemonic(owner, passphrase)
+	if err != nil {
+		utils.Fatalf("Could not export the mnemonic: %v", err)
+	}
+	fmt.Println(mnemonic)
+	return nil
+}
+
+// accountMnemonicRestore rebuilds the owner's HD wallet from the mnemonic,
+// deriving the accounts with activity in the local chain.
+func accountMnemonicRestore(ctx *cli.Context) error {
+	owner := ctx.Args().First()
+	if len(owner) == 0 {
+		utils.Fatalf("owner uuid must be given as argument")
+	}
+	stack, _ := makeConfigNode(ctx)
+	ks := getKStore(stack)
+
+	mnemonic, err := console.Stdin.PromptPassword("Mnemonic: ")
+	if err != nil {
+		utils.Fatalf("Failed to read mnemonic: %v", err)
+	}
+	passphrase := getPassPhrase("The restored accounts are locked with the wallet password.", true, 0, utils.MakePasswordList(ctx))
+
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	accts, err := ks.RestoreWallet(owner, mnemonic, passphrase, ethcore.NewBlockChainState(chain))
+	for index, acct := range accts {
+		fmt.Printf("Account #%d: {%x} %s\n", index, acct.Address, &acct.URL)
+	}
+	if err != nil {
+		utils.Fatalf("Could not restore the wallet: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ether
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"gopkg.in/urfave/cli.v1"
+	"tudo/kstore"
+)
+
+var (
+	auditCommand = cli.Command{
+		Name:     "audit",
+		Usage:    "Check the keystore audit log",
+		Category: "ACCOUNT COMMANDS",
+		Description: `
+
+Every key operation on the SQL keystore (sign, unlock, delete, export, import and
+new account) is appended to the audit_record table.  Each record holds the hash of
+the one before, so a changed, removed or reordered record breaks the chain.  The
+hashes are keyed by the master key, verifying them needs the master key versions
+of the records.`,
+		Subcommands: []cli.Command{
+			{
+				Name:   "verify",
+				Usage:  "Re-check the hash chain of the audit log",
+				Action: utils.MigrateFlags(auditVerify),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					kstoreBatchFlag,
+				},
+				Description: `
+    tudo-geth audit verify [--batch 100]
+
+Reads the audit log from the first record, recomputes each record's hash and
+checks it links to the record before.  The last record must match the audit
+head.  Reports the first record failing the check.`,
+			},
+		},
+	}
+)
+
+func auditVerify(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	storage := getKStore(stack).GetStorageIf()
+
+	count, err := kstore.VerifyAudit(storage, ctx.Int(kstoreBatchFlag.Name))
+	if err != nil {
+		utils.Fatalf("Audit log verification failed after %d records: %v", count, err)
+	}
+	fmt.Printf("Verified %d audit records\n", count)
+	return nil
+}
@@ -139,7 +139,8 @@ func defaultNodeConfig() node.Config {
 	return cfg
 }
 
-func makeConfigNode(ctx *cli.Context) (*node.Node, gethConfig) {
+// makeConfig loads the defaults, the config file and the node flags.
+func makeConfig(ctx *cli.Context) gethConfig {
 	// Load defaults.
 	cfg := gethConfig{
 		Eth:       eth.DefaultConfig,
@@ -157,6 +158,11 @@ func makeConfigNode(ctx *cli.Context) (*node.Node, gethConfig) {
 
 	// Apply flags.
 	utils.SetNodeConfig(ctx, &cfg.Node)
+	return cfg
+}
+
+func makeConfigNode(ctx *cli.Context) (*node.Node, gethConfig) {
+	cfg := makeConfig(ctx)
 	stack, err := ethcore.NewTudoNode(&cfg.Node, &cfg.TudoConfig)
 	if err != nil {
 		utils.Fatalf("Failed to create the protocol stack: %v", err)
@@ -0,0 +1,171 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ether
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"gopkg.in/urfave/cli.v1"
+	"tudo/ethcore"
+	"tudo/models"
+)
+
+var (
+	dbTargetFlag = cli.IntFlag{
+		Name:  "to",
+		Usage: "Schema version to migrate or roll back to",
+		Value: -1,
+	}
+	dbCommand = cli.Command{
+		Name:     "db",
+		Usage:    "Manage the schema of the keystore database",
+		Category: "ACCOUNT COMMANDS",
+		Description: `
+
+The keystore tables are changed by versioned migrations, recorded in the
+schema_version table.  A node makes the tables of an empty database, but refuses
+to start on a database with migrations to apply or made by a newer release.`,
+		Subcommands: []cli.Command{
+			{
+				Name:   "migrate",
+				Usage:  "Apply the schema migrations",
+				Action: utils.MigrateFlags(dbMigrate),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					dbTargetFlag,
+				},
+				Description: `
+    tudo-geth db migrate [--to version]
+
+Applies the migrations up to the given version, the latest by default.  Run it
+from one node after installing the new release, before starting the nodes.  On a
+database made by a release without schema versions, the migrations whose tables
+and columns are there already are recorded as adopted, the others are applied.`,
+			},
+			{
+				Name:   "status",
+				Usage:  "Show the applied and pending schema migrations",
+				Action: utils.MigrateFlags(dbStatus),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+				},
+			},
+			{
+				Name:   "rollback",
+				Usage:  "Undo schema migrations",
+				Action: utils.MigrateFlags(dbRollback),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					dbTargetFlag,
+				},
+				Description: `
+    tudo-geth db rollback [--to version]
+
+Undoes the migrations above the given version, the last one by default, to go
+back to an older release.  Columns added by the undone migrations are lost.  The
+baseline can't be rolled back.`,
+			},
+		},
+	}
+)
+
+// openDatabase registers the keystore database without checking its schema.
+func openDatabase(ctx *cli.Context) {
+	cfg := makeConfig(ctx)
+	_, _, keydir, err := cfg.Node.AccountConfig()
+	if err != nil {
+		utils.Fatalf("Failed to read the account config: %v", err)
+	}
+	tdcfg := &cfg.TudoConfig
+	if tdcfg.KsBackend == models.MemoryBackend {
+		utils.Fatalf("The memory keystore has no database")
+	}
+	err = models.OpenDatabase(tdcfg.KsBackend, ethcore.KsDataSource(&cfg.Node, tdcfg, keydir))
+	if err != nil {
+		utils.Fatalf("Failed to open the keystore database: %v", err)
+	}
+}
+
+func dbMigrate(ctx *cli.Context) error {
+	openDatabase(ctx)
+
+	target := ctx.Int(dbTargetFlag.Name)
+	if target < 0 {
+		target = models.LatestVersion()
+	}
+	done, err := models.Migrate(target)
+	for _, mig := range done {
+		fmt.Printf("Applied %d: %s\n", mig.Version, mig.Name)
+	}
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	version, _ := models.SchemaVersion()
+	fmt.Printf("Schema version %d\n", version)
+	return nil
+}
+
+func dbStatus(ctx *cli.Context) error {
+	openDatabase(ctx)
+
+	version, err := models.SchemaVersion()
+	if err != nil {
+		utils.Fatalf("Failed to read the schema version: %v", err)
+	}
+	history, err := models.SchemaHistory()
+	if err != nil {
+		utils.Fatalf("Failed to read the schema versions: %v", err)
+	}
+	applied := make(map[int]models.AppliedMigration)
+	for _, rec := range history {
+		applied[rec.Version] = rec
+	}
+	for _, mig := range models.Migrations {
+		status := "pending"
+		if rec, ok := applied[mig.Version]; ok {
+			status = "applied " + rec.Applied
+		} else if mig.Version <= version {
+			status = "applied"
+		}
+		fmt.Printf("%4d  %-32s %s\n", mig.Version, mig.Name, status)
+	}
+	for _, rec := range history {
+		if rec.Version > models.LatestVersion() {
+			fmt.Printf("%4d  %-32s unknown, applied %s\n", rec.Version, rec.Name, rec.Applied)
+		}
+	}
+	fmt.Printf("Schema version %d, this release %d\n", version, models.LatestVersion())
+	return nil
+}
+
+func dbRollback(ctx *cli.Context) error {
+	openDatabase(ctx)
+
+	version, err := models.SchemaVersion()
+	if err != nil {
+		utils.Fatalf("Failed to read the schema version: %v", err)
+	}
+	target := ctx.Int(dbTargetFlag.Name)
+	if target < 0 {
+		target = version - 1
+	}
+	done, err := models.Rollback(target)
+	for _, mig := range done {
+		fmt.Printf("Rolled back %d: %s\n", mig.Version, mig.Name)
+	}
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	version, _ = models.SchemaVersion()
+	fmt.Printf("Schema version %d\n", version)
+	return nil
+}
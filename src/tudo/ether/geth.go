@@ -166,6 +166,12 @@ func init() {
 		// See accountcmd.go:
 		accountCommand,
 		walletCommand,
+		// See kstorecmd.go:
+		kstoreCommand,
+		// See auditcmd.go:
+		auditCommand,
+		// See dbcmd.go:
+		dbCommand,
 		// See consolecmd.go:
 		consoleCommand,
 		attachCommand,
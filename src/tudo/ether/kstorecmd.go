@@ -0,0 +1,313 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package ether
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/node"
+	"gopkg.in/urfave/cli.v1"
+	"tudo/ethcore"
+	"tudo/kstore"
+)
+
+var (
+	kstoreBatchFlag = cli.IntFlag{
+		Name:  "batch",
+		Value: 100,
+		Usage: "Number of account_key rows read per query",
+	}
+	kstoreReplaceFlag = cli.BoolFlag{
+		Name:  "replace",
+		Usage: "Overwrite stored rows differing from the backup",
+	}
+	kstoreRepairFlag = cli.BoolFlag{
+		Name:  "repair",
+		Usage: "Fix the issues found",
+	}
+	kstoreCommand = cli.Command{
+		Name:     "kstore",
+		Usage:    "Manage the SQL keystore",
+		Category: "ACCOUNT COMMANDS",
+		Description: `
+
+Maintenance commands for the SQL keystore holding the custodial account keys.`,
+		Subcommands: []cli.Command{
+			{
+				Name:   "migrate-keys",
+				Usage:  "Encrypt plain text keys stored in the account_key table",
+				Action: utils.MigrateFlags(kstoreMigrateKeys),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					utils.LightKDFFlag,
+				},
+				Description: `
+    tudo-geth kstore migrate-keys
+
+Converts every account_key row still holding a hex private key and a clear text
+passphrase into the Web3 Secret Storage format, encrypted with that passphrase.
+The clear text passphrase is removed from the row.  Rows already encrypted are
+left untouched, so the command is safe to run more than once.`,
+			},
+			{
+				Name:   "rotate-master",
+				Usage:  "Wrap the stored keys with the current master key",
+				Action: utils.MigrateFlags(kstoreRotateMaster),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					kstoreBatchFlag,
+				},
+				Description: `
+    tudo-geth kstore rotate-master [--batch 100]
+
+Re-wraps every account_key row sealed with an older master key version, or not
+wrapped yet, with the highest version in the master key file (KsMasterKeyFile or
+the TUDO_KS_MASTER_KEY environment variable).  Rows are rewritten one at a time
+in batches, nodes sharing the database keep serving while it runs.
+
+To rotate, add the new version to the key file of every node, keeping the old
+one, and run this command.  Nodes read the key file again when they find a row
+with an unknown version.  Drop the old version once the command reports no more
+rows to wrap.  Legacy plain text rows are wrapped by migrate-keys.`,
+			},
+			{
+				Name:   "purge",
+				Usage:  "Remove the accounts deleted before the retention period",
+				Action: utils.MigrateFlags(kstorePurge),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					kstoreBatchFlag,
+				},
+				Description: `
+    tudo-geth kstore purge [--batch 100]
+
+Deleting an account only archives its account and account_key rows, it can be
+restored with tudo_restoreAccount for KsRetentionDays.  This command removes the
+rows of the accounts deleted before that for good.  A single deleted account can
+be purged earlier by an admin with tudo_purgeAccount.`,
+			},
+			{
+				Name:   "fsck",
+				Usage:  "Check the account and account_key tables agree",
+				Action: utils.MigrateFlags(kstoreFsck),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					kstoreBatchFlag,
+					kstoreRepairFlag,
+				},
+				Description: `
+    tudo-geth kstore fsck [--repair] [--batch 100]
+
+Reports the keys without an account row, the account rows without a key, owner
+uuids or deletion states differing between the two tables, and keys not matching
+their address.  Keys are checked against the address of their V3 JSON, the
+passphrase isn't known.  Running nodes can be checked with tudo_fsck, which also
+compares their cached wallets with the database.
+
+With --repair, the account rows are rewritten to agree with the account_key rows,
+and account rows without a key are archived.  Bad keys are only reported.  The
+command exits with status 1 when it finds issues without --repair.`,
+			},
+			{
+				Name:      "backup",
+				Usage:     "Write an encrypted backup of the keystore tables",
+				Action:    utils.MigrateFlags(kstoreBackup),
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					utils.PasswordFileFlag,
+					kstoreBatchFlag,
+				},
+				Description: `
+    tudo-geth kstore backup [--password file] [--batch 100] <file>
+
+Writes the account, account_key and wallet_seed rows, archived ones included, to
+a new file encrypted with the given passphrase (aes-256-gcm with a scrypt key).
+Keys wrapped with the master key stay wrapped, restoring them needs the same
+master key versions.  The file is created with mode 0600 and never overwritten.`,
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore the keystore tables from a backup",
+				Action:    utils.MigrateFlags(kstoreRestore),
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.KeyStoreDirFlag,
+					utils.PasswordFileFlag,
+					kstoreReplaceFlag,
+				},
+				Description: `
+    tudo-geth kstore restore [--password file] [--replace] <file>
+
+Verifies and decrypts the backup, then adds its rows missing from the database.
+Rows stored with a different content are kept and listed as conflicts by address
+(owner uuid for wallet seeds), or overwritten with --replace.  Rows not in the
+backup are left alone.  Nothing is written if the backup fails to verify or
+holds keys wrapped with a master key version this node doesn't have.`,
+			},
+		},
+	}
+)
+
+// getKStore returns the SQL keystore registered with the node's account manager.
+func getKStore(stack *node.Node) kstore.KStoreIface {
+	am, ok := stack.AccountManager().(ethcore.AmInterface)
+	if !ok {
+		utils.Fatalf("Account manager has no SQL keystore")
+	}
+	ks, ok := am.DefaultKeyStore().(kstore.KStoreIface)
+	if !ok {
+		utils.Fatalf("Account manager has no SQL keystore")
+	}
+	return ks
+}
+
+func kstoreMigrateKeys(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	ks := getKStore(stack)
+
+	count, err := ks.GetStorageIf().MigratePlainKeys()
+	fmt.Printf("Encrypted %d plain text keys\n", count)
+	if err != nil {
+		utils.Fatalf("Failed to migrate keys: %v", err)
+	}
+	return nil
+}
+
+func kstoreRotateMaster(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	storage := getKStore(stack).GetStorageIf()
+
+	version := storage.MasterKeys().Current()
+	if version == 0 {
+		utils.Fatalf("No master key configured")
+	}
+	count, err := storage.RewrapKeys(ctx.Int(kstoreBatchFlag.Name))
+	fmt.Printf("Wrapped %d keys with master key version %d\n", count, version)
+	if err != nil {
+		utils.Fatalf("Failed to rotate the master key: %v", err)
+	}
+	return nil
+}
+
+func kstorePurge(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	ks := getKStore(stack)
+
+	count, err := ks.PurgeExpired(ctx.Int(kstoreBatchFlag.Name))
+	fmt.Printf("Purged %d accounts deleted more than %v ago\n", count, ks.Retention())
+	if err != nil {
+		utils.Fatalf("Failed to purge deleted accounts: %v", err)
+	}
+	return nil
+}
+
+func kstoreBackup(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("The backup file is required")
+	}
+	stack, _ := makeConfigNode(ctx)
+	storage := getKStore(stack).GetStorageIf()
+
+	backup, err := kstore.NewBackup(storage, ctx.Int(kstoreBatchFlag.Name))
+	if err != nil {
+		utils.Fatalf("Failed to read the keystore: %v", err)
+	}
+	auth := getPassPhrase("Please give a password for the backup. Do not forget this password.",
+		true, 0, utils.MakePasswordList(ctx))
+
+	file := ctx.Args().First()
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		utils.Fatalf("Failed to create the backup: %v", err)
+	}
+	scryptN, scryptP := storage.ScryptParams()
+	if err = backup.Write(out, auth, scryptN, scryptP); err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(file)
+		utils.Fatalf("Failed to write the backup: %v", err)
+	}
+	fmt.Printf("Saved %d accounts, %d keys and %d wallet seeds to %s\n",
+		len(backup.Accounts), len(backup.Keys), len(backup.Seeds), file)
+	return nil
+}
+
+func kstoreRestore(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("The backup file is required")
+	}
+	stack, _ := makeConfigNode(ctx)
+	storage := getKStore(stack).GetStorageIf()
+
+	in, err := os.Open(ctx.Args().First())
+	if err != nil {
+		utils.Fatalf("Failed to open the backup: %v", err)
+	}
+	defer in.Close()
+
+	auth := getPassPhrase("Please give the password of the backup.",
+		false, 0, utils.MakePasswordList(ctx))
+	backup, err := kstore.ReadBackup(in, auth)
+	if err != nil {
+		utils.Fatalf("Failed to read the backup: %v", err)
+	}
+	report, err := backup.Restore(storage, ctx.Bool(kstoreReplaceFlag.Name))
+	if report != nil {
+		for _, conflict := range report.Conflicts {
+			fmt.Printf("Conflict: %s\n", conflict)
+		}
+		fmt.Printf("Added %d rows, %d unchanged, %d replaced, %d conflicts\n",
+			report.Added, report.Same, report.Replaced,
+			len(report.Conflicts)-report.Replaced)
+	}
+	if err != nil {
+		utils.Fatalf("Failed to restore the backup: %v", err)
+	}
+	return nil
+}
+
+func kstoreFsck(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	ks := getKStore(stack)
+
+	repair := ctx.Bool(kstoreRepairFlag.Name)
+	report, err := ks.Fsck(repair, ctx.Int(kstoreBatchFlag.Name))
+	if err != nil {
+		utils.Fatalf("Failed to check the keystore: %v", err)
+	}
+	repaired := 0
+	for _, issue := range report.Issues {
+		status := ""
+		if issue.Repaired {
+			status = " (repaired)"
+			repaired++
+		}
+		fmt.Printf("%s %s: %s%s\n", issue.Kind, issue.Account, issue.Detail, status)
+	}
+	fmt.Printf("Checked %d accounts and %d keys, %d issues, %d repaired\n",
+		report.Accounts, report.Keys, len(report.Issues), repaired)
+	if len(report.Unverified) > 0 {
+		fmt.Printf("%d encrypted keys unverified, only the address of their "+
+			"JSON was checked\n", len(report.Unverified))
+	}
+	if !repair && len(report.Issues) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
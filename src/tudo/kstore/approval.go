@@ -0,0 +1,373 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"tudo/models"
+)
+
+/**
+ * M-of-N approval of the transactions sent from admin accounts.  SignTx stores
+ * a pending request for the transaction and refuses to sign it until a quorum of
+ * the other admins have approved the request.  Each vote is signed by the admin
+ * over the request's approve or reject hash, in personal_sign format.
+ */
+type Approvals struct {
+	storage KsInterface
+	admins  map[common.Address]bool
+	quorum  int
+}
+
+// Admin operations on an account, signed with AdminOpHash.  Fsck is signed for
+// the zero address.
+const (
+	AdminOpDelete     = "delete"
+	AdminOpPurge      = "purge"
+	AdminOpFsck       = "fsck"
+	AdminOpFsckRepair = "fsck-repair"
+)
+
+// A signed admin operation is refused once older than this.
+const adminOpWindow = 5 * time.Minute
+
+/**
+ * Error returned by SignTx for a transaction waiting for approval.
+ */
+type ApprovalPendingError struct {
+	Id      int64
+	Account string
+}
+
+func (e *ApprovalPendingError) Error() string {
+	return fmt.Sprintf("Transaction from admin account %s needs approval, request %d",
+		e.Account, e.Id)
+}
+
+/**
+ * NewApprovals
+ * ------------
+ * A zero quorum means a majority of the other admins.
+ */
+func NewApprovals(storage KsInterface, admins []common.Address, quorum int) *Approvals {
+	ap := &Approvals{
+		storage: storage,
+		admins:  make(map[common.Address]bool),
+		quorum:  quorum,
+	}
+	for _, addr := range admins {
+		ap.admins[addr] = true
+	}
+	return ap
+}
+
+/**
+ * IsAdmin
+ * -------
+ */
+func (ap *Approvals) IsAdmin(addr common.Address) bool {
+	return ap != nil && ap.admins[addr]
+}
+
+/**
+ * Quorum
+ * ------
+ * Return the number of approvals a transaction from the account needs, at most
+ * the number of other admins.  An admin with no peer signs without approval.
+ */
+func (ap *Approvals) Quorum(account common.Address) int {
+	others := ap.others(account)
+	quorum := ap.quorum
+	if quorum <= 0 {
+		quorum = others/2 + 1
+	}
+	if quorum > others {
+		quorum = others
+	}
+	return quorum
+}
+
+func (ap *Approvals) others(account common.Address) int {
+	if ap.admins[account] {
+		return len(ap.admins) - 1
+	}
+	return len(ap.admins)
+}
+
+/**
+ * checkTx
+ * -------
+ * Return the approved request for the transaction from an admin account, nil
+ * if it needs no approval.  The request is stored on first sight.
+ */
+func (ap *Approvals) checkTx(account common.Address, tx *types.Transaction,
+	chainId *big.Int) (*models.ApprovalRequest, error) {
+	if !ap.IsAdmin(account) {
+		return nil, nil
+	}
+	quorum := ap.Quorum(account)
+	if quorum == 0 {
+		return nil, nil
+	}
+	sigHash := txSigHash(tx, chainId).Hex()
+	req, err := ap.storage.GetApprovalReqByHash(account.Hex(), sigHash)
+	if err == ErrNoApproval {
+		req, err = ap.newRequest(account, tx, chainId, sigHash, quorum)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch req.Status {
+	case models.ApprovalApproved, models.ApprovalSigned:
+		return req, nil
+
+	case models.ApprovalRejected:
+		return nil, fmt.Errorf("Transaction request %d was rejected", req.Id)
+	}
+	return nil, &ApprovalPendingError{Id: req.Id, Account: req.Account}
+}
+
+func (ap *Approvals) newRequest(account common.Address, tx *types.Transaction,
+	chainId *big.Int, sigHash string, quorum int) (*models.ApprovalRequest, error) {
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return nil, err
+	}
+	req := &models.ApprovalRequest{
+		Account: account.Hex(),
+		SigHash: sigHash,
+		TxData:  hexutil.Encode(data),
+		Quorum:  quorum,
+		Status:  models.ApprovalPending,
+	}
+	if chainId != nil {
+		req.ChainId = chainId.String()
+	}
+	if err = ap.storage.StoreApprovalReq(req); err != nil {
+		// Another node may have stored it first.
+		if exist, err2 := ap.storage.GetApprovalReqByHash(req.Account,
+			sigHash); err2 == nil {
+			return exist, nil
+		}
+		return nil, err
+	}
+	fmt.Printf("Transaction from admin %s waits for approval, request %d\n",
+		req.Account, req.Id)
+	return req, nil
+}
+
+/**
+ * txSigned
+ * --------
+ * Record the hash of the signed transaction.
+ */
+func (ap *Approvals) txSigned(req *models.ApprovalRequest, tx *types.Transaction) {
+	if req.Status != models.ApprovalApproved {
+		return
+	}
+	req.Status = models.ApprovalSigned
+	req.TxHash = tx.Hash().Hex()
+	if _, err := ap.storage.UpdateApprovalReq(req, models.ApprovalApproved); err != nil {
+		fmt.Printf("Failed to update approval request %d: %v\n", req.Id, err)
+	}
+}
+
+/**
+ * Vote
+ * ----
+ * Record the admin's signed vote on the pending request.  The request is approved
+ * with a quorum of approvals, rejected once the quorum can't be reached.
+ */
+func (ap *Approvals) Vote(id int64, approver common.Address,
+	sig []byte, approve bool) (*models.ApprovalRequest, error) {
+	req, err := ap.storage.GetApprovalReq(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ap.IsAdmin(approver) {
+		return nil, fmt.Errorf("%s is not an admin account", approver.Hex())
+	}
+	if approver == common.HexToAddress(req.Account) {
+		return nil, fmt.Errorf("Admin %s can't vote on its own request", approver.Hex())
+	}
+	if req.Status != models.ApprovalPending {
+		return nil, fmt.Errorf("Request %d is %s", req.Id, req.Status)
+	}
+	signer, err := recoverVoter(ApprovalHash(req, approve), sig)
+	if err != nil {
+		return nil, err
+	}
+	if signer != approver {
+		return nil, fmt.Errorf("Signature is from %s, not %s", signer.Hex(), approver.Hex())
+	}
+	err = ap.storage.StoreApproval(&models.Approval{
+		RequestId: req.Id,
+		Approver:  approver.Hex(),
+		Approve:   approve,
+		Signature: hexutil.Encode(sig),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ap.tally(req)
+}
+
+func (ap *Approvals) tally(req *models.ApprovalRequest) (*models.ApprovalRequest, error) {
+	votes, err := ap.storage.GetApprovals(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	approved, rejected := 0, 0
+	for _, vote := range votes {
+		if !ap.IsAdmin(common.HexToAddress(vote.Approver)) {
+			continue
+		}
+		if vote.Approve {
+			approved++
+		} else {
+			rejected++
+		}
+	}
+	switch {
+	case approved >= req.Quorum:
+		req.Status = models.ApprovalApproved
+
+	case ap.others(common.HexToAddress(req.Account))-rejected < req.Quorum:
+		req.Status = models.ApprovalRejected
+
+	default:
+		return req, nil
+	}
+	if _, err = ap.storage.UpdateApprovalReq(req, models.ApprovalPending); err != nil {
+		return nil, err
+	}
+	return ap.storage.GetApprovalReq(req.Id)
+}
+
+/**
+ * CheckAdminOp
+ * ------------
+ * Verify the admin signed the operation on the account, stamped with the unix
+ * time of the request.  Stale requests are refused so a signature can't be
+ * replayed later.
+ */
+func (ap *Approvals) CheckAdminOp(op string, account, admin common.Address,
+	stamp int64, sig []byte) error {
+	return ap.CheckAdminSig(AdminOpHash(op, account, stamp), admin, stamp, sig)
+}
+
+/**
+ * CheckAdminSig
+ * -------------
+ * Verify the admin signed the hash of a request stamped with the unix time.
+ */
+func (ap *Approvals) CheckAdminSig(hash common.Hash, admin common.Address,
+	stamp int64, sig []byte) error {
+	if !ap.IsAdmin(admin) {
+		return fmt.Errorf("%s is not an admin account", admin.Hex())
+	}
+	age := time.Since(time.Unix(stamp, 0))
+	if age > adminOpWindow || age < -adminOpWindow {
+		return fmt.Errorf("Admin request time %d is not current", stamp)
+	}
+	signer, err := recoverVoter(hash, sig)
+	if err != nil {
+		return err
+	}
+	if signer != admin {
+		return fmt.Errorf("Signature is from %s, not %s", signer.Hex(), admin.Hex())
+	}
+	return nil
+}
+
+/**
+ * AdminOpHash
+ * -----------
+ * Hash the admin signs with personal_sign to run the operation on the account.
+ */
+func AdminOpHash(op string, account common.Address, stamp int64) common.Hash {
+	var ts [8]byte
+
+	binary.BigEndian.PutUint64(ts[:], uint64(stamp))
+	return crypto.Keccak256Hash([]byte("tudo-"+op), account.Bytes(), ts[:])
+}
+
+/**
+ * ApprovalHash
+ * ------------
+ * Hash the admin signs to approve or reject the request.
+ */
+func ApprovalHash(req *models.ApprovalRequest, approve bool) common.Hash {
+	var id [8]byte
+
+	prefix := "tudo-reject"
+	if approve {
+		prefix = "tudo-approve"
+	}
+	binary.BigEndian.PutUint64(id[:], uint64(req.Id))
+	return crypto.Keccak256Hash([]byte(prefix), id[:],
+		common.HexToAddress(req.Account).Bytes(), common.HexToHash(req.SigHash).Bytes())
+}
+
+/**
+ * DecodeApprovalTx
+ * ----------------
+ * Return the transaction and chain id held by the request.
+ */
+func DecodeApprovalTx(req *models.ApprovalRequest) (*types.Transaction, *big.Int, error) {
+	data, err := hexutil.Decode(req.TxData)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx := new(types.Transaction)
+	if err = rlp.DecodeBytes(data, tx); err != nil {
+		return nil, nil, err
+	}
+	if req.ChainId == "" {
+		return tx, nil, nil
+	}
+	chainId, ok := new(big.Int).SetString(req.ChainId, 10)
+	if !ok {
+		return nil, nil, fmt.Errorf("Invalid chain id %s", req.ChainId)
+	}
+	return tx, chainId, nil
+}
+
+// txSigHash returns the hash SignTx signs for the chain.
+func txSigHash(tx *types.Transaction, chainId *big.Int) common.Hash {
+	if chainId != nil {
+		return types.NewEIP155Signer(chainId).Hash(tx)
+	}
+	return types.HomesteadSigner{}.Hash(tx)
+}
+
+// recoverVoter returns the address signing the hash with personal_sign.
+func recoverVoter(hash common.Hash, sig []byte) (common.Address, error) {
+	if len(sig) != 65 {
+		return common.Address{}, fmt.Errorf("Signature must be 65 bytes")
+	}
+	rsv := append([]byte{}, sig...)
+	if rsv[64] >= 27 {
+		rsv[64] -= 27
+	}
+	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(hash), hash.Bytes())
+	pub, err := crypto.SigToPub(crypto.Keccak256([]byte(msg)), rsv)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
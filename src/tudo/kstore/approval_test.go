@@ -0,0 +1,123 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+// signVote signs the request's vote hash the way personal_sign does.
+func signVote(t *testing.T, key *ecdsa.PrivateKey,
+	req *models.ApprovalRequest, approve bool) []byte {
+	hash := ApprovalHash(req, approve)
+	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(hash), hash.Bytes())
+	sig, err := crypto.Sign(crypto.Keccak256([]byte(msg)), key)
+	if err != nil {
+		t.Fatalf("sign vote failed: %v", err)
+	}
+	sig[64] += 27
+	return sig
+}
+
+func TestAdminApproval(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	admin, _, err := ks.NewAccountOwner(uuid.NewRandom().String(), "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	peers := make([]*ecdsa.PrivateKey, 2)
+	admins := []common.Address{admin.Address}
+	for i := range peers {
+		peers[i], _ = crypto.GenerateKey()
+		admins = append(admins, crypto.PubkeyToAddress(peers[i].PublicKey))
+	}
+	ks.SetApprovals(NewApprovals(storage, admins, 0))
+	if quorum := ks.Approvals().Quorum(admin.Address); quorum != 2 {
+		t.Fatalf("quorum %d, want 2", quorum)
+	}
+	ks.Unlock(*admin, "pass")
+
+	chainId := big.NewInt(7)
+	to := common.HexToAddress("0x1234")
+	newTx := func(nonce uint64) *types.Transaction {
+		return types.NewTransaction(nonce, to, big.NewInt(100), 21000, big.NewInt(1), nil)
+	}
+	_, err = ks.SignTx(*admin, newTx(0), chainId)
+	pending, ok := err.(*ApprovalPendingError)
+	if !ok {
+		t.Fatalf("admin tx signed without approval: %v", err)
+	}
+	req, _ := storage.GetApprovalReq(pending.Id)
+
+	// Bad signature, own vote and a non admin are refused.
+	if _, err = ks.Approvals().Vote(req.Id, admins[1],
+		signVote(t, peers[1], req, true), true); err == nil {
+		t.Errorf("vote signed by another admin accepted")
+	}
+	other, _ := crypto.GenerateKey()
+	if _, err = ks.Approvals().Vote(req.Id, crypto.PubkeyToAddress(other.PublicKey),
+		signVote(t, other, req, true), true); err == nil {
+		t.Errorf("vote from non admin accepted")
+	}
+	if req, err = ks.Approvals().Vote(req.Id, admins[1],
+		signVote(t, peers[0], req, true), true); err != nil ||
+		req.Status != models.ApprovalPending {
+		t.Fatalf("first approval: %v, %v", req, err)
+	}
+	if _, err = ks.Approvals().Vote(req.Id, admins[1],
+		signVote(t, peers[0], req, true), true); err == nil {
+		t.Errorf("admin voted twice")
+	}
+	// One rejection leaves too few admins for the quorum.
+	if req, err = ks.Approvals().Vote(req.Id, admins[2],
+		signVote(t, peers[1], req, false), false); err != nil ||
+		req.Status != models.ApprovalRejected {
+		t.Fatalf("rejection: %v, %v", req, err)
+	}
+	if _, err = ks.SignTx(*admin, newTx(0), chainId); err == nil {
+		t.Errorf("rejected tx signed")
+	}
+	// Approved by both peers.
+	_, err = ks.SignTx(*admin, newTx(1), chainId)
+	req, _ = storage.GetApprovalReq(err.(*ApprovalPendingError).Id)
+	for i, peer := range peers {
+		req, err = ks.Approvals().Vote(req.Id, admins[i+1], signVote(t, peer, req, true), true)
+		if err != nil {
+			t.Fatalf("approval %d: %v", i, err)
+		}
+	}
+	if req.Status != models.ApprovalApproved {
+		t.Fatalf("request %s after quorum", req.Status)
+	}
+	signed, err := ks.SignTxWithPassphrase(accounts.Account{Address: admin.Address},
+		"pass", newTx(1), chainId)
+	if err != nil {
+		t.Fatalf("approved tx not signed: %v", err)
+	}
+	if req, _ = storage.GetApprovalReq(req.Id); req.Status != models.ApprovalSigned ||
+		req.TxHash != signed.Hash().Hex() {
+		t.Errorf("request %s, tx %s after signing", req.Status, req.TxHash)
+	}
+	tx, _, err := DecodeApprovalTx(req)
+	if err != nil || tx.Nonce() != 1 || *tx.To() != to {
+		t.Errorf("decoded tx %v, %v", tx, err)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+)
+
+func TestDeleteRestore(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	owner := uuid.Parse(uuid.NewRandom().String())
+	acct, _, err := ks.NewAccountOwner(owner.String(), "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	a := accounts.Account{Address: acct.Address}
+	if err = ks.Delete(a, "wrong"); err == nil {
+		t.Fatalf("deleted with the wrong passphrase")
+	}
+	if err = ks.Delete(a, "pass"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if ks.HasAddress(acct.Address) {
+		t.Errorf("deleted account still loaded")
+	}
+	if _, err = storage.GetKeyRecord(acct.Address); err != accounts.ErrUnknownAccount {
+		t.Errorf("deleted key found: %v", err)
+	}
+	if _, err = storage.GetUserAccount(owner); err != ErrNoAccount {
+		t.Errorf("deleted account found: %v", err)
+	}
+	if err = ks.RestoreAccount(a, "wrong"); err == nil {
+		t.Errorf("restored with the wrong passphrase")
+	}
+	if err = ks.RestoreAccount(a, "pass"); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if !ks.HasAddress(acct.Address) {
+		t.Errorf("restored account not loaded")
+	}
+	if accts, _ := storage.GetUserAccount(owner); len(accts) != 1 {
+		t.Errorf("%d accounts after restore", len(accts))
+	}
+	// Past the retention period the account can only be purged.
+	if err = ks.AdminDelete(a); err != nil {
+		t.Fatalf("admin delete failed: %v", err)
+	}
+	storage.keys[acct.Address.Hex()].Archived -= int64(2 * DefaultRetention / time.Second)
+	if err = ks.RestoreAccount(a, "pass"); err == nil {
+		t.Errorf("restored past the retention period")
+	}
+	if count, err := ks.PurgeExpired(1); count != 1 || err != nil {
+		t.Fatalf("purged %d accounts, %v", count, err)
+	}
+	if _, err = storage.GetArchivedKey(acct.Address); err != accounts.ErrUnknownAccount {
+		t.Errorf("purged key found: %v", err)
+	}
+	if len(storage.accounts) != 0 {
+		t.Errorf("purged account found")
+	}
+}
+
+func TestCheckAdminOp(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	key, _ := crypto.GenerateKey()
+	admin := crypto.PubkeyToAddress(key.PublicKey)
+	ap := NewApprovals(storage, []common.Address{admin}, 0)
+
+	account := common.HexToAddress("0x1234")
+	sign := func(op string, stamp int64) []byte {
+		hash := AdminOpHash(op, account, stamp)
+		msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(hash), hash.Bytes())
+		sig, _ := crypto.Sign(crypto.Keccak256([]byte(msg)), key)
+		return sig
+	}
+	now := time.Now().Unix()
+	if err := ap.CheckAdminOp(AdminOpPurge, account, admin, now,
+		sign(AdminOpPurge, now)); err != nil {
+		t.Errorf("signed purge refused: %v", err)
+	}
+	if err := ap.CheckAdminOp(AdminOpPurge, account, admin, now,
+		sign(AdminOpDelete, now)); err == nil {
+		t.Errorf("delete signature accepted for purge")
+	}
+	old := now - 3600
+	if err := ap.CheckAdminOp(AdminOpPurge, account, admin, old,
+		sign(AdminOpPurge, old)); err == nil {
+		t.Errorf("stale signature accepted")
+	}
+	if err := ap.CheckAdminOp(AdminOpPurge, account, account, now,
+		sign(AdminOpPurge, now)); err == nil {
+		t.Errorf("non admin accepted")
+	}
+}
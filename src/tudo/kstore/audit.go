@@ -0,0 +1,251 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"tudo/models"
+)
+
+// Key operations written to the audit log.
+const (
+	AuditSignTx     = "SignTx"
+	AuditSignHash   = "SignHash"
+	AuditUnlock     = "Unlock"
+	AuditDelete     = "Delete"
+	AuditRestore    = "Restore"
+	AuditPurge      = "Purge"
+	AuditExport     = "Export"
+	AuditImport     = "Import"
+	AuditNewAccount = "NewAccount"
+	AuditRepair     = "Repair"
+	AuditFreeze     = "Freeze"
+	AuditUnfreeze   = "Unfreeze"
+	AuditLock       = "Lock"
+)
+
+// Row id of the audit_head table, made by the schema migration.
+const auditHeadId = 1
+
+// Number of audit records read per query by VerifyAudit.
+const auditBatch = 1000
+
+// Number of failed audit writes kept for Fsck.
+const auditFailsKept = 100
+
+var ErrNoAuditHead = errors.New("No audit head found")
+
+/**
+ * Client of the RPC methods calling the keystore, recorded in the audit log:
+ * Identity names its token or JWT subject, Remote is its network address.
+ */
+type AuditCaller struct {
+	Identity string
+	Remote   string
+}
+
+/**
+ * WithCaller
+ * ----------
+ * Return the keystore auditing the operations made through it as the caller's.
+ * It shares the wallets and keys of ks.
+ */
+func (ks *KStore) WithCaller(caller *AuditCaller) KStoreIface {
+	return &KStore{kstoreState: ks.kstoreState, caller: caller}
+}
+
+/**
+ * audit
+ * -----
+ * Append the operation on the account to the audit log, with the API function
+ * calling the keystore and the RPC client given to WithCaller.  Return the error
+ * of the operation, else the failure to write the record: an operation that
+ * can't be audited fails.  The failures are logged and reported by Fsck.
+ */
+func (ks *KStore) audit(op string, addr common.Address, owner, hash string,
+	err error) error {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	rec := &models.AuditRecord{
+		Stamp:     time.Now().UnixNano(),
+		Origin:    ks.Storage.Origin(),
+		Caller:    truncate(auditCaller(), 128),
+		Op:        op,
+		Account:   addr.Hex(),
+		OwnerUuid: owner,
+		TxHash:    hash,
+		Result:    truncate(result, 256),
+	}
+	if ks.caller != nil {
+		rec.Identity = truncate(ks.caller.Identity, 128)
+		rec.Remote = truncate(ks.caller.Remote, 64)
+	}
+	auditErr := ks.Storage.AppendAudit(rec)
+	if auditErr == nil {
+		return err
+	}
+	fmt.Printf("Failed to audit %s %s: %v\n", op, rec.Account, auditErr)
+	detail := fmt.Sprintf("%s by %s at %d not audited: %v", op, rec.Caller,
+		rec.Stamp, auditErr)
+
+	ks.mu.Lock()
+	if len(ks.auditFails) == auditFailsKept {
+		ks.auditFails = ks.auditFails[1:]
+	}
+	ks.auditFails = append(ks.auditFails,
+		FsckIssue{Kind: FsckAudit, Account: rec.Account, Detail: detail})
+	ks.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Failed to audit %s: %v", op, auditErr)
+}
+
+// ownerOf returns the owner of the account if it's loaded.
+func (ks *KStore) ownerOf(addr common.Address) string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if acctKey := ks.acctIndex[addr]; acctKey != nil {
+		return acctKey.OwnerUuid
+	}
+	return ""
+}
+
+/**
+ * auditCaller
+ * -----------
+ * Name the first function on the stack outside of the keystore and account
+ * manager, e.g. ethapi.(*PrivateAccountAPI).UnlockAccount.
+ */
+func auditCaller() string {
+	pc := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function
+		if !strings.Contains(name, "tudo/kstore.") &&
+			!strings.Contains(name, "go-ethereum/accounts") &&
+			!strings.Contains(name, "ethcore.(*ksRouter)") &&
+			!strings.Contains(name, "ethcore.(*Manager)") {
+			return name[strings.LastIndex(name, "/")+1:]
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+/**
+ * AuditHash
+ * ---------
+ * Hash the record's content and the previous hash with an HMAC keyed by the
+ * record's master key version, the chain can't be made again without the master
+ * key file.  A record of a keystore without master key has a plain Keccak hash,
+ * anyone writing to the database could rewrite those.
+ */
+func AuditHash(rec *models.AuditRecord, master *MasterKeys) (string, error) {
+	data, _ := rlp.EncodeToBytes([]interface{}{
+		uint64(rec.Seq), uint64(rec.Stamp), rec.Origin, rec.Caller, rec.Identity,
+		rec.Remote, rec.Op, rec.Account, rec.OwnerUuid, rec.TxHash, rec.Result,
+		uint64(rec.KeyVersion), rec.PrevHash,
+	})
+	if rec.KeyVersion == 0 {
+		return crypto.Keccak256Hash(data).Hex(), nil
+	}
+	key := master.auditKey(rec.KeyVersion)
+	if key == nil {
+		return "", fmt.Errorf("Master key version %d of the audit log not loaded",
+			rec.KeyVersion)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hexutil.Encode(mac.Sum(nil)), nil
+}
+
+/**
+ * VerifyAudit
+ * -----------
+ * Walk the audit log in batches, check each record's hash and its link to the one
+ * before, then that the last record is the head.  Return the number of records
+ * verified.  With master keys, the records without master key are refused: they
+ * could have replaced the keyed ones.
+ */
+func VerifyAudit(storage KsInterface, batch int) (int64, error) {
+	var (
+		seq    int64
+		lastId int64
+		prev   string
+	)
+	if batch <= 0 {
+		batch = auditBatch
+	}
+	master := storage.MasterKeys()
+	for {
+		recs, err := storage.GetAuditRecords(lastId, batch)
+		if err != nil {
+			return seq, err
+		}
+		for idx := range recs {
+			rec := &recs[idx]
+			if rec.Seq != seq+1 {
+				return seq, fmt.Errorf("Audit record %d has sequence %d, want %d",
+					rec.Id, rec.Seq, seq+1)
+			}
+			if rec.PrevHash != prev {
+				return seq, fmt.Errorf("Audit record %d doesn't link to record %d",
+					rec.Id, lastId)
+			}
+			if rec.KeyVersion == 0 && master != nil {
+				return seq, fmt.Errorf("Audit record %d isn't keyed by a master key",
+					rec.Id)
+			}
+			hash, err := AuditHash(rec, master)
+			if err != nil {
+				return seq, fmt.Errorf("Audit record %d: %v", rec.Id, err)
+			}
+			if hash != rec.Hash {
+				return seq, fmt.Errorf("Audit record %d was altered", rec.Id)
+			}
+			seq, lastId, prev = rec.Seq, rec.Id, rec.Hash
+		}
+		if len(recs) < batch {
+			break
+		}
+	}
+	head, err := storage.GetAuditHead()
+	if err != nil {
+		return seq, err
+	}
+	if head.Seq != seq || head.Hash != prev {
+		return seq, fmt.Errorf("Audit log ends at sequence %d, head is at %d",
+			seq, head.Seq)
+	}
+	return seq, nil
+}
+
+func truncate(s string, size int) string {
+	if len(s) > size {
+		return s[:size]
+	}
+	return s
+}
@@ -0,0 +1,180 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+func TestAuditLog(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	owner := uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	ks.Unlock(*acct, "wrong")
+	ks.Unlock(*acct, "pass")
+	tx := types.NewTransaction(0, common.HexToAddress("0x1234"),
+		big.NewInt(1), 21000, big.NewInt(1), nil)
+	signed, _ := ks.SignTx(*acct, tx, big.NewInt(1))
+	ks.Export(*acct, "pass", "new")
+	ks.Delete(accounts.Account{Address: acct.Address}, "pass")
+
+	recs, _ := storage.GetAuditRecords(0, 100)
+	ops := []string{AuditNewAccount, AuditUnlock, AuditUnlock,
+		AuditSignTx, AuditExport, AuditDelete}
+	if len(recs) != len(ops) {
+		t.Fatalf("%d audit records, want %d", len(recs), len(ops))
+	}
+	for i, rec := range recs {
+		if rec.Op != ops[i] || rec.Account != acct.Address.Hex() ||
+			rec.OwnerUuid != owner || rec.Caller == "" {
+			t.Errorf("record %d: %+v", i, rec)
+		}
+	}
+	if recs[1].Result == "ok" || recs[2].Result != "ok" {
+		t.Errorf("unlock results %q, %q", recs[1].Result, recs[2].Result)
+	}
+	if recs[3].TxHash != signed.Hash().Hex() {
+		t.Errorf("signed tx hash %s, want %s", recs[3].TxHash, signed.Hash().Hex())
+	}
+	// The records of the operations made through WithCaller name the client.
+	caller := &AuditCaller{Identity: "token:admin:01020304", Remote: "10.0.0.1:5000"}
+	if _, err = ks.WithCaller(caller).FreezeOwner(owner, "test"); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	last, _ := storage.GetAuditRecords(recs[5].Id, 1)
+	if len(last) != 1 || last[0].Identity != caller.Identity ||
+		last[0].Remote != caller.Remote || recs[0].Identity != "" {
+		t.Errorf("caller records %+v", last)
+	}
+	if count, err := VerifyAudit(storage, 4); count != 7 || err != nil {
+		t.Fatalf("verified %d records, %v", count, err)
+	}
+	// Altered, removed and truncated records are caught.
+	storage.audits[1].Result = "ok"
+	if _, err = VerifyAudit(storage, 4); err == nil {
+		t.Errorf("altered record not detected")
+	}
+	storage.audits[1] = recs[1]
+	storage.audits = append(storage.audits[:2], storage.audits[3:]...)
+	if _, err = VerifyAudit(storage, 4); err == nil {
+		t.Errorf("removed record not detected")
+	}
+	storage.audits = recs[:5]
+	if _, err = VerifyAudit(storage, 4); err == nil {
+		t.Errorf("truncated log not detected")
+	}
+}
+
+// auditFailStorage can't write the audit log.
+type auditFailStorage struct {
+	*MemKeyStore
+}
+
+func (s auditFailStorage) AppendAudit(rec *models.AuditRecord) error {
+	return errors.New("audit log is full")
+}
+
+func TestAuditFailure(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	owner := uuid.NewRandom().String()
+	acct, _, err := newTestKStore(t, storage, 0).NewAccountOwner(owner, "", "a",
+		"pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	ks := newTestKStore(t, auditFailStorage{storage}, 0)
+
+	// The operations that can't be audited fail and give nothing out.
+	if err = ks.Unlock(*acct, "pass"); err == nil {
+		t.Errorf("unlock not audited")
+	}
+	if ks.GetAccountKey(acct.Address).Key != nil {
+		t.Errorf("account left unlocked")
+	}
+	tx := types.NewTransaction(0, common.HexToAddress("0x1234"),
+		big.NewInt(1), 21000, big.NewInt(1), nil)
+	signed, err := ks.SignTxWithPassphrase(*acct, "pass", tx, big.NewInt(1))
+	if signed != nil || err == nil {
+		t.Errorf("signed without audit: %v", err)
+	}
+	if keyJson, err := ks.Export(*acct, "pass", "new"); keyJson != nil || err == nil {
+		t.Errorf("exported without audit: %v", err)
+	}
+	// A failed operation keeps its own error.
+	err = ks.Unlock(*acct, "wrong")
+	if err == nil || strings.Contains(err.Error(), "audit") {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+	report, err := ks.Fsck(false, 0)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	failed := 0
+	for _, issue := range report.Issues {
+		if issue.Kind == FsckAudit && issue.Account == acct.Address.Hex() {
+			failed++
+		}
+	}
+	if failed != 4 {
+		t.Errorf("fsck reports %d audit failures, want 4: %+v", failed, report.Issues)
+	}
+}
+
+func TestAuditKeyed(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+	master, _ := ParseMasterKeys(testMasterV1)
+	storage.SetMasterKeys(master)
+
+	owner := uuid.NewRandom().String()
+	ks.FreezeOwner(owner, "test")
+	ks.UnfreezeOwner(owner)
+	if count, err := VerifyAudit(storage, 0); count != 2 || err != nil {
+		t.Fatalf("verified %d records: %v", count, err)
+	}
+	if rec := storage.audits[1]; rec.KeyVersion != 1 {
+		t.Errorf("record key version %d", rec.KeyVersion)
+	}
+	keyed := append([]models.AuditRecord{}, storage.audits...)
+
+	// A chain made again with plain hashes is refused.
+	prev := ""
+	for idx := range storage.audits {
+		rec := &storage.audits[idx]
+		rec.KeyVersion, rec.PrevHash = 0, prev
+		rec.Hash, _ = AuditHash(rec, nil)
+		prev = rec.Hash
+	}
+	storage.auditHead.Hash = prev
+	if _, err := VerifyAudit(storage, 0); err == nil {
+		t.Errorf("unkeyed chain verified with a master key")
+	}
+	// The records can't be checked without their master key version.
+	storage.audits = keyed
+	storage.auditHead.Hash = keyed[1].Hash
+	master, _ = ParseMasterKeys(testMasterV2)
+	storage.SetMasterKeys(master)
+	if _, err := VerifyAudit(storage, 0); err == nil {
+		t.Errorf("verified without the master key version")
+	}
+}
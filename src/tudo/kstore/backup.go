@@ -0,0 +1,313 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/scrypt"
+	"tudo/models"
+)
+
+// Outcome of writing a row restored from a backup: added, already stored with
+// the same content, kept because the stored row differs, or replaced.
+const (
+	RowAdded = iota
+	RowSame
+	RowConflict
+	RowReplaced
+)
+
+const backupVersion = 1
+
+var ErrBackupPassphrase = errors.New("could not decrypt backup with given passphrase")
+
+/**
+ * Rows of the keystore tables.  Keys stay encrypted with their passphrase, and
+ * wrapped with the master key if they were, the backup adds its own layer.
+ */
+type Backup struct {
+	Created  int64               `json:"created"`
+	Origin   string              `json:"origin"`
+	Accounts []models.Account    `json:"accounts"`
+	Keys     []models.AccountKey `json:"keys"`
+	Seeds    []models.WalletSeed `json:"seeds"`
+}
+
+/**
+ * Backup file, the JSON encoded Backup sealed with aes-256-gcm under a scrypt
+ * key.  The GCM tag authenticates the content and the header.
+ */
+type backupJSON struct {
+	Version    int            `json:"version"`
+	Created    int64          `json:"created"`
+	Cipher     string         `json:"cipher"`
+	Nonce      string         `json:"nonce"`
+	KDF        string         `json:"kdf"`
+	KDFParams  map[string]int `json:"kdfparams"`
+	Salt       string         `json:"salt"`
+	CipherText string         `json:"ciphertext"`
+}
+
+/**
+ * Result of Backup.Restore.  Conflicts lists the rows kept because the stored
+ * row differs, by address or owner uuid for wallet seeds.
+ */
+type RestoreReport struct {
+	Added     int
+	Same      int
+	Replaced  int
+	Conflicts []string
+}
+
+/**
+ * NewBackup
+ * ---------
+ * Read the account, account_key and wallet_seed rows, batch rows per query.
+ * Archived rows are included so they can still be restored or purged.
+ */
+func NewBackup(storage KsInterface, batch int) (*Backup, error) {
+	if batch <= 0 {
+		batch = migrateBatch
+	}
+	backup := &Backup{
+		Created: time.Now().Unix(),
+		Origin:  storage.Origin(),
+	}
+	for offset := 0; ; offset += batch {
+		rows, err := storage.ListAccountRows(offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		backup.Accounts = append(backup.Accounts, rows...)
+		if len(rows) < batch {
+			break
+		}
+	}
+	for offset := 0; ; offset += batch {
+		rows, err := storage.ListKeyRows(offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		backup.Keys = append(backup.Keys, rows...)
+		if len(rows) < batch {
+			break
+		}
+	}
+	for offset := 0; ; offset += batch {
+		rows, err := storage.ListSeeds(offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		backup.Seeds = append(backup.Seeds, rows...)
+		if len(rows) < batch {
+			break
+		}
+	}
+	return backup, nil
+}
+
+/**
+ * Write
+ * -----
+ * Encrypt the backup with the passphrase.
+ */
+func (b *Backup) Write(w io.Writer, auth string, scryptN, scryptP int) error {
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 32)
+	if _, err = crand.Read(salt); err != nil {
+		return err
+	}
+	derivedKey, err := scrypt.Key([]byte(auth), salt, scryptN, 8, scryptP, 32)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(derivedKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = crand.Read(nonce); err != nil {
+		return err
+	}
+	enc := &backupJSON{
+		Version:   backupVersion,
+		Created:   b.Created,
+		Cipher:    "aes-256-gcm",
+		Nonce:     hex.EncodeToString(nonce),
+		KDF:       "scrypt",
+		KDFParams: map[string]int{"n": scryptN, "r": 8, "p": scryptP, "dklen": 32},
+		Salt:      hex.EncodeToString(salt),
+	}
+	sealed := aead.Seal(nil, nonce, plain, backupHeader(enc))
+	enc.CipherText = base64.StdEncoding.EncodeToString(sealed)
+	return json.NewEncoder(w).Encode(enc)
+}
+
+/**
+ * ReadBackup
+ * ----------
+ * Decrypt and verify the backup written by Write.
+ */
+func ReadBackup(r io.Reader, auth string) (*Backup, error) {
+	var enc backupJSON
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &enc); err != nil {
+		return nil, fmt.Errorf("Invalid backup file: %v", err)
+	}
+	if enc.Version != backupVersion || enc.Cipher != "aes-256-gcm" || enc.KDF != "scrypt" {
+		return nil, fmt.Errorf("Unsupported backup format")
+	}
+	salt, err := hex.DecodeString(enc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(enc.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(enc.CipherText)
+	if err != nil {
+		return nil, err
+	}
+	params := enc.KDFParams
+	derivedKey, err := scrypt.Key([]byte(auth), salt,
+		params["n"], params["r"], params["p"], params["dklen"])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid backup nonce")
+	}
+	plain, err := aead.Open(nil, nonce, sealed, backupHeader(&enc))
+	if err != nil {
+		// Wrong passphrase or altered file, GCM can't tell which.
+		return nil, ErrBackupPassphrase
+	}
+	backup := &Backup{}
+	if err = json.Unmarshal(plain, backup); err != nil {
+		return nil, err
+	}
+	if backup.Created != enc.Created {
+		return nil, fmt.Errorf("Backup header doesn't match its content")
+	}
+	return backup, nil
+}
+
+// backupHeader returns the header fields authenticated with the content.
+func backupHeader(enc *backupJSON) []byte {
+	return []byte(fmt.Sprintf("tudo-backup:%d:%d:%s:%s:%d:%d:%d", enc.Version,
+		enc.Created, enc.Cipher, enc.KDF, enc.KDFParams["n"], enc.KDFParams["r"],
+		enc.KDFParams["p"]))
+}
+
+/**
+ * Restore
+ * -------
+ * Write the backup rows to the storage.  Rows already stored with a different
+ * content are reported as conflicts, and overwritten if replace is set.  Stored
+ * rows missing from the backup are left alone.  Keys wrapped with the master key
+ * need the same master key versions on this node.
+ */
+func (b *Backup) Restore(storage KsInterface, replace bool) (*RestoreReport, error) {
+	master := storage.MasterKeys()
+	for idx := range b.Keys {
+		keyRec := &b.Keys[idx]
+		if !common.IsHexAddress(keyRec.Account) {
+			return nil, fmt.Errorf("Invalid key address %s in backup", keyRec.Account)
+		}
+		if keyRec.KeyVersion != 0 && !master.Has(keyRec.KeyVersion) {
+			return nil, fmt.Errorf("Key %s is wrapped with master key version %d, "+
+				"not loaded", keyRec.Account, keyRec.KeyVersion)
+		}
+	}
+	report := &RestoreReport{}
+	count := func(name string, result int, err error) error {
+		switch result {
+		case RowAdded:
+			report.Added++
+		case RowSame:
+			report.Same++
+		case RowReplaced:
+			report.Replaced++
+			report.Conflicts = append(report.Conflicts, name+" (replaced)")
+		case RowConflict:
+			report.Conflicts = append(report.Conflicts, name)
+		}
+		return err
+	}
+	for idx := range b.Keys {
+		keyRec := &b.Keys[idx]
+		result, err := storage.PutKeyRow(keyRec, replace)
+		if err = count(keyRec.Account+" account_key", result, err); err != nil {
+			return report, err
+		}
+	}
+	for idx := range b.Accounts {
+		acct := &b.Accounts[idx]
+		result, err := storage.PutAccountRow(acct, replace)
+		if err = count(acct.Account+" account", result, err); err != nil {
+			return report, err
+		}
+	}
+	for idx := range b.Seeds {
+		seed := &b.Seeds[idx]
+		result, err := storage.PutSeed(seed, replace)
+		if err = count(seed.OwnerUuid+" wallet_seed", result, err); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// putResult returns the outcome of writing a row over a stored one.
+func putResult(same, replace bool) int {
+	switch {
+	case same:
+		return RowSame
+	case replace:
+		return RowReplaced
+	}
+	return RowConflict
+}
+
+// keyChangeOps returns the key_change ops telling the nodes about the replaced key.
+func keyChangeOps(old, rec *models.AccountKey) []string {
+	switch {
+	case old.Archived != 0 && rec.Archived != 0:
+		return nil
+	case rec.Archived != 0:
+		return []string{models.KeyDeleted}
+	case old.Archived != 0:
+		return []string{models.KeyAdded}
+	case old.OwnerUuid != rec.OwnerUuid:
+		// Move the account to the new owner's wallet.
+		return []string{models.KeyDeleted, models.KeyAdded}
+	}
+	return []string{models.KeyUpdated}
+}
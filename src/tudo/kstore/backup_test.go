@@ -0,0 +1,98 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+func TestBackupRestore(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	owner, wallet := uuid.NewRandom().String(), uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, wallet, "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	gone, _, err := ks.NewAccountOwner(owner, wallet, "b", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if err = ks.Delete(*gone, "pass"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	storage.StoreSeed(&models.WalletSeed{OwnerUuid: owner, WalletUuid: wallet, Seed: "seed"})
+
+	backup, err := NewBackup(storage, 1)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if len(backup.Accounts) != 2 || len(backup.Keys) != 2 || len(backup.Seeds) != 1 {
+		t.Fatalf("backup has %d accounts, %d keys, %d seeds",
+			len(backup.Accounts), len(backup.Keys), len(backup.Seeds))
+	}
+	var buf bytes.Buffer
+	if err = backup.Write(&buf, "secret", keystore.LightScryptN, keystore.LightScryptP); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	data := buf.Bytes()
+	if _, err = ReadBackup(bytes.NewReader(data), "wrong"); err != ErrBackupPassphrase {
+		t.Errorf("read with a wrong passphrase: %v", err)
+	}
+	altered := bytes.Replace(data, []byte(`"created":`), []byte(`"created":1`), 1)
+	if _, err = ReadBackup(bytes.NewReader(altered), "secret"); err == nil {
+		t.Errorf("read an altered backup")
+	}
+	if backup, err = ReadBackup(bytes.NewReader(data), "secret"); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// Restore on an empty node.
+	target := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	report, err := backup.Restore(target, false)
+	if err != nil || report.Added != 5 || len(report.Conflicts) != 0 {
+		t.Fatalf("restore: %+v, %v", report, err)
+	}
+	restored := newTestKStore(t, target, 0)
+	if err = restored.Unlock(*acct, "pass"); err != nil {
+		t.Errorf("restored key doesn't unlock: %v", err)
+	}
+	if _, err = target.GetArchivedKey(gone.Address); err != nil {
+		t.Errorf("archived key not restored: %v", err)
+	}
+	if report, _ = backup.Restore(target, false); report.Same != 5 {
+		t.Errorf("second restore: %+v", report)
+	}
+
+	// Rows differing from the stored ones are kept unless replaced.
+	backup.Accounts[0].PublicName = "renamed"
+	report, _ = backup.Restore(target, false)
+	if len(report.Conflicts) != 1 || report.Replaced != 0 {
+		t.Errorf("conflict not reported: %+v", report)
+	}
+	report, _ = backup.Restore(target, true)
+	if report.Replaced != 1 {
+		t.Errorf("conflict not replaced: %+v", report)
+	}
+	accts, _ := target.ListAccountRows(0, 10)
+	if accts[0].PublicName != "renamed" {
+		t.Errorf("row not replaced: %+v", accts[0])
+	}
+
+	// Keys wrapped with a master key this node doesn't have are refused.
+	backup.Keys[0].KeyVersion = 9
+	if _, err = backup.Restore(target, true); err == nil {
+		t.Errorf("restored a key with an unknown master key version")
+	}
+}
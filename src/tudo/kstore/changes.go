@@ -0,0 +1,95 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"tudo/models"
+)
+
+const (
+	// How often the updater polls the key change log.
+	changePoll = 3 * time.Second
+	// Max number of key changes read per query.
+	changeBatch = 500
+	// Key changes older than this are pruned from the log, once per changePrune.
+	changeRetention = 24 * time.Hour
+	changePrune     = time.Hour
+)
+
+/**
+ * syncChanges
+ * -----------
+ * Apply the key changes made by other nodes sharing the storage to the cached
+ * wallets, and send the wallet events.  Only called by the updater.
+ */
+func (ks *KStore) syncChanges() {
+	origin := ks.Storage.Origin()
+	for {
+		changes, err := ks.Storage.GetKeyChanges(ks.changeId, changeBatch)
+		if err != nil {
+			fmt.Printf("Failed to read key changes: %v\n", err)
+			return
+		}
+		for idx := range changes {
+			change := &changes[idx]
+			if change.Origin != origin {
+				ks.applyChange(change)
+			}
+			ks.changeId = change.Id
+		}
+		if len(changes) < changeBatch {
+			return
+		}
+	}
+}
+
+func (ks *KStore) applyChange(change *models.KeyChange) {
+	addr := common.HexToAddress(change.Account)
+
+	ks.mu.RLock()
+	acctKey := ks.acctIndex[addr]
+	ks.mu.RUnlock()
+
+	switch change.Op {
+	case models.KeyAdded:
+		if acctKey != nil {
+			return
+		}
+		if acctKey = ks.loadAccountKey(addr); acctKey != nil {
+			ks.sendEvent(acctKey.wallet, accounts.WalletArrived)
+		}
+
+	case models.KeyUpdated:
+		if acctKey == nil {
+			return
+		}
+		keyRec, err := ks.Storage.GetKeyRecord(addr)
+		if err != nil {
+			fmt.Printf("Failed to reload key %s: %v\n", change.Account, err)
+			return
+		}
+		// New passphrase, the account must be unlocked again.
+		acctKey.wallet.mu.Lock()
+		acctKey.AccountKey = keyRec
+		acctKey.lock()
+		acctKey.wallet.mu.Unlock()
+
+	case models.KeyDeleted:
+		if acctKey == nil {
+			return
+		}
+		if wallet := ks.removeAccountKey(acctKey); wallet != nil {
+			ks.sendEvent(wallet, accounts.WalletDropped)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/pborman/uuid"
+)
+
+func TestChangeSync(t *testing.T) {
+	// Two storage objects over the same database act as two nodes.
+	a := newTestKStore(t, newSqlStorage(t), 0)
+	b := newTestKStore(t, NewSqlKeyStore(keystore.LightScryptN, keystore.LightScryptP), 0)
+
+	sink := make(chan accounts.WalletEvent, 4)
+	sub := b.Subscribe(sink)
+	defer sub.Unsubscribe()
+
+	// Wake up b's updater rather than waiting for the next poll.
+	next := func() accounts.WalletEvent {
+		select {
+		case b.changes <- struct{}{}:
+		default:
+		}
+		select {
+		case ev := <-sink:
+			return ev
+		case <-time.After(2 * changePoll):
+			t.Fatalf("no wallet event")
+		}
+		return accounts.WalletEvent{}
+	}
+	owner := uuid.NewRandom().String()
+	acct, _, err := a.NewAccountOwner(owner, "", "alice", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	ev := next()
+	if ev.Kind != accounts.WalletArrived || ev.Wallet.URL() != NewURL(owner) {
+		t.Fatalf("new account event %+v", ev)
+	}
+	if err = b.Unlock(*acct, "pass"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if err = a.Update(*acct, "pass", "pass2"); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	// Changes apply in order, the update is seen once the next account arrives.
+	if _, _, err = a.NewAccountOwner(uuid.NewRandom().String(), "", "bob",
+		"pass", "normal"); err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if ev = next(); ev.Kind != accounts.WalletArrived {
+		t.Fatalf("second account event %+v", ev)
+	}
+	if b.GetAccountKey(acct.Address).Key != nil {
+		t.Errorf("key still unlocked after passphrase update")
+	}
+	if err = b.Unlock(*acct, "pass"); err == nil {
+		t.Errorf("old passphrase still unlocks")
+	}
+	if err = b.Unlock(*acct, "pass2"); err != nil {
+		t.Errorf("unlock with new passphrase failed: %v", err)
+	}
+
+	if err = a.Delete(*acct, "pass2"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if ev = next(); ev.Kind != accounts.WalletDropped || ev.Wallet.URL() != NewURL(owner) {
+		t.Fatalf("delete event %+v", ev)
+	}
+	if b.HasAddress(acct.Address) {
+		t.Errorf("deleted account still cached")
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+/**
+ * Error returned for a key of a frozen owner: signing, unlocking and exporting
+ * are refused until the owner is unfrozen.
+ */
+type OwnerFrozenError struct {
+	OwnerUuid string
+	Reason    string
+}
+
+func (e *OwnerFrozenError) Error() string {
+	return fmt.Sprintf("Owner %s is frozen: %s", e.OwnerUuid, e.Reason)
+}
+
+/**
+ * Keystore figures of KStore.Stats, the storage counts and the keys held by this
+ * node.
+ */
+type KStoreStats struct {
+	*models.KeyStats
+	LoadedWallets    int
+	LoadedKeys       int
+	UnlockedKeys     int
+	OpenWallets      int
+	MasterKeyVersion int
+}
+
+/**
+ * checkFrozen
+ * -----------
+ * The freeze is read from the storage each time, so an owner frozen from another
+ * node can't use the keys unlocked here.  A storage error refuses the key too.
+ */
+func (ks *KStore) checkFrozen(ownerUuid string) error {
+	freeze, err := ks.Storage.GetOwnerFreeze(ownerUuid)
+	if err == nil {
+		return &OwnerFrozenError{OwnerUuid: ownerUuid, Reason: freeze.Reason}
+	}
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func parseOwner(ownerUuid string) (string, error) {
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		return "", fmt.Errorf("Invalid owner uuid %s", ownerUuid)
+	}
+	return owner.String(), nil
+}
+
+/**
+ * FreezeOwner
+ * -----------
+ * Refuse the use of the owner's keys, or replace the reason of the freeze, and
+ * lock the keys unlocked on this node.  Return the number of keys locked.
+ */
+func (ks *KStore) FreezeOwner(ownerUuid, reason string) (locked int, err error) {
+	defer func() { err = ks.audit(AuditFreeze, common.Address{}, ownerUuid, "", err) }()
+
+	owner, err := parseOwner(ownerUuid)
+	if err != nil {
+		return 0, err
+	}
+	freeze := &models.OwnerFreeze{OwnerUuid: owner, Reason: reason}
+	if err = ks.Storage.StoreOwnerFreeze(freeze); err != nil {
+		return 0, err
+	}
+	return ks.LockKeys(owner), nil
+}
+
+/**
+ * UnfreezeOwner
+ * -------------
+ * The keys stay locked, they must be unlocked again.
+ */
+func (ks *KStore) UnfreezeOwner(ownerUuid string) (err error) {
+	defer func() { err = ks.audit(AuditUnfreeze, common.Address{}, ownerUuid, "", err) }()
+
+	owner, err := parseOwner(ownerUuid)
+	if err != nil {
+		return err
+	}
+	return ks.Storage.DeleteOwnerFreeze(owner)
+}
+
+/**
+ * LockKeys
+ * --------
+ * Lock the unlocked keys and close the open HD wallet of the owner, of every
+ * owner if ownerUuid is empty.  Only the keys held by this node are locked.
+ * Return the number of keys locked.
+ */
+func (ks *KStore) LockKeys(ownerUuid string) int {
+	ks.mu.RLock()
+	wallets := make([]*Wallet, 0, len(ks.wallets))
+	for owner, wallet := range ks.wallets {
+		if ownerUuid == "" || owner == ownerUuid {
+			wallets = append(wallets, wallet)
+		}
+	}
+	ks.mu.RUnlock()
+
+	locked := []*AccountKey{}
+	for _, wallet := range wallets {
+		wallet.mu.Lock()
+		for _, acctKey := range wallet.AcctMap {
+			if acctKey.Key != nil {
+				acctKey.lock()
+				locked = append(locked, acctKey)
+			}
+		}
+		if wallet.seed != nil {
+			zeroBytes(wallet.seed)
+			wallet.seed = nil
+			wallet.auth = ""
+		}
+		wallet.mu.Unlock()
+	}
+	// Out of the wallet locks, see keyCache.
+	for _, acctKey := range locked {
+		ks.keyCache.remove(acctKey.Account.Address)
+		ks.audit(AuditLock, acctKey.Account.Address, acctKey.OwnerUuid, "", nil)
+	}
+	return len(locked)
+}
+
+/**
+ * Stats
+ * -----
+ */
+func (ks *KStore) Stats() (*KStoreStats, error) {
+	keyStats, err := ks.Storage.GetKeyStats()
+	if err != nil {
+		return nil, err
+	}
+	stats := &KStoreStats{
+		KeyStats:         keyStats,
+		MasterKeyVersion: ks.Storage.MasterKeys().Current(),
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	stats.LoadedWallets = len(ks.wallets)
+	for _, wallet := range ks.wallets {
+		wallet.mu.Lock()
+		stats.LoadedKeys += len(wallet.AcctMap)
+		for _, acctKey := range wallet.AcctMap {
+			if acctKey.Key != nil {
+				stats.UnlockedKeys++
+			}
+		}
+		if wallet.seed != nil {
+			stats.OpenWallets++
+		}
+		wallet.mu.Unlock()
+	}
+	return stats, nil
+}
@@ -0,0 +1,90 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pborman/uuid"
+)
+
+func TestFreezeOwner(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	owner, other := uuid.NewRandom().String(), uuid.NewRandom().String()
+	wallet := uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, wallet, "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	peer, _, err := ks.NewAccountOwner(other, "", "b", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	ks.Unlock(*acct, "pass")
+	ks.Unlock(*peer, "pass")
+
+	locked, err := ks.FreezeOwner(owner, "stolen card")
+	if err != nil || locked != 1 {
+		t.Fatalf("freeze locked %d keys: %v", locked, err)
+	}
+	tx := types.NewTransaction(0, common.HexToAddress("0x1234"), big.NewInt(1),
+		21000, big.NewInt(1), nil)
+	if _, err = ks.SignTxWithPassphrase(*acct, "pass", tx, nil); err == nil {
+		t.Errorf("frozen owner signed")
+	} else if frozen, _ := err.(*OwnerFrozenError); frozen == nil ||
+		frozen.Reason != "stolen card" {
+		t.Errorf("frozen owner error: %v", err)
+	}
+	if err = ks.Unlock(*acct, "pass"); err == nil {
+		t.Errorf("frozen owner unlocked")
+	}
+	if _, err = ks.Export(*acct, "pass", "new"); err == nil {
+		t.Errorf("frozen owner exported")
+	}
+	if _, err = ks.SignTx(*peer, tx, nil); err != nil {
+		t.Errorf("other owner refused: %v", err)
+	}
+	stats, err := ks.Stats()
+	if err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	if stats.Owners != 2 || stats.Keys != 2 || stats.FrozenOwners != 1 ||
+		stats.UnlockedKeys != 1 || stats.LoadedWallets != 2 {
+		t.Errorf("stats %+v %+v", stats, stats.KeyStats)
+	}
+	owners, err := storage.ListOwners(0, 10)
+	if err != nil || len(owners) != 2 || owners[0].Accounts != 1 ||
+		owners[0].Wallets != 1 {
+		t.Errorf("owners %+v: %v", owners, err)
+	}
+	if wallets, _ := storage.ListWallets(owner, 0, 10); len(wallets) != 1 {
+		t.Errorf("wallets of the owner %+v", wallets)
+	}
+
+	if err = ks.UnfreezeOwner(owner); err != nil {
+		t.Fatalf("unfreeze failed: %v", err)
+	}
+	if err = ks.UnfreezeOwner(owner); !IsNotFound(err) {
+		t.Errorf("unfreeze twice: %v", err)
+	}
+	if _, err = ks.SignTx(*acct, tx, nil); err != keystore.ErrLocked {
+		t.Errorf("key unlocked after the freeze: %v", err)
+	}
+	if _, err = ks.SignTxWithPassphrase(*acct, "pass", tx, nil); err != nil {
+		t.Errorf("unfrozen owner refused: %v", err)
+	}
+	if locked = ks.LockKeys(""); locked != 1 {
+		t.Errorf("lock of every owner locked %d keys", locked)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+// Kinds of FsckIssue.
+const (
+	FsckNoAccount = "keyWithoutAccount"
+	FsckNoKey     = "accountWithoutKey"
+	FsckOwner     = "ownerMismatch"
+	FsckArchived  = "archiveMismatch"
+	FsckBadKey    = "badKey"
+	FsckWallet    = "walletMismatch"
+	FsckAudit     = "auditFailure"
+)
+
+/**
+ * Problem found by Fsck.  Repaired is set when the repair mode fixed it, bad
+ * keys can't be repaired.
+ */
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Account  string `json:"account"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+/**
+ * Result of Fsck.  Unverified lists the encrypted keys without issue, only the
+ * address of their JSON was checked since decrypting them needs the passphrase.
+ */
+type FsckReport struct {
+	Accounts   int         `json:"accounts"`
+	Keys       int         `json:"keys"`
+	Wallets    int         `json:"wallets"`
+	Issues     []FsckIssue `json:"issues"`
+	Unverified []string    `json:"unverified"`
+}
+
+/**
+ * Fsck
+ * ----
+ * Cross check the account and account_key tables, and the cached wallets with
+ * the account_key table.  The account_key row is taken as the truth: repair
+ * writes the account rows matching the keys, archives the account rows without
+ * a key and reloads the cached accounts.  Keys not matching their address are
+ * only reported, like the last operations this node failed to audit.  Rows
+ * changed while the check runs may show up as issues.
+ */
+func (ks *KStore) Fsck(repair bool, batch int) (*FsckReport, error) {
+	if batch <= 0 {
+		batch = migrateBatch
+	}
+	report := &FsckReport{Issues: []FsckIssue{}, Unverified: []string{}}
+	accts := make(map[string]*models.Account)
+	for offset := 0; ; offset += batch {
+		rows, err := ks.Storage.ListAccountRows(offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range rows {
+			accts[common.HexToAddress(rows[idx].Account).Hex()] = &rows[idx]
+		}
+		if len(rows) < batch {
+			break
+		}
+	}
+	report.Accounts = len(accts)
+
+	master := ks.Storage.MasterKeys()
+	for offset := 0; ; offset += batch {
+		keyRecs, err := ks.Storage.ListKeyRows(offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range keyRecs {
+			keyRec := &keyRecs[idx]
+			acct := accts[keyRec.Account]
+			delete(accts, keyRec.Account)
+
+			verified, err := checkKeyAddress(master, keyRec)
+			if err != nil {
+				report.add(FsckBadKey, keyRec.Account, err.Error())
+			} else if !verified {
+				report.Unverified = append(report.Unverified, keyRec.Account)
+			}
+			if issue := fsckAccount(acct, keyRec); issue != nil {
+				if repair {
+					issue.Repaired = ks.repairAccount(acct, keyRec, issue) == nil
+				}
+				report.Issues = append(report.Issues, *issue)
+			}
+		}
+		report.Keys += len(keyRecs)
+		if len(keyRecs) < batch {
+			break
+		}
+	}
+	addrs := make([]string, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		acct := accts[addr]
+		if acct.Archived != 0 {
+			// Left by a repair, hidden like the other archived rows.
+			continue
+		}
+		issue := FsckIssue{
+			Kind:    FsckNoKey,
+			Account: addr,
+			Detail:  "account row of owner " + acct.OwnerUuid + " has no key row",
+		}
+		if repair {
+			issue.Repaired = ks.repairAccount(acct, nil, &issue) == nil
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	ks.fsckWallets(report, repair)
+
+	ks.mu.RLock()
+	report.Issues = append(report.Issues, ks.auditFails...)
+	ks.mu.RUnlock()
+	return report, nil
+}
+
+func (r *FsckReport) add(kind, account, detail string) {
+	r.Issues = append(r.Issues, FsckIssue{Kind: kind, Account: account, Detail: detail})
+}
+
+// fsckAccount compares the account row with its key row, acct may be nil.
+func fsckAccount(acct *models.Account, keyRec *models.AccountKey) *FsckIssue {
+	issue := &FsckIssue{Account: keyRec.Account}
+	switch {
+	case acct == nil:
+		issue.Kind = FsckNoAccount
+		issue.Detail = "key of owner " + keyRec.OwnerUuid + " has no account row"
+	case acct.OwnerUuid != keyRec.OwnerUuid:
+		issue.Kind = FsckOwner
+		issue.Detail = fmt.Sprintf("account owner %s, key owner %s",
+			acct.OwnerUuid, keyRec.OwnerUuid)
+	case (acct.Archived == 0) != (keyRec.Archived == 0):
+		issue.Kind = FsckArchived
+		issue.Detail = fmt.Sprintf("account archived at %d, key archived at %d",
+			acct.Archived, keyRec.Archived)
+	default:
+		return nil
+	}
+	return issue
+}
+
+/**
+ * repairAccount
+ * -------------
+ * Make the account row agree with the key row, or archive it without key.
+ */
+func (ks *KStore) repairAccount(acct *models.Account,
+	keyRec *models.AccountKey, issue *FsckIssue) (err error) {
+	addr := common.HexToAddress(issue.Account)
+	rec := models.Account{}
+	if acct != nil {
+		rec = *acct
+	}
+	defer func() { err = ks.audit(AuditRepair, addr, rec.OwnerUuid, "", err) }()
+
+	if keyRec == nil {
+		rec.Archived = time.Now().Unix()
+	} else {
+		if acct == nil {
+			// Same defaults as StoreAccount, wallet uuid unknown.
+			rec = models.Account{
+				Account:    keyRec.Account,
+				WalletUuid: uuid.NewRandom().String(),
+				PublicName: "Anonymous",
+				Type:       "normal",
+			}
+		}
+		rec.OwnerUuid = keyRec.OwnerUuid
+		rec.Archived = keyRec.Archived
+	}
+	_, err = ks.Storage.PutAccountRow(&rec, true)
+	return err
+}
+
+/**
+ * fsckWallets
+ * -----------
+ * Compare the cached accounts with their key row, reload the ones differing.
+ * Changes made by other nodes are only applied by the next key change poll.
+ */
+func (ks *KStore) fsckWallets(report *FsckReport, repair bool) {
+	ks.mu.RLock()
+	cached := make([]*AccountKey, 0, len(ks.acctIndex))
+	for _, acctKey := range ks.acctIndex {
+		cached = append(cached, acctKey)
+	}
+	report.Wallets = len(ks.wallets)
+	ks.mu.RUnlock()
+
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].Account.Address.Hex() < cached[j].Account.Address.Hex()
+	})
+	for _, acctKey := range cached {
+		addr := acctKey.Account.Address
+
+		acctKey.wallet.mu.Lock()
+		rec := *acctKey.AccountKey
+		walletOwner := acctKey.wallet.OwnerUuid.String()
+		acctKey.wallet.mu.Unlock()
+
+		detail := ""
+		keyRec, err := ks.Storage.GetKeyRecord(addr)
+		switch {
+		case IsNotFound(err):
+			detail = "cached account has no live key row"
+		case err != nil:
+			fmt.Printf("Failed to check key %s: %v\n", addr.Hex(), err)
+			continue
+		case keyRec.OwnerUuid != walletOwner:
+			detail = fmt.Sprintf("cached in wallet %s, key owner %s",
+				walletOwner, keyRec.OwnerUuid)
+		case keyRec.PrivKey != rec.PrivKey || keyRec.WrapKey != rec.WrapKey ||
+			keyRec.KeyVersion != rec.KeyVersion:
+			detail = "cached key differs from the key row"
+		default:
+			continue
+		}
+		issue := FsckIssue{Kind: FsckWallet, Account: addr.Hex(), Detail: detail}
+		if repair {
+			if wallet := ks.removeAccountKey(acctKey); wallet != nil {
+				ks.sendEvent(wallet, accounts.WalletDropped)
+			}
+			if err == nil {
+				if acctKey = ks.loadAccountKey(addr); acctKey != nil {
+					ks.sendEvent(acctKey.wallet, accounts.WalletArrived)
+				}
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+}
+
+/**
+ * checkKeyAddress
+ * ---------------
+ * Check the key of the row is for its address.  Without the passphrase, only
+ * the address of the V3 JSON can be checked, the key itself for plain rows.
+ * Return true if the key itself was checked.
+ */
+func checkKeyAddress(master *MasterKeys, keyRec *models.AccountKey) (bool, error) {
+	want := common.HexToAddress(keyRec.Account)
+	if !isEncryptedKey(keyRec) {
+		privKey, err := crypto.HexToECDSA(keyRec.PrivKey)
+		if err != nil {
+			return false, fmt.Errorf("invalid plain key: %v", err)
+		}
+		defer zeroKey(privKey)
+		if have := crypto.PubkeyToAddress(privKey.PublicKey); have != want {
+			return false, fmt.Errorf("plain key is for %s", have.Hex())
+		}
+		return true, nil
+	}
+	data := []byte(keyRec.PrivKey)
+	if keyRec.KeyVersion > 0 {
+		plain, err := master.unwrap(keyRec.Account, keyRec.KeyVersion, keyRec.WrapKey)
+		if err != nil {
+			return false, err
+		}
+		data = plain
+	}
+	var keyJson struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(data, &keyJson); err != nil {
+		return false, fmt.Errorf("invalid key JSON: %v", err)
+	}
+	if !common.IsHexAddress(keyJson.Address) {
+		return false, fmt.Errorf("key JSON has no address")
+	}
+	if have := common.HexToAddress(keyJson.Address); have != want {
+		return false, fmt.Errorf("key JSON is for %s", have.Hex())
+	}
+	return false, nil
+}
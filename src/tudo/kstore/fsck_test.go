@@ -0,0 +1,130 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+)
+
+func TestFsck(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	newAcct := func() string {
+		acct, _, err := ks.NewAccountOwner("", "", "a", "pass", "normal")
+		if err != nil {
+			t.Fatalf("new account failed: %v", err)
+		}
+		return acct.Address.Hex()
+	}
+	good, moved, badKey, cached := newAcct(), newAcct(), newAcct(), newAcct()
+
+	// A key without account row, and an account row without key.
+	key, _ := newKey(rand.Reader)
+	noAcct := key.Address.Hex()
+	storage.StoreKeyUuid(key, uuid.NewRandom(), "pass")
+	key, _ = newKey(rand.Reader)
+	noKey := key.Address.Hex()
+	storage.StoreAccount(key, "", "normal", nil, nil)
+
+	accts, _ := storage.ListAccountRows(0, 100)
+	for _, acct := range accts {
+		if acct.Account == moved {
+			acct.OwnerUuid = uuid.NewRandom().String()
+			storage.PutAccountRow(&acct, true)
+		}
+	}
+	keyRecs, _ := storage.ListKeyRows(0, 100)
+	goodRec := storage.keys[good]
+	for _, keyRec := range keyRecs {
+		if keyRec.Account == badKey {
+			keyRec.PrivKey = goodRec.PrivKey
+			storage.PutKeyRow(&keyRec, true)
+		}
+	}
+	// Passphrase changed behind the keystore's back.
+	storage.UpdateKeyAuth(common.HexToAddress(cached), "pass", "new")
+
+	want := []FsckIssue{
+		{Kind: FsckNoAccount, Account: noAcct},
+		{Kind: FsckNoKey, Account: noKey},
+		{Kind: FsckOwner, Account: moved},
+		{Kind: FsckBadKey, Account: badKey},
+		{Kind: FsckWallet, Account: badKey},
+		{Kind: FsckWallet, Account: cached},
+	}
+	check := func(repair bool, want []FsckIssue) {
+		report, err := ks.Fsck(repair, 2)
+		if err != nil {
+			t.Fatalf("fsck failed: %v", err)
+		}
+		found := map[FsckIssue]bool{}
+		for _, issue := range report.Issues {
+			if repair && issue.Repaired != (issue.Kind != FsckBadKey) {
+				t.Errorf("issue repaired %v: %+v", issue.Repaired, issue)
+			}
+			found[FsckIssue{Kind: issue.Kind, Account: issue.Account}] = true
+		}
+		if len(report.Issues) != len(want) {
+			t.Errorf("found issues %+v, want %+v", report.Issues, want)
+		}
+		for _, issue := range want {
+			if !found[issue] {
+				t.Errorf("issue %s of %s not found", issue.Kind, issue.Account)
+			}
+		}
+
+		unverified := map[string]bool{}
+		for _, addr := range report.Unverified {
+			unverified[addr] = true
+		}
+		if !unverified[good] || unverified[badKey] {
+			t.Errorf("unverified keys %v", report.Unverified)
+		}
+	}
+	check(false, want)
+	check(true, want)
+	check(false, want[3:4])
+
+	if _, err := storage.GetAccountOwner(noAcct, storage.keys[noAcct].OwnerUuid); err != nil {
+		t.Errorf("account row not added: %v", err)
+	}
+	if acctKey := ks.GetAccountKey(common.HexToAddress(cached)); acctKey == nil ||
+		acctKey.PrivKey != storage.keys[cached].PrivKey {
+		t.Errorf("cached key not reloaded")
+	}
+}
+
+func TestCheckKeyAddress(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	key, _ := newKey(rand.Reader)
+	addr := key.Address.Hex()
+	storage.StoreKeyUuid(key, uuid.NewRandom(), "pass")
+	keyRec := *storage.keys[addr]
+
+	// Only the JSON address of an encrypted key is checked.
+	if verified, err := checkKeyAddress(nil, &keyRec); verified || err != nil {
+		t.Errorf("encrypted key verified %v: %v", verified, err)
+	}
+	keyRec.PrivKey = hex.EncodeToString(crypto.FromECDSA(key.PrivateKey))
+	if verified, err := checkKeyAddress(nil, &keyRec); !verified || err != nil {
+		t.Errorf("plain key verified %v: %v", verified, err)
+	}
+	other, _ := newKey(rand.Reader)
+	keyRec.PrivKey = hex.EncodeToString(crypto.FromECDSA(other.PrivateKey))
+	if _, err := checkKeyAddress(nil, &keyRec); err == nil {
+		t.Errorf("plain key of another address accepted")
+	}
+}
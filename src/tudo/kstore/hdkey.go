@@ -0,0 +1,219 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Size of the BIP39 entropy, 256 bits gives a 24 word mnemonic.
+const seedEntropyBits = 256
+
+var (
+	ErrSeedPassphrase = errors.New("could not decrypt wallet seed with given passphrase")
+	ErrInvalidPath    = errors.New("invalid derivation path")
+)
+
+/**
+ * Encrypted mnemonic, same scrypt/aes-128-ctr scheme as the V3 key JSON.
+ */
+type seedJSON struct {
+	Version      int               `json:"version"`
+	Cipher       string            `json:"cipher"`
+	CipherText   string            `json:"ciphertext"`
+	CipherParams map[string]string `json:"cipherparams"`
+	KDF          string            `json:"kdf"`
+	KDFParams    map[string]int    `json:"kdfparams"`
+	Salt         string            `json:"salt"`
+	MAC          string            `json:"mac"`
+}
+
+/**
+ * newMnemonic
+ * -----------
+ */
+func newMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(seedEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+/**
+ * encryptSeed
+ * -----------
+ * Encrypt the mnemonic with the passphrase.
+ */
+func encryptSeed(mnemonic, auth string, scryptN, scryptP int) (string, error) {
+	salt := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := crand.Read(salt); err != nil {
+		return "", err
+	}
+	if _, err := crand.Read(iv); err != nil {
+		return "", err
+	}
+	derivedKey, err := scrypt.Key([]byte(auth), salt, scryptN, 8, scryptP, 32)
+	if err != nil {
+		return "", err
+	}
+	cipherText, err := aesCTR(derivedKey[:16], iv, []byte(mnemonic))
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(&seedJSON{
+		Version:      1,
+		Cipher:       "aes-128-ctr",
+		CipherText:   hex.EncodeToString(cipherText),
+		CipherParams: map[string]string{"iv": hex.EncodeToString(iv)},
+		KDF:          "scrypt",
+		KDFParams:    map[string]int{"n": scryptN, "r": 8, "p": scryptP, "dklen": 32},
+		Salt:         hex.EncodeToString(salt),
+		MAC:          hex.EncodeToString(crypto.Keccak256(derivedKey[16:32], cipherText)),
+	})
+	return string(out), err
+}
+
+/**
+ * decryptSeed
+ * -----------
+ * Return the mnemonic encrypted by encryptSeed.
+ */
+func decryptSeed(seed, auth string) (string, error) {
+	var enc seedJSON
+
+	if err := json.Unmarshal([]byte(seed), &enc); err != nil {
+		return "", err
+	}
+	if enc.Version != 1 || enc.Cipher != "aes-128-ctr" || enc.KDF != "scrypt" {
+		return "", fmt.Errorf("Unsupported wallet seed format")
+	}
+	salt, err := hex.DecodeString(enc.Salt)
+	if err != nil {
+		return "", err
+	}
+	iv, err := hex.DecodeString(enc.CipherParams["iv"])
+	if err != nil {
+		return "", err
+	}
+	cipherText, err := hex.DecodeString(enc.CipherText)
+	if err != nil {
+		return "", err
+	}
+	mac, err := hex.DecodeString(enc.MAC)
+	if err != nil {
+		return "", err
+	}
+	params := enc.KDFParams
+	derivedKey, err := scrypt.Key([]byte(auth), salt,
+		params["n"], params["r"], params["p"], params["dklen"])
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(crypto.Keccak256(derivedKey[16:32], cipherText), mac) {
+		return "", ErrSeedPassphrase
+	}
+	plainText, err := aesCTR(derivedKey[:16], iv, cipherText)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
+
+func aesCTR(key, iv, in []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+	return out, nil
+}
+
+/**
+ * deriveKey
+ * ---------
+ * Derive the BIP32 private key at the path from the BIP39 seed.
+ */
+func deriveKey(seed []byte, path accounts.DerivationPath) (*keystore.Key, error) {
+	if len(path) == 0 {
+		return nil, ErrInvalidPath
+	}
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+
+	curveN := crypto.S256().Params().N
+	key, chain := new(big.Int).SetBytes(sum[:32]), sum[32:]
+	if key.Sign() == 0 || key.Cmp(curveN) >= 0 {
+		return nil, fmt.Errorf("Invalid master key")
+	}
+	for _, index := range path {
+		var data bytes.Buffer
+
+		if index >= 0x80000000 {
+			data.WriteByte(0)
+			data.Write(math.PaddedBigBytes(key, 32))
+		} else {
+			priv, err := crypto.ToECDSA(math.PaddedBigBytes(key, 32))
+			if err != nil {
+				return nil, err
+			}
+			data.Write(crypto.CompressPubkey(&priv.PublicKey))
+		}
+		binary.Write(&data, binary.BigEndian, index)
+
+		mac = hmac.New(sha512.New, chain)
+		mac.Write(data.Bytes())
+		sum = mac.Sum(nil)
+
+		tweak := new(big.Int).SetBytes(sum[:32])
+		if tweak.Cmp(curveN) >= 0 {
+			return nil, fmt.Errorf("Invalid child key at %s", path)
+		}
+		key.Add(key, tweak).Mod(key, curveN)
+		if key.Sign() == 0 {
+			return nil, fmt.Errorf("Invalid child key at %s", path)
+		}
+		chain = sum[32:]
+	}
+	priv, err := crypto.ToECDSA(math.PaddedBigBytes(key, 32))
+	if err != nil {
+		return nil, err
+	}
+	return newKeyFromECDSA(priv), nil
+}
+
+/**
+ * zeroBytes
+ * ---------
+ */
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
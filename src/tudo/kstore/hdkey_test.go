@@ -0,0 +1,180 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"github.com/tyler-smith/go-bip39"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon " +
+	"abandon abandon abandon abandon abandon about"
+
+func TestDeriveKey(t *testing.T) {
+	seed := bip39.NewSeed(testMnemonic, "")
+	key, err := deriveKey(seed, accounts.DefaultBaseDerivationPath)
+	if err != nil {
+		t.Fatalf("derive failed: %v", err)
+	}
+	want := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+	if key.Address != want {
+		t.Errorf("derived %s, want %s", key.Address.Hex(), want.Hex())
+	}
+}
+
+func TestSeedEncrypt(t *testing.T) {
+	enc, err := encryptSeed(testMnemonic, "pass",
+		keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	if _, err = decryptSeed(enc, "wrong"); err != ErrSeedPassphrase {
+		t.Errorf("decrypt with wrong passphrase: %v", err)
+	}
+	if mnemonic, err := decryptSeed(enc, "pass"); err != nil || mnemonic != testMnemonic {
+		t.Errorf("decrypt returned %q, %v", mnemonic, err)
+	}
+}
+
+// usedChain reports the accounts in used as having a nonce.
+type usedChain map[common.Address]bool
+
+func (c usedChain) BalanceAt(ctx context.Context, account common.Address,
+	block *big.Int) (*big.Int, error) {
+	return new(big.Int), nil
+}
+
+func (c usedChain) StorageAt(ctx context.Context, account common.Address,
+	key common.Hash, block *big.Int) ([]byte, error) {
+	return nil, nil
+}
+
+func (c usedChain) CodeAt(ctx context.Context, account common.Address,
+	block *big.Int) ([]byte, error) {
+	return nil, nil
+}
+
+func (c usedChain) NonceAt(ctx context.Context, account common.Address,
+	block *big.Int) (uint64, error) {
+	if c[account] {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func TestHDWallet(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	owner := uuid.NewRandom()
+	acct, model, err := ks.storeSeed(owner, uuid.NewRandom(), testMnemonic, "pass")
+	if err != nil {
+		t.Fatalf("store seed failed: %v", err)
+	}
+	if acct.Address != common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94") ||
+		model.OwnerUuid != owner.String() {
+		t.Errorf("wrong first account %s, owner %s", acct.Address.Hex(), model.OwnerUuid)
+	}
+	if _, _, err = ks.NewHDWallet(owner.String(), "", "pass"); err == nil {
+		t.Errorf("second seed stored for the owner")
+	}
+	w, _ := ks.OwnerWallet(owner.String())
+	wallet := w.(*Wallet)
+
+	path := accounts.DerivationPath{0x80000000 + 44, 0x80000000 + 60, 0x80000000, 0, 1}
+	if _, err = wallet.Derive(path, true); err != accounts.ErrWalletClosed {
+		t.Errorf("derive from closed wallet: %v", err)
+	}
+	if err = wallet.Open("wrong"); err != ErrSeedPassphrase {
+		t.Errorf("open with wrong passphrase: %v", err)
+	}
+	if err = wallet.Open("pass"); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	chain := make(usedChain)
+	for i := uint32(1); i < 4; i++ {
+		path[len(path)-1] = i
+		next, _ := wallet.Derive(path, false)
+		if wallet.Contains(next) {
+			t.Errorf("account %d pinned", i)
+		}
+		if i < 3 {
+			chain[next.Address] = true
+		}
+	}
+	wallet.SelfDerive(accounts.DefaultBaseDerivationPath, chain)
+	for i := 0; i < 500; i++ {
+		wallet.mu.Lock()
+		deriving := wallet.deriving
+		wallet.mu.Unlock()
+		if !deriving {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := len(wallet.Accounts()); count != 3 {
+		t.Fatalf("wallet has %d accounts after self derive, want 3", count)
+	}
+	derived, _ := storage.GetOwnerKeys(owner.String())
+	if len(derived) != 3 {
+		t.Errorf("%d keys stored, want 3", len(derived))
+	}
+	if err = ks.Unlock(wallet.Accounts()[0], "pass"); err != nil {
+		t.Errorf("derived account unlock failed: %v", err)
+	}
+	wallet.Close()
+	if _, err = wallet.Derive(path, false); err != accounts.ErrWalletClosed {
+		t.Errorf("derive after close: %v", err)
+	}
+}
+
+func TestRestoreWallet(t *testing.T) {
+	owner := uuid.NewRandom().String()
+	seed := bip39.NewSeed(testMnemonic, "")
+	chain := make(usedChain)
+	path := accounts.DerivationPath{0x80000000 + 44, 0x80000000 + 60, 0x80000000, 0, 0}
+	for i := uint32(1); i < 3; i++ {
+		path[len(path)-1] = i
+		key, _ := deriveKey(seed, path)
+		chain[key.Address] = true
+	}
+	// Nothing left of the owner after data loss.
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	accts, err := ks.RestoreWallet(owner, "  "+testMnemonic+"\n", "pass", chain)
+	if err != nil || len(accts) != 3 {
+		t.Fatalf("restored %d accounts, %v", len(accts), err)
+	}
+	recs, _ := storage.GetUserAccount(uuid.Parse(owner))
+	if len(recs) != 3 {
+		t.Errorf("%d account records restored, want 3", len(recs))
+	}
+	if mnemonic, err := ks.ExportMnemonic(owner, "pass"); mnemonic != testMnemonic {
+		t.Errorf("exported %q, %v", mnemonic, err)
+	}
+	if _, err = ks.ExportMnemonic(owner, "wrong"); err != ErrSeedPassphrase {
+		t.Errorf("export with wrong passphrase: %v", err)
+	}
+	// Restoring again is a no-op, another mnemonic is refused.
+	if accts, err = ks.RestoreWallet(owner, testMnemonic, "pass", chain); len(accts) != 3 {
+		t.Errorf("restored again %d accounts, %v", len(accts), err)
+	}
+	other, _ := newMnemonic()
+	if _, err = ks.RestoreWallet(owner, other, "pass", chain); err == nil {
+		t.Errorf("restored a different mnemonic")
+	}
+}
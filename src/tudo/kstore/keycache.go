@@ -0,0 +1,96 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// Max number of decrypted keys kept in memory when the config doesn't say.
+const defaultKeyCacheSize = 4096
+
+/**
+ * Bounded LRU of unlocked accounts.  The least recently used account is locked,
+ * its key zeroed, when the cache is full.  Accounts unlocked indefinitely, with
+ * a zero timeout, are exempt: they leave the cache when evicted but stay unlocked
+ * until Lock is called.  Lock order is cache, then wallet; the cache must not be
+ * called with a wallet lock held.
+ */
+type keyCache struct {
+	lru *simplelru.LRU
+	mu  sync.Mutex
+}
+
+func newKeyCache(size int) *keyCache {
+	if size <= 0 {
+		size = defaultKeyCacheSize
+	}
+	lru, _ := simplelru.NewLRU(size, func(key, value interface{}) {
+		acctKey := value.(*AccountKey)
+		acctKey.wallet.mu.Lock()
+		if acctKey.abort != nil {
+			acctKey.lock()
+		}
+		acctKey.wallet.mu.Unlock()
+	})
+	return &keyCache{lru: lru}
+}
+
+/**
+ * add
+ * ---
+ * Record the account as most recently unlocked, evict the oldest one if needed.
+ */
+func (c *keyCache) add(acctKey *AccountKey) {
+	c.mu.Lock()
+	c.lru.Add(acctKey.Account.Address, acctKey)
+	c.mu.Unlock()
+}
+
+/**
+ * touch
+ * -----
+ * Mark the account as recently used.
+ */
+func (c *keyCache) touch(addr common.Address) {
+	c.mu.Lock()
+	c.lru.Get(addr)
+	c.mu.Unlock()
+}
+
+/**
+ * remove
+ * ------
+ * Drop the account from the cache, its key is locked even if it was unlocked
+ * indefinitely.
+ */
+func (c *keyCache) remove(addr common.Address) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value, ok := c.lru.Peek(addr); ok {
+		c.lru.Remove(addr)
+		acctKey := value.(*AccountKey)
+		acctKey.wallet.mu.Lock()
+		acctKey.lock()
+		acctKey.wallet.mu.Unlock()
+	}
+}
+
+/**
+ * len
+ * ---
+ */
+func (c *keyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
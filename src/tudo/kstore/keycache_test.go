@@ -0,0 +1,172 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+const benchAccounts = 100000
+
+// newBenchStorage fills a memory keystore with count accounts, two per owner.  The
+// key blobs are fake, lookups never decrypt them.
+func newBenchStorage(count int) (*MemKeyStore, []common.Address) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	addrs := make([]common.Address, count)
+
+	owner := ""
+	for i := 0; i < count; i++ {
+		if i%2 == 0 {
+			owner = uuid.NewRandom().String()
+		}
+		addrs[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+		storage.putKeyRec(&models.AccountKey{
+			Account:   addrs[i].Hex(),
+			OwnerUuid: owner,
+			PrivKey:   "{}",
+		})
+	}
+	return storage, addrs
+}
+
+// newTestKStore makes the keystore over the storage, with no master key file.
+func newTestKStore(tb testing.TB, storage KsInterface, keyCacheSize int) *KStore {
+	ks, err := NewKeyStore(storage, keyCacheSize, "")
+	if err != nil {
+		tb.Fatalf("new keystore failed: %v", err)
+	}
+	return ks.(*KStore)
+}
+
+func TestLazyLoad(t *testing.T) {
+	storage, addrs := newBenchStorage(1500)
+	ks := newTestKStore(t, storage, 0)
+
+	if len(ks.Wallets()) != 0 {
+		t.Fatalf("wallets loaded at startup")
+	}
+	// Past the old 1000 row limit.
+	acctKey, wallet := ks.getAccountKey(accounts.Account{Address: addrs[1200]})
+	if acctKey == nil {
+		t.Fatalf("account %s not found", addrs[1200].Hex())
+	}
+	if len(wallet.Accounts()) != 2 || !wallet.Contains(accounts.Account{Address: addrs[1201]}) {
+		t.Errorf("wallet not fully loaded: %v", wallet.Accounts())
+	}
+	if ks.HasAddress(common.BigToAddress(big.NewInt(benchAccounts * 2))) {
+		t.Errorf("unknown address found")
+	}
+	other := accounts.Account{Address: addrs[1200], URL: NewURL(uuid.NewRandom().String())}
+	if acctKey, _ = ks.getAccountKey(other); acctKey != nil {
+		t.Errorf("account found under the wrong wallet url")
+	}
+}
+
+func TestKeyCacheEvict(t *testing.T) {
+	storage, addrs := newBenchStorage(4)
+	ks := newTestKStore(t, storage, 2)
+
+	// The first account is unlocked indefinitely, the others with a timeout.
+	for i, addr := range addrs {
+		acctKey, wallet := ks.getAccountKey(accounts.Account{Address: addr})
+		privKey, _ := crypto.GenerateKey()
+		ks.keyCache.add(acctKey)
+		wallet.mu.Lock()
+		acctKey.Key = &keystore.Key{Address: addr, PrivateKey: privKey}
+		if i > 0 {
+			acctKey.abort = make(chan struct{})
+		}
+		wallet.mu.Unlock()
+	}
+	if ks.keyCache.len() != 2 {
+		t.Fatalf("cache holds %d keys, want 2", ks.keyCache.len())
+	}
+	for i, addr := range addrs {
+		acctKey := ks.GetAccountKey(addr)
+		if unlocked := acctKey.Key != nil; unlocked != (i != 1) {
+			t.Errorf("account %d unlocked %v", i, unlocked)
+		}
+	}
+	ks.keyCache.remove(addrs[3])
+	if ks.GetAccountKey(addrs[3]).Key != nil || ks.keyCache.len() != 1 {
+		t.Errorf("removed account still unlocked")
+	}
+	ks.Lock(addrs[0])
+	if ks.GetAccountKey(addrs[0]).Key != nil {
+		t.Errorf("evicted indefinite unlock not locked by Lock")
+	}
+}
+
+// BenchmarkAccountKeyCached looks up accounts already in the address index.
+func BenchmarkAccountKeyCached(b *testing.B) {
+	storage, addrs := newBenchStorage(benchAccounts)
+	ks := newTestKStore(b, storage, 0)
+	for _, addr := range addrs {
+		ks.GetAccountKey(addr)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ks.GetAccountKey(addrs[i%benchAccounts]) == nil {
+			b.Fatalf("account not found")
+		}
+	}
+}
+
+// BenchmarkAccountKeyLoad looks up accounts on first use, loading the wallets.
+func BenchmarkAccountKeyLoad(b *testing.B) {
+	storage, addrs := newBenchStorage(benchAccounts)
+	ks := newTestKStore(b, storage, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%benchAccounts == 0 && i > 0 {
+			b.StopTimer()
+			ks = newTestKStore(b, storage, 0)
+			b.StartTimer()
+		}
+		if ks.GetAccountKey(addrs[i%benchAccounts]) == nil {
+			b.Fatalf("account not found")
+		}
+	}
+}
+
+// BenchmarkAccountKeyMiss looks up addresses not in the keystore.
+func BenchmarkAccountKeyMiss(b *testing.B) {
+	storage, _ := newBenchStorage(benchAccounts)
+	ks := newTestKStore(b, storage, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(benchAccounts + i + 1)))
+		if ks.GetAccountKey(addr) != nil {
+			b.Fatalf("unknown account found")
+		}
+	}
+}
+
+// BenchmarkKeyCacheAdd unlocks accounts through a full cache, evicting one each time.
+func BenchmarkKeyCacheAdd(b *testing.B) {
+	storage, addrs := newBenchStorage(benchAccounts)
+	ks := newTestKStore(b, storage, 1000)
+	acctKeys := make([]*AccountKey, benchAccounts)
+	for i, addr := range addrs {
+		acctKeys[i] = ks.GetAccountKey(addr)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ks.keyCache.add(acctKeys[i%benchAccounts])
+	}
+}
@@ -10,36 +10,72 @@ package kstore
 import (
 	"crypto/ecdsa"
 	crand "crypto/rand"
-	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"strings"
 	"time"
 
-	"github.com/astaxie/beego/orm"
+	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/pborman/uuid"
+	"github.com/tyler-smith/go-bip39"
 	"tudo/models"
 )
 
+// Number of account_key rows converted per query by MigratePlainKeys.
+const migrateBatch = 100
+
+// Deleted accounts can be restored for this long by default.
+const DefaultRetention = 30 * 24 * time.Hour
+
 /**
  * NewKeyStore
  * -----------
+ * Keep at most keyCacheSize unlocked keys in memory, zero means the default.  The
+ * master keys wrapping the account_key rows are read from masterKeyFile, or from
+ * the TUDO_KS_MASTER_KEY environment variable if no file is given.
  */
-func NewKeyStore(keydir string, scryptN, scryptP int) KStoreIface {
-	storage := NewSqlKeyStore(scryptN, scryptP)
+func NewKeyStore(storage KsInterface, keyCacheSize int,
+	masterKeyFile string) (KStoreIface, error) {
+	master, err := LoadMasterKeys(masterKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load master keys: %v", err)
+	}
 	kstore := &KStore{
-		Storage: storage,
+		kstoreState: &kstoreState{Storage: storage},
 	}
+	kstore.base = kstore
+	storage.SetMasterKeys(master)
 	storage.SetKeyStoreRef(kstore)
-	kstore.init()
-	return kstore
+	kstore.init(keyCacheSize)
+	return kstore, nil
+}
+
+/**
+ * NewStorage
+ * ----------
+ * Make the storage backend: MySQL, a SQLite file or memory.  The data source is
+ * the MySQL DSN or the SQLite file path.
+ */
+func NewStorage(backend, dataSource string, scryptN, scryptP int) (KsInterface, error) {
+	switch backend {
+	case models.MemoryBackend:
+		return NewMemKeyStore(scryptN, scryptP), nil
+
+	case "", models.MySqlBackend, models.SqliteBackend:
+		if err := models.InitDatabase(backend, dataSource); err != nil {
+			return nil, err
+		}
+		return NewSqlKeyStore(scryptN, scryptP), nil
+	}
+	return nil, fmt.Errorf("Unknown keystore backend %s", backend)
 }
 
 /**
@@ -53,36 +89,17 @@ func NewAccount(acct, ownerUuid string) *accounts.Account {
 	}
 }
 
-func (ks *KStore) init() {
-	var key *keystore.Key
-	var accounts []models.AccountKey
-
-	orm := ks.Storage.GetOrm()
-	sql := "SELECT * FROM account_key LIMIT 1000 OFFSET 0"
-
-	// execute the raw query string
-	orm.Raw(sql).QueryRows(&accounts)
-
-	ks.wallets = make(map[string]*Wallet)
-	for idx, _ := range accounts {
-		acct := &accounts[idx]
-		wallet := ks.wallets[acct.OwnerUuid]
-		if wallet == nil {
-			wallet = NewWallet(ks, acct.OwnerUuid)
-			ks.wallets[acct.OwnerUuid] = wallet
-		}
-		key = nil
-		acctRec := NewAccount(acct.Account, acct.OwnerUuid)
-		if acct.PassKey != "" {
-			var err error
-
-			key, err = getDecryptedKey(acct, "")
-			if err == nil {
-				wallet.unlock = true
-			}
-		}
-		wallet.Add(acct, key, acctRec)
+func (ks *KStore) init(keyCacheSize int) {
+	changeId, err := ks.Storage.LastKeyChange()
+	if err != nil {
+		fmt.Printf("Failed to read key change log: %v\n", err)
 	}
+	ks.changeId = changeId
+	ks.changes = make(chan struct{}, 1)
+	ks.wallets = make(map[string]*Wallet)
+	ks.acctIndex = make(map[common.Address]*AccountKey)
+	ks.keyCache = newKeyCache(keyCacheSize)
+	ks.retention = DefaultRetention
 }
 
 /**
@@ -93,6 +110,48 @@ func (ks *KStore) GetStorageIf() KsInterface {
 	return ks.Storage
 }
 
+/**
+ * SetApprovals
+ * ------------
+ * Hold the transactions from admin accounts for approval before signing them.
+ */
+func (ks *KStore) SetApprovals(approvals *Approvals) {
+	ks.approvals = approvals
+}
+
+func (ks *KStore) Approvals() *Approvals {
+	return ks.approvals
+}
+
+/**
+ * CheckTx
+ * -------
+ * Hold the transaction from an admin account until it's approved and check the
+ * spending policies, whichever keystore or wallet signs it.  Return the approved
+ * request to give TxSigned once signed, nil if the transaction needs no approval.
+ */
+func (ks *KStore) CheckTx(addr common.Address, tx *types.Transaction,
+	chainId *big.Int) (*models.ApprovalRequest, error) {
+	req, err := ks.approvals.checkTx(addr, tx, chainId)
+	if err != nil {
+		return nil, err
+	}
+	if err = ks.checkPolicy(addr, tx, chainId); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+/**
+ * TxSigned
+ * --------
+ */
+func (ks *KStore) TxSigned(req *models.ApprovalRequest, signed *types.Transaction) {
+	if req != nil {
+		ks.approvals.txSigned(req, signed)
+	}
+}
+
 /**
  * AddWallet
  * ---------
@@ -110,8 +169,14 @@ func (ks *KStore) AddWallet(wallet *Wallet) {
 /**
  * Wallets
  * -------
+ * Only the wallets loaded so far, not every wallet in storage.  The others are
+ * loaded on first use, by address or with OwnerWallet; page through the storage
+ * with GetAccountKeys to list them all.
  */
 func (ks *KStore) Wallets() []accounts.Wallet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
 	wallets := make([]accounts.Wallet, 0, len(ks.wallets))
 	for _, w := range ks.wallets {
 		wallets = append(wallets, w)
@@ -137,10 +202,18 @@ func (ks *KStore) Subscribe(sink chan<- accounts.WalletEvent) event.Subscription
 }
 
 func (ks *KStore) updater() {
+	var pruned time.Time
+
 	for {
 		select {
 		case <-ks.changes:
-		case <-time.After(3 * time.Second):
+		case <-time.After(changePoll):
+		}
+		ks.syncChanges()
+		if time.Since(pruned) > changePrune {
+			ks.Storage.PruneKeyChanges(time.Now().Add(-changeRetention))
+			ks.Storage.PruneSpends(time.Now().Add(-spendWindow).Unix())
+			pruned = time.Now()
 		}
 
 		ks.mu.Lock()
@@ -167,8 +240,12 @@ func (ks *KStore) HasAddress(addr common.Address) bool {
 /**
  * Accounts
  * --------
+ * Only the accounts of the wallets loaded so far, see Wallets.
  */
 func (ks *KStore) Accounts() []accounts.Account {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
 	accounts := []accounts.Account{}
 	for _, wallet := range ks.wallets {
 		out := wallet.Accounts()
@@ -193,53 +270,325 @@ func (ks *KStore) GetAccountKey(addr common.Address) *AccountKey {
 	return acctKey
 }
 
+/**
+ * updateKeyRec
+ * ------------
+ * Refresh the cached account_key record after its key material was rewritten.
+ */
+func (ks *KStore) updateKeyRec(keyRec *models.AccountKey) {
+	ks.mu.RLock()
+	acctKey := ks.acctIndex[common.HexToAddress(keyRec.Account)]
+	ks.mu.RUnlock()
+
+	if acctKey != nil {
+		acctKey.wallet.mu.Lock()
+		acctKey.AccountKey = keyRec
+		acctKey.wallet.mu.Unlock()
+	}
+}
+
+/**
+ * FindWallet
+ * ----------
+ * Return the wallet holding the account, load it from the storage if needed.
+ */
+func (ks *KStore) FindWallet(a accounts.Account) (accounts.Wallet, error) {
+	_, wallet := ks.getAccountKey(a)
+	if wallet == nil {
+		return nil, accounts.ErrUnknownAccount
+	}
+	return wallet, nil
+}
+
 func (ks *KStore) getAccountKey(a accounts.Account) (*AccountKey, *Wallet) {
 	ks.mu.RLock()
-	defer ks.mu.RUnlock()
+	acctKey := ks.acctIndex[a.Address]
+	ks.mu.RUnlock()
 
-	for _, wallet := range ks.wallets {
-		acctKey := wallet.Find(a)
-		if acctKey != nil {
-			return acctKey, wallet
+	if acctKey == nil {
+		if acctKey = ks.loadAccountKey(a.Address); acctKey == nil {
+			return nil, nil
+		}
+	}
+	wallet := acctKey.wallet
+	if a.URL != (accounts.URL{}) && a.URL != wallet.URL() {
+		return nil, nil
+	}
+	return acctKey, wallet
+}
+
+/**
+ * loadAccountKey
+ * --------------
+ * Read the account key record and its owner's wallet from the storage.
+ */
+func (ks *KStore) loadAccountKey(addr common.Address) *AccountKey {
+	keyRec, err := ks.Storage.GetKeyRecord(addr)
+	if err != nil {
+		if !IsNotFound(err) {
+			fmt.Printf("Failed to load key %s: %v\n", addr.Hex(), err)
 		}
+		return nil
+	}
+	return ks.addAccountKey(keyRec, NewAccount(keyRec.Account, keyRec.OwnerUuid))
+}
+
+/**
+ * loadWallet
+ * ----------
+ * Return the owner's wallet, read all its account keys from the storage the first
+ * time.
+ */
+func (ks *KStore) loadWallet(ownerUuid string) *Wallet {
+	ks.mu.RLock()
+	wallet := ks.wallets[ownerUuid]
+	ks.mu.RUnlock()
+
+	if wallet != nil {
+		return wallet
+	}
+	keyRecs, err := ks.Storage.GetOwnerKeys(ownerUuid)
+	if err != nil && !IsNotFound(err) {
+		fmt.Printf("Failed to load wallet %s: %v\n", ownerUuid, err)
+	}
+	return ks.cacheWallet(ownerUuid, keyRecs)
+}
+
+/**
+ * OwnerWallet
+ * -----------
+ * Return the owner's wallet, load it from the storage if needed.
+ */
+func (ks *KStore) OwnerWallet(ownerUuid string) (accounts.Wallet, error) {
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		return nil, fmt.Errorf("Invalid owner uuid %s", ownerUuid)
+	}
+	ownerUuid = owner.String()
+
+	ks.mu.RLock()
+	wallet := ks.wallets[ownerUuid]
+	ks.mu.RUnlock()
+
+	if wallet != nil {
+		return wallet, nil
+	}
+	keyRecs, err := ks.Storage.GetOwnerKeys(ownerUuid)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyRecs) == 0 {
+		return nil, accounts.ErrUnknownWallet
+	}
+	return ks.cacheWallet(ownerUuid, keyRecs), nil
+}
+
+/**
+ * cacheWallet
+ * -----------
+ * Make the owner's wallet with the account keys read from the storage, unless
+ * another thread did it first.
+ */
+func (ks *KStore) cacheWallet(ownerUuid string, keyRecs []models.AccountKey) *Wallet {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	wallet := ks.wallets[ownerUuid]
+	if wallet != nil {
+		return wallet
+	}
+	wallet = NewWallet(ks, ownerUuid)
+	ks.wallets[ownerUuid] = wallet
+
+	for idx := range keyRecs {
+		keyRec := &keyRecs[idx]
+		acct := NewAccount(keyRec.Account, ownerUuid)
+		ks.acctIndex[acct.Address] = wallet.Add(keyRec, nil, acct)
 	}
-	return nil, nil
+	return wallet
 }
 
 /**
  * Delete
  * ------
+ * Archive the account once the passphrase is checked.  It can be restored with
+ * RestoreAccount within the retention period, until it's purged.
  */
-func (ks *KStore) Delete(a accounts.Account, passpharse string) error {
-	acctKey, wallet := ks.getAccountKey(a)
+func (ks *KStore) Delete(a accounts.Account, passphrase string) (err error) {
+	owner := ks.ownerOf(a.Address)
+	defer func() { err = ks.audit(AuditDelete, a.Address, owner, "", err) }()
+
+	acctKey, _ := ks.getAccountKey(a)
 	if acctKey == nil {
 		return accounts.ErrUnknownAccount
 	}
-	orm := ks.Storage.GetOrm()
-	sql := "DELETE FROM account_key WHERE account = ?"
-	res, err := orm.Raw(sql, acctKey.Account).Exec()
+	owner = acctKey.OwnerUuid
+	key, err := ks.Storage.DecryptKeyRec(acctKey.AccountKey, passphrase)
+	if err != nil {
+		return err
+	}
+	zeroKey(key.PrivateKey)
+	return ks.archive(acctKey)
+}
 
-	if err == nil {
-		num, _ := res.RowsAffected()
-		wallet.Remove(a)
+/**
+ * AdminDelete
+ * -----------
+ * Archive the account without its passphrase, the caller must check the request
+ * comes from an admin.
+ */
+func (ks *KStore) AdminDelete(a accounts.Account) (err error) {
+	owner := ks.ownerOf(a.Address)
+	defer func() { err = ks.audit(AuditDelete, a.Address, owner, "", err) }()
 
-		fmt.Printf("Deleted %d rows\n", num)
-	} else {
-		fmt.Printf("Error returned %v\n", err)
+	acctKey, _ := ks.getAccountKey(a)
+	if acctKey == nil {
+		return accounts.ErrUnknownAccount
+	}
+	owner = acctKey.OwnerUuid
+	return ks.archive(acctKey)
+}
+
+func (ks *KStore) archive(acctKey *AccountKey) error {
+	if err := ks.Storage.ArchiveKey(acctKey.Account.Address); err != nil {
+		return err
+	}
+	if wallet := ks.removeAccountKey(acctKey); wallet != nil {
+		ks.sendEvent(wallet, accounts.WalletDropped)
+	}
+	return nil
+}
+
+/**
+ * RestoreAccount
+ * --------------
+ * Bring back the account deleted within the retention period, the passphrase
+ * must open its key.
+ */
+func (ks *KStore) RestoreAccount(a accounts.Account, passphrase string) (err error) {
+	owner := ""
+	defer func() { err = ks.audit(AuditRestore, a.Address, owner, "", err) }()
+
+	keyRec, err := ks.Storage.GetArchivedKey(a.Address)
+	if err != nil {
+		return err
+	}
+	owner = keyRec.OwnerUuid
+	since := time.Now().Add(-ks.retention).Unix()
+	if keyRec.Archived < since {
+		return fmt.Errorf("Account %s was deleted on %s, past the retention period",
+			keyRec.Account, time.Unix(keyRec.Archived, 0).Format(time.RFC3339))
+	}
+	key, err := ks.Storage.DecryptKeyRec(keyRec, passphrase)
+	if err != nil {
+		return err
+	}
+	zeroKey(key.PrivateKey)
+
+	if keyRec, err = ks.Storage.RestoreKey(a.Address, since); err != nil {
+		return err
+	}
+	acctKey := ks.addAccountKey(keyRec, NewAccount(keyRec.Account, keyRec.OwnerUuid))
+	ks.sendEvent(acctKey.wallet, accounts.WalletArrived)
+	return nil
+}
+
+/**
+ * PurgeAccount
+ * ------------
+ * Remove the deleted account for good, the caller must check the request comes
+ * from an admin.
+ */
+func (ks *KStore) PurgeAccount(a accounts.Account) (err error) {
+	owner := ""
+	defer func() { err = ks.audit(AuditPurge, a.Address, owner, "", err) }()
+
+	keyRec, err := ks.Storage.GetArchivedKey(a.Address)
+	if err != nil {
+		return err
+	}
+	owner = keyRec.OwnerUuid
+	return ks.Storage.PurgeKey(a.Address)
+}
+
+/**
+ * PurgeExpired
+ * ------------
+ * Purge the accounts deleted before the retention period, in batches.  Return
+ * the number of accounts purged.
+ */
+func (ks *KStore) PurgeExpired(batch int) (int, error) {
+	if batch <= 0 {
+		batch = migrateBatch
+	}
+	count := 0
+	before := time.Now().Add(-ks.retention).Unix()
+	for {
+		keyRecs, err := ks.Storage.GetArchivedKeys(before, batch)
+		if err != nil {
+			return count, err
+		}
+		for idx := range keyRecs {
+			acct := accounts.Account{Address: common.HexToAddress(keyRecs[idx].Account)}
+			if err = ks.PurgeAccount(acct); err != nil {
+				if IsNotFound(err) {
+					// Restored or purged by another node.
+					continue
+				}
+				return count, err
+			}
+			count++
+		}
+		if len(keyRecs) < batch {
+			return count, nil
+		}
+	}
+}
+
+/**
+ * SetRetention
+ * ------------
+ * Deleted accounts can be restored for the retention period, zero means the
+ * default.
+ */
+func (ks *KStore) SetRetention(retention time.Duration) {
+	if retention <= 0 {
+		retention = DefaultRetention
 	}
-	return err
+	ks.retention = retention
+}
+
+func (ks *KStore) Retention() time.Duration {
+	return ks.retention
 }
 
 /**
  * SignHash
  * --------
  */
-func (ks *KStore) SignHash(a accounts.Account, hash []byte) ([]byte, error) {
-	acctKey, _ := ks.getAccountKey(a)
-	if acctKey != nil && acctKey.Key != nil {
-		return crypto.Sign(hash, acctKey.Key.PrivateKey)
+func (ks *KStore) SignHash(a accounts.Account, hash []byte) (sig []byte, err error) {
+	defer func() {
+		err = ks.audit(AuditSignHash, a.Address, ks.ownerOf(a.Address),
+			hexutil.Encode(hash), err)
+		if err != nil {
+			sig = nil
+		}
+	}()
+	acctKey, wallet := ks.getAccountKey(a)
+	if acctKey == nil {
+		return nil, accounts.ErrUnknownAccount
+	}
+	if err = ks.checkFrozen(acctKey.OwnerUuid); err != nil {
+		return nil, err
 	}
-	return nil, accounts.ErrUnknownAccount
+	ks.keyCache.touch(acctKey.Account.Address)
+	wallet.mu.Lock()
+	defer wallet.mu.Unlock()
+
+	if acctKey.Key == nil {
+		return nil, keystore.ErrLocked
+	}
+	return crypto.Sign(hash, acctKey.Key.PrivateKey)
 }
 
 /**
@@ -247,17 +596,61 @@ func (ks *KStore) SignHash(a accounts.Account, hash []byte) ([]byte, error) {
  * ------
  */
 func (ks *KStore) SignTx(a accounts.Account, tx *types.Transaction,
-	chainId *big.Int) (*types.Transaction, error) {
-	acctKey, _ := ks.getAccountKey(a)
-
-	if acctKey != nil && acctKey.Key != nil {
-		privKey := acctKey.Key.PrivateKey
-		if chainId != nil {
-			return types.SignTx(tx, types.NewEIP155Signer(chainId), privKey)
+	chainId *big.Int) (signed *types.Transaction, err error) {
+	defer func() {
+		if err = ks.auditTx(a.Address, tx, signed, err); err != nil {
+			signed = nil
 		}
-		return types.SignTx(tx, types.HomesteadSigner{}, privKey)
+	}()
+
+	acctKey, wallet := ks.getAccountKey(a)
+	if acctKey == nil {
+		return nil, accounts.ErrUnknownAccount
+	}
+	if err = ks.checkFrozen(acctKey.OwnerUuid); err != nil {
+		return nil, err
+	}
+	ks.keyCache.touch(acctKey.Account.Address)
+	wallet.mu.Lock()
+	locked := acctKey.Key == nil
+	wallet.mu.Unlock()
+
+	if locked {
+		return nil, keystore.ErrLocked
 	}
-	return nil, accounts.ErrUnknownAccount
+	req, err := ks.CheckTx(acctKey.Account.Address, tx, chainId)
+	if err != nil {
+		return nil, err
+	}
+	wallet.mu.Lock()
+	if acctKey.Key == nil {
+		wallet.mu.Unlock()
+		return nil, keystore.ErrLocked
+	}
+	signed, err = signTx(tx, chainId, acctKey.Key.PrivateKey)
+	wallet.mu.Unlock()
+
+	if err == nil {
+		ks.TxSigned(req, signed)
+	}
+	return signed, err
+}
+
+// auditTx audits the signing of the transaction, by its hash once signed.
+func (ks *KStore) auditTx(addr common.Address, tx, signed *types.Transaction,
+	err error) error {
+	if signed != nil {
+		tx = signed
+	}
+	return ks.audit(AuditSignTx, addr, ks.ownerOf(addr), tx.Hash().Hex(), err)
+}
+
+func signTx(tx *types.Transaction, chainId *big.Int,
+	privKey *ecdsa.PrivateKey) (*types.Transaction, error) {
+	if chainId != nil {
+		return types.SignTx(tx, types.NewEIP155Signer(chainId), privKey)
+	}
+	return types.SignTx(tx, types.HomesteadSigner{}, privKey)
 }
 
 /**
@@ -290,9 +683,7 @@ func (ks *KStore) LogTx(tx *types.Transaction) error {
 		ToAcct:   to.Hex(),
 		TxHash:   tx.Hash().Hex(),
 	}
-	orm := ks.Storage.GetOrm()
-	_, err := orm.Insert(&trans)
-	return err
+	return ks.Storage.StoreTransaction(&trans)
 }
 
 /**
@@ -300,15 +691,26 @@ func (ks *KStore) LogTx(tx *types.Transaction) error {
  * ----------------------
  */
 func (ks *KStore) SignHashWithPassphrase(a accounts.Account, passphrase string,
-	hash []byte) ([]byte, error) {
+	hash []byte) (sig []byte, err error) {
+	defer func() {
+		err = ks.audit(AuditSignHash, a.Address, ks.ownerOf(a.Address),
+			hexutil.Encode(hash), err)
+		if err != nil {
+			sig = nil
+		}
+	}()
 	acctKey, _ := ks.getAccountKey(a)
 	if acctKey == nil {
 		return nil, accounts.ErrUnknownAccount
 	}
-	key, err := getDecryptedKey(acctKey.AccountKey, passphrase)
+	if err = ks.checkFrozen(acctKey.OwnerUuid); err != nil {
+		return nil, err
+	}
+	key, err := ks.Storage.DecryptKeyRec(acctKey.AccountKey, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroKey(key.PrivateKey)
 	return crypto.Sign(hash, key.PrivateKey)
 }
 
@@ -317,66 +719,127 @@ func (ks *KStore) SignHashWithPassphrase(a accounts.Account, passphrase string,
  * --------------------
  */
 func (ks *KStore) SignTxWithPassphrase(a accounts.Account, passphrase string,
-	tx *types.Transaction, chainId *big.Int) (*types.Transaction, error) {
+	tx *types.Transaction, chainId *big.Int) (signed *types.Transaction, err error) {
+	defer func() {
+		if err = ks.auditTx(a.Address, tx, signed, err); err != nil {
+			signed = nil
+		}
+	}()
+
 	acctKey, _ := ks.getAccountKey(a)
 	if acctKey == nil {
 		return nil, accounts.ErrUnknownAccount
 	}
-	key, err := getDecryptedKey(acctKey.AccountKey, passphrase)
-	if key != nil {
-		privKey := acctKey.Key.PrivateKey
-		if chainId != nil {
-			return types.SignTx(tx, types.NewEIP155Signer(chainId), privKey)
-		}
-		return types.SignTx(tx, types.HomesteadSigner{}, privKey)
+	if err = ks.checkFrozen(acctKey.OwnerUuid); err != nil {
+		return nil, err
+	}
+	key, err := ks.Storage.DecryptKeyRec(acctKey.AccountKey, passphrase)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	defer zeroKey(key.PrivateKey)
+
+	req, err := ks.CheckTx(acctKey.Account.Address, tx, chainId)
+	if err != nil {
+		return nil, err
+	}
+	signed, err = signTx(tx, chainId, key.PrivateKey)
+	if err == nil {
+		ks.TxSigned(req, signed)
+	}
+	return signed, err
 }
 
 /**
  * Unlock
  * ------
+ * Unlock the account indefinitely, until Lock is called.
  */
 func (ks *KStore) Unlock(a accounts.Account, passphrase string) error {
-	fmt.Printf("Key store unlock account %v, pass %s\n", a, passphrase)
 	return ks.TimedUnlock(a, passphrase, 0)
 }
 
 /**
  * Lock
  * ----
+ * Zero and drop the decrypted key of the account.
  */
 func (ks *KStore) Lock(addr common.Address) error {
+	acctKey, wallet := ks.getAccountKey(accounts.Account{Address: addr})
+	if acctKey != nil {
+		wallet.mu.Lock()
+		acctKey.lock()
+		wallet.mu.Unlock()
+	}
 	return nil
 }
 
 /**
  * TimedUnlock
  * -----------
+ * Unlock the account with the passphrase, the key is locked again after the
+ * timeout.  A zero timeout keeps it unlocked until Lock is called.  Unlocking an
+ * unlocked account replaces its timeout, except when the account was unlocked
+ * indefinitely.
  */
 func (ks *KStore) TimedUnlock(a accounts.Account, passphrase string,
-	timeout time.Duration) error {
-	acctKey, _ := ks.getAccountKey(a)
-	if acctKey != nil {
-		key, err := getDecryptedKey(acctKey.AccountKey, "")
-		fmt.Printf("Got key %v, timeout %v\n", key, timeout)
-		if err != nil {
-			return err
+	timeout time.Duration) (err error) {
+	defer func() {
+		auditErr := ks.audit(AuditUnlock, a.Address, ks.ownerOf(a.Address), "", err)
+		if err == nil && auditErr != nil {
+			// Not left unlocked without a record.
+			ks.Lock(a.Address)
+			err = auditErr
+		}
+	}()
+
+	acctKey, wallet := ks.getAccountKey(a)
+	if acctKey == nil {
+		return accounts.ErrUnknownAccount
+	}
+	if err = ks.checkFrozen(acctKey.OwnerUuid); err != nil {
+		return err
+	}
+	key, err := ks.Storage.DecryptKeyRec(acctKey.AccountKey, passphrase)
+	if err != nil {
+		return err
+	}
+	// Make room before taking the wallet lock, see keyCache.
+	ks.keyCache.add(acctKey)
+	wallet.mu.Lock()
+	defer wallet.mu.Unlock()
+
+	if acctKey.Key != nil {
+		if acctKey.abort == nil {
+			// The account was unlocked indefinitely, so unlocking
+			// it with a timeout would be confusing.
+			zeroKey(key.PrivateKey)
+			return nil
 		}
-		acctKey.Key = key
-		go ks.expire(acctKey, timeout)
+		// Terminate the expire goroutine and replace it below.
+		acctKey.lock()
+	}
+	acctKey.Key = key
+	if timeout > 0 {
+		acctKey.abort = make(chan struct{})
+		go ks.expire(wallet, acctKey, acctKey.abort, timeout)
 	}
 	return nil
 }
 
-func (ks *KStore) expire(acctKey *AccountKey, timeout time.Duration) {
+func (ks *KStore) expire(wallet *Wallet, acctKey *AccountKey,
+	abort chan struct{}, timeout time.Duration) {
 	t := time.NewTimer(timeout)
 	defer t.Stop()
 	select {
-	case <-acctKey.abort:
-		// Exit out
+	case <-abort:
+		// Locked or unlocked again with a new timeout.
 	case <-t.C:
-		// Timeout, encrypt back the key.
+		wallet.mu.Lock()
+		if acctKey.abort == abort {
+			acctKey.lock()
+		}
+		wallet.mu.Unlock()
 	}
 }
 
@@ -394,11 +857,15 @@ func (ks *KStore) Find(a accounts.Account) (accounts.Account, error) {
  * ----------
  */
 func (ks *KStore) NewAccount(passphrase string) (accounts.Account, error) {
-	key, account, err := storeNewKey(ks.Storage, crand.Reader, "", passphrase)
+	key, account, err := ks.storeNewKey(nil, passphrase)
 	if err != nil {
+		ks.audit(AuditNewAccount, common.Address{}, "", "", err)
 		return accounts.Account{}, err
 	}
+	defer zeroKey(key.PrivateKey)
+
 	_, err = ks.Storage.StoreAccount(key, "annon", "normal", nil, nil)
+	err = ks.audit(AuditNewAccount, account.Address, key.Id.String(), "", err)
 	return account, err
 }
 
@@ -407,421 +874,603 @@ func (ks *KStore) NewAccountOwner(ownerUuid, walletUuid,
 	owner := uuid.Parse(ownerUuid)
 	if owner == nil {
 		owner = uuid.NewRandom()
-		ownerUuid = owner.String()
 	}
 	wallet := uuid.Parse(walletUuid)
 	if wallet == nil {
 		wallet = uuid.NewRandom()
 	}
-	key, account, err := storeNewKey(ks.Storage, crand.Reader, ownerUuid, passphrase)
+	key, account, err := ks.storeNewKey(owner, passphrase)
 	if err != nil {
+		ks.audit(AuditNewAccount, common.Address{}, owner.String(), "", err)
 		return nil, nil, err
 	}
+	defer zeroKey(key.PrivateKey)
+
 	model, err := ks.Storage.StoreAccount(key, name, actType, &owner, &wallet)
+	err = ks.audit(AuditNewAccount, account.Address, owner.String(), "", err)
 	return &account, model, err
 }
 
 /**
- * Export
- * ------
- */
-func (ks *KStore) Export(a accounts.Account,
-	passphase, newPassPhase string) ([]byte, error) {
-	return nil, nil
-}
-
-/**
- * Import
- * ------
+ * NewHDWallet
+ * -----------
+ * Make a new BIP39 seed for the owner, stored encrypted with the passphrase, and
+ * derive its first account.  An owner can have only one seed.
  */
-func (ks *KStore) Import(keyJson []byte,
-	passphase, newPassphase string) (accounts.Account, error) {
-	acct := accounts.Account{}
-	fmt.Printf("Import json key %v, pass %s %s\n", keyJson, passphase, newPassphase)
-	return acct, nil
+func (ks *KStore) NewHDWallet(ownerUuid, walletUuid,
+	passphrase string) (*accounts.Account, *models.Account, error) {
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		owner = uuid.NewRandom()
+	}
+	wallet := uuid.Parse(walletUuid)
+	if wallet == nil {
+		wallet = uuid.NewRandom()
+	}
+	mnemonic, err := newMnemonic()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ks.storeSeed(owner, wallet, mnemonic, passphrase)
 }
 
 /**
- * ImportECDSA
- * -----------
+ * storeSeed
+ * ---------
+ * Store the mnemonic encrypted under the owner and pin the account at the default
+ * derivation path.
  */
-func (ks *KStore) ImportECDSA(priv *ecdsa.PrivateKey,
-	passphrase string) (accounts.Account, error) {
-	key := newKeyFromECDSA(priv)
-	acct := accounts.Account{
-		Address: key.Address,
-		URL:     NewURL(key.Id.String()),
+func (ks *KStore) storeSeed(owner, wallet uuid.UUID,
+	mnemonic, passphrase string) (*accounts.Account, *models.Account, error) {
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return nil, nil, fmt.Errorf("Invalid mnemonic")
 	}
-	_, wallet := ks.getAccountKey(acct)
-	if wallet != nil {
-		return accounts.Account{}, fmt.Errorf("account already exists")
+	scryptN, scryptP := ks.Storage.ScryptParams()
+	encSeed, err := encryptSeed(mnemonic, passphrase, scryptN, scryptP)
+	if err != nil {
+		return nil, nil, err
 	}
-	ownerUuid := acct.URL.Path
-	if err := ks.Storage.StoreKey(ownerUuid, key, passphrase); err != nil {
-		return accounts.Account{}, err
+	seedRec := &models.WalletSeed{
+		OwnerUuid:  owner.String(),
+		WalletUuid: wallet.String(),
+		Seed:       encSeed,
 	}
-	wallet = NewWallet(ks, ownerUuid)
-	wallet.Add(&models.AccountKey{
-		Account:   key.Address.Hex(),
-		OwnerUuid: acct.URL.Path,
-		PassKey:   passphrase,
-		PrivKey:   hex.EncodeToString(crypto.FromECDSA(priv)),
-	}, key, &acct)
-
-	ks.AddWallet(wallet)
-	// Send event to update account manager
-	return acct, nil
+	if err = ks.Storage.StoreSeed(seedRec); err != nil {
+		return nil, nil, err
+	}
+	seed := bip39.NewSeed(mnemonic, "")
+	defer zeroBytes(seed)
+
+	acct, model, err := ks.loadWallet(seedRec.OwnerUuid).deriveAccount(seed,
+		accounts.DefaultBaseDerivationPath, true, seedRec.WalletUuid, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &acct, model, nil
 }
 
 /**
- * Update
- * ------
+ * ExportMnemonic
+ * --------------
+ * Return the owner's BIP39 mnemonic decrypted with the wallet passphrase.
  */
-func (ks *KStore) Update(a accounts.Account, passphrase, newPassphrase string) error {
-	return nil
+func (ks *KStore) ExportMnemonic(ownerUuid, passphrase string) (string, error) {
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		return "", fmt.Errorf("Invalid owner uuid %s", ownerUuid)
+	}
+	if err := ks.checkFrozen(owner.String()); err != nil {
+		return "", err
+	}
+	seedRec, err := ks.Storage.GetSeed(owner.String())
+	if err != nil {
+		return "", err
+	}
+	return decryptSeed(seedRec.Seed, passphrase)
 }
 
 /**
- * ImportPreSaleKey
- * ----------------
+ * RestoreWallet
+ * -------------
+ * Rebuild the owner's HD wallet from the mnemonic.  The seed is stored if lost,
+ * then the accounts used on the chain are derived again with their key and
+ * account records.  The passphrase must match a seed still stored.
  */
-func (ks *KStore) ImportPreSaleKey(keyJSON []byte,
-	passphrase string) (accounts.Account, error) {
-	acct := accounts.Account{}
-	return acct, nil
-}
-
-func getDecryptedKey(acctKey *models.AccountKey, passwd string) (*keystore.Key, error) {
-	s := acctKey.Account
-	if s[0] == '0' {
-		s = s[1:]
+func (ks *KStore) RestoreWallet(ownerUuid, mnemonic, passphrase string,
+	chain ethereum.ChainStateReader) ([]accounts.Account, error) {
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		return nil, fmt.Errorf("Invalid owner uuid %s", ownerUuid)
 	}
-	if s[0] == 'x' || s[0] == 'X' {
-		s = s[1:]
+	ownerUuid = owner.String()
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+
+	seedRec, err := ks.Storage.GetSeed(ownerUuid)
+	if IsNotFound(err) {
+		// Keep the wallet uuid of the account records left, if any.
+		wallet := uuid.NewRandom()
+		if acctRecs, err := ks.Storage.GetUserAccount(owner); err == nil && len(acctRecs) > 0 {
+			if curr := uuid.Parse(acctRecs[0].WalletUuid); curr != nil {
+				wallet = curr
+			}
+		}
+		if _, _, err = ks.storeSeed(owner, wallet, mnemonic, passphrase); err != nil {
+			return nil, err
+		}
+		seedRec, err = ks.Storage.GetSeed(ownerUuid)
 	}
-	addr, err := hex.DecodeString(s)
 	if err != nil {
 		return nil, err
 	}
-	privKey, err := crypto.HexToECDSA(acctKey.PrivKey)
+	stored, err := decryptSeed(seedRec.Seed, passphrase)
 	if err != nil {
 		return nil, err
 	}
-	return &keystore.Key{
-		Id:         uuid.Parse(acctKey.OwnerUuid),
-		Address:    common.BytesToAddress(addr),
-		PrivateKey: privKey,
-	}, nil
+	if stored != mnemonic {
+		return nil, fmt.Errorf("Owner %s has a different wallet seed", ownerUuid)
+	}
+	seed := bip39.NewSeed(mnemonic, "")
+	defer zeroBytes(seed)
+
+	wallet := ks.loadWallet(ownerUuid)
+	derive := func(path accounts.DerivationPath, pin bool) (accounts.Account, error) {
+		acct, _, err := wallet.deriveAccount(seed, path, pin, seedRec.WalletUuid, passphrase)
+		return acct, err
+	}
+	err = wallet.deriveUsed(accounts.DefaultBaseDerivationPath, chain, derive)
+	return wallet.Accounts(), err
 }
 
 /**
- * newKeyFromECDSA
- * ---------------
+ * Export
+ * ------
+ * Export the account as a V3 JSON key, re-encrypted with the new passphrase.
  */
-func newKeyFromECDSA(privateKeyECDSA *ecdsa.PrivateKey) *keystore.Key {
-	id := uuid.NewRandom()
-	key := &keystore.Key{
-		Id:         id,
-		Address:    crypto.PubkeyToAddress(privateKeyECDSA.PublicKey),
-		PrivateKey: privateKeyECDSA,
+func (ks *KStore) Export(a accounts.Account,
+	passphrase, newPassphrase string) (keyJson []byte, err error) {
+	defer func() {
+		err = ks.audit(AuditExport, a.Address, ks.ownerOf(a.Address), "", err)
+		if err != nil {
+			keyJson = nil
+		}
+	}()
+
+	acctKey, _ := ks.getAccountKey(a)
+	if acctKey == nil {
+		return nil, accounts.ErrUnknownAccount
 	}
-	return key
+	if err = ks.checkFrozen(acctKey.OwnerUuid); err != nil {
+		return nil, err
+	}
+	key, err := ks.Storage.DecryptKeyRec(acctKey.AccountKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+
+	// Don't leak the owner uuid, the exported key gets its own id.
+	key.Id = uuid.NewRandom()
+	scryptN, scryptP := ks.Storage.ScryptParams()
+	return keystore.EncryptKey(key, newPassphrase, scryptN, scryptP)
 }
 
 /**
- * newKey
+ * Import
  * ------
+ * Import a V3 JSON key under a new owner.
  */
-func newKey(rand io.Reader) (*keystore.Key, error) {
-	privKeyECDSA, err := ecdsa.GenerateKey(crypto.S256(), rand)
+func (ks *KStore) Import(keyJson []byte,
+	passphrase, newPassphrase string) (accounts.Account, error) {
+	acct, _, err := ks.ImportOwner(keyJson,
+		passphrase, newPassphrase, "", "", "", "normal")
 	if err != nil {
-		return nil, err
+		return accounts.Account{}, err
 	}
-	return newKeyFromECDSA(privKeyECDSA), nil
+	return *acct, nil
 }
 
 /**
- * storeNewKey
+ * ImportOwner
  * -----------
+ * Decrypt the V3 JSON key with the passphrase, store it encrypted with the new
+ * passphrase under the owner and wallet uuid.  New uuids are made for the ones
+ * not given.
  */
-func storeNewKey(ks keystore.KeyStoreIf, rand io.Reader,
-	ownerUuid, auth string) (*keystore.Key, accounts.Account, error) {
-	key, err := newKey(rand)
+func (ks *KStore) ImportOwner(keyJson []byte, passphrase, newPassphrase,
+	ownerUuid, walletUuid, name, actType string) (*accounts.Account, *models.Account, error) {
+	key, err := keystore.DecryptKey(keyJson, passphrase)
 	if err != nil {
-		return nil, accounts.Account{}, err
+		ks.audit(AuditImport, common.Address{}, ownerUuid, "", err)
+		return nil, nil, err
 	}
-	owner := key.Id
-	if ownerUuid != "" {
-		if owner = uuid.Parse(ownerUuid); owner != nil {
-			key.Id = owner
-		}
+	defer zeroKey(key.PrivateKey)
+
+	owner := uuid.Parse(ownerUuid)
+	if owner == nil {
+		owner = uuid.NewRandom()
 	}
-	ownerStr := owner.String()
-	a := accounts.Account{
-		Address: key.Address,
-		URL: accounts.URL{
-			Scheme: "sql",
-			Path:   ownerStr,
-		},
+	wallet := uuid.Parse(walletUuid)
+	if wallet == nil {
+		wallet = uuid.NewRandom()
 	}
-	if err := ks.StoreKey(ownerStr, key, auth); err != nil {
-		return nil, a, err
+	acct, err := ks.importKey(key, owner, newPassphrase)
+	if err != nil {
+		ks.audit(AuditImport, key.Address, owner.String(), "", err)
+		return nil, nil, err
 	}
-	return key, a, err
+	model, err := ks.Storage.StoreAccount(key, name, actType, &owner, &wallet)
+	err = ks.audit(AuditImport, key.Address, owner.String(), "", err)
+	return &acct, model, err
 }
 
 /**
- * Base KeyStore
+ * ImportECDSA
+ * -----------
  */
-func (ks *BaseKeyStore) GetOrm() orm.Ormer {
-	return ks.ormHandler
+func (ks *KStore) ImportECDSA(priv *ecdsa.PrivateKey,
+	passphrase string) (accounts.Account, error) {
+	key := newKeyFromECDSA(priv)
+	acct, err := ks.importKey(key, key.Id, passphrase)
+	if err == nil {
+		_, err = ks.Storage.StoreAccount(key, "", "normal", nil, nil)
+	}
+	err = ks.audit(AuditImport, key.Address, key.Id.String(), "", err)
+	return acct, err
 }
 
-func (ks *BaseKeyStore) JoinPath(filename string) string {
-	return filename
+/**
+ * importKey
+ * ---------
+ * Store the key encrypted under the owner and add it to the owner's wallet.
+ */
+func (ks *KStore) importKey(key *keystore.Key,
+	owner uuid.UUID, passphrase string) (accounts.Account, error) {
+	if ks.HasAddress(key.Address) {
+		return accounts.Account{}, fmt.Errorf("account already exists")
+	}
+	key.Id = owner
+	acct := accounts.Account{
+		Address: key.Address,
+		URL:     NewURL(owner.String()),
+	}
+	keyRec, err := ks.Storage.StoreKeyUuid(key, owner, passphrase)
+	if err != nil {
+		return accounts.Account{}, err
+	}
+	acctKey := ks.addAccountKey(keyRec, &acct)
+	ks.sendEvent(acctKey.wallet, accounts.WalletArrived)
+	return acct, nil
 }
 
-func (ks *BaseKeyStore) SetKeyStoreRef(kstore *KStore) {
-	ks.kstore = kstore
+/**
+ * storeNewKey
+ * -----------
+ * Make a new key for the owner, a nil owner means the key id.
+ */
+func (ks *KStore) storeNewKey(owner uuid.UUID,
+	passphrase string) (*keystore.Key, accounts.Account, error) {
+	key, err := newKey(crand.Reader)
+	if err != nil {
+		return nil, accounts.Account{}, err
+	}
+	if owner == nil {
+		owner = key.Id
+	}
+	acct, err := ks.importKey(key, owner, passphrase)
+	if err != nil {
+		zeroKey(key.PrivateKey)
+		return nil, acct, err
+	}
+	return key, acct, nil
 }
 
 /**
- * SQL based keystore.
+ * sendEvent
+ * ---------
+ * Tell the subscribers about the wallet.  No lock must be held, the account
+ * manager may call back into the keystore.
  */
-func NewSqlKeyStore(scryptN, scryptP int) *SqlKeyStore {
-	return &SqlKeyStore{
-		BaseKeyStore: BaseKeyStore{scryptN, scryptP, nil, orm.NewOrm()},
+func (ks *KStore) sendEvent(wallet *Wallet, kind accounts.WalletEventType) {
+	ks.updateFeed.Send(accounts.WalletEvent{Wallet: wallet, Kind: kind})
+}
+
+/**
+ * addAccountKey
+ * -------------
+ * Add the account to its owner's wallet and the address index.
+ */
+func (ks *KStore) addAccountKey(keyRec *models.AccountKey,
+	acct *accounts.Account) *AccountKey {
+	owner := keyRec.OwnerUuid
+	wallet := ks.loadWallet(owner)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	acctKey := ks.acctIndex[acct.Address]
+	if acctKey == nil {
+		if curr := ks.wallets[owner]; curr != wallet {
+			// The wallet was dropped after we loaded it.
+			if curr == nil {
+				curr = NewWallet(ks, owner)
+				ks.wallets[owner] = curr
+			}
+			wallet = curr
+		}
+		acctKey = wallet.Add(keyRec, nil, acct)
+		ks.acctIndex[acct.Address] = acctKey
 	}
+	return acctKey
 }
 
 /**
- * StoreKey
- * --------
+ * removeAccountKey
+ * ----------------
+ * Remove the account from its wallet and the address index.  The wallet is
+ * dropped and returned when it has no account left.
  */
-func (ks *SqlKeyStore) StoreKey(filename string, key *keystore.Key, auth string) error {
-	return ks.StoreKeyUuid(key, key.Id, auth)
+func (ks *KStore) removeAccountKey(acctKey *AccountKey) *Wallet {
+	addr := acctKey.Account.Address
+	wallet := acctKey.wallet
+	wallet.Remove(*acctKey.Account)
+
+	ks.mu.Lock()
+	if ks.acctIndex[addr] == acctKey {
+		delete(ks.acctIndex, addr)
+	}
+	owner := wallet.OwnerUuid.String()
+	if wallet.size() != 0 || ks.wallets[owner] != wallet {
+		wallet = nil
+	} else {
+		delete(ks.wallets, owner)
+	}
+	ks.mu.Unlock()
+
+	ks.keyCache.remove(addr)
+	return wallet
 }
 
 /**
- * GetKey
+ * Update
  * ------
+ * Rotate the account passphrase.  Any decrypted copy of the key is dropped, the
+ * account must be unlocked again with the new passphrase.
  */
-func (ks *SqlKeyStore) GetKey(addr common.Address,
-	path, auth string) (*keystore.Key, error) {
-	return ks.GetKeyUuid(addr, uuid.Parse(path), auth)
+func (ks *KStore) Update(a accounts.Account, passphrase, newPassphrase string) error {
+	acctKey, _ := ks.getAccountKey(a)
+	if acctKey == nil {
+		return accounts.ErrUnknownAccount
+	}
+	keyRec, err := ks.Storage.UpdateKeyAuth(acctKey.Account.Address,
+		passphrase, newPassphrase)
+	if err != nil {
+		return err
+	}
+	ks.updateKeyRec(keyRec)
+	return ks.Lock(acctKey.Account.Address)
 }
 
 /**
- * GetAccount
- * ----------
+ * ImportPreSaleKey
+ * ----------------
  */
-func (ks *SqlKeyStore) GetAccount(addr common.Address) ([]models.Account, error) {
-	sql := fmt.Sprintf(
-		"SELECT * from account WHERE account=\"%s\"", addr.Hex())
-
-	return ks.getAccountQuery(sql)
+func (ks *KStore) ImportPreSaleKey(keyJSON []byte,
+	passphrase string) (accounts.Account, error) {
+	acct := accounts.Account{}
+	return acct, nil
 }
 
 /**
- * GetAccountOwner
+ * getDecryptedKey
  * ---------------
+ * Decrypt the V3 key blob stored in the account_key row with the passphrase.  Rows
+ * written before keys were encrypted still hold the hex private key; those are only
+ * released when the passphrase matches the one recorded with them.  The row must
+ * be unwrapped.
  */
-func (ks *SqlKeyStore) GetAccountOwner(addr, owner string) (*models.Account, error) {
-	sql := fmt.Sprintf(
-		"SELECT * from account where account=\"%s\" AND owner_uuid=\"%s\"", addr, owner)
-
-	results, err := ks.getAccountQuery(sql)
-	if err == nil {
-		return &results[0], err
+func getDecryptedKey(acctKey *models.AccountKey, passwd string) (*keystore.Key, error) {
+	if !isEncryptedKey(acctKey) {
+		return getPlainKey(acctKey, passwd)
+	}
+	key, err := keystore.DecryptKey([]byte(acctKey.PrivKey), passwd)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	if key.Address != common.HexToAddress(acctKey.Account) {
+		return nil, fmt.Errorf("key content mismatch: have account %x, want %s",
+			key.Address, acctKey.Account)
+	}
+	key.Id = uuid.Parse(acctKey.OwnerUuid)
+	return key, nil
 }
 
 /**
- * GetUserAccount
- * --------------
+ * getPlainKey
+ * -----------
+ * Legacy rows with the private key in hex and the passphrase in clear text.
  */
-func (ks *SqlKeyStore) GetUserAccount(ownerUuid uuid.UUID) ([]models.Account, error) {
-	sql := fmt.Sprintf(
-		"SELECT * from account WHERE owner_uuid=\"%s\"", ownerUuid.String())
-
-	return ks.getAccountQuery(sql)
+func getPlainKey(acctKey *models.AccountKey, passwd string) (*keystore.Key, error) {
+	if acctKey.PassKey != passwd {
+		return nil, keystore.ErrDecrypt
+	}
+	privKey, err := crypto.HexToECDSA(acctKey.PrivKey)
+	if err != nil {
+		return nil, err
+	}
+	key := newKeyFromECDSA(privKey)
+	if key.Address != common.HexToAddress(acctKey.Account) {
+		return nil, fmt.Errorf("key content mismatch: have account %x, want %s",
+			key.Address, acctKey.Account)
+	}
+	key.Id = uuid.Parse(acctKey.OwnerUuid)
+	return key, nil
 }
 
 /**
- * GetWallet
- * ---------
+ * isEncryptedKey
+ * --------------
+ * Encrypted keys are stored as Web3 Secret Storage JSON, plain keys as hex.
+ * Wrapped rows always hold an encrypted key.
  */
-func (ks *SqlKeyStore) GetWallet(walletUuid uuid.UUID) ([]models.Account, error) {
-	sql := fmt.Sprintf(
-		"SELECT * from account WHERE wallet_uuid=\"%s\"", walletUuid.String())
-
-	return ks.getAccountQuery(sql)
+func isEncryptedKey(acctKey *models.AccountKey) bool {
+	return acctKey.KeyVersion > 0 ||
+		strings.HasPrefix(strings.TrimSpace(acctKey.PrivKey), "{")
 }
 
 /**
- * GetTransaction
- * --------------
+ * zeroKey
+ * -------
+ * Zero out the private key in memory.
  */
-func (ks *SqlKeyStore) GetTransaction(addr *common.Address, owner *uuid.UUID,
-	from *bool, offset, limit int) ([]models.Transaction, error) {
-	var sql string
-	acct := "from_acct"
-	uuid := "from_uuid"
-
-	if from == nil {
-		hex := addr.Hex()
-		sql = fmt.Sprintf(
-			"SELECT * from transaction where from_acct=\"%s\" OR to_acct=\"%s\" ",
-			hex, hex)
-	} else {
-		if *from == false {
-			acct = "to_acct"
-			uuid = "to_uuid"
-		}
-		if addr != nil && owner != nil {
-			sql = fmt.Sprintf(
-				"SELECT * from transaction where %s=\"%s\" OR %s=\"%s\"",
-				acct, addr.Hex(), uuid, owner.String())
-
-		} else if addr != nil {
-			sql = fmt.Sprintf(
-				"SELECT * from transaction where %s=\"%s\"", acct, addr.Hex())
-
-		} else if owner != nil {
-			sql = fmt.Sprintf(
-				"SELECT * from transaction where %s=\"%s\"", uuid, owner.String())
-		} else {
-			return nil, errors.New("Invalid arguments")
-		}
+func zeroKey(k *ecdsa.PrivateKey) {
+	b := k.D.Bits()
+	for i := range b {
+		b[i] = 0
 	}
-	if limit != 0 {
-		sql = fmt.Sprintf("%s LIMIT %d OFFSET %d", sql, limit, offset)
-	}
-	return ks.getTransQuery(sql)
 }
 
 /**
- * getAccountQuery
+ * newKeyFromECDSA
  * ---------------
  */
-func (ks *SqlKeyStore) getAccountQuery(sql string) ([]models.Account, error) {
-	var results []models.Account
-	orm := ks.GetOrm()
-
-	orm.Raw(sql).QueryRows(&results)
-	if len(results) > 0 {
-		return results, nil
+func newKeyFromECDSA(privateKeyECDSA *ecdsa.PrivateKey) *keystore.Key {
+	id := uuid.NewRandom()
+	key := &keystore.Key{
+		Id:         id,
+		Address:    crypto.PubkeyToAddress(privateKeyECDSA.PublicKey),
+		PrivateKey: privateKeyECDSA,
 	}
-	return nil, errors.New("No account record found")
+	return key
 }
 
 /**
- * getTransQuery
- * -------------
+ * newKey
+ * ------
  */
-func (ks *SqlKeyStore) getTransQuery(sql string) ([]models.Transaction, error) {
-	var results []models.Transaction
-	orm := ks.GetOrm()
+func newKey(rand io.Reader) (*keystore.Key, error) {
+	privKeyECDSA, err := ecdsa.GenerateKey(crypto.S256(), rand)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyFromECDSA(privKeyECDSA), nil
+}
 
-	orm.Raw(sql).QueryRows(&results)
-	if len(results) > 0 {
-		return results, nil
+/**
+ * Base KeyStore
+ */
+func newBaseKeyStore(scryptN, scryptP int) BaseKeyStore {
+	return BaseKeyStore{
+		scryptN: scryptN,
+		scryptP: scryptP,
+		origin:  uuid.NewRandom().String(),
 	}
-	return nil, errors.New("No transaction record found")
 }
 
 /**
- * UpdateAccount
+ * encryptKeyRec
  * -------------
+ * Encrypt the key with the passphrase, then wrap it with the current master key.
  */
-func (ks *SqlKeyStore) UpdateAccount(addr common.Address,
-	name, actType string, ownerUuid, walletUuid uuid.UUID) error {
-	sql := fmt.Sprintf(
-		"SELECT * from account WHERE account=\"%s\" and owner_uuid=\"%s\"",
-		addr.Hex(), ownerUuid.String())
-
-	results, err := ks.getAccountQuery(sql)
+func (ks *BaseKeyStore) encryptKeyRec(k *keystore.Key,
+	owner string, auth string) (*models.AccountKey, error) {
+	keyJson, err := keystore.EncryptKey(k, auth, ks.scryptN, ks.scryptP)
 	if err != nil {
-		acctRec := &models.Account{
-			OwnerUuid:  ownerUuid.String(),
-			WalletUuid: walletUuid.String(),
-			PublicName: name,
-			Account:    addr.Hex(),
-			Type:       actType,
-		}
-		_, err := ks.GetOrm().Insert(acctRec)
-		return err
+		return nil, err
 	}
-	obj := &results[0]
-	if walletUuid != nil {
-		obj.WalletUuid = walletUuid.String()
+	keyRec := &models.AccountKey{
+		Account:   k.Address.Hex(),
+		OwnerUuid: owner,
+		PrivKey:   string(keyJson),
 	}
-	obj.PublicName = name
-	obj.Type = actType
-
-	_, err = ks.ormHandler.Update(obj)
-	return err
+	return ks.wrapKeyRec(keyRec)
 }
 
 /**
- * GetKeyUuid
- * ----------
+ * DecryptKeyRec
+ * -------------
+ * Unwrap the row with its master key version and decrypt the key.
  */
-func (ks *SqlKeyStore) GetKeyUuid(addr common.Address,
-	owner uuid.UUID, auth string) (*keystore.Key, error) {
-	var results []models.AccountKey
-
-	orm := ks.GetOrm()
-	sql := fmt.Sprintf("SELECT * FROM account_key WHERE Account = %s", addr.Hex())
-
-	orm.Raw(sql).QueryRows(&results)
-	if len(results) > 0 {
-		acct := &results[0]
-		return getDecryptedKey(acct, auth)
+func (ks *BaseKeyStore) DecryptKeyRec(keyRec *models.AccountKey,
+	auth string) (*keystore.Key, error) {
+	plain, err := ks.unwrapKeyRec(keyRec)
+	if err != nil {
+		return nil, err
 	}
-	return nil, accounts.ErrUnknownAccount
+	return getDecryptedKey(plain, auth)
 }
 
 /**
- * StoreAccountKey
- * ---------------
+ * wrapKeyRec
+ * ----------
+ * Return the row with the key sealed by the current master key.  Rows are left
+ * as is without a master key, and legacy plain rows until they are migrated.
  */
-func (ks *SqlKeyStore) StoreAccount(key *keystore.Key, name, actType string,
-	ownerUuid *uuid.UUID, walletUuid *uuid.UUID) (*models.Account, error) {
-	if walletUuid == nil {
-		uid := uuid.NewRandom()
-		walletUuid = &uid
+func (ks *BaseKeyStore) wrapKeyRec(keyRec *models.AccountKey) (*models.AccountKey, error) {
+	if ks.master == nil || keyRec.KeyVersion == ks.master.Current() ||
+		!isEncryptedKey(keyRec) {
+		return keyRec, nil
 	}
-	if ownerUuid == nil {
-		ownerUuid = &key.Id
-	}
-	if name == "" {
-		name = "Anonymous"
+	plain, err := ks.unwrapKeyRec(keyRec)
+	if err != nil {
+		return nil, err
 	}
-	orm := ks.ormHandler
-	acctRec := &models.Account{
-		OwnerUuid:  ownerUuid.String(),
-		WalletUuid: walletUuid.String(),
-		PublicName: name,
-		Account:    key.Address.Hex(),
-		Type:       actType,
+	version, wrapped, err := ks.master.wrap(plain.Account, []byte(plain.PrivKey))
+	if err != nil {
+		return nil, err
 	}
-	_, err := orm.Insert(acctRec)
-	return acctRec, err
+	rec := *plain
+	rec.PrivKey = ""
+	rec.WrapKey = wrapped
+	rec.KeyVersion = version
+	return &rec, nil
 }
 
 /**
- * StoreKeyUuid
+ * unwrapKeyRec
  * ------------
+ * Return the row with the V3 JSON in PrivKey.
  */
-func (ks *SqlKeyStore) StoreKeyUuid(k *keystore.Key, owner uuid.UUID, auth string) error {
-	keyRec := &models.AccountKey{
-		Account:   k.Address.Hex(),
-		OwnerUuid: owner.String(),
-		PassKey:   auth,
-		PrivKey:   hex.EncodeToString(crypto.FromECDSA(k.PrivateKey)),
+func (ks *BaseKeyStore) unwrapKeyRec(keyRec *models.AccountKey) (*models.AccountKey, error) {
+	if keyRec.KeyVersion == 0 {
+		return keyRec, nil
 	}
-	_, err := ks.ormHandler.Insert(keyRec)
-	return err
+	plain, err := ks.master.unwrap(keyRec.Account, keyRec.KeyVersion, keyRec.WrapKey)
+	if err != nil {
+		return nil, err
+	}
+	rec := *keyRec
+	rec.PrivKey = string(plain)
+	rec.WrapKey = ""
+	rec.KeyVersion = 0
+	return &rec, nil
+}
+
+/**
+ * SetMasterKeys
+ * -------------
+ * Wrap the rows written from now on with the master keys.
+ */
+func (ks *BaseKeyStore) SetMasterKeys(master *MasterKeys) {
+	ks.master = master
+}
+
+func (ks *BaseKeyStore) MasterKeys() *MasterKeys {
+	return ks.master
+}
+
+func (ks *BaseKeyStore) JoinPath(filename string) string {
+	return filename
+}
+
+func (ks *BaseKeyStore) SetKeyStoreRef(kstore *KStore) {
+	ks.kstore = kstore
+}
+
+func (ks *BaseKeyStore) ScryptParams() (int, int) {
+	return ks.scryptN, ks.scryptP
+}
+
+// Origin is the id recorded with the key changes made by this process.
+func (ks *BaseKeyStore) Origin() string {
+	return ks.origin
 }
@@ -0,0 +1,287 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+func TestKeyEncryption(t *testing.T) {
+	base := newBaseKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	key, _ := newKey(rand.Reader)
+	owner := uuid.NewRandom().String()
+	keyRec, err := base.encryptKeyRec(key, owner, "pass")
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	if !isEncryptedKey(keyRec) || keyRec.PassKey != "" ||
+		strings.Contains(keyRec.PrivKey, "pass") {
+		t.Errorf("key not stored encrypted: %+v", keyRec)
+	}
+	if _, err = getDecryptedKey(keyRec, "wrong"); err != keystore.ErrDecrypt {
+		t.Errorf("decrypt with a wrong passphrase: %v", err)
+	}
+	got, err := getDecryptedKey(keyRec, "pass")
+	if err != nil || got.Address != key.Address || got.Id.String() != owner {
+		t.Errorf("decrypt failed: %v", err)
+	}
+
+	// A row of another account doesn't open.
+	other, _ := newKey(rand.Reader)
+	keyRec.Account = other.Address.Hex()
+	if _, err = getDecryptedKey(keyRec, "pass"); err == nil {
+		t.Errorf("key released for another account")
+	}
+}
+
+func TestPlainKey(t *testing.T) {
+	key, _ := newKey(rand.Reader)
+	keyRec := &models.AccountKey{
+		Account:   key.Address.Hex(),
+		OwnerUuid: uuid.NewRandom().String(),
+		PassKey:   "legacy",
+		PrivKey:   hex.EncodeToString(crypto.FromECDSA(key.PrivateKey)),
+	}
+	if isEncryptedKey(keyRec) {
+		t.Fatalf("plain key taken as encrypted")
+	}
+	if _, err := getDecryptedKey(keyRec, ""); err != keystore.ErrDecrypt {
+		t.Errorf("plain key released without its passphrase: %v", err)
+	}
+	got, err := getDecryptedKey(keyRec, "legacy")
+	if err != nil || got.Address != key.Address {
+		t.Errorf("plain key failed: %v", err)
+	}
+}
+
+func TestKeyEncryptedAtRest(t *testing.T) {
+	storages := map[string]KsInterface{
+		"memory": NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP),
+		"sqlite": newSqlStorage(t),
+	}
+	for name, storage := range storages {
+		ks := newTestKStore(t, storage, 0)
+		acct, _, err := ks.NewAccountOwner(uuid.NewRandom().String(), "", "a",
+			"pass", "normal")
+		if err != nil {
+			t.Fatalf("%s: new account failed: %v", name, err)
+		}
+		keyRec, err := storage.GetKeyRecord(acct.Address)
+		if err != nil {
+			t.Fatalf("%s: key record failed: %v", name, err)
+		}
+		if keyRec.PassKey != "" || strings.Contains(keyRec.PrivKey, "pass") {
+			t.Errorf("%s: passphrase stored with the key", name)
+		}
+		var keyJson struct {
+			Address string
+			Crypto  struct {
+				Kdf       string
+				KdfParams map[string]interface{}
+			}
+		}
+		if err = json.Unmarshal([]byte(keyRec.PrivKey), &keyJson); err != nil {
+			t.Fatalf("%s: key isn't V3 JSON: %v", name, err)
+		}
+		if keyJson.Crypto.Kdf != "scrypt" ||
+			keyJson.Crypto.KdfParams["n"] != float64(keystore.LightScryptN) {
+			t.Errorf("%s: key not encrypted with the keystore scrypt: %+v",
+				name, keyJson.Crypto)
+		}
+		if _, err = storage.DecryptKeyRec(keyRec, "wrong"); err != keystore.ErrDecrypt {
+			t.Errorf("%s: decrypt with a wrong passphrase: %v", name, err)
+		}
+		key, err := storage.DecryptKeyRec(keyRec, "pass")
+		if err != nil || key.Address != acct.Address {
+			t.Errorf("%s: decrypt failed: %v", name, err)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	from := newTestKStore(t, NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP), 0)
+	owner := uuid.NewRandom().String()
+	acct, _, err := from.NewAccountOwner(owner, "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if _, err = from.Export(*acct, "wrong", "export"); err == nil {
+		t.Errorf("exported with a wrong passphrase")
+	}
+	keyJson, err := from.Export(*acct, "pass", "export")
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	key, err := keystore.DecryptKey(keyJson, "export")
+	if err != nil || key.Address != acct.Address {
+		t.Fatalf("exported key doesn't decrypt: %v", err)
+	}
+	if key.Id.String() == owner {
+		t.Errorf("owner uuid exported as the key id")
+	}
+
+	// Geth reads the exported key.
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileKs := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	if fileAcct, err := fileKs.Import(keyJson, "export", "file"); err != nil ||
+		fileAcct.Address != acct.Address {
+		t.Errorf("geth import failed: %v", err)
+	}
+
+	to := newTestKStore(t, NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP), 0)
+	newOwner, wallet := uuid.NewRandom().String(), uuid.NewRandom().String()
+	if _, _, err = to.ImportOwner(keyJson, "wrong", "new", newOwner, wallet, "b",
+		"normal"); err == nil {
+		t.Errorf("imported with a wrong passphrase")
+	}
+	imported, model, err := to.ImportOwner(keyJson, "export", "new", newOwner, wallet,
+		"b", "normal")
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if imported.Address != acct.Address || imported.URL != NewURL(newOwner) ||
+		model.WalletUuid != wallet || model.PublicName != "b" {
+		t.Errorf("imported account %+v, %+v", imported, model)
+	}
+	if _, err = to.Import(keyJson, "export", "new"); err == nil {
+		t.Errorf("key imported twice")
+	}
+	if err = to.Unlock(accounts.Account{Address: acct.Address}, "export"); err == nil {
+		t.Errorf("imported key unlocked with the export passphrase")
+	}
+	if err = to.Unlock(accounts.Account{Address: acct.Address}, "new"); err != nil {
+		t.Errorf("unlock of the imported key failed: %v", err)
+	}
+}
+
+func TestUpdatePassphrase(t *testing.T) {
+	storages := map[string]KsInterface{
+		"memory": NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP),
+		"sqlite": newSqlStorage(t),
+	}
+	for name, storage := range storages {
+		ks := newTestKStore(t, storage, 0)
+		acct, _, err := ks.NewAccountOwner(uuid.NewRandom().String(), "", "a",
+			"pass", "normal")
+		if err != nil {
+			t.Fatalf("%s: new account failed: %v", name, err)
+		}
+		ks.Unlock(*acct, "pass")
+		if err = ks.Update(*acct, "wrong", "new"); err != keystore.ErrDecrypt {
+			t.Errorf("%s: update with a wrong passphrase: %v", name, err)
+		}
+		if ks.GetAccountKey(acct.Address).Key == nil {
+			t.Errorf("%s: failed update locked the key", name)
+		}
+		if err = ks.Update(*acct, "pass", "new"); err != nil {
+			t.Fatalf("%s: update failed: %v", name, err)
+		}
+		if ks.GetAccountKey(acct.Address).Key != nil {
+			t.Errorf("%s: key still unlocked after the update", name)
+		}
+		if err = ks.Unlock(*acct, "pass"); err == nil {
+			t.Errorf("%s: old passphrase still unlocks", name)
+		}
+		if err = ks.Unlock(*acct, "new"); err != nil {
+			t.Errorf("%s: new passphrase doesn't unlock: %v", name, err)
+		}
+		keyRec, _ := storage.GetKeyRecord(acct.Address)
+		if _, err = storage.DecryptKeyRec(keyRec, "new"); err != nil {
+			t.Errorf("%s: stored key not encrypted with the new passphrase", name)
+		}
+		other := accounts.Account{Address: common.HexToAddress("0x1234")}
+		if err = ks.Update(other, "pass", "new"); err != accounts.ErrUnknownAccount {
+			t.Errorf("%s: update of an unknown account: %v", name, err)
+		}
+	}
+}
+
+func TestTimedUnlock(t *testing.T) {
+	ks := newTestKStore(t, NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP), 0)
+	owner := uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if _, _, err = ks.NewAccountOwner(owner, "", "b", "pass", "normal"); err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	wallet, _ := ks.OwnerWallet(owner)
+	status := func() string {
+		status, _ := wallet.Status()
+		return status
+	}
+	hash := make([]byte, 32)
+
+	if err = ks.TimedUnlock(*acct, "wrong", time.Second); err != keystore.ErrDecrypt {
+		t.Errorf("unlock with a wrong passphrase: %v", err)
+	}
+	if _, err = ks.SignHash(*acct, hash); err != keystore.ErrLocked {
+		t.Errorf("sign while locked: %v", err)
+	}
+	if err = ks.TimedUnlock(*acct, "pass", 100*time.Millisecond); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if status() != "Unlocked 1/2" {
+		t.Errorf("status %s", status())
+	}
+	key := ks.GetAccountKey(acct.Address).Key
+	if _, err = ks.SignHash(*acct, hash); err != nil {
+		t.Errorf("sign while unlocked: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err = ks.SignHash(*acct, hash); err != keystore.ErrLocked {
+		t.Errorf("sign after the timeout: %v", err)
+	}
+	for _, word := range key.PrivateKey.D.Bits() {
+		if word != 0 {
+			t.Fatalf("expired key not zeroed")
+		}
+	}
+	if status() != "Locked" {
+		t.Errorf("status %s after the timeout", status())
+	}
+
+	// Unlocking again replaces the timeout.
+	ks.TimedUnlock(*acct, "pass", 100*time.Millisecond)
+	ks.TimedUnlock(*acct, "pass", time.Minute)
+	time.Sleep(300 * time.Millisecond)
+	if _, err = ks.SignHash(*acct, hash); err != nil {
+		t.Errorf("timeout not extended: %v", err)
+	}
+	ks.Lock(acct.Address)
+	if _, err = ks.SignHash(*acct, hash); err != keystore.ErrLocked {
+		t.Errorf("sign after the lock: %v", err)
+	}
+
+	// An account unlocked until locked keeps no timeout.
+	ks.Unlock(*acct, "pass")
+	ks.TimedUnlock(*acct, "pass", 100*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	if _, err = ks.SignHash(*acct, hash); err != nil {
+		t.Errorf("indefinite unlock expired: %v", err)
+	}
+}
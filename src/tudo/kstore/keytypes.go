@@ -8,25 +8,92 @@
 package kstore
 
 import (
+	"errors"
+	"math/big"
 	"sync"
+	"time"
 
 	"github.com/astaxie/beego/orm"
+	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/pborman/uuid"
 	"tudo/models"
 )
 
+// Errors returned by KsInterface when no record matches the query.  Other errors
+// come from the database.
+var (
+	ErrNoAccount  = errors.New("No account record found")
+	ErrNoTrans    = errors.New("No transaction record found")
+	ErrNoSeed     = errors.New("No wallet seed found")
+	ErrNoApproval = errors.New("No approval request found")
+	ErrNoPolicy   = errors.New("No spending policy found")
+	ErrNoFreeze   = errors.New("Owner is not frozen")
+)
+
+/**
+ * IsNotFound
+ * ----------
+ * Return true if the storage error means no matching record.
+ */
+func IsNotFound(err error) bool {
+	return err == ErrNoAccount || err == ErrNoTrans || err == ErrNoSeed ||
+		err == ErrNoApproval || err == ErrNoPolicy || err == ErrNoFreeze ||
+		err == accounts.ErrUnknownAccount
+}
+
+/**
+ * Position of a mined transaction in the chain, the transactions are listed in
+ * this order.  TxHash orders the rows at the same position.
+ */
+type TransCursor struct {
+	BlockNumber int64
+	TxIndex     int
+	TxHash      string
+}
+
+/**
+ * Transactions selected by ListTransactions.  The rows match the account or the
+ * owner on the side given by From, sent when true, received when false, either
+ * side when nil.  Peer is the account on the other side.  XuAmount is within
+ * MinXu and MaxXu when set, Created within [Since, Until) when not zero.
+ *
+ * The mined rows are listed newest first, or oldest first with Oldest, after the
+ * cursor when set, else after the first Offset rows.  Pending lists instead the
+ * rows not seen in a block yet, by creation time.
+ */
+type TransQuery struct {
+	Account *common.Address
+	Owner   uuid.UUID
+	From    *bool
+	Peer    *common.Address
+	MinXu   *uint64
+	MaxXu   *uint64
+	Since   time.Time
+	Until   time.Time
+	Pending bool
+	Oldest  bool
+	After   *TransCursor
+	Offset  int
+	Limit   int
+}
+
 /**
  * KeyStore Storage specific interface
  */
 type KsInterface interface {
 	keystore.KeyStoreIf
 
-	GetOrm() orm.Ormer
 	SetKeyStoreRef(kstore *KStore)
+	ScryptParams() (int, int)
+	Origin() string
+	SetMasterKeys(master *MasterKeys)
+	MasterKeys() *MasterKeys
+	DecryptKeyRec(keyRec *models.AccountKey, auth string) (*keystore.Key, error)
 
 	GetAccount(addr common.Address) ([]models.Account, error)
 	GetAccountOwner(addr, ownerUuid string) (*models.Account, error)
@@ -36,12 +103,68 @@ type KsInterface interface {
 	GetTransaction(addr *common.Address, owner *uuid.UUID,
 		from *bool, offset, limit int) ([]models.Transaction, error)
 	GetKeyUuid(addr common.Address, owner uuid.UUID, auth string) (*keystore.Key, error)
+	GetKeyRecord(addr common.Address) (*models.AccountKey, error)
+	GetOwnerKeys(ownerUuid string) ([]models.AccountKey, error)
+	GetAccountKeys(offset, limit int) ([]models.AccountKey, error)
+	ArchiveKey(addr common.Address) error
+	GetArchivedKey(addr common.Address) (*models.AccountKey, error)
+	GetArchivedKeys(before int64, limit int) ([]models.AccountKey, error)
+	RestoreKey(addr common.Address, since int64) (*models.AccountKey, error)
+	PurgeKey(addr common.Address) error
 
 	StoreAccount(k *keystore.Key, name, passwd string,
 		ownerUuid *uuid.UUID, walletUuid *uuid.UUID) (*models.Account, error)
-	StoreKeyUuid(k *keystore.Key, owner uuid.UUID, auth string) error
+	StoreKeyUuid(k *keystore.Key, owner uuid.UUID, auth string) (*models.AccountKey, error)
+	UpdateKeyAuth(addr common.Address, auth, newAuth string) (*models.AccountKey, error)
+	MigratePlainKeys() (int, error)
+	RewrapKeys(batch int) (int, error)
 	UpdateAccount(addr common.Address, name, actType string,
 		ownerUuid uuid.UUID, walletUuid uuid.UUID) error
+	StoreTransaction(trans *models.Transaction) error
+	ListTransactions(query *TransQuery) ([]models.Transaction, error)
+	SetTransBlock(txHash string, blockNumber int64, txIndex int) error
+
+	GetKeyChanges(afterId int64, limit int) ([]models.KeyChange, error)
+	LastKeyChange() (int64, error)
+	PruneKeyChanges(before time.Time) (int64, error)
+
+	GetSeed(ownerUuid string) (*models.WalletSeed, error)
+	StoreSeed(seed *models.WalletSeed) error
+
+	GetApprovalReq(id int64) (*models.ApprovalRequest, error)
+	GetApprovalReqByHash(account, sigHash string) (*models.ApprovalRequest, error)
+	ListApprovalReqs(status string, offset, limit int) ([]models.ApprovalRequest, error)
+	StoreApprovalReq(req *models.ApprovalRequest) error
+	UpdateApprovalReq(req *models.ApprovalRequest, from string) (bool, error)
+	GetApprovals(reqId int64) ([]models.Approval, error)
+	StoreApproval(appr *models.Approval) error
+
+	AppendAudit(rec *models.AuditRecord) error
+	GetAuditRecords(afterId int64, limit int) ([]models.AuditRecord, error)
+	GetAuditHead() (*models.AuditHead, error)
+
+	GetSpendPolicy(scope string) (*models.SpendPolicy, error)
+	ListSpendPolicies(offset, limit int) ([]models.SpendPolicy, error)
+	StoreSpendPolicy(policy *models.SpendPolicy) error
+	DeleteSpendPolicy(scope string) error
+	AddSpend(rec *models.SpendRecord, since int64,
+		check func(acctSpent, walletSpent *big.Int) error) error
+	PruneSpends(before int64) (int64, error)
+
+	ListAccountRows(offset, limit int) ([]models.Account, error)
+	ListKeyRows(offset, limit int) ([]models.AccountKey, error)
+	ListSeeds(offset, limit int) ([]models.WalletSeed, error)
+	PutAccountRow(rec *models.Account, replace bool) (int, error)
+	PutKeyRow(rec *models.AccountKey, replace bool) (int, error)
+	PutSeed(seed *models.WalletSeed, replace bool) (int, error)
+
+	ListOwners(offset, limit int) ([]models.OwnerStat, error)
+	ListWallets(ownerUuid string, offset, limit int) ([]models.WalletStat, error)
+	GetKeyStats() (*models.KeyStats, error)
+	GetOwnerFreeze(ownerUuid string) (*models.OwnerFreeze, error)
+	ListOwnerFreezes(offset, limit int) ([]models.OwnerFreeze, error)
+	StoreOwnerFreeze(freeze *models.OwnerFreeze) error
+	DeleteOwnerFreeze(ownerUuid string) error
 }
 
 /**
@@ -51,20 +174,60 @@ type KStoreIface interface {
 	keystore.KeyStore
 
 	GetStorageIf() KsInterface
+	SetApprovals(approvals *Approvals)
+	Approvals() *Approvals
+	CheckTx(addr common.Address, tx *types.Transaction,
+		chainId *big.Int) (*models.ApprovalRequest, error)
+	TxSigned(req *models.ApprovalRequest, signed *types.Transaction)
+	FindWallet(a accounts.Account) (accounts.Wallet, error)
+	OwnerWallet(ownerUuid string) (accounts.Wallet, error)
+	NewHDWallet(ownerUuid, walletUuid,
+		passphrase string) (*accounts.Account, *models.Account, error)
+	ExportMnemonic(ownerUuid, passphrase string) (string, error)
+	RestoreWallet(ownerUuid, mnemonic, passphrase string,
+		chain ethereum.ChainStateReader) ([]accounts.Account, error)
 	NewAccountOwner(ownerUuid, walletUuid,
 		name, passphrase, actType string) (*accounts.Account, *models.Account, error)
+	ImportOwner(keyJson []byte, passphrase, newPassphrase, ownerUuid, walletUuid,
+		name, actType string) (*accounts.Account, *models.Account, error)
+	AdminDelete(a accounts.Account) error
+	RestoreAccount(a accounts.Account, passphrase string) error
+	PurgeAccount(a accounts.Account) error
+	PurgeExpired(batch int) (int, error)
+	SetRetention(retention time.Duration)
+	Retention() time.Duration
+	Fsck(repair bool, batch int) (*FsckReport, error)
+	FreezeOwner(ownerUuid, reason string) (int, error)
+	UnfreezeOwner(ownerUuid string) error
+	LockKeys(ownerUuid string) int
+	Stats() (*KStoreStats, error)
+	WithCaller(caller *AuditCaller) KStoreIface
 }
 
 /**
- * SQL based keystore object.
+ * SQL based keystore object.  Wallets are loaded from the storage on first use,
+ * accounts are indexed by address.  The keystores returned by WithCaller share
+ * the state of the one they come from, the caller goes in their audit records.
  */
 type KStore struct {
+	*kstoreState
+	caller *AuditCaller
+}
+
+type kstoreState struct {
+	base        *KStore // without caller, for the wallets and the storage
 	Storage     KsInterface
 	changes     chan struct{}
 	updateFeed  event.Feed
 	updateScope event.SubscriptionScope
 	updating    bool
 	wallets     map[string]*Wallet
+	changeId    int64
+	acctIndex   map[common.Address]*AccountKey
+	keyCache    *keyCache
+	approvals   *Approvals
+	retention   time.Duration
+	auditFails  []FsckIssue
 	mu          sync.RWMutex
 }
 
@@ -77,23 +240,52 @@ type AccountKey struct {
 
 	Account *accounts.Account
 	abort   chan struct{}
+	wallet  *Wallet
 }
 
+/**
+ * The seed, wallet uuid and passphrase are set while an HD wallet is open, new
+ * derived accounts are stored encrypted with the wallet passphrase.
+ */
 type Wallet struct {
-	AcctMap   map[string]*AccountKey
-	unlock    bool
-	OwnerUuid uuid.UUID
-	KsIface   keystore.KeyStore
-	mu        sync.Mutex
+	AcctMap    map[string]*AccountKey
+	OwnerUuid  uuid.UUID
+	KsIface    keystore.KeyStore
+	kstore     *KStore
+	seed       []byte
+	walletUuid string
+	auth       string
+	deriving   bool
+	mu         sync.Mutex
 }
 
 type BaseKeyStore struct {
-	scryptN    int
-	scryptP    int
-	kstore     *KStore
-	ormHandler orm.Ormer
+	scryptN int
+	scryptP int
+	origin  string
+	master  *MasterKeys
+	kstore  *KStore
 }
 
 type SqlKeyStore struct {
 	BaseKeyStore
+	ormHandler orm.Ormer
+}
+
+type MemKeyStore struct {
+	BaseKeyStore
+	accounts  map[string]*models.Account
+	keys      map[string]*models.AccountKey
+	owners    map[string]map[string]bool
+	trans     []models.Transaction
+	changes   []models.KeyChange
+	seeds     map[string]*models.WalletSeed
+	requests  []models.ApprovalRequest
+	votes     []models.Approval
+	audits    []models.AuditRecord
+	auditHead models.AuditHead
+	policies  map[string]*models.SpendPolicy
+	spends    []models.SpendRecord
+	freezes   map[string]*models.OwnerFreeze
+	mu        sync.RWMutex
 }
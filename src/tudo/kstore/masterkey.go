@@ -0,0 +1,277 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variable holding the master keys when no key file is configured.
+const MasterKeyEnv = "TUDO_KS_MASTER_KEY"
+
+var ErrNoMasterKey = errors.New("No master key loaded")
+
+// Min time between reloads of the key file on an unknown key version.
+const masterReload = 10 * time.Second
+
+/**
+ * Versioned AES-256 key-encryption keys wrapping the account_key rows.  The
+ * highest version wraps new rows, older versions are kept to unwrap rows until
+ * they are rotated.  Each key is written as <version>:<64 hex digits>, one per
+ * line in the key file or separated by commas in the environment variable.
+ */
+type MasterKeys struct {
+	current int
+	keys    map[int][]byte
+	file    string
+	loaded  time.Time
+	mu      sync.RWMutex
+}
+
+/**
+ * Error unwrapping a key row, names the master key version the row needs.
+ */
+type MasterKeyError struct {
+	Account string
+	Version int
+	Reason  string
+}
+
+func (e *MasterKeyError) Error() string {
+	return fmt.Sprintf("Account %s: cannot unwrap key with master key version %d: %s",
+		e.Account, e.Version, e.Reason)
+}
+
+/**
+ * LoadMasterKeys
+ * --------------
+ * Read the master keys from the file, or from the environment if no file is
+ * given.  Return nil when neither is set, rows are then stored unwrapped.
+ */
+func LoadMasterKeys(file string) (*MasterKeys, error) {
+	var text string
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	} else {
+		text = os.Getenv(MasterKeyEnv)
+		if strings.TrimSpace(text) == "" {
+			return nil, nil
+		}
+	}
+	mk, err := ParseMasterKeys(text)
+	if err != nil {
+		return nil, err
+	}
+	mk.file = file
+	return mk, nil
+}
+
+/**
+ * ParseMasterKeys
+ * ---------------
+ * Lines starting with # are comments.
+ */
+func ParseMasterKeys(text string) (*MasterKeys, error) {
+	mk := &MasterKeys{
+		keys:   make(map[int][]byte),
+		loaded: time.Now(),
+	}
+	text = strings.Replace(text, ",", "\n", -1)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid master key entry, want <version>:<hex key>")
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("Invalid master key version %s", parts[0])
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Master key version %d must be 32 bytes in hex", version)
+		}
+		if mk.keys[version] != nil {
+			return nil, fmt.Errorf("Duplicate master key version %d", version)
+		}
+		mk.keys[version] = key
+		if version > mk.current {
+			mk.current = version
+		}
+	}
+	if mk.current == 0 {
+		return nil, fmt.Errorf("No master key found")
+	}
+	return mk, nil
+}
+
+/**
+ * Current
+ * -------
+ * Return the version wrapping new rows, 0 if there's no master key.
+ */
+func (mk *MasterKeys) Current() int {
+	if mk == nil {
+		return 0
+	}
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+	return mk.current
+}
+
+/**
+ * Has
+ * ---
+ * Return true if the version is loaded, reading the key file again if needed.
+ */
+func (mk *MasterKeys) Has(version int) bool {
+	if mk == nil {
+		return false
+	}
+	return mk.key(version) != nil || (mk.reload() && mk.key(version) != nil)
+}
+
+/**
+ * wrap
+ * ----
+ * Seal the key blob with the current master key, bound to the account.
+ */
+func (mk *MasterKeys) wrap(account string, plain []byte) (int, string, error) {
+	mk.mu.RLock()
+	version, key := mk.current, mk.keys[mk.current]
+	mk.mu.RUnlock()
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = crand.Read(nonce); err != nil {
+		return 0, "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(account))
+	return version, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+/**
+ * unwrap
+ * ------
+ * Open the key blob sealed with the master key version.  The key file is read
+ * again if the version is unknown, it may have been added by a rotation.
+ */
+func (mk *MasterKeys) unwrap(account string, version int, wrapped string) ([]byte, error) {
+	if mk == nil {
+		return nil, &MasterKeyError{account, version, "no master key loaded"}
+	}
+	key := mk.key(version)
+	if key == nil && mk.reload() {
+		key = mk.key(version)
+	}
+	if key == nil {
+		return nil, &MasterKeyError{account, version, "key version not loaded"}
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, &MasterKeyError{account, version, err.Error()}
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, &MasterKeyError{account, version, "truncated key blob"}
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(account))
+	if err != nil {
+		return nil, &MasterKeyError{account, version, "wrong master key"}
+	}
+	return plain, nil
+}
+
+/**
+ * auditKey
+ * --------
+ * Derive the key of the audit record hashes from the master key version, nil if
+ * the version isn't loaded.  The master key itself only wraps the key rows.
+ */
+func (mk *MasterKeys) auditKey(version int) []byte {
+	if mk == nil {
+		return nil
+	}
+	key := mk.key(version)
+	if key == nil && mk.reload() {
+		key = mk.key(version)
+	}
+	if key == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("tudo audit log"))
+	return mac.Sum(nil)
+}
+
+func (mk *MasterKeys) key(version int) []byte {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+	return mk.keys[version]
+}
+
+/**
+ * reload
+ * ------
+ * Read the key file again, at most every masterReload.  Return true if the keys
+ * were reloaded.
+ */
+func (mk *MasterKeys) reload() bool {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if mk.file == "" || time.Since(mk.loaded) < masterReload {
+		return false
+	}
+	mk.loaded = time.Now()
+
+	fresh, err := LoadMasterKeys(mk.file)
+	if err != nil {
+		fmt.Printf("Failed to reload master keys: %v\n", err)
+		return false
+	}
+	mk.keys, mk.current = fresh.keys, fresh.current
+	return true
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,107 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/pborman/uuid"
+)
+
+const (
+	testMasterV1 = "1:" + "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testMasterV2 = "2:" + "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+)
+
+func TestParseMasterKeys(t *testing.T) {
+	mk, err := ParseMasterKeys("# keys\n" + testMasterV1 + "\n\n" + testMasterV2 + "\n")
+	if err != nil || mk.Current() != 2 {
+		t.Fatalf("parsed current %d, %v", mk.Current(), err)
+	}
+	if mk, err = ParseMasterKeys(testMasterV2 + "," + testMasterV1); err != nil ||
+		mk.Current() != 2 {
+		t.Errorf("parsed env list current %d, %v", mk.Current(), err)
+	}
+	for _, bad := range []string{"", "0:00", "1:abcd", testMasterV1 + "," + testMasterV1} {
+		if _, err = ParseMasterKeys(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kstore-master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "master.keys")
+	ioutil.WriteFile(keyFile, []byte(testMasterV1+"\n"), 0600)
+
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	iface, err := NewKeyStore(storage, 0, keyFile)
+	if err != nil {
+		t.Fatalf("new keystore failed: %v", err)
+	}
+	ks := iface.(*KStore)
+
+	acct, _, err := ks.NewAccountOwner(uuid.NewRandom().String(), "", "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	keyRec, _ := storage.GetKeyRecord(acct.Address)
+	if keyRec.KeyVersion != 1 || keyRec.PrivKey != "" || keyRec.WrapKey == "" {
+		t.Fatalf("key not wrapped: version %d", keyRec.KeyVersion)
+	}
+	// Moving the blob to another row must fail.
+	moved := *keyRec
+	moved.Account = "0x0000000000000000000000000000000000000001"
+	if _, err = storage.DecryptKeyRec(&moved, "pass"); err == nil {
+		t.Errorf("wrapped key opened for another account")
+	}
+	ioutil.WriteFile(keyFile, []byte(testMasterV1+"\n"+testMasterV2+"\n"), 0600)
+	master, _ := LoadMasterKeys(keyFile)
+	storage.SetMasterKeys(master)
+
+	if count, err := storage.RewrapKeys(1); count != 1 || err != nil {
+		t.Fatalf("rewrapped %d keys, %v", count, err)
+	}
+	if count, _ := storage.RewrapKeys(1); count != 0 {
+		t.Errorf("rewrapped %d keys again", count)
+	}
+	if keyRec, _ = storage.GetKeyRecord(acct.Address); keyRec.KeyVersion != 2 {
+		t.Errorf("key version %d after rotation", keyRec.KeyVersion)
+	}
+	if err = ks.Unlock(*acct, "pass"); err != nil {
+		t.Errorf("unlock after rotation failed: %v", err)
+	}
+	// A node still on the old key names the version it lacks.
+	old, _ := ParseMasterKeys(testMasterV1)
+	storage.SetMasterKeys(old)
+	_, err = storage.DecryptKeyRec(keyRec, "pass")
+	if mkErr, ok := err.(*MasterKeyError); !ok || mkErr.Version != 2 ||
+		!strings.Contains(err.Error(), "version 2") {
+		t.Errorf("unwrap with old key: %v", err)
+	}
+	wrong, _ := ParseMasterKeys(strings.Replace(testMasterV2, "20", "ff", 1))
+	storage.SetMasterKeys(wrong)
+	if _, err = storage.DecryptKeyRec(keyRec, "pass"); err == nil ||
+		!strings.Contains(err.Error(), "wrong master key") {
+		t.Errorf("unwrap with wrong key: %v", err)
+	}
+	if err = ks.Unlock(accounts.Account{Address: acct.Address}, "pass"); err == nil {
+		t.Errorf("unlocked with the wrong master key")
+	}
+}
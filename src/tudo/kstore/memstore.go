@@ -0,0 +1,1413 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+/**
+ * Memory based keystore for tests and dev nodes, nothing survives a restart.
+ */
+func NewMemKeyStore(scryptN, scryptP int) *MemKeyStore {
+	return &MemKeyStore{
+		BaseKeyStore: newBaseKeyStore(scryptN, scryptP),
+		accounts:     make(map[string]*models.Account),
+		keys:         make(map[string]*models.AccountKey),
+		owners:       make(map[string]map[string]bool),
+		seeds:        make(map[string]*models.WalletSeed),
+		policies:     make(map[string]*models.SpendPolicy),
+		freezes:      make(map[string]*models.OwnerFreeze),
+		auditHead:    models.AuditHead{Id: auditHeadId},
+	}
+}
+
+/**
+ * StoreKey
+ * --------
+ */
+func (ks *MemKeyStore) StoreKey(filename string, key *keystore.Key, auth string) error {
+	_, err := ks.StoreKeyUuid(key, key.Id, auth)
+	return err
+}
+
+/**
+ * GetKey
+ * ------
+ */
+func (ks *MemKeyStore) GetKey(addr common.Address,
+	path, auth string) (*keystore.Key, error) {
+	return ks.GetKeyUuid(addr, uuid.Parse(path), auth)
+}
+
+/**
+ * GetAccount
+ * ----------
+ */
+func (ks *MemKeyStore) GetAccount(addr common.Address) ([]models.Account, error) {
+	return ks.getAccounts(func(acct *models.Account) bool {
+		return acct.Account == addr.Hex()
+	})
+}
+
+/**
+ * GetAccountOwner
+ * ---------------
+ */
+func (ks *MemKeyStore) GetAccountOwner(addr, owner string) (*models.Account, error) {
+	account := common.HexToAddress(addr).Hex()
+	results, err := ks.getAccounts(func(acct *models.Account) bool {
+		return acct.Account == account && acct.OwnerUuid == owner
+	})
+	if err == nil {
+		return &results[0], err
+	}
+	return nil, err
+}
+
+/**
+ * GetUserAccount
+ * --------------
+ */
+func (ks *MemKeyStore) GetUserAccount(ownerUuid uuid.UUID) ([]models.Account, error) {
+	return ks.getAccounts(func(acct *models.Account) bool {
+		return acct.OwnerUuid == ownerUuid.String()
+	})
+}
+
+/**
+ * GetWallet
+ * ---------
+ */
+func (ks *MemKeyStore) GetWallet(walletUuid uuid.UUID) ([]models.Account, error) {
+	return ks.getAccounts(func(acct *models.Account) bool {
+		return acct.WalletUuid == walletUuid.String()
+	})
+}
+
+/**
+ * GetTransaction
+ * --------------
+ * Same matching rules as the SQL keystore.
+ */
+func (ks *MemKeyStore) GetTransaction(addr *common.Address, owner *uuid.UUID,
+	from *bool, offset, limit int) ([]models.Transaction, error) {
+	var match func(t *models.Transaction) bool
+
+	if from == nil {
+		if addr == nil {
+			return nil, errors.New("Invalid arguments")
+		}
+		hex := addr.Hex()
+		match = func(t *models.Transaction) bool {
+			return t.FromAcct == hex || t.ToAcct == hex
+		}
+	} else {
+		if addr == nil && owner == nil {
+			return nil, errors.New("Invalid arguments")
+		}
+		match = func(t *models.Transaction) bool {
+			acct, user := t.FromAcct, t.FromUuid
+			if *from == false {
+				acct, user = t.ToAcct, t.ToUuid
+			}
+			if addr != nil && acct == addr.Hex() {
+				return true
+			}
+			return owner != nil && user == owner.String()
+		}
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.Transaction{}
+	for idx := range ks.trans {
+		if match(&ks.trans[idx]) {
+			results = append(results, ks.trans[idx])
+		}
+	}
+	if limit != 0 {
+		results = pageSlice(len(results), offset, limit, results)
+	}
+	if len(results) > 0 {
+		return results, nil
+	}
+	return nil, ErrNoTrans
+}
+
+func pageSlice(count, offset, limit int,
+	results []models.Transaction) []models.Transaction {
+	if offset >= count {
+		return nil
+	}
+	end := offset + limit
+	if end > count {
+		end = count
+	}
+	return results[offset:end]
+}
+
+/**
+ * getAccounts
+ * -----------
+ */
+func (ks *MemKeyStore) getAccounts(
+	match func(acct *models.Account) bool) ([]models.Account, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.Account{}
+	for _, acct := range ks.accounts {
+		if acct.Archived == 0 && match(acct) {
+			results = append(results, *acct)
+		}
+	}
+	if len(results) > 0 {
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Account < results[j].Account
+		})
+		return results, nil
+	}
+	return nil, ErrNoAccount
+}
+
+/**
+ * UpdateAccount
+ * -------------
+ */
+func (ks *MemKeyStore) UpdateAccount(addr common.Address,
+	name, actType string, ownerUuid, walletUuid uuid.UUID) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	obj := ks.accounts[addr.Hex()]
+	if obj == nil || obj.Archived != 0 || obj.OwnerUuid != ownerUuid.String() {
+		if obj != nil {
+			return fmt.Errorf("Duplicate account %s", addr.Hex())
+		}
+		ks.accounts[addr.Hex()] = &models.Account{
+			OwnerUuid:  ownerUuid.String(),
+			WalletUuid: walletUuid.String(),
+			PublicName: name,
+			Account:    addr.Hex(),
+			Type:       actType,
+		}
+		return nil
+	}
+	if walletUuid != nil {
+		obj.WalletUuid = walletUuid.String()
+	}
+	obj.PublicName = name
+	obj.Type = actType
+	return nil
+}
+
+/**
+ * GetKeyUuid
+ * ----------
+ */
+func (ks *MemKeyStore) GetKeyUuid(addr common.Address,
+	owner uuid.UUID, auth string) (*keystore.Key, error) {
+	keyRec, err := ks.GetKeyRecord(addr)
+	if err != nil {
+		return nil, err
+	}
+	return ks.DecryptKeyRec(keyRec, auth)
+}
+
+/**
+ * GetKeyRecord
+ * ------------
+ */
+func (ks *MemKeyStore) GetKeyRecord(addr common.Address) (*models.AccountKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keyRec := ks.keys[addr.Hex()]
+	if keyRec == nil || keyRec.Archived != 0 {
+		return nil, accounts.ErrUnknownAccount
+	}
+	rec := *keyRec
+	return &rec, nil
+}
+
+/**
+ * GetOwnerKeys
+ * ------------
+ */
+func (ks *MemKeyStore) GetOwnerKeys(ownerUuid string) ([]models.AccountKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.AccountKey{}
+	for addr := range ks.owners[ownerUuid] {
+		results = append(results, *ks.keys[addr])
+	}
+	return results, nil
+}
+
+/**
+ * putKeyRec
+ * ---------
+ * Store a copy of the record and index it by owner unless it's archived.  The
+ * lock must be held.
+ */
+func (ks *MemKeyStore) putKeyRec(keyRec *models.AccountKey) {
+	rec := *keyRec
+	ks.keys[rec.Account] = &rec
+	if rec.Archived != 0 {
+		return
+	}
+
+	owned := ks.owners[rec.OwnerUuid]
+	if owned == nil {
+		owned = make(map[string]bool)
+		ks.owners[rec.OwnerUuid] = owned
+	}
+	owned[rec.Account] = true
+}
+
+/**
+ * GetAccountKeys
+ * --------------
+ */
+func (ks *MemKeyStore) GetAccountKeys(offset, limit int) ([]models.AccountKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	addrs := make([]string, 0, len(ks.keys))
+	for addr, keyRec := range ks.keys {
+		if keyRec.Archived == 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+
+	results := []models.AccountKey{}
+	for idx := offset; idx < len(addrs) && len(results) < limit; idx++ {
+		results = append(results, *ks.keys[addrs[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * ArchiveKey
+ * ----------
+ */
+func (ks *MemKeyStore) ArchiveKey(addr common.Address) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keyRec := ks.keys[addr.Hex()]
+	if keyRec == nil || keyRec.Archived != 0 {
+		return accounts.ErrUnknownAccount
+	}
+	now := time.Now().Unix()
+	delete(ks.owners[keyRec.OwnerUuid], keyRec.Account)
+	keyRec.Archived = now
+	if acct := ks.accounts[keyRec.Account]; acct != nil && acct.Archived == 0 {
+		acct.Archived = now
+	}
+	ks.logKeyChange(keyRec.Account, "", models.KeyDeleted)
+	return nil
+}
+
+/**
+ * GetArchivedKey
+ * --------------
+ */
+func (ks *MemKeyStore) GetArchivedKey(addr common.Address) (*models.AccountKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keyRec := ks.keys[addr.Hex()]
+	if keyRec == nil || keyRec.Archived == 0 {
+		return nil, accounts.ErrUnknownAccount
+	}
+	rec := *keyRec
+	return &rec, nil
+}
+
+/**
+ * GetArchivedKeys
+ * ---------------
+ */
+func (ks *MemKeyStore) GetArchivedKeys(before int64,
+	limit int) ([]models.AccountKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.AccountKey{}
+	for _, keyRec := range ks.keys {
+		if keyRec.Archived != 0 && keyRec.Archived < before {
+			results = append(results, *keyRec)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Archived != results[j].Archived {
+			return results[i].Archived < results[j].Archived
+		}
+		return results[i].Account < results[j].Account
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+/**
+ * RestoreKey
+ * ----------
+ */
+func (ks *MemKeyStore) RestoreKey(addr common.Address,
+	since int64) (*models.AccountKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keyRec := ks.keys[addr.Hex()]
+	if keyRec == nil || keyRec.Archived == 0 || keyRec.Archived < since {
+		return nil, accounts.ErrUnknownAccount
+	}
+	if acct := ks.accounts[keyRec.Account]; acct != nil && acct.Archived == keyRec.Archived {
+		acct.Archived = 0
+	}
+	keyRec.Archived = 0
+	ks.putKeyRec(keyRec)
+	ks.logKeyChange(keyRec.Account, keyRec.OwnerUuid, models.KeyAdded)
+
+	rec := *keyRec
+	return &rec, nil
+}
+
+/**
+ * PurgeKey
+ * --------
+ */
+func (ks *MemKeyStore) PurgeKey(addr common.Address) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keyRec := ks.keys[addr.Hex()]
+	if keyRec == nil || keyRec.Archived == 0 {
+		return accounts.ErrUnknownAccount
+	}
+	delete(ks.keys, keyRec.Account)
+	if acct := ks.accounts[keyRec.Account]; acct != nil && acct.Archived != 0 {
+		delete(ks.accounts, keyRec.Account)
+	}
+	return nil
+}
+
+/**
+ * StoreAccount
+ * ------------
+ */
+func (ks *MemKeyStore) StoreAccount(key *keystore.Key, name, actType string,
+	ownerUuid *uuid.UUID, walletUuid *uuid.UUID) (*models.Account, error) {
+	if walletUuid == nil {
+		uid := uuid.NewRandom()
+		walletUuid = &uid
+	}
+	if ownerUuid == nil {
+		ownerUuid = &key.Id
+	}
+	if name == "" {
+		name = "Anonymous"
+	}
+	acctRec := &models.Account{
+		OwnerUuid:  ownerUuid.String(),
+		WalletUuid: walletUuid.String(),
+		PublicName: name,
+		Account:    key.Address.Hex(),
+		Type:       actType,
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.accounts[acctRec.Account] != nil {
+		return nil, fmt.Errorf("Duplicate account %s", acctRec.Account)
+	}
+	rec := *acctRec
+	ks.accounts[acctRec.Account] = &rec
+	return acctRec, nil
+}
+
+/**
+ * StoreKeyUuid
+ * ------------
+ */
+func (ks *MemKeyStore) StoreKeyUuid(k *keystore.Key,
+	owner uuid.UUID, auth string) (*models.AccountKey, error) {
+	keyRec, err := ks.encryptKeyRec(k, owner.String(), auth)
+	if err != nil {
+		return nil, err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.keys[keyRec.Account] != nil {
+		return nil, fmt.Errorf("Duplicate account key %s", keyRec.Account)
+	}
+	ks.putKeyRec(keyRec)
+	ks.logKeyChange(keyRec.Account, keyRec.OwnerUuid, models.KeyAdded)
+	return keyRec, nil
+}
+
+/**
+ * UpdateKeyAuth
+ * -------------
+ */
+func (ks *MemKeyStore) UpdateKeyAuth(addr common.Address,
+	auth, newAuth string) (*models.AccountKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keyRec := ks.keys[addr.Hex()]
+	if keyRec == nil || keyRec.Archived != 0 {
+		return nil, accounts.ErrUnknownAccount
+	}
+	key, err := ks.DecryptKeyRec(keyRec, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+
+	newRec, err := ks.encryptKeyRec(key, keyRec.OwnerUuid, newAuth)
+	if err != nil {
+		return nil, err
+	}
+	ks.putKeyRec(newRec)
+	ks.logKeyChange(newRec.Account, newRec.OwnerUuid, models.KeyUpdated)
+	return newRec, nil
+}
+
+/**
+ * MigratePlainKeys
+ * ----------------
+ * Keys in memory are always encrypted.
+ */
+func (ks *MemKeyStore) MigratePlainKeys() (int, error) {
+	return 0, nil
+}
+
+/**
+ * RewrapKeys
+ * ----------
+ */
+func (ks *MemKeyStore) RewrapKeys(batch int) (int, error) {
+	if ks.master.Current() == 0 {
+		return 0, ErrNoMasterKey
+	}
+	ks.mu.Lock()
+	wrapped := []*models.AccountKey{}
+	for _, keyRec := range ks.keys {
+		newRec, err := ks.wrapKeyRec(keyRec)
+		if err != nil {
+			ks.mu.Unlock()
+			return len(wrapped), err
+		}
+		if newRec == keyRec {
+			continue
+		}
+		ks.putKeyRec(newRec)
+		ks.logKeyChange(newRec.Account, newRec.OwnerUuid, models.KeyUpdated)
+		wrapped = append(wrapped, newRec)
+	}
+	ks.mu.Unlock()
+
+	if kstore := ks.kstore; kstore != nil {
+		for _, keyRec := range wrapped {
+			kstore.updateKeyRec(keyRec)
+		}
+	}
+	return len(wrapped), nil
+}
+
+/**
+ * StoreTransaction
+ * ----------------
+ */
+func (ks *MemKeyStore) StoreTransaction(trans *models.Transaction) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for idx := range ks.trans {
+		if ks.trans[idx].TxHash == trans.TxHash {
+			return fmt.Errorf("Duplicate transaction %s", trans.TxHash)
+		}
+	}
+	if trans.Created.IsZero() {
+		trans.Created = time.Now()
+	}
+	ks.trans = append(ks.trans, *trans)
+	return nil
+}
+
+/**
+ * ListTransactions
+ * ----------------
+ * Same selection and order as the SQL keystore.
+ */
+func (ks *MemKeyStore) ListTransactions(q *TransQuery) ([]models.Transaction, error) {
+	if q.Account == nil && q.Owner == nil {
+		return nil, errors.New("Invalid arguments")
+	}
+	side := func(acct, user, peer string) bool {
+		if q.Peer != nil && peer != q.Peer.Hex() {
+			return false
+		}
+		return (q.Account != nil && acct == q.Account.Hex()) ||
+			(q.Owner != nil && user == q.Owner.String())
+	}
+	match := func(t *models.Transaction) bool {
+		sent := side(t.FromAcct, t.FromUuid, t.ToAcct)
+		received := side(t.ToAcct, t.ToUuid, t.FromAcct)
+		switch {
+		case q.From == nil && !sent && !received:
+			return false
+		case q.From != nil && *q.From && !sent:
+			return false
+		case q.From != nil && !*q.From && !received:
+			return false
+		case q.MinXu != nil && t.XuAmount < *q.MinXu:
+			return false
+		case q.MaxXu != nil && t.XuAmount > *q.MaxXu:
+			return false
+		case !q.Since.IsZero() && t.Created.Before(q.Since):
+			return false
+		case !q.Until.IsZero() && !t.Created.Before(q.Until):
+			return false
+		case q.Pending:
+			return t.BlockNumber == 0
+		case t.BlockNumber == 0:
+			return false
+		}
+		return q.After == nil || listedAfter(q.After, t, q.Oldest)
+	}
+	ks.mu.RLock()
+	results := []models.Transaction{}
+	for idx := range ks.trans {
+		if match(&ks.trans[idx]) {
+			results = append(results, ks.trans[idx])
+		}
+	}
+	ks.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		ti, tj := &results[i], &results[j]
+		if q.Oldest {
+			ti, tj = tj, ti
+		}
+		if q.Pending {
+			if !ti.Created.Equal(tj.Created) {
+				return ti.Created.After(tj.Created)
+			}
+			return ti.TxHash > tj.TxHash
+		}
+		return listedAfter(transCursor(ti), tj, false)
+	})
+	offset := q.Offset
+	if q.After != nil {
+		offset = 0
+	}
+	if page := pageSlice(len(results), offset, q.Limit, results); page != nil {
+		return page, nil
+	}
+	return []models.Transaction{}, nil
+}
+
+func transCursor(t *models.Transaction) *TransCursor {
+	return &TransCursor{BlockNumber: t.BlockNumber, TxIndex: t.TxIndex, TxHash: t.TxHash}
+}
+
+// listedAfter is true if t is listed after the cursor, newest first unless oldest.
+func listedAfter(c *TransCursor, t *models.Transaction, oldest bool) bool {
+	cmp := 0
+	switch {
+	case t.BlockNumber != c.BlockNumber:
+		cmp = int(t.BlockNumber - c.BlockNumber)
+	case t.TxIndex != c.TxIndex:
+		cmp = t.TxIndex - c.TxIndex
+	case t.TxHash < c.TxHash:
+		cmp = -1
+	case t.TxHash > c.TxHash:
+		cmp = 1
+	}
+	if oldest {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+/**
+ * SetTransBlock
+ * -------------
+ */
+func (ks *MemKeyStore) SetTransBlock(txHash string,
+	blockNumber int64, txIndex int) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for idx := range ks.trans {
+		if ks.trans[idx].TxHash == txHash {
+			ks.trans[idx].BlockNumber = blockNumber
+			ks.trans[idx].TxIndex = txIndex
+			return nil
+		}
+	}
+	return ErrNoTrans
+}
+
+/**
+ * logKeyChange
+ * ------------
+ * The lock must be held.
+ */
+func (ks *MemKeyStore) logKeyChange(account, owner, op string) {
+	var id int64 = 1
+
+	if count := len(ks.changes); count > 0 {
+		id = ks.changes[count-1].Id + 1
+	}
+	ks.changes = append(ks.changes, models.KeyChange{
+		Id:        id,
+		Account:   account,
+		OwnerUuid: owner,
+		Op:        op,
+		Origin:    ks.origin,
+		Created:   time.Now(),
+	})
+}
+
+/**
+ * GetKeyChanges
+ * -------------
+ */
+func (ks *MemKeyStore) GetKeyChanges(afterId int64, limit int) ([]models.KeyChange, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	idx := sort.Search(len(ks.changes), func(i int) bool {
+		return ks.changes[i].Id > afterId
+	})
+	end := idx + limit
+	if end > len(ks.changes) {
+		end = len(ks.changes)
+	}
+	return append([]models.KeyChange{}, ks.changes[idx:end]...), nil
+}
+
+/**
+ * LastKeyChange
+ * -------------
+ */
+func (ks *MemKeyStore) LastKeyChange() (int64, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if count := len(ks.changes); count > 0 {
+		return ks.changes[count-1].Id, nil
+	}
+	return 0, nil
+}
+
+/**
+ * PruneKeyChanges
+ * ---------------
+ */
+func (ks *MemKeyStore) PruneKeyChanges(before time.Time) (int64, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	idx := sort.Search(len(ks.changes), func(i int) bool {
+		return !ks.changes[i].Created.Before(before)
+	})
+	ks.changes = append([]models.KeyChange{}, ks.changes[idx:]...)
+	return int64(idx), nil
+}
+
+/**
+ * GetSeed
+ * -------
+ */
+func (ks *MemKeyStore) GetSeed(ownerUuid string) (*models.WalletSeed, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	seed := ks.seeds[ownerUuid]
+	if seed == nil {
+		return nil, ErrNoSeed
+	}
+	rec := *seed
+	return &rec, nil
+}
+
+/**
+ * StoreSeed
+ * ---------
+ */
+func (ks *MemKeyStore) StoreSeed(seed *models.WalletSeed) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.seeds[seed.OwnerUuid] != nil {
+		return fmt.Errorf("Owner %s already has a wallet seed", seed.OwnerUuid)
+	}
+	rec := *seed
+	rec.Created = time.Now()
+	ks.seeds[seed.OwnerUuid] = &rec
+	return nil
+}
+
+/**
+ * GetApprovalReq
+ * --------------
+ */
+func (ks *MemKeyStore) GetApprovalReq(id int64) (*models.ApprovalRequest, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if id <= 0 || id > int64(len(ks.requests)) {
+		return nil, ErrNoApproval
+	}
+	req := ks.requests[id-1]
+	return &req, nil
+}
+
+/**
+ * GetApprovalReqByHash
+ * --------------------
+ */
+func (ks *MemKeyStore) GetApprovalReqByHash(account,
+	sigHash string) (*models.ApprovalRequest, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, req := range ks.requests {
+		if req.Account == account && req.SigHash == sigHash {
+			return &req, nil
+		}
+	}
+	return nil, ErrNoApproval
+}
+
+/**
+ * ListApprovalReqs
+ * ----------------
+ */
+func (ks *MemKeyStore) ListApprovalReqs(status string,
+	offset, limit int) ([]models.ApprovalRequest, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.ApprovalRequest{}
+	for i := len(ks.requests) - 1; i >= 0 && len(results) < limit; i-- {
+		if status != "" && ks.requests[i].Status != status {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		results = append(results, ks.requests[i])
+	}
+	return results, nil
+}
+
+/**
+ * StoreApprovalReq
+ * ----------------
+ */
+func (ks *MemKeyStore) StoreApprovalReq(req *models.ApprovalRequest) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for _, rec := range ks.requests {
+		if rec.Account == req.Account && rec.SigHash == req.SigHash {
+			return fmt.Errorf("Duplicate approval request %s", req.SigHash)
+		}
+	}
+	req.Id = int64(len(ks.requests) + 1)
+	req.Created = time.Now()
+	req.Modified = req.Created
+	ks.requests = append(ks.requests, *req)
+	return nil
+}
+
+/**
+ * UpdateApprovalReq
+ * -----------------
+ */
+func (ks *MemKeyStore) UpdateApprovalReq(req *models.ApprovalRequest,
+	from string) (bool, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if req.Id <= 0 || req.Id > int64(len(ks.requests)) {
+		return false, ErrNoApproval
+	}
+	rec := &ks.requests[req.Id-1]
+	if rec.Status != from {
+		return false, nil
+	}
+	rec.Status = req.Status
+	rec.TxHash = req.TxHash
+	rec.Modified = time.Now()
+	return true, nil
+}
+
+/**
+ * GetApprovals
+ * ------------
+ */
+func (ks *MemKeyStore) GetApprovals(reqId int64) ([]models.Approval, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.Approval{}
+	for _, appr := range ks.votes {
+		if appr.RequestId == reqId {
+			results = append(results, appr)
+		}
+	}
+	return results, nil
+}
+
+/**
+ * StoreApproval
+ * -------------
+ */
+func (ks *MemKeyStore) StoreApproval(appr *models.Approval) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for _, rec := range ks.votes {
+		if rec.RequestId == appr.RequestId && rec.Approver == appr.Approver {
+			return fmt.Errorf("%s already voted on request %d",
+				appr.Approver, appr.RequestId)
+		}
+	}
+	appr.Id = int64(len(ks.votes) + 1)
+	appr.Created = time.Now()
+	ks.votes = append(ks.votes, *appr)
+	return nil
+}
+
+/**
+ * AppendAudit
+ * -----------
+ */
+func (ks *MemKeyStore) AppendAudit(rec *models.AuditRecord) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	rec.Id = int64(len(ks.audits) + 1)
+	rec.Seq = ks.auditHead.Seq + 1
+	rec.PrevHash = ks.auditHead.Hash
+	rec.KeyVersion = ks.master.Current()
+
+	var err error
+	if rec.Hash, err = AuditHash(rec, ks.master); err != nil {
+		return err
+	}
+	ks.audits = append(ks.audits, *rec)
+	ks.auditHead = models.AuditHead{Id: auditHeadId, Seq: rec.Seq, Hash: rec.Hash}
+	return nil
+}
+
+/**
+ * GetAuditRecords
+ * ---------------
+ */
+func (ks *MemKeyStore) GetAuditRecords(afterId int64,
+	limit int) ([]models.AuditRecord, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	results := []models.AuditRecord{}
+	for _, rec := range ks.audits {
+		if rec.Id > afterId && len(results) < limit {
+			results = append(results, rec)
+		}
+	}
+	return results, nil
+}
+
+/**
+ * GetAuditHead
+ * ------------
+ */
+func (ks *MemKeyStore) GetAuditHead() (*models.AuditHead, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	head := ks.auditHead
+	return &head, nil
+}
+
+/**
+ * GetSpendPolicy
+ * --------------
+ */
+func (ks *MemKeyStore) GetSpendPolicy(scope string) (*models.SpendPolicy, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	policy := ks.policies[scope]
+	if policy == nil {
+		return nil, ErrNoPolicy
+	}
+	result := *policy
+	return &result, nil
+}
+
+/**
+ * ListSpendPolicies
+ * -----------------
+ */
+func (ks *MemKeyStore) ListSpendPolicies(offset,
+	limit int) ([]models.SpendPolicy, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	scopes := make([]string, 0, len(ks.policies))
+	for scope := range ks.policies {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	results := []models.SpendPolicy{}
+	for idx := offset; idx < len(scopes) && len(results) < limit; idx++ {
+		results = append(results, *ks.policies[scopes[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * StoreSpendPolicy
+ * ----------------
+ */
+func (ks *MemKeyStore) StoreSpendPolicy(policy *models.SpendPolicy) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if exist := ks.policies[policy.Scope]; exist != nil {
+		policy.Id = exist.Id
+	} else {
+		policy.Id = int64(len(ks.policies) + 1)
+	}
+	policy.Modified = time.Now()
+	rec := *policy
+	ks.policies[policy.Scope] = &rec
+	return nil
+}
+
+/**
+ * DeleteSpendPolicy
+ * -----------------
+ */
+func (ks *MemKeyStore) DeleteSpendPolicy(scope string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.policies[scope] == nil {
+		return ErrNoPolicy
+	}
+	delete(ks.policies, scope)
+	return nil
+}
+
+/**
+ * AddSpend
+ * --------
+ */
+func (ks *MemKeyStore) AddSpend(rec *models.SpendRecord, since int64,
+	check func(acctSpent, walletSpent *big.Int) error) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var acctRecs, walletRecs []models.SpendRecord
+	for _, spend := range ks.spends {
+		if spend.Account == rec.Account && spend.SigHash == rec.SigHash {
+			return nil
+		}
+		if spend.Stamp < since {
+			continue
+		}
+		if spend.Account == rec.Account {
+			acctRecs = append(acctRecs, spend)
+		}
+		if rec.WalletUuid != "" && spend.WalletUuid == rec.WalletUuid {
+			walletRecs = append(walletRecs, spend)
+		}
+	}
+	if err := check(sumSpends(acctRecs), sumSpends(walletRecs)); err != nil {
+		return err
+	}
+	rec.Id = int64(len(ks.spends) + 1)
+	ks.spends = append(ks.spends, *rec)
+	return nil
+}
+
+/**
+ * PruneSpends
+ * -----------
+ */
+func (ks *MemKeyStore) PruneSpends(before int64) (int64, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	kept := ks.spends[:0]
+	for _, spend := range ks.spends {
+		if spend.Stamp >= before {
+			kept = append(kept, spend)
+		}
+	}
+	count := int64(len(ks.spends) - len(kept))
+	ks.spends = kept
+	return count, nil
+}
+
+/**
+ * ListAccountRows
+ * ---------------
+ */
+func (ks *MemKeyStore) ListAccountRows(offset, limit int) ([]models.Account, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	addrs := make([]string, 0, len(ks.accounts))
+	for addr := range ks.accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	results := []models.Account{}
+	for idx := offset; idx < len(addrs) && len(results) < limit; idx++ {
+		results = append(results, *ks.accounts[addrs[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * ListKeyRows
+ * -----------
+ */
+func (ks *MemKeyStore) ListKeyRows(offset, limit int) ([]models.AccountKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	addrs := make([]string, 0, len(ks.keys))
+	for addr := range ks.keys {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	results := []models.AccountKey{}
+	for idx := offset; idx < len(addrs) && len(results) < limit; idx++ {
+		results = append(results, *ks.keys[addrs[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * ListSeeds
+ * ---------
+ */
+func (ks *MemKeyStore) ListSeeds(offset, limit int) ([]models.WalletSeed, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	owners := make([]string, 0, len(ks.seeds))
+	for owner := range ks.seeds {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	results := []models.WalletSeed{}
+	for idx := offset; idx < len(owners) && len(results) < limit; idx++ {
+		results = append(results, *ks.seeds[owners[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * PutAccountRow
+ * -------------
+ */
+func (ks *MemKeyStore) PutAccountRow(rec *models.Account, replace bool) (int, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	result := RowAdded
+	if exist := ks.accounts[rec.Account]; exist != nil {
+		result = putResult(*exist == *rec, replace)
+	}
+	if result == RowAdded || result == RowReplaced {
+		acct := *rec
+		ks.accounts[rec.Account] = &acct
+	}
+	return result, nil
+}
+
+/**
+ * PutKeyRow
+ * ---------
+ */
+func (ks *MemKeyStore) PutKeyRow(rec *models.AccountKey, replace bool) (int, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	exist := ks.keys[rec.Account]
+	if exist == nil {
+		ks.putKeyRec(rec)
+		if rec.Archived == 0 {
+			ks.logKeyChange(rec.Account, rec.OwnerUuid, models.KeyAdded)
+		}
+		return RowAdded, nil
+	}
+	result := putResult(*exist == *rec, replace)
+	if result == RowReplaced {
+		delete(ks.owners[exist.OwnerUuid], exist.Account)
+		ks.putKeyRec(rec)
+		for _, op := range keyChangeOps(exist, rec) {
+			owner := rec.OwnerUuid
+			if op == models.KeyDeleted {
+				owner = exist.OwnerUuid
+			}
+			ks.logKeyChange(rec.Account, owner, op)
+		}
+	}
+	return result, nil
+}
+
+/**
+ * PutSeed
+ * -------
+ */
+func (ks *MemKeyStore) PutSeed(seed *models.WalletSeed, replace bool) (int, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	result := RowAdded
+	if exist := ks.seeds[seed.OwnerUuid]; exist != nil {
+		same := exist.WalletUuid == seed.WalletUuid && exist.Seed == seed.Seed
+		result = putResult(same, replace)
+	}
+	if result == RowAdded || result == RowReplaced {
+		rec := *seed
+		ks.seeds[seed.OwnerUuid] = &rec
+	}
+	return result, nil
+}
+
+/**
+ * ListOwners
+ * ----------
+ */
+func (ks *MemKeyStore) ListOwners(offset, limit int) ([]models.OwnerStat, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	stats := make(map[string]*models.OwnerStat)
+	wallets := make(map[string]map[string]bool)
+	for _, acct := range ks.accounts {
+		if acct.Archived != 0 {
+			continue
+		}
+		stat := stats[acct.OwnerUuid]
+		if stat == nil {
+			stat = &models.OwnerStat{OwnerUuid: acct.OwnerUuid}
+			stats[acct.OwnerUuid] = stat
+			wallets[acct.OwnerUuid] = make(map[string]bool)
+		}
+		stat.Accounts++
+		wallets[acct.OwnerUuid][acct.WalletUuid] = true
+	}
+	owners := make([]string, 0, len(stats))
+	for owner, stat := range stats {
+		stat.Wallets = len(wallets[owner])
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	results := []models.OwnerStat{}
+	for idx := offset; idx < len(owners) && len(results) < limit; idx++ {
+		results = append(results, *stats[owners[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * ListWallets
+ * -----------
+ */
+func (ks *MemKeyStore) ListWallets(ownerUuid string,
+	offset, limit int) ([]models.WalletStat, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	stats := make(map[[2]string]*models.WalletStat)
+	for _, acct := range ks.accounts {
+		if acct.Archived != 0 || (ownerUuid != "" && acct.OwnerUuid != ownerUuid) {
+			continue
+		}
+		key := [2]string{acct.WalletUuid, acct.OwnerUuid}
+		if stats[key] == nil {
+			stats[key] = &models.WalletStat{
+				WalletUuid: acct.WalletUuid,
+				OwnerUuid:  acct.OwnerUuid,
+			}
+		}
+		stats[key].Accounts++
+	}
+	keys := make([][2]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	results := []models.WalletStat{}
+	for idx := offset; idx < len(keys) && len(results) < limit; idx++ {
+		results = append(results, *stats[keys[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * GetKeyStats
+ * -----------
+ */
+func (ks *MemKeyStore) GetKeyStats() (*models.KeyStats, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	stats := &models.KeyStats{
+		KeyVersions:   make(map[int]int),
+		Seeds:         len(ks.seeds),
+		SpendPolicies: len(ks.policies),
+		FrozenOwners:  len(ks.freezes),
+	}
+	owners := make(map[string]bool)
+	wallets := make(map[string]bool)
+	for _, acct := range ks.accounts {
+		if acct.Archived != 0 {
+			stats.ArchivedAccounts++
+			continue
+		}
+		stats.Accounts++
+		owners[acct.OwnerUuid] = true
+		if acct.WalletUuid != "" {
+			wallets[acct.WalletUuid] = true
+		}
+	}
+	stats.Owners, stats.Wallets = len(owners), len(wallets)
+
+	for _, keyRec := range ks.keys {
+		if keyRec.Archived != 0 {
+			stats.ArchivedKeys++
+			continue
+		}
+		stats.Keys++
+		stats.KeyVersions[keyRec.KeyVersion]++
+		if keyRec.PassKey != "" {
+			stats.PlainKeys++
+		}
+	}
+	for _, req := range ks.requests {
+		if req.Status == models.ApprovalPending {
+			stats.PendingApprovals++
+		}
+	}
+	return stats, nil
+}
+
+/**
+ * GetOwnerFreeze
+ * --------------
+ */
+func (ks *MemKeyStore) GetOwnerFreeze(ownerUuid string) (*models.OwnerFreeze, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	freeze := ks.freezes[ownerUuid]
+	if freeze == nil {
+		return nil, ErrNoFreeze
+	}
+	result := *freeze
+	return &result, nil
+}
+
+/**
+ * ListOwnerFreezes
+ * ----------------
+ */
+func (ks *MemKeyStore) ListOwnerFreezes(offset,
+	limit int) ([]models.OwnerFreeze, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	owners := make([]string, 0, len(ks.freezes))
+	for owner := range ks.freezes {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	results := []models.OwnerFreeze{}
+	for idx := offset; idx < len(owners) && len(results) < limit; idx++ {
+		results = append(results, *ks.freezes[owners[idx]])
+	}
+	return results, nil
+}
+
+/**
+ * StoreOwnerFreeze
+ * ----------------
+ */
+func (ks *MemKeyStore) StoreOwnerFreeze(freeze *models.OwnerFreeze) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if exist := ks.freezes[freeze.OwnerUuid]; exist != nil {
+		freeze.Created = exist.Created
+	} else {
+		freeze.Created = time.Now()
+	}
+	rec := *freeze
+	ks.freezes[freeze.OwnerUuid] = &rec
+	return nil
+}
+
+/**
+ * DeleteOwnerFreeze
+ * -----------------
+ */
+func (ks *MemKeyStore) DeleteOwnerFreeze(ownerUuid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.freezes[ownerUuid] == nil {
+		return ErrNoFreeze
+	}
+	delete(ks.freezes, ownerUuid)
+	return nil
+}
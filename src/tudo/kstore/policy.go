@@ -0,0 +1,252 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+// Rules of a spending policy, named in PolicyError.
+const (
+	PolicyMaxValue   = "maxValue"
+	PolicyDailyLimit = "dailyLimit"
+	PolicyAllowlist  = "allowlist"
+	PolicyNoContract = "noContract"
+)
+
+// Admin operations on a spending policy, signed with PolicyHash.
+const (
+	AdminOpSetPolicy    = "set-policy"
+	AdminOpDeletePolicy = "delete-policy"
+)
+
+// Window of the daily limits, spend records older than this are pruned.
+const spendWindow = 24 * time.Hour
+
+/**
+ * Error returned by SignTx for a transaction breaking a spending policy rule.
+ * Scope is the account or wallet the policy is attached to.
+ */
+type PolicyError struct {
+	Account string
+	Scope   string
+	Rule    string
+	Reason  string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("Transaction from %s refused by the %s rule of policy %s: %s",
+		e.Account, e.Rule, e.Scope, e.Reason)
+}
+
+/**
+ * NewSpendPolicy
+ * --------------
+ * Validate the rules and return the policy for the account address or wallet
+ * uuid.  Empty values mean no limit, an empty allowlist any recipient.
+ */
+func NewSpendPolicy(scope, maxTxValue, dailyLimit, allowlist string,
+	noContract bool) (*models.SpendPolicy, error) {
+	scope, err := PolicyScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range []string{maxTxValue, dailyLimit} {
+		if _, err = parseWei(value); err != nil {
+			return nil, err
+		}
+	}
+	addrs := []string{}
+	for _, addr := range strings.Split(allowlist, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("Invalid allowlist address %s", addr)
+		}
+		addrs = append(addrs, common.HexToAddress(addr).Hex())
+	}
+	return &models.SpendPolicy{
+		Scope:      scope,
+		MaxTxValue: maxTxValue,
+		DailyLimit: dailyLimit,
+		Allowlist:  strings.Join(addrs, ","),
+		NoContract: noContract,
+	}, nil
+}
+
+/**
+ * PolicyScope
+ * -----------
+ * Return the account address or wallet uuid in the form policies are stored.
+ */
+func PolicyScope(scope string) (string, error) {
+	if common.IsHexAddress(scope) {
+		return common.HexToAddress(scope).Hex(), nil
+	}
+	if id := uuid.Parse(scope); id != nil {
+		return id.String(), nil
+	}
+	return "", fmt.Errorf("Policy scope %s is neither an address nor a wallet uuid", scope)
+}
+
+/**
+ * PolicyHash
+ * ----------
+ * Hash the admin signs with personal_sign to set or delete the policy.
+ */
+func PolicyHash(op string, policy *models.SpendPolicy, stamp int64) common.Hash {
+	var ts [8]byte
+
+	data, _ := rlp.EncodeToBytes([]interface{}{
+		policy.Scope, policy.MaxTxValue, policy.DailyLimit,
+		policy.Allowlist, policy.NoContract,
+	})
+	binary.BigEndian.PutUint64(ts[:], uint64(stamp))
+	return crypto.Keccak256Hash([]byte("tudo-"+op), data, ts[:])
+}
+
+/**
+ * checkPolicy
+ * -----------
+ * Check the transaction against the policies of the account and its wallet, and
+ * count it against their daily limits.  The limits hold for every signer going
+ * through the keystore, whichever API sent the transaction.
+ */
+func (ks *KStore) checkPolicy(addr common.Address,
+	tx *types.Transaction, chainId *big.Int) error {
+	account, wallet := addr.Hex(), ""
+
+	accts, err := ks.Storage.GetAccount(addr)
+	if err == nil {
+		wallet = accts[0].WalletUuid
+	} else if !IsNotFound(err) {
+		return err
+	}
+	policies := []*models.SpendPolicy{}
+	for _, scope := range []string{account, wallet} {
+		if scope == "" {
+			continue
+		}
+		policy, err := ks.Storage.GetSpendPolicy(scope)
+		if err == ErrNoPolicy {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = checkTxRules(account, policy, tx); err != nil {
+			return err
+		}
+		policies = append(policies, policy)
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	now := time.Now()
+	rec := &models.SpendRecord{
+		Account:    account,
+		WalletUuid: wallet,
+		SigHash:    txSigHash(tx, chainId).Hex(),
+		Value:      tx.Value().String(),
+		Stamp:      now.Unix(),
+	}
+	return ks.Storage.AddSpend(rec, now.Add(-spendWindow).Unix(),
+		func(acctSpent, walletSpent *big.Int) error {
+			for _, policy := range policies {
+				spent := acctSpent
+				if policy.Scope != account {
+					spent = walletSpent
+				}
+				limit, err := parseWei(policy.DailyLimit)
+				if err != nil {
+					return err
+				}
+				if limit != nil && new(big.Int).Add(spent, tx.Value()).Cmp(limit) > 0 {
+					return &PolicyError{
+						Account: account,
+						Scope:   policy.Scope,
+						Rule:    PolicyDailyLimit,
+						Reason: fmt.Sprintf("%s wei spent in the last 24 hours, limit %s",
+							spent, limit),
+					}
+				}
+			}
+			return nil
+		})
+}
+
+// checkTxRules checks the rules not depending on past transactions.
+func checkTxRules(account string, policy *models.SpendPolicy, tx *types.Transaction) error {
+	refuse := func(rule, format string, args ...interface{}) error {
+		return &PolicyError{
+			Account: account,
+			Scope:   policy.Scope,
+			Rule:    rule,
+			Reason:  fmt.Sprintf(format, args...),
+		}
+	}
+	max, err := parseWei(policy.MaxTxValue)
+	if err != nil {
+		return err
+	}
+	if max != nil && tx.Value().Cmp(max) > 0 {
+		return refuse(PolicyMaxValue, "value %s wei above %s", tx.Value(), max)
+	}
+	// Without the chain state, any transaction with input data is a call.
+	if policy.NoContract && (tx.To() == nil || len(tx.Data()) > 0) {
+		return refuse(PolicyNoContract, "contract calls are not allowed")
+	}
+	if policy.Allowlist != "" {
+		if tx.To() == nil {
+			return refuse(PolicyAllowlist, "contract creation is not allowed")
+		}
+		to := tx.To().Hex()
+		for _, addr := range strings.Split(policy.Allowlist, ",") {
+			if addr == to {
+				return nil
+			}
+		}
+		return refuse(PolicyAllowlist, "recipient %s is not allowed", to)
+	}
+	return nil
+}
+
+// parseWei parses the decimal wei amount, nil if empty.
+func parseWei(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	wei, ok := new(big.Int).SetString(value, 10)
+	if !ok || wei.Sign() < 0 {
+		return nil, fmt.Errorf("Invalid wei amount %s", value)
+	}
+	return wei, nil
+}
+
+// sumSpends adds up the values of the spend records.
+func sumSpends(recs []models.SpendRecord) *big.Int {
+	sum := new(big.Int)
+	for _, rec := range recs {
+		if value, err := parseWei(rec.Value); err == nil && value != nil {
+			sum.Add(sum, value)
+		}
+	}
+	return sum
+}
@@ -0,0 +1,104 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pborman/uuid"
+)
+
+func TestSpendPolicy(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	ks := newTestKStore(t, storage, 0)
+
+	owner, wallet := uuid.NewRandom().String(), uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, wallet, "a", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	peer, _, err := ks.NewAccountOwner(owner, wallet, "b", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	friend := common.HexToAddress("0x1234")
+	policy, err := NewSpendPolicy(acct.Address.Hex(), "100", "", friend.Hex(), true)
+	if err != nil {
+		t.Fatalf("new policy failed: %v", err)
+	}
+	storage.StoreSpendPolicy(policy)
+	if policy, err = NewSpendPolicy(wallet, "", "150", "", false); err != nil {
+		t.Fatalf("new policy failed: %v", err)
+	}
+	storage.StoreSpendPolicy(policy)
+	if _, err = NewSpendPolicy("bogus", "", "", "", false); err == nil {
+		t.Errorf("policy with a bad scope")
+	}
+	if _, err = NewSpendPolicy(wallet, "-1", "", "", false); err == nil {
+		t.Errorf("policy with a negative limit")
+	}
+	ks.Unlock(*acct, "pass")
+	ks.Unlock(*peer, "pass")
+
+	chainId := big.NewInt(7)
+	sign := func(from *accounts.Account, nonce uint64, to common.Address,
+		value int64, data []byte) error {
+		tx := types.NewTransaction(nonce, to, big.NewInt(value), 21000, big.NewInt(1), data)
+		_, err := ks.SignTx(*from, tx, chainId)
+		return err
+	}
+	rule := func(err error) string {
+		if policyErr, ok := err.(*PolicyError); ok {
+			return policyErr.Rule
+		}
+		return ""
+	}
+	if err = sign(acct, 0, friend, 200, nil); rule(err) != PolicyMaxValue {
+		t.Errorf("value above max: %v", err)
+	}
+	if err = sign(acct, 0, common.HexToAddress("0x5678"), 10, nil); rule(err) != PolicyAllowlist {
+		t.Errorf("recipient not allowed: %v", err)
+	}
+	if err = sign(acct, 0, friend, 10, []byte{1}); rule(err) != PolicyNoContract {
+		t.Errorf("contract call: %v", err)
+	}
+	// Signing the same transaction again doesn't count twice.
+	for i := 0; i < 2; i++ {
+		if err = sign(acct, 0, friend, 100, nil); err != nil {
+			t.Fatalf("allowed tx refused: %v", err)
+		}
+	}
+	if err = sign(acct, 1, friend, 60, nil); rule(err) != PolicyDailyLimit {
+		t.Errorf("above daily limit: %v", err)
+	}
+	// The wallet limit covers its other accounts, with either signer.
+	tx := types.NewTransaction(0, friend, big.NewInt(60), 21000, big.NewInt(1), nil)
+	_, err = ks.SignTxWithPassphrase(accounts.Account{Address: peer.Address}, "pass", tx, chainId)
+	if rule(err) != PolicyDailyLimit {
+		t.Errorf("wallet above daily limit: %v", err)
+	}
+	if err = sign(peer, 0, friend, 50, nil); err != nil {
+		t.Errorf("wallet tx within the limit refused: %v", err)
+	}
+	// Spending older than a day is out of the window.
+	for idx := range storage.spends {
+		storage.spends[idx].Stamp -= 2 * 24 * 3600
+	}
+	if err = sign(acct, 1, friend, 60, nil); err != nil {
+		t.Errorf("tx refused the next day: %v", err)
+	}
+	storage.DeleteSpendPolicy(acct.Address.Hex())
+	if err = sign(acct, 2, common.HexToAddress("0x5678"), 10, nil); err != nil {
+		t.Errorf("tx refused after the policy was deleted: %v", err)
+	}
+}
@@ -0,0 +1,1451 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+/**
+ * SQL based keystore, on MySQL or SQLite through the beego orm.  The database must
+ * be set up with models.InitDatabase.
+ */
+func NewSqlKeyStore(scryptN, scryptP int) *SqlKeyStore {
+	return &SqlKeyStore{
+		BaseKeyStore: newBaseKeyStore(scryptN, scryptP),
+		ormHandler:   orm.NewOrm(),
+	}
+}
+
+// Columns rewritten when a key is encrypted or wrapped again.
+var keyColumns = []string{"PassKey", "PrivKey", "WrapKey", "KeyVersion"}
+
+func (ks *SqlKeyStore) GetOrm() orm.Ormer {
+	return ks.ormHandler
+}
+
+/**
+ * StoreKey
+ * --------
+ */
+func (ks *SqlKeyStore) StoreKey(filename string, key *keystore.Key, auth string) error {
+	_, err := ks.StoreKeyUuid(key, key.Id, auth)
+	return err
+}
+
+/**
+ * GetKey
+ * ------
+ */
+func (ks *SqlKeyStore) GetKey(addr common.Address,
+	path, auth string) (*keystore.Key, error) {
+	return ks.GetKeyUuid(addr, uuid.Parse(path), auth)
+}
+
+/**
+ * Query tables, every filter value is bound by the orm.
+ */
+func (ks *SqlKeyStore) accountTable() orm.QuerySeter {
+	return ks.GetOrm().QueryTable(new(models.Account))
+}
+
+func (ks *SqlKeyStore) transTable() orm.QuerySeter {
+	return ks.GetOrm().QueryTable(new(models.Transaction))
+}
+
+func (ks *SqlKeyStore) keyTable() orm.QuerySeter {
+	return ks.GetOrm().QueryTable(new(models.AccountKey))
+}
+
+// Rows not archived by a delete.
+func (ks *SqlKeyStore) liveAccounts() orm.QuerySeter {
+	return ks.accountTable().Filter("archived", 0)
+}
+
+func (ks *SqlKeyStore) liveKeys() orm.QuerySeter {
+	return ks.keyTable().Filter("archived", 0)
+}
+
+/**
+ * GetAccount
+ * ----------
+ */
+func (ks *SqlKeyStore) GetAccount(addr common.Address) ([]models.Account, error) {
+	return ks.getAccountQuery(ks.liveAccounts().Filter("account", addr.Hex()))
+}
+
+/**
+ * GetAccountOwner
+ * ---------------
+ */
+func (ks *SqlKeyStore) GetAccountOwner(addr, owner string) (*models.Account, error) {
+	qs := ks.liveAccounts().
+		Filter("account", common.HexToAddress(addr).Hex()).Filter("owner_uuid", owner)
+
+	results, err := ks.getAccountQuery(qs)
+	if err == nil {
+		return &results[0], err
+	}
+	return nil, err
+}
+
+/**
+ * GetUserAccount
+ * --------------
+ */
+func (ks *SqlKeyStore) GetUserAccount(ownerUuid uuid.UUID) ([]models.Account, error) {
+	return ks.getAccountQuery(ks.liveAccounts().Filter("owner_uuid", ownerUuid.String()))
+}
+
+/**
+ * GetWallet
+ * ---------
+ */
+func (ks *SqlKeyStore) GetWallet(walletUuid uuid.UUID) ([]models.Account, error) {
+	return ks.getAccountQuery(ks.liveAccounts().Filter("wallet_uuid", walletUuid.String()))
+}
+
+/**
+ * GetTransaction
+ * --------------
+ */
+func (ks *SqlKeyStore) GetTransaction(addr *common.Address, owner *uuid.UUID,
+	from *bool, offset, limit int) ([]models.Transaction, error) {
+	acct := "from_acct"
+	uuid := "from_uuid"
+	cond := orm.NewCondition()
+
+	if from == nil {
+		if addr == nil {
+			return nil, errors.New("Invalid arguments")
+		}
+		hex := addr.Hex()
+		cond = cond.Or("from_acct", hex).Or("to_acct", hex)
+	} else {
+		if *from == false {
+			acct = "to_acct"
+			uuid = "to_uuid"
+		}
+		if addr == nil && owner == nil {
+			return nil, errors.New("Invalid arguments")
+		}
+		if addr != nil {
+			cond = cond.Or(acct, addr.Hex())
+		}
+		if owner != nil {
+			cond = cond.Or(uuid, owner.String())
+		}
+	}
+	qs := ks.transTable().SetCond(cond)
+	if limit != 0 {
+		qs = qs.Limit(limit, offset)
+	} else {
+		qs = qs.Limit(-1)
+	}
+	return ks.getTransQuery(qs)
+}
+
+/**
+ * getAccountQuery
+ * ---------------
+ */
+func (ks *SqlKeyStore) getAccountQuery(qs orm.QuerySeter) ([]models.Account, error) {
+	var results []models.Account
+
+	if _, err := qs.All(&results); err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		return results, nil
+	}
+	return nil, ErrNoAccount
+}
+
+/**
+ * getTransQuery
+ * -------------
+ */
+func (ks *SqlKeyStore) getTransQuery(qs orm.QuerySeter) ([]models.Transaction, error) {
+	var results []models.Transaction
+
+	if _, err := qs.All(&results); err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		return results, nil
+	}
+	return nil, ErrNoTrans
+}
+
+/**
+ * UpdateAccount
+ * -------------
+ */
+func (ks *SqlKeyStore) UpdateAccount(addr common.Address,
+	name, actType string, ownerUuid, walletUuid uuid.UUID) error {
+	obj := &models.Account{}
+	err := ks.liveAccounts().Filter("account", addr.Hex()).
+		Filter("owner_uuid", ownerUuid.String()).One(obj)
+
+	if err == orm.ErrNoRows {
+		acctRec := &models.Account{
+			OwnerUuid:  ownerUuid.String(),
+			WalletUuid: walletUuid.String(),
+			PublicName: name,
+			Account:    addr.Hex(),
+			Type:       actType,
+		}
+		_, err := ks.GetOrm().Insert(acctRec)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if walletUuid != nil {
+		obj.WalletUuid = walletUuid.String()
+	}
+	obj.PublicName = name
+	obj.Type = actType
+
+	_, err = ks.ormHandler.Update(obj)
+	return err
+}
+
+/**
+ * GetKeyUuid
+ * ----------
+ */
+func (ks *SqlKeyStore) GetKeyUuid(addr common.Address,
+	owner uuid.UUID, auth string) (*keystore.Key, error) {
+	keyRec, err := ks.GetKeyRecord(addr)
+	if err != nil {
+		return nil, err
+	}
+	return ks.DecryptKeyRec(keyRec, auth)
+}
+
+/**
+ * GetKeyRecord
+ * ------------
+ */
+func (ks *SqlKeyStore) GetKeyRecord(addr common.Address) (*models.AccountKey, error) {
+	keyRec := &models.AccountKey{}
+
+	err := ks.liveKeys().Filter("account", addr.Hex()).One(keyRec)
+	if err == orm.ErrNoRows {
+		return nil, accounts.ErrUnknownAccount
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keyRec, nil
+}
+
+/**
+ * GetOwnerKeys
+ * ------------
+ */
+func (ks *SqlKeyStore) GetOwnerKeys(ownerUuid string) ([]models.AccountKey, error) {
+	var results []models.AccountKey
+
+	_, err := ks.liveKeys().Filter("owner_uuid", ownerUuid).Limit(-1).All(&results)
+	return results, err
+}
+
+/**
+ * StoreAccountKey
+ * ---------------
+ */
+func (ks *SqlKeyStore) StoreAccount(key *keystore.Key, name, actType string,
+	ownerUuid *uuid.UUID, walletUuid *uuid.UUID) (*models.Account, error) {
+	if walletUuid == nil {
+		uid := uuid.NewRandom()
+		walletUuid = &uid
+	}
+	if ownerUuid == nil {
+		ownerUuid = &key.Id
+	}
+	if name == "" {
+		name = "Anonymous"
+	}
+	orm := ks.ormHandler
+	acctRec := &models.Account{
+		OwnerUuid:  ownerUuid.String(),
+		WalletUuid: walletUuid.String(),
+		PublicName: name,
+		Account:    key.Address.Hex(),
+		Type:       actType,
+	}
+	_, err := orm.Insert(acctRec)
+	return acctRec, err
+}
+
+/**
+ * StoreKeyUuid
+ * ------------
+ * Encrypt the key with the passphrase and store the V3 JSON blob.
+ */
+func (ks *SqlKeyStore) StoreKeyUuid(k *keystore.Key,
+	owner uuid.UUID, auth string) (*models.AccountKey, error) {
+	keyRec, err := ks.encryptKeyRec(k, owner.String(), auth)
+	if err != nil {
+		return nil, err
+	}
+	err = inTx(func(o orm.Ormer) error {
+		if _, err := o.Insert(keyRec); err != nil {
+			return err
+		}
+		return ks.logKeyChange(o, keyRec.Account, keyRec.OwnerUuid, models.KeyAdded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keyRec, nil
+}
+
+/**
+ * GetAccountKeys
+ * --------------
+ */
+func (ks *SqlKeyStore) GetAccountKeys(offset, limit int) ([]models.AccountKey, error) {
+	var results []models.AccountKey
+
+	_, err := ks.liveKeys().OrderBy("account").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * ArchiveKey
+ * ----------
+ * Mark the key and account rows archived, the account can be restored until the
+ * rows are purged.
+ */
+func (ks *SqlKeyStore) ArchiveKey(addr common.Address) error {
+	now := time.Now().Unix()
+	return inTx(func(o orm.Ormer) error {
+		num, err := o.QueryTable(new(models.AccountKey)).Filter("account", addr.Hex()).
+			Filter("archived", 0).Update(orm.Params{"archived": now})
+		if err != nil {
+			return err
+		}
+		if num == 0 {
+			return accounts.ErrUnknownAccount
+		}
+		_, err = o.QueryTable(new(models.Account)).Filter("account", addr.Hex()).
+			Filter("archived", 0).Update(orm.Params{"archived": now})
+		if err != nil {
+			return err
+		}
+		return ks.logKeyChange(o, addr.Hex(), "", models.KeyDeleted)
+	})
+}
+
+/**
+ * GetArchivedKey
+ * --------------
+ */
+func (ks *SqlKeyStore) GetArchivedKey(addr common.Address) (*models.AccountKey, error) {
+	keyRec := &models.AccountKey{}
+
+	err := ks.keyTable().Filter("account", addr.Hex()).
+		Filter("archived__gt", 0).One(keyRec)
+	if err == orm.ErrNoRows {
+		return nil, accounts.ErrUnknownAccount
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keyRec, nil
+}
+
+/**
+ * GetArchivedKeys
+ * ---------------
+ * Return the keys archived before the unix time, oldest first.
+ */
+func (ks *SqlKeyStore) GetArchivedKeys(before int64,
+	limit int) ([]models.AccountKey, error) {
+	var results []models.AccountKey
+
+	_, err := ks.keyTable().Filter("archived__gt", 0).Filter("archived__lt", before).
+		OrderBy("archived", "account").Limit(limit).All(&results)
+	return results, err
+}
+
+/**
+ * RestoreKey
+ * ----------
+ * Bring back the key and account rows archived since the unix time.
+ */
+func (ks *SqlKeyStore) RestoreKey(addr common.Address,
+	since int64) (*models.AccountKey, error) {
+	keyRec := &models.AccountKey{Account: addr.Hex()}
+
+	err := inTx(func(o orm.Ormer) error {
+		if err := o.ReadForUpdate(keyRec); err != nil {
+			if err == orm.ErrNoRows {
+				return accounts.ErrUnknownAccount
+			}
+			return err
+		}
+		if keyRec.Archived == 0 || keyRec.Archived < since {
+			return accounts.ErrUnknownAccount
+		}
+		archived := keyRec.Archived
+		keyRec.Archived = 0
+		if _, err := o.Update(keyRec, "Archived"); err != nil {
+			return err
+		}
+		_, err := o.QueryTable(new(models.Account)).Filter("account", addr.Hex()).
+			Filter("archived", archived).Update(orm.Params{"archived": 0})
+		if err != nil {
+			return err
+		}
+		return ks.logKeyChange(o, keyRec.Account, keyRec.OwnerUuid, models.KeyAdded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keyRec, nil
+}
+
+/**
+ * PurgeKey
+ * --------
+ * Remove the archived key and account rows for good.
+ */
+func (ks *SqlKeyStore) PurgeKey(addr common.Address) error {
+	return inTx(func(o orm.Ormer) error {
+		num, err := o.QueryTable(new(models.AccountKey)).Filter("account", addr.Hex()).
+			Filter("archived__gt", 0).Delete()
+		if err != nil {
+			return err
+		}
+		if num == 0 {
+			return accounts.ErrUnknownAccount
+		}
+		_, err = o.QueryTable(new(models.Account)).Filter("account", addr.Hex()).
+			Filter("archived__gt", 0).Delete()
+		return err
+	})
+}
+
+/**
+ * StoreTransaction
+ * ----------------
+ */
+func (ks *SqlKeyStore) StoreTransaction(trans *models.Transaction) error {
+	_, err := ks.GetOrm().Insert(trans)
+	return err
+}
+
+/**
+ * ListTransactions
+ * ----------------
+ * An empty page is not an error.
+ */
+func (ks *SqlKeyStore) ListTransactions(q *TransQuery) ([]models.Transaction, error) {
+	if q.Account == nil && q.Owner == nil {
+		return nil, errors.New("Invalid arguments")
+	}
+	side := func(acct, owner, peer string) *orm.Condition {
+		cond := orm.NewCondition()
+		if q.Account != nil {
+			cond = cond.Or(acct, q.Account.Hex())
+		}
+		if q.Owner != nil {
+			cond = cond.Or(owner, q.Owner.String())
+		}
+		if q.Peer != nil {
+			cond = orm.NewCondition().AndCond(cond).And(peer, q.Peer.Hex())
+		}
+		return cond
+	}
+	sent := side("from_acct", "from_uuid", "to_acct")
+	received := side("to_acct", "to_uuid", "from_acct")
+
+	// Nest the match so the filters below apply to both sides.
+	cond := orm.NewCondition()
+	switch {
+	case q.From == nil:
+		cond = cond.AndCond(orm.NewCondition().OrCond(sent).OrCond(received))
+	case *q.From:
+		cond = cond.AndCond(sent)
+	default:
+		cond = cond.AndCond(received)
+	}
+	if q.MinXu != nil {
+		cond = cond.And("xu_amount__gte", *q.MinXu)
+	}
+	if q.MaxXu != nil {
+		cond = cond.And("xu_amount__lte", *q.MaxXu)
+	}
+	if !q.Since.IsZero() {
+		cond = cond.And("created__gte", q.Since)
+	}
+	if !q.Until.IsZero() {
+		cond = cond.And("created__lt", q.Until)
+	}
+	order := []string{"block_number", "tx_index", "tx_hash"}
+	if q.Pending {
+		cond = cond.And("block_number", 0)
+		order = []string{"created", "tx_hash"}
+	} else {
+		cond = cond.And("block_number__gt", 0)
+		if q.After != nil {
+			cond = cond.AndCond(afterCursor(q.After, q.Oldest))
+		}
+	}
+	if !q.Oldest {
+		for idx := range order {
+			order[idx] = "-" + order[idx]
+		}
+	}
+	qs := ks.transTable().SetCond(cond).OrderBy(order...)
+	if q.After == nil {
+		qs = qs.Limit(q.Limit, q.Offset)
+	} else {
+		qs = qs.Limit(q.Limit)
+	}
+	results := []models.Transaction{}
+	_, err := qs.All(&results)
+	return results, err
+}
+
+// afterCursor matches the rows listed after the cursor.
+func afterCursor(c *TransCursor, oldest bool) *orm.Condition {
+	op := "__lt"
+	if oldest {
+		op = "__gt"
+	}
+	sameIndex := orm.NewCondition().
+		And("tx_index", c.TxIndex).And("tx_hash"+op, c.TxHash)
+	sameBlock := orm.NewCondition().Or("tx_index"+op, c.TxIndex).OrCond(sameIndex)
+	return orm.NewCondition().Or("block_number"+op, c.BlockNumber).
+		OrCond(orm.NewCondition().And("block_number", c.BlockNumber).AndCond(sameBlock))
+}
+
+/**
+ * SetTransBlock
+ * -------------
+ * Record the position of the transaction once it's mined.
+ */
+func (ks *SqlKeyStore) SetTransBlock(txHash string,
+	blockNumber int64, txIndex int) error {
+	num, err := ks.transTable().Filter("tx_hash", txHash).Update(orm.Params{
+		"block_number": blockNumber,
+		"tx_index":     txIndex,
+	})
+	if err == nil && num == 0 {
+		return ErrNoTrans
+	}
+	return err
+}
+
+/**
+ * UpdateKeyAuth
+ * -------------
+ * Verify the passphrase against the stored key, re-encrypt the key with the new
+ * passphrase in one transaction.
+ */
+func (ks *SqlKeyStore) UpdateKeyAuth(addr common.Address,
+	auth, newAuth string) (*models.AccountKey, error) {
+	o := orm.NewOrm()
+	if err := o.Begin(); err != nil {
+		return nil, err
+	}
+	keyRec, err := ks.updateKeyAuth(o, addr, auth, newAuth)
+	if err != nil {
+		o.Rollback()
+		return nil, err
+	}
+	return keyRec, o.Commit()
+}
+
+func (ks *SqlKeyStore) updateKeyAuth(o orm.Ormer, addr common.Address,
+	auth, newAuth string) (*models.AccountKey, error) {
+	keyRec := &models.AccountKey{Account: addr.Hex()}
+	if err := o.ReadForUpdate(keyRec); err != nil {
+		if err == orm.ErrNoRows {
+			return nil, accounts.ErrUnknownAccount
+		}
+		return nil, err
+	}
+	if keyRec.Archived != 0 {
+		return nil, accounts.ErrUnknownAccount
+	}
+	key, err := ks.DecryptKeyRec(keyRec, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+
+	newRec, err := ks.encryptKeyRec(key, keyRec.OwnerUuid, newAuth)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = o.Update(newRec, keyColumns...); err != nil {
+		return nil, err
+	}
+	err = ks.logKeyChange(o, newRec.Account, newRec.OwnerUuid, models.KeyUpdated)
+	if err != nil {
+		return nil, err
+	}
+	return newRec, nil
+}
+
+/**
+ * MigratePlainKeys
+ * ----------------
+ * One-shot conversion of account_key rows holding the hex private key and the clear
+ * text passphrase.  Each key is encrypted with its recorded passphrase, and the
+ * passphrase column is cleared, one row per transaction.  Return the number of rows
+ * converted.
+ */
+func (ks *SqlKeyStore) MigratePlainKeys() (int, error) {
+	var rows []models.AccountKey
+
+	count, last := 0, ""
+	for {
+		rows = rows[:0]
+		_, err := ks.keyTable().Filter("account__gt", last).OrderBy("account").
+			Limit(migrateBatch).All(&rows)
+		if err != nil {
+			return count, err
+		}
+		for idx := range rows {
+			last = rows[idx].Account
+			if isEncryptedKey(&rows[idx]) {
+				continue
+			}
+			migrated, err := ks.migratePlainKey(last)
+			if err != nil {
+				return count, err
+			}
+			if migrated {
+				count++
+			}
+		}
+		if len(rows) < migrateBatch {
+			return count, nil
+		}
+	}
+}
+
+/**
+ * migratePlainKey
+ * ---------------
+ * Lock the row and encrypt its key, another node may have migrated it since the
+ * batch was read.
+ */
+func (ks *SqlKeyStore) migratePlainKey(account string) (bool, error) {
+	var keyRec *models.AccountKey
+
+	err := inTx(func(o orm.Ormer) error {
+		row := &models.AccountKey{Account: account}
+		if err := o.ReadForUpdate(row); err != nil {
+			if err == orm.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+		if isEncryptedKey(row) {
+			return nil
+		}
+		key, err := getPlainKey(row, row.PassKey)
+		if err != nil {
+			return fmt.Errorf("account %s: %v", row.Account, err)
+		}
+		newRec, err := ks.encryptKeyRec(key, row.OwnerUuid, row.PassKey)
+		if err != nil {
+			return err
+		}
+		if _, err = o.Update(newRec, keyColumns...); err != nil {
+			return err
+		}
+		keyRec = newRec
+		return ks.logKeyChange(o, newRec.Account, newRec.OwnerUuid, models.KeyUpdated)
+	})
+	if err != nil || keyRec == nil {
+		return false, err
+	}
+	if kstore := ks.kstore; kstore != nil {
+		kstore.updateKeyRec(keyRec)
+	}
+	return true, nil
+}
+
+/**
+ * RewrapKeys
+ * ----------
+ * Wrap the account_key rows sealed with an older master key version, or not yet
+ * wrapped, with the current version.  Rows are read in batches and each one is
+ * rewritten in its own transaction so the keystore stays online.  Return the
+ * number of rows wrapped again.
+ */
+func (ks *SqlKeyStore) RewrapKeys(batch int) (int, error) {
+	var rows []models.AccountKey
+
+	current := ks.master.Current()
+	if current == 0 {
+		return 0, ErrNoMasterKey
+	}
+	if batch <= 0 {
+		batch = migrateBatch
+	}
+	count, last := 0, ""
+	for {
+		rows = rows[:0]
+		_, err := ks.keyTable().Filter("account__gt", last).
+			Exclude("key_version", current).OrderBy("account").Limit(batch).All(&rows)
+		if err != nil {
+			return count, err
+		}
+		for idx := range rows {
+			last = rows[idx].Account
+			wrapped, err := ks.rewrapKey(last)
+			if err != nil {
+				return count, err
+			}
+			if wrapped {
+				count++
+			}
+		}
+		if len(rows) < batch {
+			return count, nil
+		}
+	}
+}
+
+/**
+ * rewrapKey
+ * ---------
+ * Lock the row, it may have been updated since the batch was read.  Legacy plain
+ * rows are skipped, they are wrapped when migrated.
+ */
+func (ks *SqlKeyStore) rewrapKey(account string) (bool, error) {
+	var keyRec *models.AccountKey
+
+	err := inTx(func(o orm.Ormer) error {
+		row := &models.AccountKey{Account: account}
+		if err := o.ReadForUpdate(row); err != nil {
+			if err == orm.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+		newRec, err := ks.wrapKeyRec(row)
+		if err != nil || newRec == row {
+			return err
+		}
+		if _, err = o.Update(newRec, keyColumns...); err != nil {
+			return err
+		}
+		keyRec = newRec
+		return ks.logKeyChange(o, newRec.Account, newRec.OwnerUuid, models.KeyUpdated)
+	})
+	if err != nil || keyRec == nil {
+		return false, err
+	}
+	if kstore := ks.kstore; kstore != nil {
+		kstore.updateKeyRec(keyRec)
+	}
+	return true, nil
+}
+
+/**
+ * inTx
+ * ----
+ * Run the function in a database transaction on its own Ormer.
+ */
+func inTx(fn func(o orm.Ormer) error) error {
+	o := orm.NewOrm()
+	if err := o.Begin(); err != nil {
+		return err
+	}
+	if err := fn(o); err != nil {
+		o.Rollback()
+		return err
+	}
+	return o.Commit()
+}
+
+/**
+ * logKeyChange
+ * ------------
+ * Record a write to account_key for the other nodes sharing the database.
+ */
+func (ks *SqlKeyStore) logKeyChange(o orm.Ormer, account, owner, op string) error {
+	_, err := o.Insert(&models.KeyChange{
+		Account:   account,
+		OwnerUuid: owner,
+		Op:        op,
+		Origin:    ks.origin,
+	})
+	return err
+}
+
+/**
+ * GetKeyChanges
+ * -------------
+ * Return key changes logged after the given id, oldest first.
+ */
+func (ks *SqlKeyStore) GetKeyChanges(afterId int64, limit int) ([]models.KeyChange, error) {
+	var results []models.KeyChange
+
+	_, err := ks.GetOrm().QueryTable(new(models.KeyChange)).
+		Filter("id__gt", afterId).OrderBy("id").Limit(limit).All(&results)
+	return results, err
+}
+
+/**
+ * LastKeyChange
+ * -------------
+ * Return the id of the latest key change, zero if the log is empty.
+ */
+func (ks *SqlKeyStore) LastKeyChange() (int64, error) {
+	change := &models.KeyChange{}
+
+	err := ks.GetOrm().QueryTable(change).OrderBy("-id").Limit(1).One(change)
+	if err == orm.ErrNoRows {
+		return 0, nil
+	}
+	return change.Id, err
+}
+
+/**
+ * PruneKeyChanges
+ * ---------------
+ */
+func (ks *SqlKeyStore) PruneKeyChanges(before time.Time) (int64, error) {
+	return ks.GetOrm().QueryTable(new(models.KeyChange)).
+		Filter("created__lt", before).Delete()
+}
+
+/**
+ * GetSeed
+ * -------
+ */
+func (ks *SqlKeyStore) GetSeed(ownerUuid string) (*models.WalletSeed, error) {
+	seed := &models.WalletSeed{}
+
+	err := ks.GetOrm().QueryTable(seed).Filter("owner_uuid", ownerUuid).One(seed)
+	if err == orm.ErrNoRows {
+		return nil, ErrNoSeed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+/**
+ * StoreSeed
+ * ---------
+ * An owner has at most one seed, it's never replaced.
+ */
+func (ks *SqlKeyStore) StoreSeed(seed *models.WalletSeed) error {
+	return inTx(func(o orm.Ormer) error {
+		exist, err := o.QueryTable(seed).Filter("owner_uuid", seed.OwnerUuid).Count()
+		if err != nil {
+			return err
+		}
+		if exist != 0 {
+			return fmt.Errorf("Owner %s already has a wallet seed", seed.OwnerUuid)
+		}
+		_, err = o.Insert(seed)
+		return err
+	})
+}
+
+/**
+ * GetApprovalReq
+ * --------------
+ */
+func (ks *SqlKeyStore) GetApprovalReq(id int64) (*models.ApprovalRequest, error) {
+	req := &models.ApprovalRequest{Id: id}
+
+	err := ks.GetOrm().Read(req)
+	if err == orm.ErrNoRows {
+		return nil, ErrNoApproval
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+/**
+ * GetApprovalReqByHash
+ * --------------------
+ * Find the account's request for the transaction signing hash.
+ */
+func (ks *SqlKeyStore) GetApprovalReqByHash(account,
+	sigHash string) (*models.ApprovalRequest, error) {
+	req := &models.ApprovalRequest{}
+
+	err := ks.GetOrm().QueryTable(req).Filter("account", account).
+		Filter("sig_hash", sigHash).One(req)
+	if err == orm.ErrNoRows {
+		return nil, ErrNoApproval
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+/**
+ * ListApprovalReqs
+ * ----------------
+ * List the requests in the status, all of them if status is empty, newest first.
+ */
+func (ks *SqlKeyStore) ListApprovalReqs(status string,
+	offset, limit int) ([]models.ApprovalRequest, error) {
+	var results []models.ApprovalRequest
+
+	qs := ks.GetOrm().QueryTable(new(models.ApprovalRequest))
+	if status != "" {
+		qs = qs.Filter("status", status)
+	}
+	_, err := qs.OrderBy("-id").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * StoreApprovalReq
+ * ----------------
+ */
+func (ks *SqlKeyStore) StoreApprovalReq(req *models.ApprovalRequest) error {
+	_, err := ks.GetOrm().Insert(req)
+	return err
+}
+
+/**
+ * UpdateApprovalReq
+ * -----------------
+ * Write the request's status and tx hash if its stored status is still from.
+ * Return false if another node changed it first.
+ */
+func (ks *SqlKeyStore) UpdateApprovalReq(req *models.ApprovalRequest,
+	from string) (bool, error) {
+	num, err := ks.GetOrm().QueryTable(req).
+		Filter("id", req.Id).Filter("status", from).Update(orm.Params{
+		"status":   req.Status,
+		"tx_hash":  req.TxHash,
+		"modified": time.Now(),
+	})
+	return num > 0, err
+}
+
+/**
+ * GetApprovals
+ * ------------
+ */
+func (ks *SqlKeyStore) GetApprovals(reqId int64) ([]models.Approval, error) {
+	var results []models.Approval
+
+	_, err := ks.GetOrm().QueryTable(new(models.Approval)).
+		Filter("request_id", reqId).OrderBy("id").All(&results)
+	return results, err
+}
+
+/**
+ * StoreApproval
+ * -------------
+ * An admin votes once on each request.
+ */
+func (ks *SqlKeyStore) StoreApproval(appr *models.Approval) error {
+	return inTx(func(o orm.Ormer) error {
+		exist, err := o.QueryTable(appr).Filter("request_id", appr.RequestId).
+			Filter("approver", appr.Approver).Count()
+		if err != nil {
+			return err
+		}
+		if exist != 0 {
+			return fmt.Errorf("%s already voted on request %d",
+				appr.Approver, appr.RequestId)
+		}
+		_, err = o.Insert(appr)
+		return err
+	})
+}
+
+/**
+ * AppendAudit
+ * -----------
+ * Link the record to the last one and insert it.  The head row is locked so
+ * nodes sharing the database append one at a time.
+ */
+func (ks *SqlKeyStore) AppendAudit(rec *models.AuditRecord) error {
+	return inTx(func(o orm.Ormer) error {
+		head := &models.AuditHead{Id: auditHeadId}
+		err := o.ReadForUpdate(head)
+		if err == orm.ErrNoRows {
+			return ErrNoAuditHead
+		}
+		if err != nil {
+			return err
+		}
+		rec.Seq = head.Seq + 1
+		rec.PrevHash = head.Hash
+		rec.KeyVersion = ks.master.Current()
+		if rec.Hash, err = AuditHash(rec, ks.master); err != nil {
+			return err
+		}
+		if _, err = o.Insert(rec); err != nil {
+			return err
+		}
+		head.Seq, head.Hash = rec.Seq, rec.Hash
+		_, err = o.Update(head)
+		return err
+	})
+}
+
+/**
+ * GetAuditRecords
+ * ---------------
+ * Return the records after the id, oldest first.
+ */
+func (ks *SqlKeyStore) GetAuditRecords(afterId int64,
+	limit int) ([]models.AuditRecord, error) {
+	var results []models.AuditRecord
+
+	_, err := ks.GetOrm().QueryTable(new(models.AuditRecord)).
+		Filter("id__gt", afterId).OrderBy("id").Limit(limit).All(&results)
+	return results, err
+}
+
+/**
+ * GetAuditHead
+ * ------------
+ */
+func (ks *SqlKeyStore) GetAuditHead() (*models.AuditHead, error) {
+	head := &models.AuditHead{Id: auditHeadId}
+
+	err := ks.GetOrm().Read(head)
+	if err == orm.ErrNoRows {
+		return nil, ErrNoAuditHead
+	}
+	if err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+/**
+ * GetSpendPolicy
+ * --------------
+ */
+func (ks *SqlKeyStore) GetSpendPolicy(scope string) (*models.SpendPolicy, error) {
+	policy := &models.SpendPolicy{Scope: scope}
+
+	err := ks.GetOrm().Read(policy, "Scope")
+	if err == orm.ErrNoRows {
+		return nil, ErrNoPolicy
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+/**
+ * ListSpendPolicies
+ * -----------------
+ */
+func (ks *SqlKeyStore) ListSpendPolicies(offset,
+	limit int) ([]models.SpendPolicy, error) {
+	var results []models.SpendPolicy
+
+	_, err := ks.GetOrm().QueryTable(new(models.SpendPolicy)).
+		OrderBy("scope").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * StoreSpendPolicy
+ * ----------------
+ * Insert the policy, or replace the rules of the one with the same scope.
+ */
+func (ks *SqlKeyStore) StoreSpendPolicy(policy *models.SpendPolicy) error {
+	return inTx(func(o orm.Ormer) error {
+		exist := &models.SpendPolicy{Scope: policy.Scope}
+		err := o.ReadForUpdate(exist, "Scope")
+		if err == orm.ErrNoRows {
+			_, err = o.Insert(policy)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		policy.Id = exist.Id
+		_, err = o.Update(policy)
+		return err
+	})
+}
+
+/**
+ * DeleteSpendPolicy
+ * -----------------
+ */
+func (ks *SqlKeyStore) DeleteSpendPolicy(scope string) error {
+	num, err := ks.GetOrm().QueryTable(new(models.SpendPolicy)).
+		Filter("scope", scope).Delete()
+	if err == nil && num == 0 {
+		return ErrNoPolicy
+	}
+	return err
+}
+
+/**
+ * AddSpend
+ * --------
+ * Pass the account's and wallet's spending since the unix time to check, then
+ * record the spend unless check fails.  The policy rows are locked so concurrent
+ * signers see each other's spending.  A transaction already recorded is not
+ * counted again.
+ */
+func (ks *SqlKeyStore) AddSpend(rec *models.SpendRecord, since int64,
+	check func(acctSpent, walletSpent *big.Int) error) error {
+	return inTx(func(o orm.Ormer) error {
+		for _, scope := range []string{rec.Account, rec.WalletUuid} {
+			if scope == "" {
+				continue
+			}
+			policy := &models.SpendPolicy{Scope: scope}
+			if err := o.ReadForUpdate(policy, "Scope"); err != nil && err != orm.ErrNoRows {
+				return err
+			}
+		}
+		spends := o.QueryTable(new(models.SpendRecord))
+		if spends.Filter("account", rec.Account).Filter("sig_hash", rec.SigHash).Exist() {
+			return nil
+		}
+		var acctRecs, walletRecs []models.SpendRecord
+
+		_, err := spends.Filter("account", rec.Account).
+			Filter("stamp__gte", since).Limit(-1).All(&acctRecs)
+		if err != nil {
+			return err
+		}
+		if rec.WalletUuid != "" {
+			_, err = spends.Filter("wallet_uuid", rec.WalletUuid).
+				Filter("stamp__gte", since).Limit(-1).All(&walletRecs)
+			if err != nil {
+				return err
+			}
+		}
+		if err = check(sumSpends(acctRecs), sumSpends(walletRecs)); err != nil {
+			return err
+		}
+		_, err = o.Insert(rec)
+		return err
+	})
+}
+
+/**
+ * PruneSpends
+ * -----------
+ * Delete the spend records before the unix time.
+ */
+func (ks *SqlKeyStore) PruneSpends(before int64) (int64, error) {
+	return ks.GetOrm().QueryTable(new(models.SpendRecord)).
+		Filter("stamp__lt", before).Delete()
+}
+
+/**
+ * ListAccountRows
+ * ---------------
+ * Page through every account row, archived ones included.
+ */
+func (ks *SqlKeyStore) ListAccountRows(offset, limit int) ([]models.Account, error) {
+	var results []models.Account
+
+	_, err := ks.accountTable().OrderBy("account").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * ListKeyRows
+ * -----------
+ * Page through every account_key row, archived ones included.
+ */
+func (ks *SqlKeyStore) ListKeyRows(offset, limit int) ([]models.AccountKey, error) {
+	var results []models.AccountKey
+
+	_, err := ks.keyTable().OrderBy("account").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * ListSeeds
+ * ---------
+ */
+func (ks *SqlKeyStore) ListSeeds(offset, limit int) ([]models.WalletSeed, error) {
+	var results []models.WalletSeed
+
+	_, err := ks.GetOrm().QueryTable(new(models.WalletSeed)).
+		OrderBy("owner_uuid").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * PutAccountRow
+ * -------------
+ * Write the account row restored from a backup, see RowAdded.
+ */
+func (ks *SqlKeyStore) PutAccountRow(rec *models.Account, replace bool) (int, error) {
+	result := RowAdded
+	err := inTx(func(o orm.Ormer) error {
+		exist := &models.Account{Account: rec.Account}
+		err := o.ReadForUpdate(exist)
+		if err == orm.ErrNoRows {
+			_, err = o.Insert(rec)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if result = putResult(*exist == *rec, replace); result == RowReplaced {
+			_, err = o.Update(rec)
+		}
+		return err
+	})
+	return result, err
+}
+
+/**
+ * PutKeyRow
+ * ---------
+ * Write the account_key row restored from a backup, see RowAdded.  The change
+ * is logged so other nodes reload the key.
+ */
+func (ks *SqlKeyStore) PutKeyRow(rec *models.AccountKey, replace bool) (int, error) {
+	result := RowAdded
+	err := inTx(func(o orm.Ormer) error {
+		exist := &models.AccountKey{Account: rec.Account}
+		err := o.ReadForUpdate(exist)
+		if err == orm.ErrNoRows {
+			if _, err = o.Insert(rec); err != nil || rec.Archived != 0 {
+				return err
+			}
+			return ks.logKeyChange(o, rec.Account, rec.OwnerUuid, models.KeyAdded)
+		}
+		if err != nil {
+			return err
+		}
+		if result = putResult(*exist == *rec, replace); result != RowReplaced {
+			return nil
+		}
+		if _, err = o.Update(rec); err != nil {
+			return err
+		}
+		for _, op := range keyChangeOps(exist, rec) {
+			owner := rec.OwnerUuid
+			if op == models.KeyDeleted {
+				owner = exist.OwnerUuid
+			}
+			if err = ks.logKeyChange(o, rec.Account, owner, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+/**
+ * PutSeed
+ * -------
+ * Write the wallet seed restored from a backup, see RowAdded.
+ */
+func (ks *SqlKeyStore) PutSeed(seed *models.WalletSeed, replace bool) (int, error) {
+	result := RowAdded
+	err := inTx(func(o orm.Ormer) error {
+		exist := &models.WalletSeed{OwnerUuid: seed.OwnerUuid}
+		err := o.ReadForUpdate(exist)
+		if err == orm.ErrNoRows {
+			_, err = o.Insert(seed)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		same := exist.WalletUuid == seed.WalletUuid && exist.Seed == seed.Seed
+		if result = putResult(same, replace); result == RowReplaced {
+			_, err = o.Update(seed, "WalletUuid", "Seed")
+		}
+		return err
+	})
+	return result, err
+}
+
+/**
+ * ListOwners
+ * ----------
+ * Page through the owners of live accounts, with their account and wallet counts.
+ */
+func (ks *SqlKeyStore) ListOwners(offset, limit int) ([]models.OwnerStat, error) {
+	results := []models.OwnerStat{}
+
+	_, err := ks.GetOrm().Raw("SELECT `owner_uuid`, "+
+		"COUNT(DISTINCT `wallet_uuid`) AS `wallets`, COUNT(*) AS `accounts` "+
+		"FROM `account` WHERE `archived` = 0 GROUP BY `owner_uuid` "+
+		"ORDER BY `owner_uuid` LIMIT ? OFFSET ?", limit, offset).QueryRows(&results)
+	return results, err
+}
+
+/**
+ * ListWallets
+ * -----------
+ * Page through the wallets of live accounts with their account counts, of every
+ * owner if ownerUuid is empty.
+ */
+func (ks *SqlKeyStore) ListWallets(ownerUuid string,
+	offset, limit int) ([]models.WalletStat, error) {
+	results := []models.WalletStat{}
+
+	where := "`archived` = 0"
+	args := []interface{}{}
+	if ownerUuid != "" {
+		where += " AND `owner_uuid` = ?"
+		args = append(args, ownerUuid)
+	}
+	_, err := ks.GetOrm().Raw("SELECT `wallet_uuid`, `owner_uuid`, "+
+		"COUNT(*) AS `accounts` FROM `account` WHERE "+where+" GROUP BY `wallet_uuid`, `owner_uuid` "+
+		"ORDER BY `wallet_uuid`, `owner_uuid` LIMIT ? OFFSET ?",
+		append(args, limit, offset)...).QueryRows(&results)
+	return results, err
+}
+
+/**
+ * GetKeyStats
+ * -----------
+ */
+func (ks *SqlKeyStore) GetKeyStats() (*models.KeyStats, error) {
+	var versions []struct {
+		KeyVersion int
+		Count      int
+	}
+	o := ks.GetOrm()
+	stats := &models.KeyStats{KeyVersions: make(map[int]int)}
+
+	err := o.Raw("SELECT COUNT(DISTINCT `owner_uuid`), "+
+		"COUNT(DISTINCT NULLIF(`wallet_uuid`, '')), COUNT(*) "+
+		"FROM `account` WHERE `archived` = 0").
+		QueryRow(&stats.Owners, &stats.Wallets, &stats.Accounts)
+	if err != nil {
+		return nil, err
+	}
+	_, err = o.Raw("SELECT `key_version`, COUNT(*) AS `count` FROM `account_key` " +
+		"WHERE `archived` = 0 GROUP BY `key_version`").QueryRows(&versions)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range versions {
+		stats.KeyVersions[row.KeyVersion] = row.Count
+		stats.Keys += row.Count
+	}
+	counts := []struct {
+		count *int
+		qs    orm.QuerySeter
+	}{
+		{&stats.ArchivedAccounts, ks.accountTable().Filter("archived__gt", 0)},
+		{&stats.ArchivedKeys, ks.keyTable().Filter("archived__gt", 0)},
+		{&stats.PlainKeys, ks.liveKeys().Exclude("pass_key", "")},
+		{&stats.Seeds, o.QueryTable(new(models.WalletSeed))},
+		{&stats.SpendPolicies, o.QueryTable(new(models.SpendPolicy))},
+		{&stats.PendingApprovals, o.QueryTable(new(models.ApprovalRequest)).
+			Filter("status", models.ApprovalPending)},
+		{&stats.FrozenOwners, o.QueryTable(new(models.OwnerFreeze))},
+	}
+	for _, c := range counts {
+		num, err := c.qs.Count()
+		if err != nil {
+			return nil, err
+		}
+		*c.count = int(num)
+	}
+	return stats, nil
+}
+
+/**
+ * GetOwnerFreeze
+ * --------------
+ */
+func (ks *SqlKeyStore) GetOwnerFreeze(ownerUuid string) (*models.OwnerFreeze, error) {
+	freeze := &models.OwnerFreeze{OwnerUuid: ownerUuid}
+
+	err := ks.GetOrm().Read(freeze)
+	if err == orm.ErrNoRows {
+		return nil, ErrNoFreeze
+	}
+	if err != nil {
+		return nil, err
+	}
+	return freeze, nil
+}
+
+/**
+ * ListOwnerFreezes
+ * ----------------
+ */
+func (ks *SqlKeyStore) ListOwnerFreezes(offset,
+	limit int) ([]models.OwnerFreeze, error) {
+	var results []models.OwnerFreeze
+
+	_, err := ks.GetOrm().QueryTable(new(models.OwnerFreeze)).
+		OrderBy("owner_uuid").Limit(limit, offset).All(&results)
+	return results, err
+}
+
+/**
+ * StoreOwnerFreeze
+ * ----------------
+ * Freeze the owner, or replace the reason if it's already frozen.
+ */
+func (ks *SqlKeyStore) StoreOwnerFreeze(freeze *models.OwnerFreeze) error {
+	return inTx(func(o orm.Ormer) error {
+		exist := &models.OwnerFreeze{OwnerUuid: freeze.OwnerUuid}
+		err := o.ReadForUpdate(exist)
+		if err == orm.ErrNoRows {
+			_, err = o.Insert(freeze)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		freeze.Created = exist.Created
+		_, err = o.Update(freeze, "Reason")
+		return err
+	})
+}
+
+/**
+ * DeleteOwnerFreeze
+ * -----------------
+ */
+func (ks *SqlKeyStore) DeleteOwnerFreeze(ownerUuid string) error {
+	num, err := ks.GetOrm().QueryTable(new(models.OwnerFreeze)).
+		Filter("owner_uuid", ownerUuid).Delete()
+	if err == nil && num == 0 {
+		return ErrNoFreeze
+	}
+	return err
+}
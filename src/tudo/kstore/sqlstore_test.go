@@ -0,0 +1,267 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/astaxie/beego/orm"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+var (
+	sqliteOnce sync.Once
+	sqliteErr  error
+)
+
+// newSqlStorage returns a SQL keystore over the empty test SQLite database.  The
+// orm registers the database once, the tests share it.  The audit head made by
+// the migrations is put back.
+func newSqlStorage(t *testing.T) *SqlKeyStore {
+	sqliteOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "kstore")
+		if err != nil {
+			sqliteErr = err
+			return
+		}
+		sqliteErr = models.InitDatabase(models.SqliteBackend,
+			filepath.Join(dir, "kstore.db"))
+	})
+	if sqliteErr != nil {
+		t.Fatalf("open test database failed: %v", sqliteErr)
+	}
+	o := orm.NewOrm()
+	var tables []string
+	_, err := o.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND " +
+		"name NOT IN ('sqlite_sequence', 'schema_version')").QueryRows(&tables)
+	if err != nil {
+		t.Fatalf("list tables failed: %v", err)
+	}
+	for _, table := range tables {
+		if _, err = o.Raw("DELETE FROM `" + table + "`").Exec(); err != nil {
+			t.Fatalf("empty %s failed: %v", table, err)
+		}
+	}
+	_, err = o.Raw("INSERT INTO `audit_head` (`id`, `seq`, `hash`) VALUES (1, 0, '')").Exec()
+	if err != nil {
+		t.Fatalf("reset audit head failed: %v", err)
+	}
+	return NewSqlKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+}
+
+func TestSqlMigratePlainKeys(t *testing.T) {
+	storage := newSqlStorage(t)
+	key, _ := newKey(rand.Reader)
+	owner := uuid.NewRandom()
+	if _, err := storage.StoreKeyUuid(key, owner, "pass"); err != nil {
+		t.Fatalf("store key failed: %v", err)
+	}
+	// A row of the releases storing the keys in clear.
+	plain, _ := newKey(rand.Reader)
+	_, err := storage.GetOrm().Insert(&models.AccountKey{
+		Account:   plain.Address.Hex(),
+		OwnerUuid: owner.String(),
+		PassKey:   "legacy",
+		PrivKey:   hex.EncodeToString(crypto.FromECDSA(plain.PrivateKey)),
+	})
+	if err != nil {
+		t.Fatalf("insert plain row failed: %v", err)
+	}
+	if count, err := storage.MigratePlainKeys(); count != 1 || err != nil {
+		t.Fatalf("migrated %d keys: %v", count, err)
+	}
+	keyRec, err := storage.GetKeyRecord(plain.Address)
+	if err != nil || !isEncryptedKey(keyRec) || keyRec.PassKey != "" {
+		t.Fatalf("migrated row %+v: %v", keyRec, err)
+	}
+	if _, err = storage.GetKeyUuid(plain.Address, owner, "legacy"); err != nil {
+		t.Errorf("migrated key doesn't decrypt: %v", err)
+	}
+	if count, err := storage.MigratePlainKeys(); count != 0 || err != nil {
+		t.Errorf("migrated %d keys twice: %v", count, err)
+	}
+}
+
+func TestSqlAuditHead(t *testing.T) {
+	storage := newSqlStorage(t)
+	if count, err := VerifyAudit(storage, 0); count != 0 || err != nil {
+		t.Fatalf("verified empty log %d: %v", count, err)
+	}
+	rec := &models.AuditRecord{Op: AuditLock}
+	if err := storage.AppendAudit(rec); err != nil || rec.Seq != 1 {
+		t.Fatalf("append audit %+v: %v", rec, err)
+	}
+	if count, err := VerifyAudit(storage, 0); count != 1 || err != nil {
+		t.Errorf("verified %d records: %v", count, err)
+	}
+	// A missing head isn't made again, the log would restart from it.
+	if _, err := storage.GetOrm().Raw("DELETE FROM `audit_head`").Exec(); err != nil {
+		t.Fatalf("delete head failed: %v", err)
+	}
+	if err := storage.AppendAudit(&models.AuditRecord{Op: AuditLock}); err != ErrNoAuditHead {
+		t.Errorf("append without head: %v", err)
+	}
+	if _, err := VerifyAudit(storage, 0); err == nil {
+		t.Errorf("missing head not detected")
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	storage, err := NewStorage(models.MemoryBackend, "",
+		keystore.LightScryptN, keystore.LightScryptP)
+	if _, ok := storage.(*MemKeyStore); !ok || err != nil {
+		t.Fatalf("memory backend %T: %v", storage, err)
+	}
+	if _, err = NewStorage("bogus", "", 0, 0); err == nil {
+		t.Errorf("unknown backend accepted")
+	}
+	backends := map[string]KsInterface{
+		models.MemoryBackend: storage,
+		models.SqliteBackend: newSqlStorage(t),
+	}
+	for name, storage := range backends {
+		testStorage(t, name, storage)
+	}
+}
+
+// testStorage runs the same account and transaction ops against a backend.
+func testStorage(t *testing.T, name string, storage KsInterface) {
+	key, _ := newKey(rand.Reader)
+	owner, wallet := uuid.NewRandom(), uuid.NewRandom()
+
+	if _, err := storage.StoreKeyUuid(key, owner, "pass"); err != nil {
+		t.Fatalf("%s: store key failed: %v", name, err)
+	}
+	_, err := storage.StoreAccount(key, "alice", "normal", &owner, &wallet)
+	if err != nil {
+		t.Fatalf("%s: store account failed: %v", name, err)
+	}
+	acct, err := storage.GetAccountOwner(key.Address.Hex(), owner.String())
+	if err != nil || acct.PublicName != "alice" || acct.WalletUuid != wallet.String() {
+		t.Errorf("%s: account owner %+v: %v", name, acct, err)
+	}
+	if accts, err := storage.GetUserAccount(owner); err != nil || len(accts) != 1 {
+		t.Errorf("%s: owner accounts %v: %v", name, accts, err)
+	}
+	if accts, err := storage.GetWallet(wallet); err != nil || len(accts) != 1 {
+		t.Errorf("%s: wallet accounts %v: %v", name, accts, err)
+	}
+	got, err := storage.GetKeyUuid(key.Address, owner, "pass")
+	if err != nil || got.Address != key.Address {
+		t.Errorf("%s: get key failed: %v", name, err)
+	}
+	err = storage.UpdateAccount(key.Address, "bob", "normal", owner, wallet)
+	if err != nil {
+		t.Errorf("%s: update account failed: %v", name, err)
+	}
+	acct, err = storage.GetAccountOwner(key.Address.Hex(), owner.String())
+	if err != nil || acct.PublicName != "bob" {
+		t.Errorf("%s: updated account %+v: %v", name, acct, err)
+	}
+	if keys, err := storage.GetAccountKeys(0, 10); err != nil || len(keys) != 1 {
+		t.Errorf("%s: account keys %v: %v", name, keys, err)
+	}
+	to := common.HexToAddress("0x1234")
+	err = storage.StoreTransaction(&models.Transaction{
+		TxHash:   "0x01",
+		FromUuid: owner.String(),
+		FromAcct: key.Address.Hex(),
+		ToAcct:   to.Hex(),
+		XuAmount: 10,
+	})
+	if err != nil {
+		t.Fatalf("%s: store transaction failed: %v", name, err)
+	}
+	from := false
+	trans, err := storage.GetTransaction(&to, nil, &from, 0, 0)
+	if err != nil || len(trans) != 1 || trans[0].XuAmount != 10 {
+		t.Errorf("%s: transactions %v: %v", name, trans, err)
+	}
+	if _, err = storage.GetTransaction(&key.Address, nil, &from, 0, 0); err != ErrNoTrans {
+		t.Errorf("%s: no incoming transaction: %v", name, err)
+	}
+	if trans, err = storage.GetTransaction(&to, nil, nil, 0, 0); err != nil ||
+		len(trans) != 1 {
+		t.Errorf("%s: transactions either way %v: %v", name, trans, err)
+	}
+	if _, err = storage.GetTransaction(nil, &owner, nil, 0, 0); err == nil {
+		t.Errorf("%s: transactions either way without an address", name)
+	}
+	if _, err = storage.GetTransaction(nil, nil, &from, 0, 0); err == nil {
+		t.Errorf("%s: transactions without an address or owner", name)
+	}
+}
+
+func TestSqlQueries(t *testing.T) {
+	storage := newSqlStorage(t)
+	key, _ := newKey(rand.Reader)
+	owner, wallet := uuid.NewRandom(), uuid.NewRandom()
+	if _, err := storage.StoreKeyUuid(key, owner, "pass"); err != nil {
+		t.Fatalf("store key failed: %v", err)
+	}
+	_, err := storage.StoreAccount(key, "alice", "normal", &owner, &wallet)
+	if err != nil {
+		t.Fatalf("store account failed: %v", err)
+	}
+	err = storage.StoreTransaction(&models.Transaction{
+		TxHash:   "0x01",
+		FromUuid: owner.String(),
+		FromAcct: key.Address.Hex(),
+		ToAcct:   common.HexToAddress("0x1234").Hex(),
+	})
+	if err != nil {
+		t.Fatalf("store transaction failed: %v", err)
+	}
+
+	// The values are bound, quotes in them don't change the query.
+	inject := "x' OR '1'='1"
+	if _, err = storage.GetAccountOwner(key.Address.Hex(), inject); err != ErrNoAccount {
+		t.Errorf("owner lookup: %v", err)
+	}
+	if _, err = storage.GetAccountOwner(inject, owner.String()); err != ErrNoAccount {
+		t.Errorf("address lookup: %v", err)
+	}
+	if _, err = storage.GetUserAccount(uuid.UUID(inject)); err != ErrNoAccount {
+		t.Errorf("user lookup: %v", err)
+	}
+	if _, err = storage.GetWallet(uuid.UUID(inject)); err != ErrNoAccount {
+		t.Errorf("wallet lookup: %v", err)
+	}
+	from := true
+	owned := uuid.UUID(inject)
+	if _, err = storage.GetTransaction(nil, &owned, &from, 0, 0); err != ErrNoTrans {
+		t.Errorf("transaction lookup: %v", err)
+	}
+	if _, err = storage.GetKeyUuid(common.Address{}, owner, "pass"); !IsNotFound(err) {
+		t.Errorf("unknown key: %v", err)
+	}
+	if accts, err := storage.GetAccount(key.Address); err != nil || len(accts) != 1 {
+		t.Errorf("account lookup %v: %v", accts, err)
+	}
+
+	// Database errors aren't reported as missing rows.
+	o := storage.GetOrm()
+	if _, err = o.Raw("ALTER TABLE account RENAME TO account_off").Exec(); err != nil {
+		t.Fatalf("rename table failed: %v", err)
+	}
+	defer o.Raw("ALTER TABLE account_off RENAME TO account").Exec()
+
+	err = storage.UpdateAccount(key.Address, "bob", "normal", owner, wallet)
+	if err == nil || IsNotFound(err) {
+		t.Errorf("update without table: %v", err)
+	}
+}
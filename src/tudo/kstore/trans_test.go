@@ -0,0 +1,98 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"tudo/models"
+)
+
+func TestListTransactions(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	owner := uuid.NewRandom()
+	acct := common.HexToAddress("0x1111")
+	peer := common.HexToAddress("0x2222")
+	other := common.HexToAddress("0x3333")
+
+	// Two transactions a block in blocks 1 to 5, sent on the odd index.
+	start := time.Now().Add(-time.Hour)
+	for idx := 0; idx < 10; idx++ {
+		from, to := other, acct
+		if idx%2 == 1 {
+			from, to = acct, peer
+		}
+		err := storage.StoreTransaction(&models.Transaction{
+			TxHash:   fmt.Sprintf("0x%02d", idx),
+			FromUuid: owner.String(),
+			ToUuid:   "Anonymous",
+			FromAcct: from.Hex(),
+			ToAcct:   to.Hex(),
+			XuAmount: uint64(idx),
+			Created:  start.Add(time.Duration(idx) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+		if idx < 8 {
+			storage.SetTransBlock(fmt.Sprintf("0x%02d", idx), int64(idx/2+1), idx%2)
+		}
+	}
+	if err := storage.SetTransBlock("0x99", 1, 0); err != ErrNoTrans {
+		t.Errorf("block of unknown tx: %v", err)
+	}
+	hashes := func(q *TransQuery) string {
+		rows, err := storage.ListTransactions(q)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		out := ""
+		for _, row := range rows {
+			out += row.TxHash[2:] + " "
+		}
+		return out
+	}
+	q := &TransQuery{Account: &acct, Limit: 3}
+	if got := hashes(q); got != "07 06 05 " {
+		t.Errorf("newest first %s", got)
+	}
+	q.After = &TransCursor{BlockNumber: 3, TxIndex: 1, TxHash: "0x05"}
+	if got := hashes(q); got != "04 03 02 " {
+		t.Errorf("after the cursor %s", got)
+	}
+	q.Oldest = true
+	if got := hashes(q); got != "06 07 " {
+		t.Errorf("oldest after the cursor %s", got)
+	}
+	sent, min, max := true, uint64(2), uint64(6)
+	q = &TransQuery{Account: &acct, From: &sent, MinXu: &min, MaxXu: &max, Limit: 10}
+	if got := hashes(q); got != "05 03 " {
+		t.Errorf("sent amounts %s", got)
+	}
+	q = &TransQuery{Account: &acct, Peer: &other, Limit: 10}
+	if got := hashes(q); got != "06 04 02 00 " {
+		t.Errorf("peer %s", got)
+	}
+	q = &TransQuery{Owner: owner, Since: start.Add(2 * time.Minute),
+		Until: start.Add(5 * time.Minute), Offset: 1, Limit: 10}
+	if got := hashes(q); got != "03 02 " {
+		t.Errorf("dates %s", got)
+	}
+	q = &TransQuery{Account: &acct, Pending: true, Limit: 10}
+	if got := hashes(q); got != "09 08 " {
+		t.Errorf("pending %s", got)
+	}
+	if _, err := storage.ListTransactions(&TransQuery{Limit: 10}); err == nil {
+		t.Errorf("listed without account or owner")
+	}
+}
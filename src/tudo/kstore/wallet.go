@@ -8,29 +8,39 @@
 package kstore
 
 import (
+	"context"
+	"fmt"
 	"math/big"
+	"time"
 
 	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/pborman/uuid"
+	"github.com/tyler-smith/go-bip39"
 	"tudo/models"
 )
 
+// URL scheme of the SQL keystore wallets, the path is the owner uuid.
+const SqlScheme = "sql"
+
+// Time allowed for the chain lookups of one self derived account.
+const selfDeriveTimeout = 10 * time.Second
+
 func NewURL(path string) accounts.URL {
 	return accounts.URL{
-		Scheme: "sql",
+		Scheme: SqlScheme,
 		Path:   path,
 	}
 }
 
 func NewWallet(ks *KStore, ownerUuid string) *Wallet {
 	return &Wallet{
-		unlock:    false,
 		AcctMap:   make(map[string]*AccountKey),
 		OwnerUuid: uuid.Parse(ownerUuid),
-		KsIface:   ks,
+		KsIface:   ks.base,
+		kstore:    ks.base,
 	}
 }
 
@@ -45,29 +55,76 @@ func (w *Wallet) URL() accounts.URL {
 /**
  * Status
  * ------
+ * Report how many accounts in the wallet have their keys unlocked.
  */
 func (w *Wallet) Status() (string, error) {
-	if w.unlock == true {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	unlocked := 0
+	for _, acctKey := range w.AcctMap {
+		if acctKey.Key != nil {
+			unlocked++
+		}
+	}
+	switch unlocked {
+	case 0:
+		return "Locked", nil
+	case len(w.AcctMap):
 		return "Unlocked", nil
 	}
-	return "Locked", nil
+	return fmt.Sprintf("Unlocked %d/%d", unlocked, len(w.AcctMap)), nil
 }
 
 /**
  * Open
  * ----
- * If the wallet was encrypted, open it with the passphrase.
+ * Decrypt the owner's HD seed with the passphrase so new accounts can be derived.
+ * An empty passphrase is a no-op, accounts are unlocked one by one.
  */
 func (w *Wallet) Open(passphrase string) error {
+	if passphrase == "" {
+		return nil
+	}
+	seedRec, err := w.kstore.Storage.GetSeed(w.OwnerUuid.String())
+	if err != nil {
+		return err
+	}
+	mnemonic, err := decryptSeed(seedRec.Seed, passphrase)
+	if err != nil {
+		return err
+	}
+	seed := bip39.NewSeed(mnemonic, "")
+
+	w.mu.Lock()
+	if w.seed != nil {
+		w.mu.Unlock()
+		zeroBytes(seed)
+		return accounts.ErrWalletAlreadyOpen
+	}
+	w.seed = seed
+	w.walletUuid = seedRec.WalletUuid
+	w.auth = passphrase
+	w.mu.Unlock()
+
+	w.kstore.sendEvent(w, accounts.WalletOpened)
 	return nil
 }
 
 /**
  * Close
  * -----
- * Close the decrypted wallet.
+ * Zero the decrypted seed.
  */
 func (w *Wallet) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.seed != nil {
+		zeroBytes(w.seed)
+		w.seed = nil
+		w.auth = ""
+	}
 	return nil
 }
 
@@ -77,6 +134,9 @@ func (w *Wallet) Close() error {
  * Return the list of accounts associated with this wallet.
  */
 func (w *Wallet) Accounts() []accounts.Account {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	result := make([]accounts.Account, 0, len(w.AcctMap))
 	for _, actKey := range w.AcctMap {
 		result = append(result, accounts.Account{
@@ -103,7 +163,10 @@ func (w *Wallet) Contains(account accounts.Account) bool {
  * ----
  */
 func (w *Wallet) Find(account accounts.Account) *AccountKey {
+	w.mu.Lock()
 	acctKey := w.AcctMap[account.Address.Hex()]
+	w.mu.Unlock()
+
 	if acctKey == nil {
 		return nil
 	}
@@ -123,7 +186,10 @@ func (w *Wallet) Find(account accounts.Account) *AccountKey {
  */
 func (w *Wallet) Remove(account accounts.Account) {
 	w.mu.Lock()
-	delete(w.AcctMap, account.Address.Hex())
+	if acctKey := w.AcctMap[account.Address.Hex()]; acctKey != nil {
+		acctKey.lock()
+		delete(w.AcctMap, account.Address.Hex())
+	}
 	w.mu.Unlock()
 }
 
@@ -133,32 +199,179 @@ func (w *Wallet) Remove(account accounts.Account) {
  * Add account to the wallet.
  */
 func (w *Wallet) Add(acctRec *models.AccountKey,
-	key *keystore.Key, account *accounts.Account) {
-	w.mu.Lock()
-	w.AcctMap[account.Address.Hex()] = &AccountKey{
+	key *keystore.Key, account *accounts.Account) *AccountKey {
+	acctKey := &AccountKey{
 		AccountKey: acctRec,
 		Key:        key,
 		Account:    account,
-		abort:      make(chan struct{}),
+		wallet:     w,
 	}
+	w.mu.Lock()
+	w.AcctMap[account.Address.Hex()] = acctKey
 	w.mu.Unlock()
+	return acctKey
+}
+
+// size returns the number of accounts in the wallet.
+func (w *Wallet) size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.AcctMap)
+}
+
+/**
+ * lock
+ * ----
+ * Stop the expire timer, zero and drop the decrypted key.  The wallet lock must
+ * be held.
+ */
+func (ak *AccountKey) lock() {
+	if ak.abort != nil {
+		close(ak.abort)
+		ak.abort = nil
+	}
+	if ak.Key != nil {
+		zeroKey(ak.Key.PrivateKey)
+		ak.Key = nil
+	}
 }
 
 /**
  * Derive
  * ------
+ * Derive the account at the path from the open seed.  A pinned account is stored
+ * in the keystore and added to the wallet.
  */
 func (w *Wallet) Derive(path accounts.DerivationPath,
 	pin bool) (accounts.Account, error) {
-	return accounts.Account{}, nil
+	w.mu.Lock()
+	if w.seed == nil {
+		w.mu.Unlock()
+		return accounts.Account{}, accounts.ErrWalletClosed
+	}
+	seed := append([]byte{}, w.seed...)
+	walletUuid, auth := w.walletUuid, w.auth
+	w.mu.Unlock()
+
+	defer zeroBytes(seed)
+	acct, _, err := w.deriveAccount(seed, path, pin, walletUuid, auth)
+	return acct, err
+}
+
+/**
+ * deriveAccount
+ * -------------
+ * No wallet lock must be held, storing the key adds it to the wallet.
+ */
+func (w *Wallet) deriveAccount(seed []byte, path accounts.DerivationPath, pin bool,
+	walletUuid, auth string) (accounts.Account, *models.Account, error) {
+	key, err := deriveKey(seed, path)
+	if err != nil {
+		return accounts.Account{}, nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+
+	acct := accounts.Account{Address: key.Address, URL: w.URL()}
+	if !pin {
+		return acct, nil, nil
+	}
+	if w.Contains(acct) {
+		// Add the account record back if it was lost.
+		model, err := w.kstore.Storage.GetAccountOwner(acct.Address.Hex(),
+			w.OwnerUuid.String())
+		if !IsNotFound(err) {
+			return acct, model, err
+		}
+	} else {
+		if acct, err = w.kstore.importKey(key, w.OwnerUuid, auth); err != nil {
+			return acct, nil, err
+		}
+	}
+	wallet := uuid.Parse(walletUuid)
+	model, err := w.kstore.Storage.StoreAccount(key,
+		path.String(), "normal", &w.OwnerUuid, &wallet)
+	return acct, model, err
 }
 
 /**
  * SelfDerive
  * ----------
+ * Pin the accounts after the base path that were used on the chain, up to the
+ * first one with no nonce and no balance.  The wallet must be open.
  */
 func (w *Wallet) SelfDerive(base accounts.DerivationPath,
 	chain ethereum.ChainStateReader) {
+	if chain == nil || len(base) == 0 {
+		return
+	}
+	w.mu.Lock()
+	if w.seed == nil || w.deriving {
+		w.mu.Unlock()
+		return
+	}
+	w.deriving = true
+	w.mu.Unlock()
+
+	go func() {
+		err := w.deriveUsed(base, chain, w.Derive)
+		if err != nil && err != accounts.ErrWalletClosed {
+			fmt.Printf("Failed to self derive %s: %v\n", w.URL(), err)
+		}
+		w.mu.Lock()
+		w.deriving = false
+		w.mu.Unlock()
+	}()
+}
+
+/**
+ * deriveUsed
+ * ----------
+ * Walk the paths from base, pin the accounts already in the wallet and the ones
+ * used on the chain.  Stop at the first unused account.
+ */
+func (w *Wallet) deriveUsed(base accounts.DerivationPath, chain ethereum.ChainStateReader,
+	derive func(accounts.DerivationPath, bool) (accounts.Account, error)) error {
+	path := make(accounts.DerivationPath, len(base))
+	copy(path, base)
+
+	for {
+		acct, err := derive(path, false)
+		if err != nil {
+			return err
+		}
+		if !w.Contains(acct) {
+			if chain == nil {
+				return nil
+			}
+			used, err := accountUsed(chain, acct)
+			if err != nil {
+				return err
+			}
+			if !used {
+				return nil
+			}
+		}
+		if _, err = derive(path, true); err != nil {
+			return err
+		}
+		path[len(path)-1]++
+	}
+}
+
+// accountUsed returns true if the account has sent a transaction or holds ether.
+func accountUsed(chain ethereum.ChainStateReader, acct accounts.Account) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selfDeriveTimeout)
+	defer cancel()
+
+	nonce, err := chain.NonceAt(ctx, acct.Address, nil)
+	if err != nil {
+		return false, err
+	}
+	balance, err := chain.BalanceAt(ctx, acct.Address, nil)
+	if err != nil {
+		return false, err
+	}
+	return nonce > 0 || balance.Sign() > 0, nil
 }
 
 /**
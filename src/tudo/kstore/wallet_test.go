@@ -0,0 +1,130 @@
+/*
+ *--------1---------2---------3---------4---------5---------6---------7---------8--------
+ * Copyright (c) 2018 by Vy Nguyen
+ * BSD License
+ *
+ * @author vynguyen
+ */
+package kstore
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/pborman/uuid"
+)
+
+func TestWalletEvents(t *testing.T) {
+	ks := newTestKStore(t, NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP), 0)
+	sink := make(chan accounts.WalletEvent, 4)
+	sub := ks.Subscribe(sink)
+
+	expect := func(kind accounts.WalletEventType, acct accounts.Account) {
+		select {
+		case ev := <-sink:
+			if ev.Kind != kind || ev.Wallet.URL() != acct.URL {
+				t.Errorf("event %v %v, want %v %v", ev.Kind, ev.Wallet.URL(), kind, acct.URL)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %v", acct.Address.Hex())
+		}
+	}
+	owner := uuid.NewRandom().String()
+	acct, _, err := ks.NewAccountOwner(owner, "", "alice", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	expect(accounts.WalletArrived, *acct)
+
+	// A second account of the owner goes to the same wallet.
+	other, _, err := ks.NewAccountOwner(owner, "", "bob", "pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	expect(accounts.WalletArrived, *other)
+
+	key, _ := newKey(rand.Reader)
+	imported, err := ks.ImportECDSA(key.PrivateKey, "pass")
+	if err != nil {
+		t.Fatalf("import ECDSA failed: %v", err)
+	}
+	expect(accounts.WalletArrived, imported)
+
+	key, _ = newKey(rand.Reader)
+	keyJson, _ := keystore.EncryptKey(key, "old", keystore.LightScryptN,
+		keystore.LightScryptP)
+	imported, err = ks.Import(keyJson, "old", "pass")
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	expect(accounts.WalletArrived, imported)
+
+	// The wallet is dropped with its last account.
+	if err = ks.Delete(*acct, "pass"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err = ks.Delete(*other, "pass"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	expect(accounts.WalletDropped, *other)
+
+	sub.Unsubscribe()
+	if _, _, err = ks.NewAccountOwner("", "", "carol", "pass", "normal"); err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	select {
+	case ev := <-sink:
+		t.Errorf("event after unsubscribe: %v", ev.Kind)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWalletURL(t *testing.T) {
+	storage := NewMemKeyStore(keystore.LightScryptN, keystore.LightScryptP)
+	owner := uuid.NewRandom().String()
+	acct, _, err := newTestKStore(t, storage, 0).NewAccountOwner(owner, "", "alice",
+		"pass", "normal")
+	if err != nil {
+		t.Fatalf("new account failed: %v", err)
+	}
+	if url := NewURL(owner); url != acct.URL || url.String() != "sql://"+owner {
+		t.Errorf("account url %v", acct.URL)
+	}
+
+	// A new keystore over the storage loads the wallet on first lookup.
+	ks := newTestKStore(t, storage, 0)
+	wallet, err := ks.OwnerWallet(strings.ToUpper(owner))
+	if err != nil || wallet.URL() != acct.URL || !wallet.Contains(*acct) {
+		t.Fatalf("owner wallet %v: %v", wallet, err)
+	}
+	if again, _ := ks.OwnerWallet(owner); again != wallet {
+		t.Errorf("owner wallet not cached")
+	}
+	if _, err = ks.OwnerWallet("bogus"); err == nil {
+		t.Errorf("malformed owner accepted")
+	}
+	if _, err = ks.OwnerWallet(uuid.NewRandom().String()); err != accounts.ErrUnknownWallet {
+		t.Errorf("unknown owner: %v", err)
+	}
+
+	if found, err := ks.FindWallet(*acct); err != nil || found != wallet {
+		t.Errorf("find wallet %v: %v", found, err)
+	}
+	if found, err := ks.FindWallet(accounts.Account{Address: acct.Address}); err != nil ||
+		found != wallet {
+		t.Errorf("find wallet without url %v: %v", found, err)
+	}
+	moved := accounts.Account{Address: acct.Address, URL: NewURL(uuid.NewRandom().String())}
+	if _, err = ks.FindWallet(moved); err != accounts.ErrUnknownAccount {
+		t.Errorf("find under another owner: %v", err)
+	}
+	key, _ := newKey(rand.Reader)
+	unknown := accounts.Account{Address: key.Address}
+	if _, err = ks.FindWallet(unknown); err != accounts.ErrUnknownAccount {
+		t.Errorf("find unknown account: %v", err)
+	}
+}
@@ -12,27 +12,211 @@ var (
 	DONG_UNIT = new(big.Int).Exp(TEN, big.NewInt(18), nil)
 )
 
+// Deleted accounts are archived, Archived is the unix time the account and its
+// key were deleted, zero for live rows.
 type Account struct {
 	Account    string `orm:"pk;size(128)"`
 	OwnerUuid  string `orm:"index;size(64)"`
 	WalletUuid string `orm:"index;size(64)"`
 	PublicName string `orm:"size(64)"`
 	Type       string `orm:"size(64)"`
+	Archived   int64  `orm:"default(0);index"`
 }
 
+// PrivKey holds the key in Web3 Secret Storage (V3 JSON) format.  PassKey is only
+// set on legacy rows with a plain hex key, until they are migrated.  With a node
+// master key, PrivKey is empty and WrapKey holds the V3 JSON sealed with master key
+// KeyVersion.
 type AccountKey struct {
-	Account   string `orm:"pk;size(64)"`
-	OwnerUuid string `orm:"index;size(64)"`
-	PassKey   string `orm:"size(128)"`
-	PrivKey   string `orm:"size(512)"`
+	Account    string `orm:"pk;size(64)"`
+	OwnerUuid  string `orm:"index;size(64)"`
+	PassKey    string `orm:"size(128)"`
+	PrivKey    string `orm:"size(512)"`
+	WrapKey    string `orm:"type(text)"`
+	KeyVersion int    `orm:"default(0);index"`
+	Archived   int64  `orm:"default(0);index"`
 }
 
+// BlockNumber and TxIndex locate the transaction in the chain, zero until known.
 type Transaction struct {
-	TxHash   string    `orm:"pk;size(128)"`
-	FromUuid string    `orm:"index;size(64)"`
-	ToUuid   string    `orm:"index;size(64)"`
-	FromAcct string    `orm:"index;size(64)"`
-	ToAcct   string    `orm:"index;size(64)"`
-	XuAmount uint64    `orm:"bigint unsigned"`
-	Created  time.Time `orm:"auto_now_add;type(date)"`
+	TxHash      string    `orm:"pk;size(128)"`
+	FromUuid    string    `orm:"index;size(64)"`
+	ToUuid      string    `orm:"index;size(64)"`
+	FromAcct    string    `orm:"index;size(64)"`
+	ToAcct      string    `orm:"index;size(64)"`
+	XuAmount    uint64    `orm:"bigint unsigned"`
+	Created     time.Time `orm:"auto_now_add;type(datetime)"`
+	BlockNumber int64     `orm:"default(0)"`
+	TxIndex     int       `orm:"default(0)"`
+}
+
+// Ops recorded in the key_change log.
+const (
+	KeyAdded   = "add"
+	KeyUpdated = "update"
+	KeyDeleted = "delete"
+)
+
+// KeyChange logs writes to account_key so nodes sharing the database can refresh
+// their cached wallets.  Origin identifies the process making the change.
+type KeyChange struct {
+	Id        int64     `orm:"auto;pk"`
+	Account   string    `orm:"size(64)"`
+	OwnerUuid string    `orm:"size(64)"`
+	Op        string    `orm:"size(16)"`
+	Origin    string    `orm:"size(64)"`
+	Created   time.Time `orm:"auto_now_add;type(datetime);index"`
+}
+
+// WalletSeed holds the owner's BIP39 mnemonic, encrypted with the wallet passphrase.
+// Accounts derived from it are stored in account_key like any other.
+type WalletSeed struct {
+	OwnerUuid  string    `orm:"pk;size(64)"`
+	WalletUuid string    `orm:"size(64)"`
+	Seed       string    `orm:"size(1024)"`
+	Created    time.Time `orm:"auto_now_add;type(datetime)"`
+}
+
+// States of an ApprovalRequest.
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	ApprovalSigned   = "signed"
+)
+
+// ApprovalRequest holds an outgoing transaction from an admin account until a
+// quorum of the other admins approves it.  SigHash is the hash the transaction
+// is signed over, TxData its RLP encoding in hex.  TxHash is set once signed.
+type ApprovalRequest struct {
+	Id       int64     `orm:"auto;pk"`
+	Account  string    `orm:"index;size(64)"`
+	SigHash  string    `orm:"size(128)"`
+	TxData   string    `orm:"type(text)"`
+	ChainId  string    `orm:"size(32)"`
+	Quorum   int       `orm:"default(0)"`
+	Status   string    `orm:"index;size(16)"`
+	TxHash   string    `orm:"size(128)"`
+	Created  time.Time `orm:"auto_now_add;type(datetime)"`
+	Modified time.Time `orm:"auto_now;type(datetime)"`
+}
+
+func (r *ApprovalRequest) TableUnique() [][]string {
+	return [][]string{
+		[]string{"Account", "SigHash"},
+	}
+}
+
+// Approval is an admin's signed vote on an ApprovalRequest.
+type Approval struct {
+	Id        int64     `orm:"auto;pk"`
+	RequestId int64     `orm:"index"`
+	Approver  string    `orm:"size(64)"`
+	Approve   bool      `orm:"default(false)"`
+	Signature string    `orm:"size(256)"`
+	Created   time.Time `orm:"auto_now_add;type(datetime)"`
+}
+
+func (a *Approval) TableUnique() [][]string {
+	return [][]string{
+		[]string{"RequestId", "Approver"},
+	}
+}
+
+// AuditRecord logs a key operation, Stamp is in unix nanoseconds.  Hash covers
+// the record and PrevHash, the hash of the record before, so the records form a
+// chain.  AuditHead holds the sequence and hash of the last record.  Caller is
+// the API function, Identity and Remote the RPC client when there is one.
+// KeyVersion is the master key version keying Hash, 0 without master key.
+type AuditRecord struct {
+	Id         int64  `orm:"auto;pk"`
+	Seq        int64  `orm:"unique"`
+	Stamp      int64  `orm:"index"`
+	Origin     string `orm:"size(64)"`
+	Caller     string `orm:"size(128)"`
+	Identity   string `orm:"size(128)"`
+	Remote     string `orm:"size(64)"`
+	Op         string `orm:"size(32)"`
+	Account    string `orm:"index;size(64)"`
+	OwnerUuid  string `orm:"size(64)"`
+	TxHash     string `orm:"size(128)"`
+	Result     string `orm:"size(256)"`
+	KeyVersion int    `orm:"default(0)"`
+	PrevHash   string `orm:"size(128)"`
+	Hash       string `orm:"size(128)"`
+}
+
+type AuditHead struct {
+	Id   int    `orm:"pk"`
+	Seq  int64  `orm:"default(0)"`
+	Hash string `orm:"size(128)"`
+}
+
+// SpendPolicy holds the spending rules of an account or a wallet, Scope is the
+// account address or the wallet uuid.  Values are in wei, empty for no limit.
+// Allowlist holds the comma separated recipient addresses, empty for any.
+type SpendPolicy struct {
+	Id         int64     `orm:"auto;pk"`
+	Scope      string    `orm:"unique;size(64)"`
+	MaxTxValue string    `orm:"size(80)"`
+	DailyLimit string    `orm:"size(80)"`
+	Allowlist  string    `orm:"type(text)"`
+	NoContract bool      `orm:"default(false)"`
+	Modified   time.Time `orm:"auto_now;type(datetime)"`
+}
+
+// SpendRecord is a transaction signed under a spending policy, counted against
+// the daily limits.  Value is in wei, Stamp in unix seconds.
+type SpendRecord struct {
+	Id         int64  `orm:"auto;pk"`
+	Account    string `orm:"index;size(64)"`
+	WalletUuid string `orm:"index;size(64)"`
+	SigHash    string `orm:"size(128)"`
+	Value      string `orm:"size(80)"`
+	Stamp      int64  `orm:"index"`
+}
+
+func (r *SpendRecord) TableUnique() [][]string {
+	return [][]string{
+		[]string{"Account", "SigHash"},
+	}
+}
+
+// OwnerFreeze marks an owner whose keys must not be used: signing, unlocking and
+// exporting are refused until the row is deleted.
+type OwnerFreeze struct {
+	OwnerUuid string    `orm:"pk;size(64)"`
+	Reason    string    `orm:"size(256)"`
+	Created   time.Time `orm:"auto_now_add;type(datetime)"`
+}
+
+// OwnerStat counts the live accounts and wallets of an owner.
+type OwnerStat struct {
+	OwnerUuid string
+	Wallets   int
+	Accounts  int
+}
+
+// WalletStat counts the live accounts of a wallet.
+type WalletStat struct {
+	WalletUuid string
+	OwnerUuid  string
+	Accounts   int
+}
+
+// KeyStats counts the keystore rows, KeyVersions the live account_key rows by
+// master key version, zero for the rows not wrapped.
+type KeyStats struct {
+	Owners           int
+	Wallets          int
+	Accounts         int
+	ArchivedAccounts int
+	Keys             int
+	ArchivedKeys     int
+	PlainKeys        int
+	KeyVersions      map[int]int
+	Seeds            int
+	SpendPolicies    int
+	PendingApprovals int
+	FrozenOwners     int
 }
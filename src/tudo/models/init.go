@@ -1,24 +1,79 @@
 package models
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/orm"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Storage backends for the keystore tables.
+const (
+	MySqlBackend  = "mysql"
+	SqliteBackend = "sqlite"
+	MemoryBackend = "memory"
 )
 
 func init() {
-	orm.RegisterDriver("mysql", orm.DRMySQL)
+	orm.RegisterModel(new(Account), new(Transaction), new(AccountKey), new(KeyChange),
+		new(WalletSeed), new(ApprovalRequest), new(Approval), new(AuditRecord),
+		new(AuditHead), new(SpendPolicy), new(SpendRecord), new(OwnerFreeze))
+}
+
+// mysqlDataSource builds the MySQL DSN from app.conf.
+func mysqlDataSource() string {
 	conf := beego.AppConfig
 	part := []string{
 		conf.String("mysqluser"), ":", conf.String("mysqlpass"),
 		"@tcp(", conf.String("mysqlurls"), ":3306)/",
 		conf.String("mysqldb"), "?charset=utf8",
 	}
-	orm.RegisterDataBase("default", "mysql", strings.Join(part, ""))
-	orm.RegisterModel(new(Account), new(Transaction), new(AccountKey))
+	return strings.Join(part, "")
+}
+
+// sqliteDataSource makes writers wait for the database lock instead of failing
+// with "database is locked", unless the file path sets its own options.
+func sqliteDataSource(dataSource string) string {
+	if strings.Contains(dataSource, "?") {
+		return dataSource
+	}
+	return dataSource + "?_busy_timeout=5000&_txlock=immediate"
+}
 
-	orm.RunSyncdb("default", false, true)
+// InitDatabase opens the default orm database for the backend and checks its
+// schema, the tables are made for an empty database.  An empty backend means
+// MySQL with the app.conf settings.
+func InitDatabase(backend, dataSource string) error {
+	if err := OpenDatabase(backend, dataSource); err != nil {
+		return err
+	}
+	return CheckSchema()
+}
+
+// OpenDatabase registers the default orm database for the backend, without
+// checking the schema.
+func OpenDatabase(backend, dataSource string) error {
+	var err error
+
+	switch backend {
+	case "", MySqlBackend:
+		if dataSource == "" {
+			dataSource = mysqlDataSource()
+		}
+		err = orm.RegisterDataBase("default", "mysql", dataSource)
+
+	case SqliteBackend:
+		if dataSource == "" {
+			return fmt.Errorf("Missing data source for sqlite backend")
+		}
+		err = orm.RegisterDataBase("default", "sqlite3", sqliteDataSource(dataSource))
+
+	default:
+		return fmt.Errorf("Unknown database backend %s", backend)
+	}
+	return err
 }
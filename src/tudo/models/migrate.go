@@ -0,0 +1,645 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// Migration changes the schema from Version-1 to Version.  Up and Down hold the
+// statements by backend, a migration without Down can't be rolled back.  Adds
+// tells if a database made by the table sync of earlier releases has it already.
+type Migration struct {
+	Version int
+	Name    string
+	Up      map[string][]string
+	Down    map[string][]string
+	Adds    []SchemaItem
+}
+
+// SchemaItem is a table, or a column of the table, made by a migration.  Type is
+// only checked on MySQL, SQLite keeps any value in any column.
+type SchemaItem struct {
+	Table  string
+	Column string
+	Type   string
+}
+
+// AppliedMigration is a row of the schema_version table.
+type AppliedMigration struct {
+	Version int
+	Name    string
+	Applied string
+}
+
+// Column types differing between the backends, see dialect.  SQLite can't add a
+// NOT NULL column without default.
+var dialects = map[string]*strings.Replacer{
+	SqliteBackend: strings.NewReplacer(
+		"{autopk}", "integer NOT NULL PRIMARY KEY AUTOINCREMENT",
+		"{bigint}", "integer",
+		"{text}", "text NOT NULL DEFAULT ''",
+		"{engine}", "",
+	),
+	MySqlBackend: strings.NewReplacer(
+		"{autopk}", "bigint AUTO_INCREMENT NOT NULL PRIMARY KEY",
+		"{bigint}", "bigint",
+		"{text}", "longtext NOT NULL",
+		"{engine}", " ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	),
+}
+
+// dialect returns the statements for both backends.
+func dialect(stmts ...string) map[string][]string {
+	out := make(map[string][]string)
+	for backend, replacer := range dialects {
+		for _, stmt := range stmts {
+			out[backend] = append(out[backend], replacer.Replace(stmt))
+		}
+	}
+	return out
+}
+
+func createTable(table string, columns []string) string {
+	return "CREATE TABLE IF NOT EXISTS `" + table + "` (" +
+		strings.Join(columns, ", ") + "){engine}"
+}
+
+// concat returns the lists of columns or statements one after the other.
+func concat(lists ...[]string) []string {
+	out := []string{}
+	for _, list := range lists {
+		out = append(out, list...)
+	}
+	return out
+}
+
+func createIndex(table, column string) string {
+	return "CREATE INDEX `" + table + "_" + column + "` ON `" + table +
+		"` (`" + column + "`)"
+}
+
+// sqliteRebuild drops columns on SQLite, which has no DROP COLUMN before 3.35:
+// the table is copied to a new one with the columns kept, and its indexes made
+// again.
+func sqliteRebuild(table string, columns []string, indexes ...string) []string {
+	names := make([]string, len(columns))
+	for idx, col := range columns {
+		names[idx] = col[:strings.Index(col[1:], "`")+2]
+	}
+	list := strings.Join(names, ", ")
+	stmts := []string{
+		"ALTER TABLE `" + table + "` RENAME TO `" + table + "_old`",
+		createTable(table, columns),
+		"INSERT INTO `" + table + "` (" + list + ") SELECT " + list +
+			" FROM `" + table + "_old`",
+		"DROP TABLE `" + table + "_old`",
+	}
+	stmts = append(stmts, indexes...)
+	for idx := range stmts {
+		stmts[idx] = dialects[SqliteBackend].Replace(stmts[idx])
+	}
+	return stmts
+}
+
+// Columns of the tables made by the table sync of the releases before schema
+// versions, and those added since.
+var (
+	accountColumns = []string{
+		"`account` varchar(128) NOT NULL PRIMARY KEY",
+		"`owner_uuid` varchar(64) NOT NULL DEFAULT ''",
+		"`wallet_uuid` varchar(64) NOT NULL DEFAULT ''",
+		"`public_name` varchar(64) NOT NULL DEFAULT ''",
+		"`type` varchar(64) NOT NULL DEFAULT ''",
+	}
+	accountKeyColumns = []string{
+		"`account` varchar(64) NOT NULL PRIMARY KEY",
+		"`owner_uuid` varchar(64) NOT NULL DEFAULT ''",
+		"`pass_key` varchar(128) NOT NULL DEFAULT ''",
+		"`priv_key` varchar(512) NOT NULL DEFAULT ''",
+	}
+	transactionColumns = []string{
+		"`tx_hash` varchar(128) NOT NULL PRIMARY KEY",
+		"`from_uuid` varchar(64) NOT NULL DEFAULT ''",
+		"`to_uuid` varchar(64) NOT NULL DEFAULT ''",
+		"`from_acct` varchar(64) NOT NULL DEFAULT ''",
+		"`to_acct` varchar(64) NOT NULL DEFAULT ''",
+		"`xu_amount` bigint unsigned NOT NULL DEFAULT 0",
+		"`created` date NOT NULL",
+	}
+	wrapKeyColumns = []string{
+		"`wrap_key` {text}",
+		"`key_version` integer NOT NULL DEFAULT 0",
+	}
+	accountIndexes = []string{
+		createIndex("account", "owner_uuid"),
+		createIndex("account", "wallet_uuid"),
+	}
+	transactionIndexes = []string{
+		createIndex("transaction", "from_uuid"),
+		createIndex("transaction", "to_uuid"),
+		createIndex("transaction", "from_acct"),
+		createIndex("transaction", "to_acct"),
+	}
+)
+
+// Migrations in version order.  Never change a released migration, add a new
+// one and update the models to match.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: dialect(concat(
+			[]string{createTable("account", accountColumns)}, accountIndexes,
+			[]string{createTable("transaction", transactionColumns)},
+			transactionIndexes,
+			[]string{createTable("account_key", accountKeyColumns),
+				createIndex("account_key", "owner_uuid")},
+		)...),
+		Adds: []SchemaItem{{Table: "account"}, {Table: "account_key"},
+			{Table: "transaction"}},
+	},
+	{
+		Version: 2,
+		Name:    "key change log",
+		Up: dialect(
+			"CREATE TABLE IF NOT EXISTS `key_change` ("+
+				"`id` {autopk}, "+
+				"`account` varchar(64) NOT NULL DEFAULT '', "+
+				"`owner_uuid` varchar(64) NOT NULL DEFAULT '', "+
+				"`op` varchar(16) NOT NULL DEFAULT '', "+
+				"`origin` varchar(64) NOT NULL DEFAULT '', "+
+				"`created` datetime NOT NULL){engine}",
+			createIndex("key_change", "created"),
+		),
+		Down: dialect("DROP TABLE `key_change`"),
+		Adds: []SchemaItem{{Table: "key_change"}},
+	},
+	{
+		Version: 3,
+		Name:    "wallet seeds",
+		Up: dialect(
+			"CREATE TABLE IF NOT EXISTS `wallet_seed` (" +
+				"`owner_uuid` varchar(64) NOT NULL PRIMARY KEY, " +
+				"`wallet_uuid` varchar(64) NOT NULL DEFAULT '', " +
+				"`seed` varchar(1024) NOT NULL DEFAULT '', " +
+				"`created` datetime NOT NULL){engine}",
+		),
+		Down: dialect("DROP TABLE `wallet_seed`"),
+		Adds: []SchemaItem{{Table: "wallet_seed"}},
+	},
+	{
+		Version: 4,
+		Name:    "account key wrapping",
+		Up: dialect(
+			"ALTER TABLE `account_key` ADD COLUMN "+wrapKeyColumns[0],
+			"ALTER TABLE `account_key` ADD COLUMN "+wrapKeyColumns[1],
+			createIndex("account_key", "key_version"),
+		),
+		Down: map[string][]string{
+			MySqlBackend: {
+				"DROP INDEX `account_key_key_version` ON `account_key`",
+				"ALTER TABLE `account_key` DROP COLUMN `key_version`, " +
+					"DROP COLUMN `wrap_key`",
+			},
+			SqliteBackend: sqliteRebuild("account_key", accountKeyColumns,
+				createIndex("account_key", "owner_uuid")),
+		},
+		Adds: []SchemaItem{{Table: "account_key", Column: "wrap_key"},
+			{Table: "account_key", Column: "key_version"}},
+	},
+	{
+		Version: 5,
+		Name:    "admin approvals",
+		Up: dialect(
+			"CREATE TABLE IF NOT EXISTS `approval_request` ("+
+				"`id` {autopk}, "+
+				"`account` varchar(64) NOT NULL DEFAULT '', "+
+				"`sig_hash` varchar(128) NOT NULL DEFAULT '', "+
+				"`tx_data` {text}, "+
+				"`chain_id` varchar(32) NOT NULL DEFAULT '', "+
+				"`quorum` integer NOT NULL DEFAULT 0, "+
+				"`status` varchar(16) NOT NULL DEFAULT '', "+
+				"`tx_hash` varchar(128) NOT NULL DEFAULT '', "+
+				"`created` datetime NOT NULL, "+
+				"`modified` datetime NOT NULL, "+
+				"UNIQUE (`account`, `sig_hash`)){engine}",
+			createIndex("approval_request", "account"),
+			createIndex("approval_request", "status"),
+
+			"CREATE TABLE IF NOT EXISTS `approval` ("+
+				"`id` {autopk}, "+
+				"`request_id` {bigint} NOT NULL DEFAULT 0, "+
+				"`approver` varchar(64) NOT NULL DEFAULT '', "+
+				"`approve` bool NOT NULL DEFAULT false, "+
+				"`signature` varchar(256) NOT NULL DEFAULT '', "+
+				"`created` datetime NOT NULL, "+
+				"UNIQUE (`request_id`, `approver`)){engine}",
+			createIndex("approval", "request_id"),
+		),
+		Down: dialect("DROP TABLE `approval`", "DROP TABLE `approval_request`"),
+		Adds: []SchemaItem{{Table: "approval_request"}, {Table: "approval"}},
+	},
+	{
+		Version: 6,
+		Name:    "audit log",
+		Up: dialect(
+			"CREATE TABLE IF NOT EXISTS `audit_record` ("+
+				"`id` {autopk}, "+
+				"`seq` {bigint} NOT NULL DEFAULT 0 UNIQUE, "+
+				"`stamp` {bigint} NOT NULL DEFAULT 0, "+
+				"`origin` varchar(64) NOT NULL DEFAULT '', "+
+				"`caller` varchar(128) NOT NULL DEFAULT '', "+
+				"`identity` varchar(128) NOT NULL DEFAULT '', "+
+				"`remote` varchar(64) NOT NULL DEFAULT '', "+
+				"`op` varchar(32) NOT NULL DEFAULT '', "+
+				"`account` varchar(64) NOT NULL DEFAULT '', "+
+				"`owner_uuid` varchar(64) NOT NULL DEFAULT '', "+
+				"`tx_hash` varchar(128) NOT NULL DEFAULT '', "+
+				"`result` varchar(256) NOT NULL DEFAULT '', "+
+				"`key_version` integer NOT NULL DEFAULT 0, "+
+				"`prev_hash` varchar(128) NOT NULL DEFAULT '', "+
+				"`hash` varchar(128) NOT NULL DEFAULT ''){engine}",
+			createIndex("audit_record", "stamp"),
+			createIndex("audit_record", "account"),
+
+			"CREATE TABLE IF NOT EXISTS `audit_head` ("+
+				"`id` integer NOT NULL PRIMARY KEY, "+
+				"`seq` {bigint} NOT NULL DEFAULT 0, "+
+				"`hash` varchar(128) NOT NULL DEFAULT ''){engine}",
+			// Made here, the nodes appending the first record can't race on it.
+			"INSERT INTO `audit_head` (`id`, `seq`, `hash`) VALUES (1, 0, '')",
+		),
+		Down: dialect("DROP TABLE `audit_head`", "DROP TABLE `audit_record`"),
+		Adds: []SchemaItem{{Table: "audit_record"}, {Table: "audit_head"}},
+	},
+	{
+		Version: 7,
+		Name:    "archived accounts",
+		Up: dialect(
+			"ALTER TABLE `account` ADD COLUMN `archived` {bigint} NOT NULL DEFAULT 0",
+			createIndex("account", "archived"),
+			"ALTER TABLE `account_key` ADD COLUMN `archived` {bigint} NOT NULL DEFAULT 0",
+			createIndex("account_key", "archived"),
+		),
+		Down: map[string][]string{
+			MySqlBackend: {
+				"DROP INDEX `account_key_archived` ON `account_key`",
+				"ALTER TABLE `account_key` DROP COLUMN `archived`",
+				"DROP INDEX `account_archived` ON `account`",
+				"ALTER TABLE `account` DROP COLUMN `archived`",
+			},
+			SqliteBackend: concat(
+				sqliteRebuild("account_key", concat(accountKeyColumns, wrapKeyColumns),
+					createIndex("account_key", "owner_uuid"),
+					createIndex("account_key", "key_version")),
+				sqliteRebuild("account", accountColumns, accountIndexes...)),
+		},
+		Adds: []SchemaItem{{Table: "account", Column: "archived"},
+			{Table: "account_key", Column: "archived"}},
+	},
+	{
+		Version: 8,
+		Name:    "spending policies",
+		Up: dialect(
+			"CREATE TABLE IF NOT EXISTS `spend_policy` ("+
+				"`id` {autopk}, "+
+				"`scope` varchar(64) NOT NULL DEFAULT '' UNIQUE, "+
+				"`max_tx_value` varchar(80) NOT NULL DEFAULT '', "+
+				"`daily_limit` varchar(80) NOT NULL DEFAULT '', "+
+				"`allowlist` {text}, "+
+				"`no_contract` bool NOT NULL DEFAULT false, "+
+				"`modified` datetime NOT NULL){engine}",
+
+			"CREATE TABLE IF NOT EXISTS `spend_record` ("+
+				"`id` {autopk}, "+
+				"`account` varchar(64) NOT NULL DEFAULT '', "+
+				"`wallet_uuid` varchar(64) NOT NULL DEFAULT '', "+
+				"`sig_hash` varchar(128) NOT NULL DEFAULT '', "+
+				"`value` varchar(80) NOT NULL DEFAULT '', "+
+				"`stamp` {bigint} NOT NULL DEFAULT 0, "+
+				"UNIQUE (`account`, `sig_hash`)){engine}",
+			createIndex("spend_record", "account"),
+			createIndex("spend_record", "wallet_uuid"),
+			createIndex("spend_record", "stamp"),
+		),
+		Down: dialect("DROP TABLE `spend_record`", "DROP TABLE `spend_policy`"),
+		Adds: []SchemaItem{{Table: "spend_policy"}, {Table: "spend_record"}},
+	},
+	{
+		// SQLite keeps the value as text either way.
+		Version: 9,
+		Name:    "transaction created datetime",
+		Up: map[string][]string{
+			MySqlBackend:  {"ALTER TABLE `transaction` MODIFY `created` datetime NOT NULL"},
+			SqliteBackend: {},
+		},
+		Down: map[string][]string{
+			MySqlBackend:  {"ALTER TABLE `transaction` MODIFY `created` date NOT NULL"},
+			SqliteBackend: {},
+		},
+		Adds: []SchemaItem{{Table: "transaction", Column: "created", Type: "datetime"}},
+	},
+	{
+		Version: 10,
+		Name:    "transaction block number",
+		Up: dialect(
+			"ALTER TABLE `transaction` ADD COLUMN `block_number` {bigint} NOT NULL DEFAULT 0",
+			"ALTER TABLE `transaction` ADD COLUMN `tx_index` integer NOT NULL DEFAULT 0",
+			"CREATE INDEX `transaction_block` ON `transaction` (`block_number`, `tx_index`)",
+		),
+		Down: map[string][]string{
+			MySqlBackend: {
+				"DROP INDEX `transaction_block` ON `transaction`",
+				"ALTER TABLE `transaction` DROP COLUMN `tx_index`, DROP COLUMN `block_number`",
+			},
+			SqliteBackend: sqliteRebuild("transaction", transactionColumns,
+				transactionIndexes...),
+		},
+		Adds: []SchemaItem{{Table: "transaction", Column: "block_number"},
+			{Table: "transaction", Column: "tx_index"}},
+	},
+	{
+		Version: 11,
+		Name:    "owner freeze",
+		Up: dialect(
+			"CREATE TABLE IF NOT EXISTS `owner_freeze` (" +
+				"`owner_uuid` varchar(64) NOT NULL PRIMARY KEY, " +
+				"`reason` varchar(256) NOT NULL DEFAULT '', " +
+				"`created` datetime NOT NULL){engine}",
+		),
+		Down: dialect("DROP TABLE `owner_freeze`"),
+		Adds: []SchemaItem{{Table: "owner_freeze"}},
+	},
+}
+
+// LatestVersion returns the schema version of the models.
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+const schemaTable = "CREATE TABLE IF NOT EXISTS `schema_version` (" +
+	"`version` integer NOT NULL PRIMARY KEY, " +
+	"`name` varchar(128) NOT NULL DEFAULT '', " +
+	"`applied` varchar(32) NOT NULL DEFAULT '')"
+
+// dbBackend returns the backend of the default database.
+func dbBackend(o orm.Ormer) string {
+	if o.Driver().Type() == orm.DRSqlite {
+		return SqliteBackend
+	}
+	return MySqlBackend
+}
+
+// hasTable returns true if the table exists in the default database.
+func hasTable(o orm.Ormer, table string) (bool, error) {
+	var count int
+
+	query := "SELECT COUNT(*) FROM information_schema.tables " +
+		"WHERE table_schema = DATABASE() AND table_name = ?"
+	if dbBackend(o) == SqliteBackend {
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	}
+	err := o.Raw(query, table).QueryRow(&count)
+	return count > 0, err
+}
+
+// hasColumn returns true if the table of the default database has the column,
+// of the type if given on MySQL.
+func hasColumn(o orm.Ormer, item SchemaItem) (bool, error) {
+	var count int
+
+	if dbBackend(o) == SqliteBackend {
+		err := o.Raw("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+			item.Table, item.Column).QueryRow(&count)
+		return count > 0, err
+	}
+	query := "SELECT COUNT(*) FROM information_schema.columns " +
+		"WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	args := []interface{}{item.Table, item.Column}
+	if item.Type != "" {
+		query += " AND data_type = ?"
+		args = append(args, item.Type)
+	}
+	err := o.Raw(query, args...).QueryRow(&count)
+	return count > 0, err
+}
+
+// hasItems returns how many of the tables and columns the migration adds are in
+// the default database.
+func (mig *Migration) hasItems(o orm.Ormer) (int, error) {
+	found := 0
+	for _, item := range mig.Adds {
+		var (
+			ok  bool
+			err error
+		)
+		if item.Column == "" {
+			ok, err = hasTable(o, item.Table)
+		} else {
+			ok, err = hasColumn(o, item)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			found++
+		}
+	}
+	return found, nil
+}
+
+// SchemaVersion returns the schema version of the default database, 0 if it has
+// no tables.  A database made by the table sync of earlier releases is taken as
+// the baseline until it's migrated.
+func SchemaVersion() (int, error) {
+	return schemaVersion(orm.NewOrm())
+}
+
+func schemaVersion(o orm.Ormer) (int, error) {
+	version, err := recordedVersion(o)
+	if err != nil || version > 0 {
+		return version, err
+	}
+	synced, err := hasTable(o, "account")
+	if synced {
+		return 1, err
+	}
+	return 0, err
+}
+
+// recordedVersion returns the latest version in the schema_version table.
+func recordedVersion(o orm.Ormer) (int, error) {
+	var version int
+
+	versioned, err := hasTable(o, "schema_version")
+	if err != nil || !versioned {
+		return 0, err
+	}
+	err = o.Raw("SELECT COALESCE(MAX(`version`), 0) FROM `schema_version`").
+		QueryRow(&version)
+	return version, err
+}
+
+// SchemaHistory returns the migrations applied to the default database.
+func SchemaHistory() ([]AppliedMigration, error) {
+	o := orm.NewOrm()
+	applied := []AppliedMigration{}
+
+	versioned, err := hasTable(o, "schema_version")
+	if err != nil || !versioned {
+		return applied, err
+	}
+	_, err = o.Raw("SELECT `version`, `name`, `applied` FROM `schema_version` " +
+		"ORDER BY `version`").QueryRows(&applied)
+	return applied, err
+}
+
+// Migrate applies the migrations up to the target version and returns them.
+// Each one runs in a transaction with its schema_version row, but MySQL commits each
+// schema change right away: a failed migration may be half applied there.  Run
+// it from one node only.
+//
+// A database made by the table sync of earlier releases has some of the changes
+// already, depending on the release.  The migrations it has are recorded without
+// running them, the others are applied.
+func Migrate(target int) ([]Migration, error) {
+	o := orm.NewOrm()
+	done := []Migration{}
+
+	if target > LatestVersion() {
+		return done, fmt.Errorf("Unknown schema version %d, latest is %d",
+			target, LatestVersion())
+	}
+	version, err := schemaVersion(o)
+	if err != nil {
+		return done, err
+	}
+	recorded, err := recordedVersion(o)
+	if err != nil {
+		return done, err
+	}
+	adopt := version > 0 && recorded == 0
+	if _, err = o.Raw(schemaTable).Exec(); err != nil {
+		return done, err
+	}
+	for idx := range Migrations {
+		mig := &Migrations[idx]
+		if mig.Version > target {
+			break
+		}
+		stmts, name := mig.Up, mig.Name
+		if adopt {
+			found, err := mig.hasItems(o)
+			if err != nil {
+				return done, err
+			}
+			if found == len(mig.Adds) {
+				stmts, name = nil, mig.Name+" (adopted)"
+			} else if found > 0 {
+				return done, fmt.Errorf("Database has part of migration %d (%s), "+
+					"fix the schema by hand", mig.Version, mig.Name)
+			}
+		}
+		applied, err := runMigration(o, mig.Version, func(current int) bool {
+			return current < mig.Version
+		}, stmts, "INSERT INTO `schema_version` (`version`, `name`, `applied`) "+
+			"VALUES (?, ?, ?)", mig.Version, name, appliedTime())
+		if err != nil {
+			return done, fmt.Errorf("Migration %d (%s) failed: %v", mig.Version, mig.Name, err)
+		}
+		if applied {
+			done = append(done, *mig)
+		}
+	}
+	return done, nil
+}
+
+// Rollback undoes the migrations above the target version, latest first, and
+// returns them.
+func Rollback(target int) ([]Migration, error) {
+	o := orm.NewOrm()
+	done := []Migration{}
+
+	version, err := schemaVersion(o)
+	if err != nil {
+		return done, err
+	}
+	if version > LatestVersion() {
+		return done, fmt.Errorf("Schema version %d is newer than this release", version)
+	}
+	for idx := len(Migrations) - 1; idx >= 0; idx-- {
+		mig := Migrations[idx]
+		if mig.Version <= target || mig.Version > version {
+			continue
+		}
+		if mig.Down == nil {
+			return done, fmt.Errorf("Migration %d (%s) can't be rolled back",
+				mig.Version, mig.Name)
+		}
+		applied, err := runMigration(o, mig.Version, func(current int) bool {
+			return current == mig.Version
+		}, mig.Down, "DELETE FROM `schema_version` WHERE `version` = ?", mig.Version)
+		if err != nil {
+			return done, fmt.Errorf("Rollback of %d (%s) failed: %v", mig.Version, mig.Name, err)
+		}
+		if applied {
+			done = append(done, mig)
+		}
+	}
+	return done, nil
+}
+
+// runMigration runs the statements and records the version in a transaction, if
+// the version read in the transaction still needs it.  Another node may have
+// done it first.
+func runMigration(o orm.Ormer, version int, needed func(current int) bool,
+	stmts map[string][]string, record string, args ...interface{}) (bool, error) {
+	if err := o.Begin(); err != nil {
+		return false, err
+	}
+	current, err := recordedVersion(o)
+	if err != nil || !needed(current) {
+		o.Rollback()
+		return false, err
+	}
+	for _, stmt := range stmts[dbBackend(o)] {
+		if _, err = o.Raw(stmt).Exec(); err != nil {
+			o.Rollback()
+			return false, err
+		}
+	}
+	if _, err = o.Raw(record, args...).Exec(); err != nil {
+		o.Rollback()
+		return false, err
+	}
+	return true, o.Commit()
+}
+
+func appliedTime() string {
+	return time.Now().UTC().Format("2006-01-02 15:04:05")
+}
+
+// CheckSchema sets up the tables of an empty database.  It refuses a database
+// with migrations to apply, or made by a newer release.
+func CheckSchema() error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := LatestVersion()
+	switch {
+	case version == 0:
+		_, err = Migrate(latest)
+		return err
+	case version > latest:
+		return fmt.Errorf("Database schema version %d is newer than this release "+
+			"(version %d), upgrade tudo-geth", version, latest)
+	case version < latest:
+		return fmt.Errorf("Database schema version %d is older than this release "+
+			"(version %d), run tudo-geth db migrate", version, latest)
+	}
+	return nil
+}
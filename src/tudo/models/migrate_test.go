@@ -0,0 +1,273 @@
+package models
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// The tests share one SQLite database, the orm registers it once.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "models")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err = OpenDatabase(SqliteBackend, filepath.Join(dir, "tudo.db")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func resetDatabase(t *testing.T) orm.Ormer {
+	o := orm.NewOrm()
+	var tables []string
+	_, err := o.Raw("SELECT name FROM sqlite_master WHERE type = 'table' " +
+		"AND name != 'sqlite_sequence'").QueryRows(&tables)
+	if err != nil {
+		t.Fatalf("list tables failed: %v", err)
+	}
+	for _, table := range tables {
+		if _, err = o.Raw("DROP TABLE `" + table + "`").Exec(); err != nil {
+			t.Fatalf("drop %s failed: %v", table, err)
+		}
+	}
+	return o
+}
+
+func execAll(t *testing.T, o orm.Ormer, stmts ...string) {
+	for _, stmt := range stmts {
+		if _, err := o.Raw(stmt).Exec(); err != nil {
+			t.Fatalf("%s failed: %v", stmt, err)
+		}
+	}
+}
+
+// Tables made by the table sync of the releases before schema versions.
+var syncedBaseline = []string{
+	`CREATE TABLE "account" ("account" varchar(128) NOT NULL PRIMARY KEY,
+	    "owner_uuid" varchar(64) NOT NULL DEFAULT '' ,
+	    "wallet_uuid" varchar(64) NOT NULL DEFAULT '' ,
+	    "public_name" varchar(64) NOT NULL DEFAULT '' ,
+	    "type" varchar(64) NOT NULL DEFAULT '')`,
+	`CREATE INDEX "account_owner_uuid" ON "account" ("owner_uuid")`,
+	`CREATE INDEX "account_wallet_uuid" ON "account" ("wallet_uuid")`,
+	`CREATE TABLE "transaction" ("tx_hash" varchar(128) NOT NULL PRIMARY KEY,
+	    "from_uuid" varchar(64) NOT NULL DEFAULT '' ,
+	    "to_uuid" varchar(64) NOT NULL DEFAULT '' ,
+	    "from_acct" varchar(64) NOT NULL DEFAULT '' ,
+	    "to_acct" varchar(64) NOT NULL DEFAULT '' ,
+	    "xu_amount" integer unsigned NOT NULL DEFAULT 0 ,
+	    "created" date NOT NULL)`,
+	`CREATE TABLE "account_key" ("account" varchar(64) NOT NULL PRIMARY KEY,
+	    "owner_uuid" varchar(64) NOT NULL DEFAULT '' ,
+	    "pass_key" varchar(128) NOT NULL DEFAULT '' ,
+	    "priv_key" varchar(512) NOT NULL DEFAULT '')`,
+	`CREATE INDEX "account_key_owner_uuid" ON "account_key" ("owner_uuid")`,
+	`INSERT INTO "account" VALUES ('0xA1', 'o1', 'w1', 'a', 'normal')`,
+	`INSERT INTO "account_key" VALUES ('0xA1', 'o1', 'pass', 'priv')`,
+	`INSERT INTO "transaction" VALUES ('0x1', 'o1', 'o2', '0xA1', '0xB2', 5,
+	    '2018-01-02')`,
+}
+
+// checkModels reads every model, each column of the model must be in the table.
+func checkModels(t *testing.T, o orm.Ormer) {
+	rows := []interface{}{
+		&[]Account{}, &[]AccountKey{}, &[]Transaction{}, &[]KeyChange{},
+		&[]WalletSeed{}, &[]ApprovalRequest{}, &[]Approval{}, &[]AuditRecord{},
+		&[]AuditHead{}, &[]SpendPolicy{}, &[]SpendRecord{}, &[]OwnerFreeze{},
+	}
+	tables := []string{"account", "account_key", "transaction", "key_change",
+		"wallet_seed", "approval_request", "approval", "audit_record", "audit_head",
+		"spend_policy", "spend_record", "owner_freeze"}
+	for idx, table := range tables {
+		if _, err := o.QueryTable(table).All(rows[idx]); err != nil {
+			t.Errorf("read %s failed: %v", table, err)
+		}
+	}
+}
+
+func historyNames(t *testing.T) []string {
+	history, err := SchemaHistory()
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	names := []string{}
+	for _, rec := range history {
+		names = append(names, rec.Name)
+	}
+	return names
+}
+
+func TestMigrateEmpty(t *testing.T) {
+	o := resetDatabase(t)
+	if version, err := SchemaVersion(); version != 0 || err != nil {
+		t.Fatalf("empty database version %d: %v", version, err)
+	}
+	if err := CheckSchema(); err != nil {
+		t.Fatalf("check of an empty database failed: %v", err)
+	}
+	if version, _ := SchemaVersion(); version != LatestVersion() {
+		t.Errorf("version %d after the setup", version)
+	}
+	if names := historyNames(t); len(names) != len(Migrations) ||
+		strings.Contains(strings.Join(names, ","), "adopted") {
+		t.Errorf("history %v", names)
+	}
+	checkModels(t, o)
+	if done, err := Migrate(LatestVersion()); err != nil || len(done) != 0 {
+		t.Errorf("migrate twice applied %v: %v", done, err)
+	}
+	if _, err := Migrate(LatestVersion() + 1); err == nil {
+		t.Errorf("migrated to an unknown version")
+	}
+}
+
+func TestMigrateAdoptBaseline(t *testing.T) {
+	o := resetDatabase(t)
+	execAll(t, o, syncedBaseline...)
+
+	if version, _ := SchemaVersion(); version != 1 {
+		t.Fatalf("synced database version %d", version)
+	}
+	if err := CheckSchema(); err == nil || !strings.Contains(err.Error(), "older") {
+		t.Fatalf("check of a synced database: %v", err)
+	}
+	done, err := Migrate(LatestVersion())
+	if err != nil || len(done) != len(Migrations) {
+		t.Fatalf("adoption applied %d migrations: %v", len(done), err)
+	}
+	names := historyNames(t)
+	if names[0] != "baseline (adopted)" || names[1] != "key change log" ||
+		names[3] != "account key wrapping" {
+		t.Errorf("history %v", names)
+	}
+	if err = CheckSchema(); err != nil {
+		t.Errorf("check after the adoption: %v", err)
+	}
+	checkModels(t, o)
+
+	key := AccountKey{Account: "0xA1"}
+	if err = o.Read(&key); err != nil || key.PrivKey != "priv" || key.Archived != 0 {
+		t.Errorf("legacy key %+v: %v", key, err)
+	}
+	tx := Transaction{TxHash: "0x1"}
+	if err = o.Read(&tx); err != nil || tx.XuAmount != 5 || tx.Created.Day() != 2 {
+		t.Errorf("legacy transaction %+v: %v", tx, err)
+	}
+}
+
+func TestMigrateAdoptRelease(t *testing.T) {
+	// Synced by a release with the key change log, the seeds and the key wrapping.
+	o := resetDatabase(t)
+	execAll(t, o, syncedBaseline...)
+	execAll(t, o, Migrations[1].Up[SqliteBackend]...)
+	execAll(t, o, Migrations[2].Up[SqliteBackend]...)
+	execAll(t, o, Migrations[3].Up[SqliteBackend]...)
+
+	done, err := Migrate(LatestVersion())
+	if err != nil || len(done) != len(Migrations) {
+		t.Fatalf("adoption applied %d migrations: %v", len(done), err)
+	}
+	// Migration 9 changes nothing on SQLite, it's always there.
+	names := historyNames(t)
+	for idx, name := range names {
+		adopted := strings.HasSuffix(name, "(adopted)")
+		if adopted != (idx < 4 || idx == 8) {
+			t.Errorf("migration %d recorded as %s", idx+1, name)
+		}
+	}
+	checkModels(t, o)
+
+	// Half of the key wrapping.
+	o = resetDatabase(t)
+	execAll(t, o, syncedBaseline...)
+	execAll(t, o, "ALTER TABLE `account_key` ADD COLUMN `wrap_key` text "+
+		"NOT NULL DEFAULT ''")
+	done, err = Migrate(LatestVersion())
+	if err == nil || !strings.Contains(err.Error(), "part of migration 4") {
+		t.Errorf("partial migration adopted: %v", err)
+	}
+	if len(done) != 3 {
+		t.Errorf("applied %d migrations before the partial one", len(done))
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	o := resetDatabase(t)
+	if _, err := Migrate(LatestVersion()); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	execAll(t, o,
+		"INSERT INTO `account` VALUES ('0xA1', 'o1', 'w1', 'a', 'normal', 0)",
+		"INSERT INTO `account_key` VALUES ('0xA1', 'o1', '', 'priv', 'wrap', 2, 0)",
+		"INSERT INTO `transaction` VALUES ('0x1', 'o1', 'o2', '0xA1', '0xB2', 5, "+
+			"'2018-01-02 03:04:05', 7, 1)",
+	)
+	done, err := Rollback(1)
+	if err != nil || len(done) != len(Migrations)-1 ||
+		done[0].Version != LatestVersion() {
+		t.Fatalf("rollback undid %d migrations: %v", len(done), err)
+	}
+	if version, _ := SchemaVersion(); version != 1 {
+		t.Errorf("version %d after the rollback", version)
+	}
+	if ok, _ := hasTable(o, "key_change"); ok {
+		t.Errorf("key_change left after the rollback")
+	}
+	for _, item := range Migrations[3].Adds {
+		if ok, _ := hasColumn(o, item); ok {
+			t.Errorf("%s.%s left after the rollback", item.Table, item.Column)
+		}
+	}
+	var privKey string
+	err = o.Raw("SELECT `priv_key` FROM `account_key` WHERE `account` = '0xA1'").
+		QueryRow(&privKey)
+	if err != nil || privKey != "priv" {
+		t.Errorf("key lost in the rollback: %v", err)
+	}
+	if _, err = Rollback(0); err == nil {
+		t.Errorf("baseline rolled back")
+	}
+	if done, err = Migrate(LatestVersion()); err != nil ||
+		len(done) != len(Migrations)-1 {
+		t.Fatalf("migrate after the rollback applied %d: %v", len(done), err)
+	}
+	checkModels(t, o)
+	key := AccountKey{Account: "0xA1"}
+	if err = o.Read(&key); err != nil || key.WrapKey != "" || key.KeyVersion != 0 {
+		t.Errorf("key after the round trip %+v: %v", key, err)
+	}
+}
+
+func TestCheckSchemaVersions(t *testing.T) {
+	o := resetDatabase(t)
+	if err := CheckSchema(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	if _, err := Rollback(LatestVersion() - 1); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if err := CheckSchema(); err == nil || !strings.Contains(err.Error(), "older") {
+		t.Errorf("older schema accepted: %v", err)
+	}
+	if _, err := Migrate(LatestVersion()); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	execAll(t, o, fmt.Sprintf("INSERT INTO `schema_version` (`version`, `name`, "+
+		"`applied`) VALUES (%d, 'next', '')", LatestVersion()+1))
+	if err := CheckSchema(); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer schema accepted: %v", err)
+	}
+	if _, err := Rollback(1); err == nil {
+		t.Errorf("newer schema rolled back")
+	}
+}